@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+var _ Bind = (*AllowlistBind)(nil)
+
+// AllowlistBind wraps a Bind and discards every received datagram whose
+// source is not in its allowlist, before it reaches the device. This keeps
+// unknown hosts from even getting their handshakes processed. Discarded
+// datagrams are reported with a size of zero, which callers of a ReceiveFunc
+// ignore. The allowlist starts out empty, so nothing is received until it is
+// set with UpdateAllowlist; peers that roam must be added as they move.
+type AllowlistBind struct {
+	Bind
+
+	allowed atomic.Pointer[map[netip.AddrPort]struct{}]
+}
+
+// NewAllowlistBind returns an AllowlistBind that delegates to bind and only
+// receives datagrams from allowed.
+func NewAllowlistBind(bind Bind, allowed []netip.AddrPort) *AllowlistBind {
+	b := &AllowlistBind{Bind: bind}
+	b.UpdateAllowlist(allowed)
+	return b
+}
+
+// UpdateAllowlist replaces the set of sources from which datagrams are
+// received. It is safe to call while the bind is receiving.
+func (b *AllowlistBind) UpdateAllowlist(allowed []netip.AddrPort) {
+	set := make(map[netip.AddrPort]struct{}, len(allowed))
+	for _, addr := range allowed {
+		set[netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())] = struct{}{}
+	}
+	b.allowed.Store(&set)
+}
+
+func (b *AllowlistBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	filteredFns := make([]ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		fn := fn
+		filteredFns[i] = func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			allowed := *b.allowed.Load()
+			for i := 0; i < n; i++ {
+				if sizes[i] == 0 {
+					continue
+				}
+				if _, ok := allowed[endpointAddrPort(eps[i])]; !ok {
+					sizes[i] = 0
+				}
+			}
+			return n, err
+		}
+	}
+	return filteredFns, actualPort, nil
+}
+
+// endpointAddrPort returns the destination address of ep, that is the source
+// of the datagrams received from it.
+func endpointAddrPort(ep Endpoint) netip.AddrPort {
+	if p, ok := ep.(interface{ Port() uint16 }); ok {
+		return netip.AddrPortFrom(ep.DstIP().Unmap(), p.Port())
+	}
+	addr, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestAllowlistBind(t *testing.T) {
+	sender := NewStdNetBind()
+	_, senderPort, err := sender.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	bind := NewAllowlistBind(NewStdNetBind(), nil)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	dst, _ := sender.ParseEndpoint(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port).String())
+	bufs := make([][]byte, bind.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, len(bufs))
+	eps := make([]Endpoint, len(bufs))
+	receive := func(msg string) (int, Endpoint) {
+		t.Helper()
+		if err := sender.Send([][]byte{[]byte(msg)}, dst); err != nil {
+			t.Fatal(err)
+		}
+		// The IPv4 receive function comes first.
+		n, err := fns[0](bufs, sizes, eps)
+		if err != nil || n != 1 {
+			t.Fatalf("receive returned %d, %v", n, err)
+		}
+		return sizes[0], eps[0]
+	}
+
+	if size, _ := receive("dropped"); size != 0 {
+		t.Errorf("received %d bytes from a source that is not allowed", size)
+	}
+
+	src := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), senderPort)
+	bind.UpdateAllowlist([]netip.AddrPort{src})
+	size, ep := receive("allowed")
+	if !bytes.Equal(bufs[0][:size], []byte("allowed")) {
+		t.Errorf("received %q, want %q", bufs[0][:size], "allowed")
+	}
+	if ep.DstToString() != src.String() {
+		t.Errorf("received from %s, want %s", ep.DstToString(), src)
+	}
+}
@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+var _ FDExporter = (*StdNetBind)(nil)
+
+// NewBindFromFDs returns a StdNetBind that adopts fds, already bound UDP
+// sockets, for example ones inherited from a previous process, so that the
+// listening port survives a restart. fds are typically exported by the
+// previous process with FDExporter.FDs and passed to the new one through
+// exec.Cmd.ExtraFiles or a Unix socket. They are an IPv4 socket, an IPv6
+// socket or one of each, bound to the same port.
+//
+// NewBindFromFDs takes ownership of fds: it closes them, also on error,
+// after duplicating them. The first Open of the bind uses the sockets
+// instead of listening, ignoring the port it is passed and the address
+// families set with SetAddressFamilies, and returns the sockets' port. Only
+// the address families of the sockets are served; datagrams to endpoints of
+// another family fail with syscall.EAFNOSUPPORT. After Close, later Opens
+// listen as usual. Closing the bind before its first Open closes the
+// sockets too.
+//
+// Adopting sockets is supported on Unix platforms, including Linux, Android,
+// macOS and FreeBSD. On Windows and js/wasm, NewBindFromFDs returns an error.
+func NewBindFromFDs(fds ...uintptr) (Bind, error) {
+	var conns [2]*net.UDPConn // IPv4 and IPv6
+	var firstErr error
+	for _, fd := range fds {
+		// Adopt every descriptor even after an error, to close them all.
+		udp, err := adoptFD(fd)
+		if err == nil {
+			laddr := udp.LocalAddr().(*net.UDPAddr)
+			family := 1
+			if laddr.IP.To4() != nil {
+				family = 0
+			}
+			other := conns[1-family]
+			switch {
+			case conns[family] != nil:
+				err = fmt.Errorf("file descriptor %d is a second socket of the same address family", fd)
+			case other != nil && other.LocalAddr().(*net.UDPAddr).Port != laddr.Port:
+				err = fmt.Errorf("file descriptor %d is bound to port %d, not %d", fd, laddr.Port, other.LocalAddr().(*net.UDPAddr).Port)
+			default:
+				conns[family] = udp
+				continue
+			}
+			udp.Close()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil && conns[0] == nil && conns[1] == nil {
+		firstErr = errors.New("no file descriptors to adopt")
+	}
+	if firstErr != nil {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		return nil, firstErr
+	}
+	s := NewStdNetBind().(*StdNetBind)
+	s.handover4, s.handover6 = conns[0], conns[1]
+	return s, nil
+}
+
+// NewBindFromFD returns a StdNetBind that adopts fd, an already bound UDP
+// socket, like NewBindFromFDs.
+func NewBindFromFD(fd uintptr) (Bind, error) {
+	return NewBindFromFDs(fd)
+}
+
+// adoptFD returns a UDP socket adopting fd, which it closes, set up as a
+// StdNetBind sets up the sockets it listens on.
+func adoptFD(fd uintptr) (*net.UDPConn, error) {
+	f := os.NewFile(fd, "udp")
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	pc, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt file descriptor %d: %w", fd, err)
+	}
+	udp, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("file descriptor %d is not a UDP socket", fd)
+	}
+	network := "udp6"
+	if udp.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		network = "udp4"
+	}
+	// The socket may not have been set up by a StdNetBind. Apply the options
+	// a StdNetBind sets when listening; those a bound socket no longer
+	// accepts, such as IPV6_V6ONLY, are left as they are.
+	if rc, err := udp.SyscallConn(); err == nil {
+		for _, fn := range controlFns {
+			_ = fn(network, udp.LocalAddr().String(), rc)
+		}
+	}
+	return udp, nil
+}
+
+// takeHandover returns the sockets handed over to NewBindFromFDs and their
+// port. The caller must hold s.mu.
+func (s *StdNetBind) takeHandover() (v4conn, v6conn *net.UDPConn, port int) {
+	v4conn, v6conn = s.handover4, s.handover6
+	s.handover4, s.handover6 = nil, nil
+	if v4conn != nil {
+		port = v4conn.LocalAddr().(*net.UDPAddr).Port
+	} else {
+		port = v6conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	return v4conn, v6conn, port
+}
+
+// FDs implements FDExporter. It returns the file descriptors of the IPv4
+// socket and of the IPv6 socket, in that order, leaving out a socket that is
+// not open.
+func (s *StdNetBind) FDs() ([]uintptr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var fds []uintptr
+	for _, conn := range [...]*net.UDPConn{s.ipv4, s.ipv6} {
+		if conn == nil {
+			continue
+		}
+		rc, err := conn.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		err = rc.Control(func(fd uintptr) {
+			fds = append(fds, fd)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fds) == 0 {
+		return nil, net.ErrClosed
+	}
+	return fds, nil
+}
@@ -0,0 +1,226 @@
+//go:build unix
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestNewBindFromFD(t *testing.T) {
+	// Hand over a socket from one bind to another, as across a restart.
+	old := NewStdNetBind().(*StdNetBind)
+	if err := old.SetAddressFamilies(AddressFamiliesV4Only); err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := old.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := old.FDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 1 {
+		t.Fatalf("got %d file descriptors, want 1", len(fds))
+	}
+	// Duplicate the descriptor as passing it to another process would.
+	dup, err := syscall.Dup(int(fds[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind, err := NewBindFromFD(uintptr(dup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	fns, adoptedPort, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if adoptedPort != port {
+		t.Fatalf("Open returned port %d, want the handed over port %d", adoptedPort, port)
+	}
+	if len(fns) != 1 {
+		t.Fatalf("got %d receive functions, want 1", len(fns))
+	}
+	if _, err := bind.(FDExporter).FDs(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	want := []byte("handed over")
+	if _, err := peer.WriteToUDP(want, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}); err != nil {
+		t.Fatal(err)
+	}
+	bufs := make([][]byte, IdealBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, IdealBatchSize)
+	eps := make([]Endpoint, IdealBatchSize)
+	n, err := fns[0](bufs, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(bufs[0][:sizes[0]], want) {
+		t.Fatalf("received %q, want %q", bufs[0][:sizes[0]], want)
+	}
+
+	// Once closed, the bind listens as usual.
+	bind.Close()
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewBindFromFDsDualStack(t *testing.T) {
+	old := NewStdNetBind().(*StdNetBind)
+	_, port, err := old.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := old.FDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 2 {
+		old.Close()
+		t.Skipf("bind has %d sockets, IPv6 is probably unavailable", len(fds))
+	}
+	var dups []uintptr
+	for _, fd := range fds {
+		dup, err := syscall.Dup(int(fd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dups = append(dups, uintptr(dup))
+	}
+	old.Close()
+
+	// Both sockets of an address family are refused.
+	dup, err := syscall.Dup(int(dups[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup2, err := syscall.Dup(int(dups[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBindFromFDs(uintptr(dup), uintptr(dup2)); err == nil {
+		t.Error("adopted two IPv4 sockets")
+	}
+
+	bind, err := NewBindFromFDs(dups...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, adoptedPort, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if adoptedPort != port {
+		t.Fatalf("Open returned port %d, want the handed over port %d", adoptedPort, port)
+	}
+	if len(fns) != 2 {
+		t.Fatalf("got %d receive functions, want 2", len(fns))
+	}
+	if fds, err := bind.(FDExporter).FDs(); err != nil || len(fds) != 2 {
+		t.Fatalf("got %d file descriptors, %v, want 2", len(fds), err)
+	}
+
+	// The IPv6 socket was handed over too.
+	peer, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	want := []byte("handed over")
+	if _, err := peer.WriteToUDP(want, &net.UDPAddr{IP: net.IPv6loopback, Port: int(port)}); err != nil {
+		t.Fatal(err)
+	}
+	bufs := make([][]byte, IdealBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, IdealBatchSize)
+	eps := make([]Endpoint, IdealBatchSize)
+	n, err := fns[1](bufs, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(bufs[0][:sizes[0]], want) {
+		t.Fatalf("received %q, want %q", bufs[0][:sizes[0]], want)
+	}
+}
+
+func TestNewBindFromFDNotUDP(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	rc, err := l.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dup int
+	rc.Control(func(fd uintptr) {
+		dup, err = syscall.Dup(int(fd))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBindFromFD(uintptr(dup)); err == nil {
+		t.Fatal("adopted a TCP socket")
+	}
+}
+
+func TestNewBindFromFDCloseUnopened(t *testing.T) {
+	old := NewStdNetBind().(*StdNetBind)
+	if err := old.SetAddressFamilies(AddressFamiliesV4Only); err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := old.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := old.FDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := syscall.Dup(int(fds[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+	bind, err := NewBindFromFD(uintptr(dup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the bind before its first Open releases the handed over port.
+	if err := bind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		t.Fatalf("handed over port %d still in use: %v", port, err)
+	}
+	c.Close()
+}
@@ -0,0 +1,225 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ Bind = (*ImpairBind)(nil)
+
+// ImpairOptions describe how an ImpairBind degrades the datagrams going
+// through it. The zero value leaves them untouched.
+type ImpairOptions struct {
+	Delay         time.Duration // fixed delay added to every datagram
+	Jitter        time.Duration // upper bound of a random delay added on top of Delay
+	DropRate      float64       // probability in [0, 1] that a datagram is dropped
+	DuplicateRate float64       // probability in [0, 1] that a datagram is delivered twice
+	Seed          int64         // seed of the random decisions
+}
+
+// ImpairBind wraps a Bind and delays, drops and duplicates the datagrams
+// sent and received through it, to emulate an unreliable network in tests
+// without kernel support. Datagrams delayed by different amounts may be
+// reordered. The random decisions are drawn from sources seeded with
+// ImpairOptions.Seed, one for each direction, so that the same sequence of
+// datagrams is impaired the same way on every run.
+type ImpairBind struct {
+	Bind
+	opts ImpairOptions
+
+	mu       sync.Mutex // protects all fields below
+	sendRand *rand.Rand
+	recvRand *rand.Rand
+	done     chan struct{} // closed when the bind is closed
+}
+
+// NewImpairBind returns an ImpairBind that delegates to inner and impairs
+// datagrams as set by opts.
+func NewImpairBind(inner Bind, opts ImpairOptions) *ImpairBind {
+	return &ImpairBind{
+		Bind:     inner,
+		opts:     opts,
+		sendRand: rand.New(rand.NewSource(opts.Seed)),
+		recvRand: rand.New(rand.NewSource(^opts.Seed)),
+	}
+}
+
+// impairment is the fate of a single datagram: how many copies of it are
+// delivered, none if it is dropped, and after what delays.
+type impairment struct {
+	copies int
+	delays [2]time.Duration
+}
+
+// impair draws the fate of the next datagram from r.
+func (b *ImpairBind) impair(r *rand.Rand) (im impairment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.opts.DropRate > 0 && r.Float64() < b.opts.DropRate {
+		return
+	}
+	im.copies = 1
+	if b.opts.DuplicateRate > 0 && r.Float64() < b.opts.DuplicateRate {
+		im.copies = 2
+	}
+	for i := 0; i < im.copies; i++ {
+		im.delays[i] = b.opts.Delay
+		if b.opts.Jitter > 0 {
+			im.delays[i] += time.Duration(r.Int63n(int64(b.opts.Jitter)))
+		}
+	}
+	return
+}
+
+func (b *ImpairBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	done := make(chan struct{})
+	b.mu.Lock()
+	b.done = done
+	b.mu.Unlock()
+
+	impairedFns := make([]ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		r := &impairedReceiver{received: make(chan impairedPacket, 1024), done: done}
+		go b.pump(fn, r.received, done)
+		impairedFns[i] = r.receive
+	}
+	return impairedFns, actualPort, nil
+}
+
+func (b *ImpairBind) Close() error {
+	b.mu.Lock()
+	if b.done != nil {
+		close(b.done)
+		b.done = nil
+	}
+	b.mu.Unlock()
+	return b.Bind.Close()
+}
+
+func (b *ImpairBind) Send(bufs [][]byte, ep Endpoint) error {
+	var now [][]byte
+	for _, buf := range bufs {
+		im := b.impair(b.sendRand)
+		for i := 0; i < im.copies; i++ {
+			if im.delays[i] == 0 {
+				now = append(now, buf)
+				continue
+			}
+			delayed := [][]byte{append([]byte(nil), buf...)}
+			time.AfterFunc(im.delays[i], func() {
+				b.Bind.Send(delayed, ep)
+			})
+		}
+	}
+	if len(now) == 0 {
+		return nil
+	}
+	return b.Bind.Send(now, ep)
+}
+
+// An impairedPacket is a received datagram, or a receive error, waiting to
+// be handed to the caller of a ReceiveFunc.
+type impairedPacket struct {
+	data []byte
+	ep   Endpoint
+	err  error
+}
+
+// pump receives datagrams with fn and queues them on received once their
+// delay has passed, until fn fails because the bind was closed.
+func (b *ImpairBind) pump(fn ReceiveFunc, received chan<- impairedPacket, done <-chan struct{}) {
+	deliver := func(packet impairedPacket) {
+		select {
+		case received <- packet:
+		case <-done:
+		}
+	}
+
+	batchSize := b.BatchSize()
+	packets := make([][]byte, batchSize)
+	for i := range packets {
+		packets[i] = make([]byte, 1<<16)
+	}
+	sizes := make([]int, batchSize)
+	eps := make([]Endpoint, batchSize)
+	for {
+		n, err := fn(packets, sizes, eps)
+		for i := 0; i < n; i++ {
+			if sizes[i] == 0 {
+				continue
+			}
+			im := b.impair(b.recvRand)
+			for j := 0; j < im.copies; j++ {
+				packet := impairedPacket{data: append([]byte(nil), packets[i][:sizes[i]]...), ep: eps[i]}
+				if im.delays[j] == 0 {
+					deliver(packet)
+				} else {
+					time.AfterFunc(im.delays[j], func() { deliver(packet) })
+				}
+			}
+		}
+		if err != nil {
+			deliver(impairedPacket{err: err})
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}
+}
+
+// An impairedReceiver hands the datagrams queued by a pump to the callers of
+// a ReceiveFunc.
+type impairedReceiver struct {
+	received chan impairedPacket
+	done     <-chan struct{}
+	pending  *impairedPacket // error held back until the packets before it are returned
+}
+
+// receive waits for at least one packet and returns as many as are ready
+// and fit in packets.
+func (r *impairedReceiver) receive(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+	var packet impairedPacket
+	if r.pending != nil {
+		packet, r.pending = *r.pending, nil
+	} else {
+		select {
+		case packet = <-r.received:
+		case <-r.done:
+			return 0, net.ErrClosed
+		}
+	}
+	n := 0
+	for {
+		if packet.err != nil {
+			if n == 0 {
+				return 0, packet.err
+			}
+			r.pending = &packet
+			return n, nil
+		}
+		sizes[n] = copy(packets[n], packet.data)
+		eps[n] = packet.ep
+		n++
+		if n == len(packets) {
+			return n, nil
+		}
+		select {
+		case packet = <-r.received:
+		default:
+			return n, nil
+		}
+	}
+}
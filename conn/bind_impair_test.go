@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+// impairedRun sends count numbered packets through an ImpairBind over a
+// loopbackBind and returns the numbers of the packets received, in order.
+func impairedRun(t *testing.T, opts ImpairOptions, count int) []byte {
+	bind := NewImpairBind(&loopbackBind{}, opts)
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep, _ := bind.ParseEndpoint("")
+	received := make(chan byte, 4*count)
+	go func() {
+		bufs := [][]byte{make([]byte, 64)}
+		sizes := make([]int, 1)
+		eps := make([]Endpoint, 1)
+		for {
+			n, err := fns[0](bufs, sizes, eps)
+			if err != nil {
+				return
+			}
+			for i := 0; i < n; i++ {
+				received <- bufs[i][0]
+			}
+		}
+	}()
+	for i := 0; i < count; i++ {
+		if err := bind.Send([][]byte{{byte(i)}}, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []byte
+	for {
+		select {
+		case n := <-received:
+			got = append(got, n)
+		case <-time.After(opts.Delay + opts.Jitter + 200*time.Millisecond):
+			return got
+		}
+	}
+}
+
+func TestImpairBind(t *testing.T) {
+	const count = 200
+	if got := impairedRun(t, ImpairOptions{}, count); len(got) != count {
+		t.Errorf("received %d of %d packets without impairment", len(got), count)
+	}
+
+	opts := ImpairOptions{DropRate: 0.2, DuplicateRate: 0.2, Seed: 1}
+	a, b := impairedRun(t, opts, count), impairedRun(t, opts, count)
+	if string(a) != string(b) {
+		t.Errorf("runs with the same seed differ:\n%v\n%v", a, b)
+	}
+	seen := make(map[byte]int)
+	for _, n := range a {
+		seen[n]++
+	}
+	if len(seen) == count {
+		t.Error("no packet was dropped")
+	}
+	if len(seen) == len(a) {
+		t.Error("no packet was duplicated")
+	}
+
+	start := time.Now()
+	got := impairedRun(t, ImpairOptions{Delay: 50 * time.Millisecond, Jitter: 20 * time.Millisecond}, 1)
+	// The packet is delayed both when sent and when received.
+	if len(got) != 1 {
+		t.Fatalf("received %d delayed packets, want 1", len(got))
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("delayed packet arrived after %v, want at least 100ms", elapsed)
+	}
+}
@@ -0,0 +1,298 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	_ Bind     = (*MultiBind)(nil)
+	_ Endpoint = (*MultiEndpoint)(nil)
+)
+
+// MultiBind implements Bind by listening on the same port on each of several
+// local addresses. The local address on which a packet arrived is recorded
+// in its MultiEndpoint, and replies to that endpoint are sent from the same
+// address, so that peers always see answers from the address they contacted.
+type MultiBind struct {
+	addrs []netip.Addr
+
+	mu      sync.Mutex // protects sockets
+	sockets []*multiSocket
+
+	msgsPool sync.Pool
+}
+
+// A multiSocket is the UDP socket of a MultiBind for a single local address.
+type multiSocket struct {
+	addr      netip.Addr
+	conn      *net.UDPConn
+	pc        batchConn // conn as an ipv4.PacketConn or ipv6.PacketConn
+	batchSize int
+}
+
+type batchConn interface {
+	batchReader
+	batchWriter
+}
+
+// NewMultiBind returns a Bind that listens on each of addrs.
+func NewMultiBind(addrs ...netip.Addr) *MultiBind {
+	return &MultiBind{
+		addrs: addrs,
+		msgsPool: sync.Pool{
+			New: func() any {
+				msgs := make([]ipv6.Message, IdealBatchSize)
+				for i := range msgs {
+					msgs[i].Buffers = make(net.Buffers, 1)
+				}
+				return &msgs
+			},
+		},
+	}
+}
+
+// MultiEndpoint is the Endpoint type of MultiBind.
+type MultiEndpoint struct {
+	// AddrPort is the endpoint destination.
+	netip.AddrPort
+	// src is the local address to send from. It is invalid if unknown,
+	// in which case the first local address of the right family is used.
+	src netip.Addr
+}
+
+func (e *MultiEndpoint) ClearSrc() { e.src = netip.Addr{} }
+
+// SetSrc sets the local address to send to e from. If no socket of the
+// MultiBind listens on src, the first one of the right family is used.
+func (e *MultiEndpoint) SetSrc(src netip.Addr) error {
+	if !src.IsValid() || src.Is6() != e.DstIP().Is6() {
+		return fmt.Errorf("source address %v does not match the family of %v", src, e.DstIP())
+	}
+	e.src = src
+	return nil
+}
+
+func (e *MultiEndpoint) SrcToString() string {
+	if !e.src.IsValid() {
+		return ""
+	}
+	return e.src.String()
+}
+
+func (e *MultiEndpoint) DstToString() string { return e.AddrPort.String() }
+
+func (e *MultiEndpoint) DstToBytes() []byte {
+	b, _ := e.AddrPort.MarshalBinary()
+	return b
+}
+
+func (e *MultiEndpoint) DstIP() netip.Addr { return e.AddrPort.Addr() }
+
+func (e *MultiEndpoint) SrcIP() netip.Addr { return e.src }
+
+func (*MultiBind) ParseEndpoint(s string) (Endpoint, error) {
+	e, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiEndpoint{AddrPort: e}, nil
+}
+
+// Open listens on port on every local address. If port is 0, the port chosen
+// for the first address is used for the remaining ones.
+func (b *MultiBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sockets != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	if len(b.addrs) == 0 {
+		return nil, 0, errors.New("no local addresses to listen on")
+	}
+
+	var tries int
+again:
+	sockets := make([]*multiSocket, 0, len(b.addrs))
+	actualPort := port
+	for _, addr := range b.addrs {
+		socket, err := listenMulti(addr, actualPort)
+		if err != nil {
+			for _, socket := range sockets {
+				socket.conn.Close()
+			}
+			if port == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
+				tries++
+				goto again
+			}
+			return nil, 0, err
+		}
+		actualPort = uint16(socket.conn.LocalAddr().(*net.UDPAddr).Port)
+		sockets = append(sockets, socket)
+	}
+
+	fns := make([]ReceiveFunc, len(sockets))
+	for i, socket := range sockets {
+		fns[i] = b.makeReceive(socket)
+	}
+	b.sockets = sockets
+	return fns, actualPort, nil
+}
+
+func listenMulti(addr netip.Addr, port uint16) (*multiSocket, error) {
+	network := "udp4"
+	if addr.Is6() {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port)))
+	if err != nil {
+		return nil, err
+	}
+	socket := &multiSocket{addr: addr, conn: conn, batchSize: multiBatchSize()}
+	if addr.Is6() {
+		socket.pc = ipv6.NewPacketConn(conn)
+	} else {
+		socket.pc = ipv4.NewPacketConn(conn)
+	}
+	return socket, nil
+}
+
+func (b *MultiBind) makeReceive(socket *multiSocket) ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		msgs := b.msgsPool.Get().(*[]ipv6.Message)
+		defer b.msgsPool.Put(msgs)
+		for i := range bufs {
+			(*msgs)[i].Buffers[0] = bufs[i]
+		}
+		numMsgs, err := socket.pc.ReadBatch((*msgs)[:len(bufs)], 0)
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i < numMsgs; i++ {
+			msg := &(*msgs)[i]
+			sizes[i] = msg.N
+			if sizes[i] == 0 {
+				continue
+			}
+			addrPort := msg.Addr.(*net.UDPAddr).AddrPort()
+			eps[i] = &MultiEndpoint{
+				AddrPort: netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()),
+				src:      socket.addr,
+			}
+		}
+		return numMsgs, nil
+	}
+}
+
+func (b *MultiBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var err error
+	for _, socket := range b.sockets {
+		if closeErr := socket.conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	b.sockets = nil
+	return err
+}
+
+func (b *MultiBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, socket := range b.sockets {
+		rawConn, err := socket.conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := setMark(rawConn, mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchSize is the smallest batch size of the sockets.
+func (b *MultiBind) BatchSize() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batchSize := multiBatchSize()
+	for _, socket := range b.sockets {
+		batchSize = min(batchSize, socket.batchSize)
+	}
+	return batchSize
+}
+
+func multiBatchSize() int {
+	if runtime.GOOS == "linux" || runtime.GOOS == "android" {
+		return IdealBatchSize
+	}
+	return 1
+}
+
+// socketFor returns the socket to send to ep from: the one listening on the
+// endpoint's source address if known, or else the first one of the right family.
+func (b *MultiBind) socketFor(ep *MultiEndpoint) *multiSocket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fallback *multiSocket
+	for _, socket := range b.sockets {
+		if socket.addr.Is6() != ep.DstIP().Is6() {
+			continue
+		}
+		if socket.addr == ep.src {
+			return socket
+		}
+		if fallback == nil {
+			fallback = socket
+		}
+	}
+	return fallback
+}
+
+func (b *MultiBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*MultiEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	socket := b.socketFor(ep)
+	if socket == nil {
+		return syscall.EAFNOSUPPORT
+	}
+
+	msgs := b.msgsPool.Get().(*[]ipv6.Message)
+	defer b.msgsPool.Put(msgs)
+	ua := net.UDPAddrFromAddrPort(ep.AddrPort)
+	for i := range bufs {
+		(*msgs)[i].Addr = ua
+		(*msgs)[i].Buffers[0] = bufs[i]
+	}
+	pending := (*msgs)[:len(bufs)]
+	for len(pending) > 0 {
+		n, err := socket.pc.WriteBatch(pending, 0)
+		if err != nil {
+			return err
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
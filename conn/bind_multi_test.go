@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMultiBind(t *testing.T) {
+	local := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}
+	bind := NewMultiBind(local...)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Skipf("unable to listen on %v: %v", local, err)
+	}
+	defer bind.Close()
+	if len(fns) != len(local) {
+		t.Fatalf("got %d receive funcs, want %d", len(fns), len(local))
+	}
+	if _, _, err := bind.Open(0); err != ErrBindAlreadyOpen {
+		t.Errorf("second Open returned %v, want ErrBindAlreadyOpen", err)
+	}
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	batchSize := bind.BatchSize()
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, batchSize)
+	eps := make([]Endpoint, batchSize)
+	for i, addr := range local {
+		server := netip.AddrPortFrom(addr, port)
+		if _, err := client.WriteToUDPAddrPort([]byte("ping"), server); err != nil {
+			t.Fatal(err)
+		}
+		n, err := fns[i](bufs, sizes, eps)
+		if err != nil || n != 1 || string(bufs[0][:sizes[0]]) != "ping" {
+			t.Fatalf("receive on %v = %d, %v; want one ping", addr, n, err)
+		}
+		if got := eps[0].SrcIP(); got != addr {
+			t.Errorf("endpoint source = %v, want %v", got, addr)
+		}
+
+		if err := bind.Send([][]byte{[]byte("pong")}, eps[0]); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, from, err := client.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "pong" || from != server {
+			t.Errorf("got %q from %v, want pong from %v", buf[:n], from, server)
+		}
+	}
+}
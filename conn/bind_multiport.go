@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+var _ Bind = (*MultiPortBind)(nil)
+
+// MultiPortBind implements Bind over several sockets, each listening on its
+// own local UDP port, so that the traffic to different peers uses different
+// source ports. Routers that hash the ports of a flow to pick one of several
+// equal-cost paths (ECMP) then spread the peers across their links.
+//
+// Packets are received on all ports. Packets to an endpoint are always sent
+// from the same port, chosen by hashing the endpoint's address, so that each
+// peer sees a stable source port. The port passed to Open is the first port;
+// the others are chosen by the system.
+type MultiPortBind struct {
+	binds []*StdNetBind
+
+	mu   sync.Mutex // protects open
+	open bool
+}
+
+// NewMultiPortBind returns a Bind that sends and receives on n local ports.
+// n is at least 1.
+func NewMultiPortBind(n int) *MultiPortBind {
+	b := &MultiPortBind{binds: make([]*StdNetBind, max(n, 1))}
+	for i := range b.binds {
+		b.binds[i] = NewStdNetBind().(*StdNetBind)
+	}
+	return b
+}
+
+func (*MultiPortBind) ParseEndpoint(s string) (Endpoint, error) {
+	return (*StdNetBind)(nil).ParseEndpoint(s)
+}
+
+// Open opens the first socket on port and the others on ports chosen by the
+// system, and returns the receive functions of all of them.
+func (b *MultiPortBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	var fns []ReceiveFunc
+	var actualPort uint16
+	for i, bind := range b.binds {
+		bindPort := uint16(0)
+		if i == 0 {
+			bindPort = port
+		}
+		bindFns, p, err := bind.Open(bindPort)
+		if err != nil {
+			for _, opened := range b.binds[:i] {
+				opened.Close()
+			}
+			return nil, 0, err
+		}
+		if i == 0 {
+			actualPort = p
+		}
+		fns = append(fns, bindFns...)
+	}
+	b.open = true
+	return fns, actualPort, nil
+}
+
+func (b *MultiPortBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errs []error
+	for _, bind := range b.binds {
+		errs = append(errs, bind.Close())
+	}
+	b.open = false
+	return errors.Join(errs...)
+}
+
+func (b *MultiPortBind) SetMark(mark uint32) error {
+	var errs []error
+	for _, bind := range b.binds {
+		errs = append(errs, bind.SetMark(mark))
+	}
+	return errors.Join(errs...)
+}
+
+// BatchSize returns the smallest batch size of the sockets.
+func (b *MultiPortBind) BatchSize() int {
+	size := b.binds[0].BatchSize()
+	for _, bind := range b.binds[1:] {
+		size = min(size, bind.BatchSize())
+	}
+	return size
+}
+
+// bindFor returns the socket that sends to ep.
+func (b *MultiPortBind) bindFor(ep Endpoint) *StdNetBind {
+	h := fnv.New32a()
+	h.Write(ep.DstToBytes())
+	return b.binds[h.Sum32()%uint32(len(b.binds))]
+}
+
+func (b *MultiPortBind) Send(bufs [][]byte, ep Endpoint) error {
+	return b.bindFor(ep).Send(bufs, ep)
+}
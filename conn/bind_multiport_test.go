@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMultiPortBind(t *testing.T) {
+	const n = 4
+	bind := NewMultiPortBind(n)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if len(fns) < n || port == 0 {
+		t.Fatalf("got %d receive funcs and port %d, want at least %d and a port", len(fns), port, n)
+	}
+	if _, _, err := bind.Open(0); err != ErrBindAlreadyOpen {
+		t.Errorf("second Open returned %v, want ErrBindAlreadyOpen", err)
+	}
+
+	// Report the senders of the packets received on any port.
+	received := make(chan string, 16)
+	for _, fn := range fns {
+		go func(fn ReceiveFunc) {
+			bufs := make([][]byte, bind.BatchSize())
+			for i := range bufs {
+				bufs[i] = make([]byte, 1500)
+			}
+			sizes := make([]int, len(bufs))
+			eps := make([]Endpoint, len(bufs))
+			for {
+				n, err := fn(bufs, sizes, eps)
+				if err != nil {
+					return
+				}
+				for i := 0; i < n; i++ {
+					received <- eps[i].DstToString()
+				}
+			}
+		}(fn)
+	}
+
+	// Each peer is sent to from a single port, the peers are spread across
+	// several ports, and their replies to those ports are received.
+	ports := make(map[uint16]bool)
+	for i := 0; i < 16; i++ {
+		peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		peer.SetDeadline(time.Now().Add(5 * time.Second))
+		ep, err := bind.ParseEndpoint(peer.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var from netip.AddrPort
+		for j := 0; j < 3; j++ {
+			if err := bind.Send([][]byte{[]byte("ping")}, ep); err != nil {
+				t.Fatal(err)
+			}
+			_, got, err := peer.ReadFromUDPAddrPort(make([]byte, 1500))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j > 0 && got.Port() != from.Port() {
+				t.Errorf("peer %d: ping %d came from port %d, want %d", i, j, got.Port(), from.Port())
+			}
+			from = got
+		}
+		ports[from.Port()] = true
+
+		if _, err := peer.WriteToUDPAddrPort([]byte("pong"), from); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case sender := <-received:
+			if sender != ep.DstToString() {
+				t.Errorf("received a packet from %s, want %s", sender, ep.DstToString())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reply to port %d was not received", from.Port())
+		}
+	}
+	if len(ports) < 2 {
+		t.Errorf("16 peers were sent to from %d port, want several", len(ports))
+	}
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+var _ Bind = (*RecordingBind)(nil)
+
+// A CapturedPacket is a datagram recorded by a RecordingBind.
+type CapturedPacket struct {
+	Time     time.Time
+	Endpoint Endpoint // destination of a sent packet, source of a received one
+	Outbound bool     // true if the packet was sent, false if it was received
+	Data     []byte
+}
+
+// RecordingBind wraps a Bind and records every datagram sent and received
+// through it in a ring buffer, which is useful for inspecting exactly what
+// goes on the wire in tests. Once the buffer is full, the oldest packets are
+// overwritten.
+type RecordingBind struct {
+	Bind
+
+	mu       sync.Mutex // protects all fields below
+	captured []CapturedPacket
+	next     int  // index in captured of the next packet to record
+	full     bool // whether captured has wrapped around
+}
+
+// NewRecordingBind returns a RecordingBind that delegates to bind and keeps
+// the most recent capacity packets.
+func NewRecordingBind(bind Bind, capacity int) *RecordingBind {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &RecordingBind{
+		Bind:     bind,
+		captured: make([]CapturedPacket, capacity),
+	}
+}
+
+func (b *RecordingBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	recordingFns := make([]ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		fn := fn
+		recordingFns[i] = func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			now := time.Now()
+			for i := 0; i < n; i++ {
+				b.record(now, eps[i], false, packets[i][:sizes[i]])
+			}
+			return n, err
+		}
+	}
+	return recordingFns, actualPort, nil
+}
+
+func (b *RecordingBind) Send(bufs [][]byte, ep Endpoint) error {
+	err := b.Bind.Send(bufs, ep)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, buf := range bufs {
+		b.record(now, ep, true, buf)
+	}
+	return nil
+}
+
+func (b *RecordingBind) record(now time.Time, ep Endpoint, outbound bool, data []byte) {
+	packet := CapturedPacket{
+		Time:     now,
+		Endpoint: ep,
+		Outbound: outbound,
+		Data:     append([]byte(nil), data...),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.captured[b.next] = packet
+	b.next++
+	if b.next == len(b.captured) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// Captured returns the recorded packets, oldest first.
+func (b *RecordingBind) Captured() []CapturedPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]CapturedPacket(nil), b.captured[:b.next]...)
+	}
+	packets := make([]CapturedPacket, 0, len(b.captured))
+	packets = append(packets, b.captured[b.next:]...)
+	return append(packets, b.captured[:b.next]...)
+}
+
+// Reset discards all recorded packets.
+func (b *RecordingBind) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.captured)
+	b.next = 0
+	b.full = false
+}
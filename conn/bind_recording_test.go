@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// loopbackBind is a Bind whose receive function returns the packets sent to it.
+type loopbackBind struct {
+	packets chan []byte
+}
+
+func (b *loopbackBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.packets = make(chan []byte, 16)
+	return []ReceiveFunc{func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		packet, ok := <-b.packets
+		if !ok {
+			return 0, net.ErrClosed
+		}
+		sizes[0] = copy(packets[0], packet)
+		eps[0] = &StdNetEndpoint{}
+		return 1, nil
+	}}, port, nil
+}
+
+func (b *loopbackBind) Close() error {
+	close(b.packets)
+	return nil
+}
+
+func (b *loopbackBind) Send(bufs [][]byte, ep Endpoint) error {
+	for _, buf := range bufs {
+		b.packets <- append([]byte(nil), buf...)
+	}
+	return nil
+}
+
+func (b *loopbackBind) SetMark(mark uint32) error                { return nil }
+func (b *loopbackBind) ParseEndpoint(s string) (Endpoint, error) { return &StdNetEndpoint{}, nil }
+func (b *loopbackBind) BatchSize() int                           { return 1 }
+
+func TestRecordingBind(t *testing.T) {
+	bind := NewRecordingBind(&loopbackBind{}, 3)
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep, _ := bind.ParseEndpoint("")
+	bufs := [][]byte{make([]byte, 64)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	for _, msg := range []string{"one", "two"} {
+		if err := bind.Send([][]byte{[]byte(msg)}, ep); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fns[0](bufs, sizes, eps); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The buffer holds three packets, so the first "one" has been overwritten.
+	captured := bind.Captured()
+	want := []struct {
+		data     string
+		outbound bool
+	}{
+		{"one", false},
+		{"two", true},
+		{"two", false},
+	}
+	if len(captured) != len(want) {
+		t.Fatalf("captured %d packets, want %d", len(captured), len(want))
+	}
+	for i, packet := range captured {
+		if !bytes.Equal(packet.Data, []byte(want[i].data)) || packet.Outbound != want[i].outbound {
+			t.Errorf("packet %d = %q (outbound %v), want %q (outbound %v)",
+				i, packet.Data, packet.Outbound, want[i].data, want[i].outbound)
+		}
+		if packet.Endpoint == nil || packet.Time.IsZero() {
+			t.Errorf("packet %d is missing its endpoint or timestamp", i)
+		}
+		if i > 0 && packet.Time.Before(captured[i-1].Time) {
+			t.Errorf("packet %d recorded out of order", i)
+		}
+	}
+
+	bind.Reset()
+	if captured := bind.Captured(); len(captured) != 0 {
+		t.Errorf("captured %d packets after Reset, want 0", len(captured))
+	}
+}
@@ -0,0 +1,455 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	_ Bind     = (*Socks5Bind)(nil)
+	_ Endpoint = (*Socks5Endpoint)(nil)
+)
+
+const (
+	socks5Version         = 5
+	socks5AuthNone        = 0
+	socks5AuthPassword    = 2
+	socks5CmdUDPAssociate = 3
+	socks5AtypIPv4        = 1
+	socks5AtypIPv6        = 4
+
+	// socks5MaxUDPHeaderLen is the length of the UDP request header
+	// for an IPv6 address.
+	socks5MaxUDPHeaderLen = 4 + 16 + 2
+
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+// Socks5Auth holds the credentials for the username/password authentication
+// of RFC 1929.
+type Socks5Auth struct {
+	Username string
+	Password string
+}
+
+// Socks5Bind implements Bind for networks that only allow traffic through a
+// SOCKS5 proxy. Open sets up a UDP ASSOCIATE over a TCP control connection to
+// the proxy, and all datagrams are then exchanged with the proxy's relay
+// address, framed with the SOCKS5 UDP request header that carries the real
+// peer address. If the control connection drops, the association is
+// re-established with exponential backoff, keeping the local UDP socket.
+// Fragmented datagrams and domain name addresses from the relay are dropped.
+type Socks5Bind struct {
+	proxy string
+	auth  *Socks5Auth
+
+	mu     sync.Mutex // protects all fields below
+	udp    *net.UDPConn
+	ctrl   net.Conn
+	relay  netip.AddrPort
+	mark   uint32
+	closed chan struct{} // closed by Close; nil when not open
+}
+
+// NewSocks5Bind returns a Bind that sends packets through the SOCKS5 proxy at
+// proxy, which must be a "host:port" address. If auth is nil, no
+// authentication is offered to the proxy.
+func NewSocks5Bind(proxy string, auth *Socks5Auth) *Socks5Bind {
+	return &Socks5Bind{proxy: proxy, auth: auth}
+}
+
+// Socks5Endpoint is the Endpoint type of Socks5Bind. It holds the address of
+// the peer behind the proxy, not that of the proxy.
+type Socks5Endpoint struct {
+	netip.AddrPort
+}
+
+func (e *Socks5Endpoint) ClearSrc() {}
+
+func (e *Socks5Endpoint) SrcToString() string { return "" }
+
+func (e *Socks5Endpoint) DstToString() string { return e.AddrPort.String() }
+
+func (e *Socks5Endpoint) DstToBytes() []byte {
+	b, _ := e.AddrPort.MarshalBinary()
+	return b
+}
+
+func (e *Socks5Endpoint) DstIP() netip.Addr { return e.AddrPort.Addr() }
+
+func (e *Socks5Endpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+func (*Socks5Bind) ParseEndpoint(s string) (Endpoint, error) {
+	e, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Socks5Endpoint{AddrPort: e}, nil
+}
+
+// Open listens on port for datagrams from the relay and sets up the
+// association with the proxy.
+func (b *Socks5Bind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	if b.closed != nil {
+		b.mu.Unlock()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	mark := b.mark
+	b.mu.Unlock()
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+	if mark != 0 {
+		if rc, err := udp.SyscallConn(); err == nil {
+			setMark(rc, mark)
+		}
+	}
+	actualPort := uint16(udp.LocalAddr().(*net.UDPAddr).Port)
+	ctrl, relay, err := b.associate(actualPort)
+	if err != nil {
+		udp.Close()
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		ctrl.Close()
+		udp.Close()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	b.udp, b.ctrl, b.relay = udp, ctrl, relay
+	b.closed = make(chan struct{})
+	go b.watchControl(ctrl, b.closed)
+	return []ReceiveFunc{b.makeReceiveSocks5(udp)}, actualPort, nil
+}
+
+func (b *Socks5Bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	b.closed = nil
+	err := b.udp.Close()
+	b.udp = nil
+	if b.ctrl != nil {
+		b.ctrl.Close()
+		b.ctrl = nil
+	}
+	return err
+}
+
+func (b *Socks5Bind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	var conns []syscall.Conn
+	if b.udp != nil {
+		conns = append(conns, b.udp)
+	}
+	if c, ok := b.ctrl.(syscall.Conn); ok {
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := setMark(rc, mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Socks5Bind) BatchSize() int { return 1 }
+
+// associate connects to the proxy and asks it to relay datagrams for the
+// local UDP socket bound to udpPort. It returns the control connection, which
+// must be kept open for as long as the association is used, and the address
+// of the relay.
+func (b *Socks5Bind) associate(udpPort uint16) (net.Conn, netip.AddrPort, error) {
+	b.mu.Lock()
+	mark := b.mark
+	b.mu.Unlock()
+	dialer := net.Dialer{
+		Timeout: socks5HandshakeTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if mark == 0 {
+				return nil
+			}
+			return setMark(c, mark)
+		},
+	}
+	ctrl, err := dialer.Dial("tcp", b.proxy)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	ctrl.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	if err := socks5Authenticate(ctrl, b.auth); err != nil {
+		ctrl.Close()
+		return nil, netip.AddrPort{}, err
+	}
+	local := ctrl.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	relay, err := socks5Associate(ctrl, netip.AddrPortFrom(local, udpPort))
+	if err != nil {
+		ctrl.Close()
+		return nil, netip.AddrPort{}, err
+	}
+	// A relay on an unspecified address is reached at the proxy's address.
+	if relay.Addr().IsUnspecified() {
+		remote := ctrl.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		relay = netip.AddrPortFrom(remote, relay.Port())
+	}
+	ctrl.SetDeadline(time.Time{})
+	return ctrl, relay, nil
+}
+
+// watchControl waits for the control connection ctrl to drop, which ends the
+// association, and then sets up a new one, until the bind is closed.
+func (b *Socks5Bind) watchControl(ctrl net.Conn, closed chan struct{}) {
+	for {
+		// The proxy sends nothing on the control connection after the
+		// association is set up, so this only returns when it drops.
+		io.Copy(io.Discard, ctrl)
+		ctrl.Close()
+
+		backoff := tcpBindMinBackoff
+		for {
+			select {
+			case <-closed:
+				return
+			default:
+			}
+			b.mu.Lock()
+			udp := b.udp
+			b.mu.Unlock()
+			if udp == nil {
+				return
+			}
+			var relay netip.AddrPort
+			var err error
+			ctrl, relay, err = b.associate(uint16(udp.LocalAddr().(*net.UDPAddr).Port))
+			if err == nil {
+				b.mu.Lock()
+				if b.closed != closed {
+					b.mu.Unlock()
+					ctrl.Close()
+					return
+				}
+				b.ctrl, b.relay = ctrl, relay
+				b.mu.Unlock()
+				break
+			}
+			select {
+			case <-closed:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > tcpBindMaxBackoff {
+				backoff = tcpBindMaxBackoff
+			}
+		}
+	}
+}
+
+func (b *Socks5Bind) makeReceiveSocks5(udp *net.UDPConn) ReceiveFunc {
+	var buf []byte
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		if need := socks5MaxUDPHeaderLen + len(bufs[0]); len(buf) < need {
+			buf = make([]byte, need)
+		}
+		for {
+			size, src, err := udp.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return 0, net.ErrClosed
+				}
+				return 0, err
+			}
+			b.mu.Lock()
+			relay := b.relay
+			b.mu.Unlock()
+			if netip.AddrPortFrom(src.Addr().Unmap(), src.Port()) != relay {
+				continue
+			}
+			addr, headerLen, err := parseSocks5UDPHeader(buf[:size])
+			if err != nil || size-headerLen > len(bufs[0]) {
+				continue
+			}
+			sizes[0] = copy(bufs[0], buf[headerLen:size])
+			eps[0] = &Socks5Endpoint{AddrPort: addr}
+			return 1, nil
+		}
+	}
+}
+
+func (b *Socks5Bind) Send(bufs [][]byte, ep Endpoint) error {
+	dst, ok := ep.(*Socks5Endpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	udp, relay := b.udp, b.relay
+	b.mu.Unlock()
+	if udp == nil {
+		return net.ErrClosed
+	}
+
+	for _, buf := range bufs {
+		packet := appendSocks5UDPHeader(make([]byte, 0, socks5MaxUDPHeaderLen+len(buf)), dst.AddrPort)
+		packet = append(packet, buf...)
+		if _, err := udp.WriteToUDPAddrPort(packet, relay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socks5Authenticate negotiates the authentication method with the proxy on
+// conn and authenticates with auth, if not nil.
+func socks5Authenticate(conn net.Conn, auth *Socks5Auth) error {
+	method := byte(socks5AuthNone)
+	if auth != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5 proxy replied with version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if auth == nil {
+			break
+		}
+		if len(auth.Username) > 255 || len(auth.Password) > 255 {
+			return errors.New("socks5 username and password must be at most 255 bytes long")
+		}
+		req := []byte{1, byte(len(auth.Username))}
+		req = append(req, auth.Username...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5 proxy rejected the username and password")
+		}
+		return nil
+	}
+	return errors.New("socks5 proxy accepted none of the offered authentication methods")
+}
+
+// socks5Associate sends a UDP ASSOCIATE request for datagrams from local on
+// conn and returns the relay address from the proxy's reply.
+func socks5Associate(conn net.Conn, local netip.AddrPort) (netip.AddrPort, error) {
+	req := []byte{socks5Version, socks5CmdUDPAssociate, 0}
+	req = appendSocks5Addr(req, local)
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if header[0] != socks5Version {
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy replied with version %d", header[0])
+	}
+	if header[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy rejected UDP associate with reply code %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case socks5AtypIPv4:
+		addrLen = 4
+	case socks5AtypIPv6:
+		addrLen = 16
+	default:
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy replied with unsupported address type %d", header[3])
+	}
+	addrPort := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, addrPort); err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, _ := netip.AddrFromSlice(addrPort[:addrLen])
+	return netip.AddrPortFrom(addr.Unmap(), binary.BigEndian.Uint16(addrPort[addrLen:])), nil
+}
+
+// appendSocks5Addr appends the SOCKS5 encoding of ap, the address type
+// followed by the address and the port, to b.
+func appendSocks5Addr(b []byte, ap netip.AddrPort) []byte {
+	if addr := ap.Addr().Unmap(); addr.Is4() {
+		a := addr.As4()
+		b = append(b, socks5AtypIPv4)
+		b = append(b, a[:]...)
+	} else {
+		a := addr.As16()
+		b = append(b, socks5AtypIPv6)
+		b = append(b, a[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
+
+// appendSocks5UDPHeader appends the SOCKS5 UDP request header for a datagram
+// to or from ap to b.
+func appendSocks5UDPHeader(b []byte, ap netip.AddrPort) []byte {
+	b = append(b, 0, 0, 0) // RSV, FRAG
+	return appendSocks5Addr(b, ap)
+}
+
+// parseSocks5UDPHeader parses the SOCKS5 UDP request header at the start of b
+// and returns the address it holds and its length.
+func parseSocks5UDPHeader(b []byte) (netip.AddrPort, int, error) {
+	if len(b) < 4 {
+		return netip.AddrPort{}, 0, errors.New("socks5 UDP header too short")
+	}
+	if b[2] != 0 {
+		return netip.AddrPort{}, 0, errors.New("fragmented socks5 UDP datagram")
+	}
+	var addrLen int
+	switch b[3] {
+	case socks5AtypIPv4:
+		addrLen = 4
+	case socks5AtypIPv6:
+		addrLen = 16
+	default:
+		return netip.AddrPort{}, 0, fmt.Errorf("unsupported socks5 address type %d", b[3])
+	}
+	headerLen := 4 + addrLen + 2
+	if len(b) < headerLen {
+		return netip.AddrPort{}, 0, errors.New("socks5 UDP header too short")
+	}
+	addr, _ := netip.AddrFromSlice(b[4 : 4+addrLen])
+	port := binary.BigEndian.Uint16(b[4+addrLen:])
+	return netip.AddrPortFrom(addr.Unmap(), port), headerLen, nil
+}
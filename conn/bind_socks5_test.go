@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// socks5Proxy is a minimal SOCKS5 proxy that only supports UDP ASSOCIATE
+// with username/password authentication. The control connections it accepts
+// are sent on ctrls, so that tests can drop them.
+type socks5Proxy struct {
+	l        net.Listener
+	username string
+	password string
+	ctrls    chan net.Conn
+}
+
+func (p *socks5Proxy) serve() {
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(c)
+	}
+}
+
+func (p *socks5Proxy) handle(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(c, buf[:3]); err != nil || buf[2] != socks5AuthPassword {
+		return
+	}
+	c.Write([]byte{socks5Version, socks5AuthPassword})
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	username := make([]byte, buf[1])
+	io.ReadFull(c, username)
+	io.ReadFull(c, buf[:1])
+	password := make([]byte, buf[0])
+	io.ReadFull(c, password)
+	if string(username) != p.username || string(password) != p.password {
+		c.Write([]byte{1, 1})
+		return
+	}
+	c.Write([]byte{1, 0})
+
+	if _, err := io.ReadFull(c, buf[:3+1+4+2]); err != nil || buf[1] != socks5CmdUDPAssociate {
+		return
+	}
+	client, _, err := parseSocks5UDPHeader(append([]byte{0, 0}, buf[2:10]...))
+	if err != nil {
+		return
+	}
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	reply := []byte{socks5Version, 0, 0}
+	reply = appendSocks5Addr(reply, relay.LocalAddr().(*net.UDPAddr).AddrPort())
+	c.Write(reply)
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, src, err := relay.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if src == client {
+				dst, headerLen, err := parseSocks5UDPHeader(buf[:n])
+				if err == nil {
+					relay.WriteToUDPAddrPort(buf[headerLen:n], dst)
+				}
+				continue
+			}
+			packet := appendSocks5UDPHeader(nil, src)
+			relay.WriteToUDPAddrPort(append(packet, buf[:n]...), client)
+		}
+	}()
+	p.ctrls <- c
+	io.Copy(io.Discard, c)
+}
+
+// udpEcho echoes every datagram received on c back to its sender.
+func udpEcho(c *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		c.WriteToUDPAddrPort(buf[:n], src)
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	proxy := &socks5Proxy{l: l, username: "user", password: "secret", ctrls: make(chan net.Conn, 4)}
+	go proxy.serve()
+
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go udpEcho(echo)
+
+	if _, _, err := NewSocks5Bind(l.Addr().String(), &Socks5Auth{"user", "wrong"}).Open(0); err == nil {
+		t.Error("open with a wrong password succeeded")
+	}
+
+	bind := NewSocks5Bind(l.Addr().String(), &Socks5Auth{"user", "secret"})
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) != 1 || bind.BatchSize() != 1 {
+		t.Fatalf("got %d receive funcs and batch size %d, want 1 and 1", len(fns), bind.BatchSize())
+	}
+	ep, err := bind.ParseEndpoint(echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	for i, msg := range [][]byte{[]byte("one"), []byte("two")} {
+		if i == 1 {
+			// Drop the association; the bind must set up a new one.
+			(<-proxy.ctrls).Close()
+		}
+		received := make(chan error, 1)
+		go func() {
+			_, err := fns[0](bufs, sizes, eps)
+			received <- err
+		}()
+		timeout := time.After(5 * time.Second)
+		ticker := time.NewTicker(50 * time.Millisecond)
+	resend:
+		for {
+			bind.Send([][]byte{msg}, ep)
+			select {
+			case err := <-received:
+				if err != nil {
+					t.Fatalf("receive failed: %v", err)
+				}
+				break resend
+			case <-ticker.C:
+			case <-timeout:
+				t.Fatalf("did not receive %q", msg)
+			}
+		}
+		ticker.Stop()
+		if !bytes.Equal(bufs[0][:sizes[0]], msg) {
+			t.Fatalf("received %q, want %q", bufs[0][:sizes[0]], msg)
+		}
+		if eps[0].DstToString() != ep.DstToString() {
+			t.Errorf("received from %s, want %s", eps[0].DstToString(), ep.DstToString())
+		}
+	}
+
+	bind.Close()
+	if _, err := fns[0](bufs, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close returned %v, want net.ErrClosed", err)
+	}
+}
+
+func TestSocks5UDPHeader(t *testing.T) {
+	for _, s := range []string{"192.0.2.1:51820", "[2001:db8::1]:1"} {
+		ap := netip.MustParseAddrPort(s)
+		packet := append(appendSocks5UDPHeader(nil, ap), "payload"...)
+		got, headerLen, err := parseSocks5UDPHeader(packet)
+		if err != nil || got != ap || string(packet[headerLen:]) != "payload" {
+			t.Errorf("%s: parsed %v, %q, %v", s, got, packet[headerLen:], err)
+		}
+	}
+	fragmented := appendSocks5UDPHeader(nil, netip.MustParseAddrPort("192.0.2.1:1"))
+	fragmented[2] = 1
+	if _, _, err := parseSocks5UDPHeader(fragmented); err == nil {
+		t.Error("fragmented datagram accepted")
+	}
+	if _, _, err := parseSocks5UDPHeader([]byte{0, 0, 0, socks5AtypIPv4, 1}); err == nil {
+		t.Error("truncated header accepted")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/net/ipv4"
@@ -41,12 +42,24 @@ type StdNetBind struct {
 	ipv6TxOffload bool
 	ipv6RxOffload bool
 
-	// these two fields are not guarded by mu
+	// these three fields are not guarded by mu
 	udpAddrPool sync.Pool
 	msgsPool    sync.Pool
+	// reportEndpointErrors is written under mu, but read by the ReceiveFuncs
+	// and Send without it.
+	reportEndpointErrors atomic.Bool
 
 	blackhole4 bool
 	blackhole6 bool
+
+	families         AddressFamilies // zero means AddressFamiliesBoth
+	socketBufferSize int             // zero means the default set by controlFns
+	netns            string          // network namespace of the sockets; "" means the process's
+
+	// handover4 and handover6 are the sockets passed to NewBindFromFDs,
+	// adopted by the next Open instead of listening.
+	handover4 *net.UDPConn
+	handover6 *net.UDPConn
 }
 
 func NewStdNetBind() Bind {
@@ -66,7 +79,7 @@ func NewStdNetBind() Bind {
 				msgs := make([]ipv6.Message, IdealBatchSize)
 				for i := range msgs {
 					msgs[i].Buffers = make(net.Buffers, 1)
-					msgs[i].OOB = make([]byte, 0, stickyControlSize+gsoControlSize)
+					msgs[i].OOB = make([]byte, 0, stickyControlSize+gsoControlSize+markControlSize)
 				}
 				return &msgs
 			},
@@ -120,8 +133,12 @@ func (e *StdNetEndpoint) DstToString() string {
 	return e.AddrPort.String()
 }
 
-func listenNet(network string, port int) (*net.UDPConn, int, error) {
-	conn, err := listenConfig().ListenPacket(context.Background(), network, ":"+strconv.Itoa(port))
+func listenNet(network string, port int, netns string) (*net.UDPConn, int, error) {
+	var conn net.PacketConn
+	err := inNetworkNamespace(netns, func() (err error) {
+		conn, err = listenConfig().ListenPacket(context.Background(), network, ":"+strconv.Itoa(port))
+		return err
+	})
 	if err != nil {
 		return nil, 0, err
 	}
@@ -149,6 +166,11 @@ func (s *StdNetBind) Open(uport uint16) ([]ReceiveFunc, uint16, error) {
 		return nil, 0, ErrBindAlreadyOpen
 	}
 
+	families := s.families
+	if families == 0 {
+		families = AddressFamiliesBoth
+	}
+
 	// Attempt to open ipv4 and ipv6 listeners on the same port.
 	// If uport is 0, we can retry on failure.
 again:
@@ -157,20 +179,62 @@ again:
 	var v4pc *ipv4.PacketConn
 	var v6pc *ipv6.PacketConn
 
-	v4conn, port, err = listenNet("udp4", port)
-	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-		return nil, 0, err
-	}
+	if s.handover4 != nil || s.handover6 != nil {
+		// Adopt the sockets handed over instead of listening.
+		v4conn, v6conn, port = s.takeHandover()
+	} else {
+		if families&AddressFamiliesV4Only != 0 {
+			v4conn, port, err = listenNet("udp4", port, s.netns)
+			if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+				return nil, 0, err
+			}
+		}
 
-	// Listen on the same port as we're using for ipv4.
-	v6conn, port, err = listenNet("udp6", port)
-	if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
-		v4conn.Close()
-		tries++
-		goto again
+		// Listen on the same port as we're using for ipv4.
+		if families&AddressFamiliesV6Only != 0 {
+			v6conn, port, err = listenNet("udp6", port, s.netns)
+			if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
+				if v4conn != nil {
+					v4conn.Close()
+				}
+				tries++
+				goto again
+			}
+			if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+				if v4conn != nil {
+					v4conn.Close()
+				}
+				return nil, 0, err
+			}
+		}
+	}
+	err = nil // ignore EAFNOSUPPORT from listening, handled below
+	if s.reportEndpointErrors.Load() {
+		if v4conn != nil {
+			err = setRecvErr(v4conn, false, true)
+		}
+		if err == nil && v6conn != nil {
+			err = setRecvErr(v6conn, true, true)
+		}
 	}
-	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-		v4conn.Close()
+	if err == nil && s.socketBufferSize != 0 {
+		if v4conn != nil {
+			err = setSocketBufferSize(v4conn, s.socketBufferSize)
+		}
+		if err == nil && v6conn != nil {
+			err = setSocketBufferSize(v6conn, s.socketBufferSize)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to set socket buffer size: %w", err)
+		}
+	}
+	if err != nil {
+		if v4conn != nil {
+			v4conn.Close()
+		}
+		if v6conn != nil {
+			v6conn.Close()
+		}
 		return nil, 0, err
 	}
 	var fns []ReceiveFunc
@@ -193,12 +257,74 @@ again:
 		s.ipv6 = v6conn
 	}
 	if len(fns) == 0 {
+		if families != AddressFamiliesBoth {
+			return nil, 0, fmt.Errorf("no socket could be opened for address families %v: %w", families, syscall.EAFNOSUPPORT)
+		}
 		return nil, 0, syscall.EAFNOSUPPORT
 	}
 
 	return fns, uint16(port), nil
 }
 
+// SetAddressFamilies limits the sockets opened by the next Open to families.
+// Datagrams sent to endpoints of a family without a socket fail with
+// syscall.EAFNOSUPPORT.
+func (s *StdNetBind) SetAddressFamilies(families AddressFamilies) error {
+	if families == 0 {
+		return errors.New("both IPv4 and IPv6 are disabled; at least one address family is needed")
+	}
+	if families&^AddressFamiliesBoth != 0 {
+		return fmt.Errorf("invalid address families %v", families)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.families = families
+	return nil
+}
+
+// SetSocketBufferSize sets the size of the receive and send buffers of the
+// sockets opened by the next Open. A size of zero restores the default.
+func (s *StdNetBind) SetSocketBufferSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid socket buffer size %d", size)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.socketBufferSize = size
+	return nil
+}
+
+// SetNetworkNamespace makes the next Open create the sockets in the network
+// namespace at path, such as /var/run/netns/NAME or /proc/PID/ns/net; a
+// namespace held by a file descriptor fd is at /proc/self/fd/FD. An empty path
+// restores the namespace of the process. Entering a namespace requires
+// CAP_SYS_ADMIN. On platforms other than Linux the setting is ignored.
+func (s *StdNetBind) SetNetworkNamespace(path string) error {
+	if path != "" {
+		if err := checkNetworkNamespace(path); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.netns = path
+	return nil
+}
+
+// SocketBufferSizes returns the sizes of the receive and send buffers
+// the open sockets obtained, those of the IPv4 socket if there are two.
+func (s *StdNetBind) SocketBufferSizes() (recv, send int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.ipv4 != nil:
+		return socketBufferSizes(s.ipv4)
+	case s.ipv6 != nil:
+		return socketBufferSizes(s.ipv6)
+	}
+	return 0, 0, net.ErrClosed
+}
+
 func (s *StdNetBind) putMessages(msgs *[]ipv6.Message) {
 	for i := range *msgs {
 		(*msgs)[i].OOB = (*msgs)[i].OOB[:0]
@@ -278,18 +404,66 @@ func (s *StdNetBind) receiveIP(
 	return numMsgs, nil
 }
 
+// receiveIPOrEndpointError is like receiveIP, but if endpoint errors are
+// reported it turns a read failing because of an ICMP error into an
+// *EndpointError. Errors that cannot be attributed to an endpoint are
+// discarded and the read is retried.
+func (s *StdNetBind) receiveIPOrEndpointError(
+	br batchReader,
+	conn *net.UDPConn,
+	rxOffload bool,
+	bufs [][]byte,
+	sizes []int,
+	eps []Endpoint,
+) (n int, err error) {
+	for {
+		n, err = s.receiveIP(br, conn, rxOffload, bufs, sizes, eps)
+		if err == nil || !s.reportEndpointErrors.Load() || !isEndpointErrno(err) {
+			return n, err
+		}
+		if epErr := readEndpointError(conn); epErr != nil {
+			return 0, epErr
+		}
+	}
+}
+
 func (s *StdNetBind) makeReceiveIPv4(pc *ipv4.PacketConn, conn *net.UDPConn, rxOffload bool) ReceiveFunc {
 	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
-		return s.receiveIP(pc, conn, rxOffload, bufs, sizes, eps)
+		return s.receiveIPOrEndpointError(pc, conn, rxOffload, bufs, sizes, eps)
 	}
 }
 
 func (s *StdNetBind) makeReceiveIPv6(pc *ipv6.PacketConn, conn *net.UDPConn, rxOffload bool) ReceiveFunc {
 	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
-		return s.receiveIP(pc, conn, rxOffload, bufs, sizes, eps)
+		return s.receiveIPOrEndpointError(pc, conn, rxOffload, bufs, sizes, eps)
 	}
 }
 
+// SetReportEndpointErrors implements EndpointErrorReporter. It is only
+// supported on Linux, including Android, where ICMP errors are received
+// through the sockets' error queues. An error that arrives while a packet is
+// being sent may be reported late, only once a later ICMP error is received.
+func (s *StdNetBind) SetReportEndpointErrors(report bool) error {
+	if report && !endpointErrorsSupported {
+		return errors.ErrUnsupported
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ipv4 != nil {
+		if err := setRecvErr(s.ipv4, false, report); err != nil {
+			return err
+		}
+	}
+	if s.ipv6 != nil {
+		if err := setRecvErr(s.ipv6, true, report); err != nil {
+			return err
+		}
+	}
+	s.reportEndpointErrors.Store(report)
+	return nil
+}
+
 // TODO: When all Binds handle IdealBatchSize, remove this dynamic function and
 // rename the IdealBatchSize constant to BatchSize.
 func (s *StdNetBind) BatchSize() int {
@@ -314,6 +488,13 @@ func (s *StdNetBind) Close() error {
 		s.ipv6 = nil
 		s.ipv6PC = nil
 	}
+	// Sockets handed over but never opened are closed too.
+	for _, conn := range [...]*net.UDPConn{s.handover4, s.handover6} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	s.handover4, s.handover6 = nil, nil
 	s.blackhole4 = false
 	s.blackhole6 = false
 	s.ipv4TxOffload = false
@@ -340,6 +521,13 @@ func (e ErrUDPGSODisabled) Unwrap() error {
 }
 
 func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	return s.sendWithControl(bufs, endpoint, nil)
+}
+
+// sendWithControl implements Send. If setControl is not nil, it is called to
+// add to the control data of every message after the sticky and GSO control
+// data has been set.
+func (s *StdNetBind) sendWithControl(bufs [][]byte, endpoint Endpoint, setControl func(control *[]byte)) error {
 	s.mu.Lock()
 	blackhole := s.blackhole4
 	conn := s.ipv4
@@ -383,6 +571,11 @@ func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 retry:
 	if offload {
 		n := coalesceMessages(ua, endpoint.(*StdNetEndpoint), bufs, *msgs, setGSOSize)
+		if setControl != nil {
+			for i := range (*msgs)[:n] {
+				setControl(&(*msgs)[i].OOB)
+			}
+		}
 		err = s.send(conn, br, (*msgs)[:n])
 		if err != nil && offload && errShouldDisableUDPGSO(err) {
 			offload = false
@@ -401,6 +594,9 @@ retry:
 			(*msgs)[i].Addr = ua
 			(*msgs)[i].Buffers[0] = bufs[i]
 			setSrcControl(&(*msgs)[i].OOB, endpoint.(*StdNetEndpoint))
+			if setControl != nil {
+				setControl(&(*msgs)[i].OOB)
+			}
 		}
 		err = s.send(conn, br, (*msgs)[:len(bufs)])
 	}
@@ -417,8 +613,16 @@ func (s *StdNetBind) send(conn *net.UDPConn, pc batchWriter, msgs []ipv6.Message
 		start int
 	)
 	if runtime.GOOS == "linux" || runtime.GOOS == "android" {
+		retried := false
 		for {
 			n, err = pc.WriteBatch(msgs[start:], 0)
+			if err != nil && !retried && s.reportEndpointErrors.Load() && isEndpointErrno(err) {
+				// The write failed on an ICMP error received for an earlier
+				// datagram, and nothing was sent. The error stays queued on
+				// the socket, so just try again.
+				retried = true
+				continue
+			}
 			if err != nil || n == len(msgs[start:]) {
 				break
 			}
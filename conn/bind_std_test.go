@@ -2,8 +2,13 @@ package conn
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/net/ipv6"
 )
@@ -27,11 +32,186 @@ func TestStdNetBindReceiveFuncAfterClose(t *testing.T) {
 	}
 }
 
+func TestStdNetBindEndpointErrors(t *testing.T) {
+	if !endpointErrorsSupported {
+		t.Skip("endpoint errors are not supported on this platform")
+	}
+	// Find a port nothing listens on.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := closed.LocalAddr().(*net.UDPAddr).AddrPort()
+	closed.Close()
+
+	bind := NewStdNetBind().(*StdNetBind)
+	if err := bind.SetReportEndpointErrors(true); err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep := &StdNetEndpoint{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), dst.Port())}
+	if err := bind.Send([][]byte{{1, 2, 3}}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		bufs := [][]byte{make([]byte, 1500)}
+		_, err := fns[0](bufs, make([]int, 1), make([]Endpoint, 1))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		var epErr *EndpointError
+		if !errors.As(err, &epErr) {
+			t.Fatalf("receive returned %v, want an *EndpointError", err)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) || epErr.Endpoint.DstToString() != ep.DstToString() {
+			t.Errorf("got %v, want connection refused by %s", err, ep.DstToString())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the endpoint error")
+	}
+}
+
 func mockSetGSOSize(control *[]byte, gsoSize uint16) {
 	*control = (*control)[:cap(*control)]
 	binary.LittleEndian.PutUint16(*control, gsoSize)
 }
 
+func TestStdNetBindAddressFamilies(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	if err := bind.SetAddressFamilies(0); err == nil {
+		t.Error("disabling both address families succeeded")
+	}
+	if err := bind.SetAddressFamilies(AddressFamiliesV4Only); err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if len(fns) != 1 || bind.ipv4 == nil || bind.ipv6 != nil {
+		t.Fatalf("got %d receive funcs, ipv4 %v, ipv6 %v; want only an IPv4 socket", len(fns), bind.ipv4 != nil, bind.ipv6 != nil)
+	}
+	ep := &StdNetEndpoint{AddrPort: netip.MustParseAddrPort("[::1]:51820")}
+	if err := bind.Send([][]byte{{1}}, ep); !errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Errorf("send to IPv6 endpoint: got %v, want EAFNOSUPPORT", err)
+	}
+}
+
+func TestStdNetBindSocketBufferSize(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	if err := bind.SetSocketBufferSize(-1); err == nil {
+		t.Error("setting a negative socket buffer size succeeded")
+	}
+	if _, _, err := bind.SocketBufferSizes(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("SocketBufferSizes of a closed bind returned %v, want net.ErrClosed", err)
+	}
+	const size = 64 << 10
+	if err := bind.SetSocketBufferSize(size); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	recv, send, err := bind.SocketBufferSizes()
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Linux doubles the size that was set.
+	if recv < size || recv > 2*size || send < size || send > 2*size {
+		t.Errorf("got socket buffer sizes %d and %d, want %d", recv, send, size)
+	}
+}
+
+// BenchmarkStdNetBindSocketBufferSize sends bursts of datagrams over the
+// loopback interface to a bind that does not read them until the burst is
+// over, and reports the fraction of them that were dropped for each socket
+// buffer size.
+func BenchmarkStdNetBindSocketBufferSize(b *testing.B) {
+	const (
+		burst    = 4096
+		dataSize = 1024
+	)
+	for _, size := range []int{64 << 10, 8 << 20} {
+		b.Run(strconv.Itoa(size>>10)+"KiB", func(b *testing.B) {
+			receiver := NewStdNetBind().(*StdNetBind)
+			receiver.SetAddressFamilies(AddressFamiliesV4Only)
+			receiver.SetSocketBufferSize(size)
+			fns, port, err := receiver.Open(0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer receiver.Close()
+			sender := NewStdNetBind().(*StdNetBind)
+			sender.SetAddressFamilies(AddressFamiliesV4Only)
+			sender.SetSocketBufferSize(size)
+			if _, _, err := sender.Open(0); err != nil {
+				b.Fatal(err)
+			}
+			defer sender.Close()
+			ep := &StdNetEndpoint{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port)}
+
+			received, done := make(chan int), make(chan struct{})
+			defer close(done)
+			go func() {
+				bufs := make([][]byte, receiver.BatchSize())
+				for i := range bufs {
+					bufs[i] = make([]byte, dataSize)
+				}
+				sizes := make([]int, len(bufs))
+				eps := make([]Endpoint, len(bufs))
+				for {
+					n, err := fns[0](bufs, sizes, eps)
+					if err != nil {
+						return
+					}
+					select {
+					case received <- n:
+					case <-done:
+						return
+					}
+				}
+			}()
+
+			bufs := make([][]byte, sender.BatchSize())
+			for i := range bufs {
+				bufs[i] = make([]byte, dataSize)
+			}
+			var sent, got int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for n := 0; n < burst; n += len(bufs) {
+					sender.Send(bufs, ep)
+					sent += len(bufs)
+				}
+			drain:
+				for {
+					select {
+					case n := <-received:
+						got += n
+					case <-time.After(50 * time.Millisecond):
+						break drain
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(1-float64(got)/float64(sent), "drop-ratio")
+		})
+	}
+}
+
 func Test_coalesceMessages(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -0,0 +1,273 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	_ Bind     = (*TCPBind)(nil)
+	_ Endpoint = (*TCPEndpoint)(nil)
+)
+
+const (
+	tcpBindMinBackoff = 100 * time.Millisecond
+	tcpBindMaxBackoff = 10 * time.Second
+)
+
+// TCPBind implements Bind for networks that block UDP. Every packet is framed
+// with a 2-byte big-endian length prefix and sent over a single persistent TCP
+// connection to a relay, which is responsible for forwarding the packets to
+// and from the peer. The endpoint passed to Send is therefore ignored.
+// If the connection to the relay is lost, it is re-established with
+// exponential backoff.
+type TCPBind struct {
+	relay string
+
+	mu     sync.Mutex // protects all fields below
+	conn   net.Conn
+	mark   uint32
+	closed chan struct{} // closed by Close; nil when not open
+
+	writeMu sync.Mutex // serializes frames written to conn
+}
+
+// NewTCPBind returns a Bind that tunnels packets over TCP to relay, which
+// must be a "host:port" address.
+func NewTCPBind(relay string) *TCPBind {
+	return &TCPBind{relay: relay}
+}
+
+// TCPEndpoint is the Endpoint type of TCPBind.
+type TCPEndpoint struct {
+	netip.AddrPort
+}
+
+func (e *TCPEndpoint) ClearSrc() {}
+
+func (e *TCPEndpoint) SrcToString() string { return "" }
+
+func (e *TCPEndpoint) DstToString() string { return e.AddrPort.String() }
+
+func (e *TCPEndpoint) DstToBytes() []byte {
+	b, _ := e.AddrPort.MarshalBinary()
+	return b
+}
+
+func (e *TCPEndpoint) DstIP() netip.Addr { return e.AddrPort.Addr() }
+
+func (e *TCPEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+func (*TCPBind) ParseEndpoint(s string) (Endpoint, error) {
+	e, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPEndpoint{AddrPort: e}, nil
+}
+
+func (b *TCPBind) dial() (net.Conn, error) {
+	b.mu.Lock()
+	mark := b.mark
+	b.mu.Unlock()
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if mark == 0 {
+				return nil
+			}
+			return setMark(c, mark)
+		},
+	}
+	return dialer.Dial("tcp", b.relay)
+}
+
+// Open dials the relay. The port is ignored, and the local port of the TCP
+// connection is reported instead.
+func (b *TCPBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	if b.closed != nil {
+		b.mu.Unlock()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	b.mu.Unlock()
+
+	conn, err := b.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		conn.Close()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	b.conn = conn
+	b.closed = make(chan struct{})
+	var actualPort uint16
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		actualPort = uint16(addr.Port)
+	}
+	return []ReceiveFunc{b.makeReceiveTCP(conn, b.closed)}, actualPort, nil
+}
+
+func (b *TCPBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	b.closed = nil
+	var err error
+	if b.conn != nil {
+		err = b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *TCPBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	if b.conn == nil {
+		return nil
+	}
+	sc, ok := b.conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setMark(rc, mark)
+}
+
+func (b *TCPBind) BatchSize() int { return 1 }
+
+// reconnect replaces the broken connection old with a new connection to the
+// relay, retrying with exponential backoff until it succeeds or the bind is
+// closed.
+func (b *TCPBind) reconnect(old net.Conn, closed chan struct{}) (net.Conn, error) {
+	old.Close()
+	backoff := tcpBindMinBackoff
+	for {
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		default:
+		}
+		conn, err := b.dial()
+		if err == nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.closed != closed {
+				conn.Close()
+				return nil, net.ErrClosed
+			}
+			b.conn = conn
+			return conn, nil
+		}
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > tcpBindMaxBackoff {
+			backoff = tcpBindMaxBackoff
+		}
+	}
+}
+
+func (b *TCPBind) makeReceiveTCP(conn net.Conn, closed chan struct{}) ReceiveFunc {
+	var header [2]byte
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		for {
+			size, err := readFrame(conn, header[:], bufs[0])
+			if err == nil {
+				ep := &TCPEndpoint{}
+				if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+					ep.AddrPort = addr.AddrPort()
+				}
+				sizes[0] = size
+				eps[0] = ep
+				return 1, nil
+			}
+			var tooLarge errFrameTooLarge
+			if errors.As(err, &tooLarge) {
+				continue
+			}
+			conn, err = b.reconnect(conn, closed)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+type errFrameTooLarge int
+
+func (e errFrameTooLarge) Error() string {
+	return fmt.Sprintf("frame of %d bytes does not fit into buffer", int(e))
+}
+
+// readFrame reads a single length-prefixed frame from r into buf.
+// Frames that do not fit into buf are discarded.
+func readFrame(r io.Reader, header, buf []byte) (int, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header))
+	if size > len(buf) {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return 0, err
+		}
+		return 0, errFrameTooLarge(size)
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (b *TCPBind) Send(bufs [][]byte, ep Endpoint) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return net.ErrClosed
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	for _, buf := range bufs {
+		if len(buf) > 0xffff {
+			return errFrameTooLarge(len(buf))
+		}
+		frame := make([]byte, 2+len(buf))
+		binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+		copy(frame[2:], buf)
+		if _, err := conn.Write(frame); err != nil {
+			// Closing the connection makes the receiver reconnect.
+			conn.Close()
+			return err
+		}
+	}
+	return nil
+}
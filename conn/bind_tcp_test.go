@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoRelay accepts connections on l and echoes every byte back.
+// The first connection is dropped after echoing its first frame.
+func echoRelay(l net.Listener) {
+	first := true
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if first {
+			first = false
+			frame := make([]byte, 2+3)
+			if _, err := io.ReadFull(c, frame); err == nil {
+				c.Write(frame)
+			}
+			c.Close()
+			continue
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, 2048)
+			for {
+				n, err := c.Read(buf)
+				if err != nil {
+					return
+				}
+				c.Write(buf[:n])
+			}
+		}()
+	}
+}
+
+func TestTCPBind(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoRelay(l)
+
+	bind := NewTCPBind(l.Addr().String())
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) != 1 || bind.BatchSize() != 1 {
+		t.Fatalf("got %d receive funcs and batch size %d, want 1 and 1", len(fns), bind.BatchSize())
+	}
+	ep, err := bind.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	for _, msg := range [][]byte{[]byte("one"), []byte("two")} {
+		received := make(chan error, 1)
+		go func() {
+			_, err := fns[0](bufs, sizes, eps)
+			received <- err
+		}()
+		// The relay drops the first connection after echoing one frame,
+		// so frames may be lost until the bind has reconnected.
+		timeout := time.After(5 * time.Second)
+		ticker := time.NewTicker(50 * time.Millisecond)
+	resend:
+		for {
+			bind.Send([][]byte{msg}, ep)
+			select {
+			case err := <-received:
+				if err != nil {
+					t.Fatalf("receive failed: %v", err)
+				}
+				break resend
+			case <-ticker.C:
+			case <-timeout:
+				t.Fatalf("did not receive %q", msg)
+			}
+		}
+		ticker.Stop()
+		if !bytes.Equal(bufs[0][:sizes[0]], msg) {
+			t.Fatalf("received %q, want %q", bufs[0][:sizes[0]], msg)
+		}
+	}
+
+	bind.Close()
+	if _, err := fns[0](bufs, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close returned %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var _ Bind = (*TeeBind)(nil)
+
+// teeQueueSize is the number of datagrams a TeeBind queues for its mirror
+// function before it drops them.
+const teeQueueSize = 1024
+
+// teePacket is a datagram queued for the mirror function.
+type teePacket struct {
+	data []byte
+	ep   Endpoint
+}
+
+// TeeBind wraps a Bind and passes a copy of every datagram sent through it
+// to a mirror function, for example to forward the encrypted traffic to a
+// collector for passive monitoring. The datagrams received can be mirrored
+// too; see SetMirrorReceived.
+//
+// The mirror function is called from a goroutine of its own, which runs while
+// the bind is open, so that a slow mirror does not delay the traffic. Copies
+// are queued for it and dropped when the queue is full; Dropped counts them.
+type TeeBind struct {
+	Bind
+	mirror func([]byte, Endpoint)
+
+	queue          chan teePacket
+	mirrorReceived atomic.Bool
+	dropped        atomic.Uint64
+
+	mu      sync.Mutex    // protects done
+	done    chan struct{} // closed to stop the mirror goroutine; nil if not running
+	running sync.WaitGroup
+}
+
+// NewTeeBind returns a TeeBind that delegates to primary and passes a copy of
+// every datagram it sends to mirror, along with its destination. The copy
+// belongs to mirror.
+func NewTeeBind(primary Bind, mirror func([]byte, Endpoint)) *TeeBind {
+	return &TeeBind{
+		Bind:   primary,
+		mirror: mirror,
+		queue:  make(chan teePacket, teeQueueSize),
+	}
+}
+
+// SetMirrorReceived sets whether the datagrams received are mirrored too,
+// along with their source. They are not by default.
+func (b *TeeBind) SetMirrorReceived(mirror bool) {
+	b.mirrorReceived.Store(mirror)
+}
+
+// Dropped returns the number of datagrams that were not mirrored because the
+// mirror function did not keep up.
+func (b *TeeBind) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (b *TeeBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.mu.Lock()
+	if b.done == nil {
+		b.done = make(chan struct{})
+		b.running.Add(1)
+		go b.routineMirror(b.done)
+	}
+	b.mu.Unlock()
+
+	teeFns := make([]ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		fn := fn
+		teeFns[i] = func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			if b.mirrorReceived.Load() {
+				for i := 0; i < n; i++ {
+					b.enqueue(packets[i][:sizes[i]], eps[i])
+				}
+			}
+			return n, err
+		}
+	}
+	return teeFns, actualPort, nil
+}
+
+// Close closes the primary bind and stops the mirror goroutine. Datagrams
+// still queued are mirrored once the bind is opened again.
+func (b *TeeBind) Close() error {
+	err := b.Bind.Close()
+	b.mu.Lock()
+	if b.done != nil {
+		close(b.done)
+		b.done = nil
+	}
+	b.mu.Unlock()
+	b.running.Wait()
+	return err
+}
+
+func (b *TeeBind) Send(bufs [][]byte, ep Endpoint) error {
+	for _, buf := range bufs {
+		b.enqueue(buf, ep)
+	}
+	return b.Bind.Send(bufs, ep)
+}
+
+// enqueue queues a copy of data for the mirror function, or drops it if the
+// queue is full.
+func (b *TeeBind) enqueue(data []byte, ep Endpoint) {
+	select {
+	case b.queue <- teePacket{data: append([]byte(nil), data...), ep: ep}:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// routineMirror passes the queued datagrams to the mirror function until done
+// is closed.
+func (b *TeeBind) routineMirror(done <-chan struct{}) {
+	defer b.running.Done()
+	for {
+		select {
+		case packet := <-b.queue:
+			b.mirror(packet.data, packet.ep)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTeeBind(t *testing.T) {
+	mirrored := make(chan string, 16)
+	bind := NewTeeBind(&loopbackBind{}, func(data []byte, ep Endpoint) {
+		if ep == nil {
+			t.Error("mirrored datagram has no endpoint")
+		}
+		mirrored <- string(data)
+	})
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-mirrored:
+			if got != want {
+				t.Fatalf("mirrored %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not mirrored", want)
+		}
+	}
+
+	ep, _ := bind.ParseEndpoint("")
+	bufs := [][]byte{make([]byte, 64)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	roundTrip := func(msg string) {
+		t.Helper()
+		buf := []byte(msg)
+		if err := bind.Send([][]byte{buf}, ep); err != nil {
+			t.Fatal(err)
+		}
+		// The mirror gets a copy, not the buffer that is reused.
+		copy(buf, "xxx")
+		if _, err := fns[0](bufs, sizes, eps); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bufs[0][:sizes[0]]); got != msg {
+			t.Fatalf("received %q, want %q", got, msg)
+		}
+	}
+
+	// Only sent datagrams are mirrored by default.
+	roundTrip("one")
+	expect("one")
+
+	bind.SetMirrorReceived(true)
+	roundTrip("two")
+	expect("two")
+	expect("two")
+
+	select {
+	case got := <-mirrored:
+		t.Fatalf("unexpectedly mirrored %q", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if dropped := bind.Dropped(); dropped != 0 {
+		t.Errorf("dropped %d datagrams, want 0", dropped)
+	}
+}
+
+func TestTeeBindDropsWhenMirrorIsSlow(t *testing.T) {
+	block := make(chan struct{})
+	bind := NewTeeBind(&nopBind{}, func([]byte, Endpoint) { <-block })
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := &StdNetEndpoint{}
+	const n = teeQueueSize + 10
+	for i := 0; i < n; i++ {
+		if err := bind.Send([][]byte{{byte(i)}}, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The mirror goroutine holds one datagram and the queue the others.
+	if dropped := bind.Dropped(); dropped < n-teeQueueSize-1 || dropped > n-teeQueueSize {
+		t.Errorf("dropped %d datagrams, want about %d", dropped, n-teeQueueSize)
+	}
+	close(block)
+	bind.Close()
+}
+
+// nopBind is a Bind that discards the packets sent to it, unlike
+// loopbackBind, which blocks once 16 are buffered.
+type nopBind struct {
+	loopbackBind
+}
+
+func (*nopBind) Close() error                          { return nil }
+func (*nopBind) Send(bufs [][]byte, ep Endpoint) error { return nil }
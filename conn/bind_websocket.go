@@ -0,0 +1,553 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var _ Bind = (*WebSocketBind)(nil)
+
+const webSocketDialTimeout = 10 * time.Second
+
+// WebSocket opcodes, from RFC 6455.
+const (
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xa
+)
+
+// webSocketGUID is appended to the handshake key to compute the accept key.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A WebSocketState is the state of the connection of a WebSocketBind.
+type WebSocketState uint32
+
+const (
+	WebSocketDisconnected WebSocketState = iota // the bind is closed
+	WebSocketConnecting                         // the connection is being established or re-established
+	WebSocketConnected                          // the connection is up
+)
+
+func (s WebSocketState) String() string {
+	switch s {
+	case WebSocketDisconnected:
+		return "disconnected"
+	case WebSocketConnecting:
+		return "connecting"
+	case WebSocketConnected:
+		return "connected"
+	}
+	return "unknown"
+}
+
+// WebSocketBind implements Bind for networks that only let HTTPS through.
+// Every packet is sent as one binary message over a single WebSocket
+// connection to a relay, which is responsible for forwarding the packets to
+// and from the peer; the endpoint passed to Send is therefore ignored, and
+// received packets come from a TCPEndpoint holding the relay's address.
+// If the connection is lost, it is re-established with exponential backoff.
+//
+// With a wss URL, the connection can be fronted through a CDN: the TLS
+// connection goes to the host in the URL, with the SNI set by SetTLSConfig,
+// while a Host header passed to NewWebSocketBind names the actual relay.
+type WebSocketBind struct {
+	url     string
+	headers http.Header
+
+	state     atomic.Uint32
+	stateHook atomic.Pointer[func(WebSocketState)]
+
+	mu        sync.Mutex // protects all fields below
+	tlsConfig *tls.Config
+	conn      *webSocketConn
+	mark      uint32
+	closed    chan struct{} // closed by Close; nil when not open
+
+	writeMu sync.Mutex // serializes messages written to conn
+}
+
+// NewWebSocketBind returns a Bind that tunnels packets over a WebSocket
+// connection to url, a ws or wss URL, sending headers with the opening
+// handshake.
+func NewWebSocketBind(url string, headers http.Header) *WebSocketBind {
+	return &WebSocketBind{url: url, headers: headers.Clone()}
+}
+
+// SetTLSConfig sets the TLS configuration of wss connections. Its ServerName
+// is the SNI sent to the server, which defaults to the host of the URL.
+// It applies from the next connection.
+func (b *WebSocketBind) SetTLSConfig(config *tls.Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tlsConfig = config.Clone()
+}
+
+// State returns the state of the connection to the relay.
+func (b *WebSocketBind) State() WebSocketState {
+	return WebSocketState(b.state.Load())
+}
+
+// SetStateHook sets fn to be called whenever the state of the connection
+// changes. fn is called synchronously and must not block.
+// Passing nil removes the hook.
+func (b *WebSocketBind) SetStateHook(fn func(WebSocketState)) {
+	if fn == nil {
+		b.stateHook.Store(nil)
+	} else {
+		b.stateHook.Store(&fn)
+	}
+}
+
+func (b *WebSocketBind) setState(state WebSocketState) {
+	if WebSocketState(b.state.Swap(uint32(state))) == state {
+		return
+	}
+	if fn := b.stateHook.Load(); fn != nil {
+		(*fn)(state)
+	}
+}
+
+func (*WebSocketBind) ParseEndpoint(s string) (Endpoint, error) {
+	return (*TCPBind)(nil).ParseEndpoint(s)
+}
+
+// A webSocketConn is an established client WebSocket connection.
+type webSocketConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *WebSocketBind) dial() (*webSocketConn, error) {
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket URL scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	b.mu.Lock()
+	mark, tlsConfig := b.mark, b.tlsConfig
+	b.mu.Unlock()
+	dialer := net.Dialer{
+		Timeout: webSocketDialTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if mark == 0 {
+				return nil
+			}
+			return setMark(c, mark)
+		},
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(webSocketDialTimeout))
+	if secure {
+		config := tlsConfig.Clone()
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	wsConn, err := webSocketHandshake(conn, u, b.headers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return wsConn, nil
+}
+
+// webSocketHandshake performs the client side of the opening handshake
+// for u over conn.
+func webSocketHandshake(conn net.Conn, u *url.URL, headers http.Header) (*webSocketConn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     headers.Clone(),
+		Host:       u.Host,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("WebSocket handshake failed: invalid Sec-WebSocket-Accept")
+	}
+	return &webSocketConn{Conn: conn, r: r}, nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for key.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Open connects to the relay. The port is ignored, and the local port of the
+// connection is reported instead.
+func (b *WebSocketBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	if b.closed != nil {
+		b.mu.Unlock()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	b.mu.Unlock()
+
+	b.setState(WebSocketConnecting)
+	conn, err := b.dial()
+	if err != nil {
+		b.setState(WebSocketDisconnected)
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		conn.Close()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	b.conn = conn
+	b.closed = make(chan struct{})
+	b.setState(WebSocketConnected)
+	var actualPort uint16
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		actualPort = uint16(addr.Port)
+	}
+	return []ReceiveFunc{b.makeReceiveWebSocket(conn, b.closed)}, actualPort, nil
+}
+
+func (b *WebSocketBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	b.closed = nil
+	var err error
+	if b.conn != nil {
+		err = b.conn.Close()
+		b.conn = nil
+	}
+	b.setState(WebSocketDisconnected)
+	return err
+}
+
+func (b *WebSocketBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	if b.conn == nil {
+		return nil
+	}
+	conn := b.conn.Conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setMark(rc, mark)
+}
+
+func (b *WebSocketBind) BatchSize() int { return 1 }
+
+// reconnect replaces the broken connection old with a new connection to the
+// relay, retrying with exponential backoff until it succeeds or the bind is
+// closed.
+func (b *WebSocketBind) reconnect(old *webSocketConn, closed chan struct{}) (*webSocketConn, error) {
+	old.Close()
+	b.mu.Lock()
+	if b.closed != closed {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	b.setState(WebSocketConnecting)
+	b.mu.Unlock()
+	backoff := tcpBindMinBackoff
+	for {
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		default:
+		}
+		conn, err := b.dial()
+		if err == nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.closed != closed {
+				conn.Close()
+				return nil, net.ErrClosed
+			}
+			b.conn = conn
+			b.setState(WebSocketConnected)
+			return conn, nil
+		}
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > tcpBindMaxBackoff {
+			backoff = tcpBindMaxBackoff
+		}
+	}
+}
+
+func (b *WebSocketBind) makeReceiveWebSocket(conn *webSocketConn, closed chan struct{}) ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		for {
+			size, err := b.readMessage(conn, bufs[0])
+			if err == nil {
+				ep := &TCPEndpoint{}
+				if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+					ep.AddrPort = addr.AddrPort()
+				}
+				sizes[0] = size
+				eps[0] = ep
+				return 1, nil
+			}
+			var tooLarge errFrameTooLarge
+			if errors.As(err, &tooLarge) {
+				continue
+			}
+			conn, err = b.reconnect(conn, closed)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// readMessage reads the next binary message from conn into buf, answering
+// pings and skipping other messages on the way. Messages that do not fit into
+// buf are discarded. A close message is reported as io.EOF.
+func (b *WebSocketBind) readMessage(conn *webSocketConn, buf []byte) (int, error) {
+	size, isBinary, tooLarge := 0, false, false
+	for {
+		fin, op, payload, err := readWebSocketFrame(conn.r, buf[min(size, len(buf)):])
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case webSocketOpPing:
+			if err := b.writeMessage(conn, webSocketOpPong, payload); err != nil {
+				return 0, err
+			}
+			continue
+		case webSocketOpPong:
+			continue
+		case webSocketOpClose:
+			return 0, io.EOF
+		case webSocketOpBinary, webSocketOpText:
+			size, isBinary, tooLarge = 0, op == webSocketOpBinary, false
+		case webSocketOpContinuation:
+		default:
+			return 0, fmt.Errorf("unknown WebSocket opcode %#x", op)
+		}
+		if payload == nil {
+			tooLarge = true
+		}
+		size += len(payload)
+		if !fin {
+			continue
+		}
+		if tooLarge {
+			return 0, errFrameTooLarge(size)
+		}
+		if isBinary {
+			return size, nil
+		}
+	}
+}
+
+// readWebSocketFrame reads a single frame from r. Its payload is unmasked
+// into buf, and nil is returned for the payload of a data frame that does not
+// fit into buf. Control frames are read into a buffer of their own.
+func readWebSocketFrame(r *bufio.Reader, buf []byte) (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	fin, op = header[0]&0x80 != 0, header[0]&0x0f
+	masked := header[1]&0x80 != 0
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+	if op&0x8 != 0 {
+		if size > 125 {
+			err = errors.New("WebSocket control frame too large")
+			return
+		}
+		buf = make([]byte, size)
+	} else if size > uint64(len(buf)) {
+		_, err = io.CopyN(io.Discard, r, int64(size))
+		return
+	}
+	payload = buf[:size]
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// appendWebSocketFrame appends a final frame with opcode op and payload to
+// dst, masked with a random key if mask is set, as clients must.
+func appendWebSocketFrame(dst []byte, op byte, payload []byte, mask bool) []byte {
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	dst = append(dst, 0x80|op)
+	switch {
+	case len(payload) < 126:
+		dst = append(dst, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		dst = append(dst, maskBit|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload)))
+	default:
+		dst = append(dst, maskBit|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(len(payload)))
+	}
+	if !mask {
+		return append(dst, payload...)
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	dst = append(dst, key[:]...)
+	for i, c := range payload {
+		dst = append(dst, c^key[i%4])
+	}
+	return dst
+}
+
+// writeMessage sends payload as a single message of type op over conn.
+func (b *WebSocketBind) writeMessage(conn *webSocketConn, op byte, payload []byte) error {
+	frame := appendWebSocketFrame(nil, op, payload, true)
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	if _, err := conn.Write(frame); err != nil {
+		// Closing the connection makes the receiver reconnect.
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (b *WebSocketBind) Send(bufs [][]byte, ep Endpoint) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	for _, buf := range bufs {
+		if err := b.writeMessage(conn, webSocketOpBinary, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
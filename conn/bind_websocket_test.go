@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webSocketEchoRelay is an http.Handler that accepts WebSocket connections
+// and echoes every binary message back, after sending a ping. The requests
+// it accepted are sent on requests, and the connections on conns, so that
+// tests can drop them.
+type webSocketEchoRelay struct {
+	requests chan *http.Request
+	conns    chan net.Conn
+}
+
+func (relay *webSocketEchoRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		http.Error(w, "not a WebSocket request", http.StatusBadRequest)
+		return
+	}
+	c, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	rw.Write(appendWebSocketFrame(nil, webSocketOpPing, []byte("hi"), false))
+	rw.Flush()
+	relay.requests <- r
+	relay.conns <- c
+
+	buf := make([]byte, 2048)
+	for {
+		_, op, payload, err := readWebSocketFrame(rw.Reader, buf)
+		if err != nil {
+			return
+		}
+		if op == webSocketOpBinary {
+			c.Write(appendWebSocketFrame(nil, webSocketOpBinary, payload, false))
+		}
+	}
+}
+
+func TestWebSocketBind(t *testing.T) {
+	relay := &webSocketEchoRelay{requests: make(chan *http.Request, 4), conns: make(chan net.Conn, 4)}
+	server := httptest.NewTLSServer(relay)
+	defer server.Close()
+
+	headers := http.Header{"Authorization": {"Bearer secret"}, "Host": {"relay.example"}}
+	bind := NewWebSocketBind(strings.Replace(server.URL, "https", "wss", 1)+"/tunnel", headers)
+	bind.SetTLSConfig(&tls.Config{ServerName: "front.example", InsecureSkipVerify: true})
+	var (
+		mu     sync.Mutex
+		states []WebSocketState
+	)
+	bind.SetStateHook(func(state WebSocketState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	})
+
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) != 1 || bind.BatchSize() != 1 {
+		t.Fatalf("got %d receive funcs and batch size %d, want 1 and 1", len(fns), bind.BatchSize())
+	}
+	if bind.State() != WebSocketConnected {
+		t.Errorf("state after open = %v, want connected", bind.State())
+	}
+	r := <-relay.requests
+	if r.Host != "relay.example" || r.URL.Path != "/tunnel" || r.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("relay got host %q, path %q and authorization %q", r.Host, r.URL.Path, r.Header.Get("Authorization"))
+	}
+	if r.TLS == nil || r.TLS.ServerName != "front.example" {
+		t.Errorf("relay got TLS connection state %+v, want SNI front.example", r.TLS)
+	}
+	ep, err := bind.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	for i, msg := range [][]byte{[]byte("one"), []byte("two")} {
+		if i == 1 {
+			// Drop the connection; the bind must reconnect.
+			(<-relay.conns).Close()
+		}
+		received := make(chan error, 1)
+		go func() {
+			_, err := fns[0](bufs, sizes, eps)
+			received <- err
+		}()
+		timeout := time.After(5 * time.Second)
+		ticker := time.NewTicker(50 * time.Millisecond)
+	resend:
+		for {
+			bind.Send([][]byte{msg}, ep)
+			select {
+			case err := <-received:
+				if err != nil {
+					t.Fatalf("receive failed: %v", err)
+				}
+				break resend
+			case <-ticker.C:
+			case <-timeout:
+				t.Fatalf("did not receive %q", msg)
+			}
+		}
+		ticker.Stop()
+		if !bytes.Equal(bufs[0][:sizes[0]], msg) {
+			t.Fatalf("received %q, want %q", bufs[0][:sizes[0]], msg)
+		}
+	}
+
+	bind.Close()
+	if _, err := fns[0](bufs, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close returned %v, want net.ErrClosed", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []WebSocketState{WebSocketConnecting, WebSocketConnected, WebSocketConnecting, WebSocketConnected, WebSocketDisconnected}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+}
+
+func TestWebSocketFrame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte{0xa5}, size)
+		for _, mask := range []bool{false, true} {
+			frame := appendWebSocketFrame(nil, webSocketOpBinary, payload, mask)
+			fin, op, got, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(frame)), make([]byte, 0x10000))
+			if err != nil || !fin || op != webSocketOpBinary || !bytes.Equal(got, payload) {
+				t.Errorf("size %d, mask %v: read %v, %#x, %d bytes, %v", size, mask, fin, op, len(got), err)
+			}
+		}
+	}
+	frame := appendWebSocketFrame(nil, webSocketOpBinary, make([]byte, 100), true)
+	if _, _, payload, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(frame)), make([]byte, 10)); err != nil || payload != nil {
+		t.Errorf("oversized frame read as %d bytes, %v; want it discarded", len(payload), err)
+	}
+}
@@ -0,0 +1,305 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+// Package bindquic implements a conn.Bind that carries packets as QUIC
+// datagrams. It is a package of its own so that programs that do not use it
+// do not depend on quic-go.
+package bindquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/syntlabs/cyanide-go/conn"
+)
+
+var _ conn.Bind = (*Bind)(nil)
+
+const (
+	dialTimeout = 10 * time.Second
+	idleTimeout = 30 * time.Second
+	keepAlive   = 10 * time.Second
+	minBackoff  = 100 * time.Millisecond
+	maxBackoff  = 10 * time.Second
+)
+
+// MaxPacketSize is the largest packet Bind sends. It is what fits
+// into a QUIC packet of 1232 bytes, the smallest size QUIC uses on any path,
+// after the headers of a short header packet with the longest connection ID
+// and of a DATAGRAM frame. Larger datagrams would be dropped silently by QUIC
+// on paths that cannot carry them, so Send rejects them: set the MTU of the
+// device to at most MaxPacketSize minus 32 bytes of WireGuard overhead.
+const MaxPacketSize = 1232 - 44
+
+// Bind implements conn.Bind over a QUIC connection to a relay, so that the
+// tunnel looks like HTTP/3 traffic. Every packet is sent as one unreliable
+// QUIC DATAGRAM frame (RFC 9221), which the relay is responsible for
+// forwarding to and from the peer; the endpoint passed to Send is therefore
+// ignored, and received packets come from a conn.StdNetEndpoint holding the relay's
+// address. The relay must enable datagrams, and accept the ALPN protocol set
+// in the TLS configuration, h3 by default.
+//
+// Sessions are resumed through the TLS session cache, which the bind provides
+// if the configuration has none, so that new connections send their first
+// packets with 0-RTT where the relay allows it. If the connection is lost, for
+// example because the path changed under a NAT or a network change, it is
+// re-established from a new socket, with exponential backoff.
+type Bind struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex // protects all fields below
+	conn   *quicConn
+	port   uint16
+	mark   uint32
+	closed chan struct{} // closed by Close; nil when not open
+	cancel context.CancelFunc
+}
+
+// NewBind returns a Bind that sends packets as QUIC datagrams to the relay
+// at serverName, a "host:port" address. The host is also the TLS server name,
+// unless tlsConf sets one.
+func NewBind(serverName string, tlsConf *tls.Config) *Bind {
+	config := tlsConf.Clone()
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(serverName); err == nil {
+			config.ServerName = host
+		}
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h3"}
+	}
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	return &Bind{addr: serverName, tlsConfig: config}
+}
+
+// A quicConn is a QUIC connection of a Bind with its own socket.
+type quicConn struct {
+	quic.EarlyConnection
+	udp       *net.UDPConn
+	transport *quic.Transport
+}
+
+func (c *quicConn) close() {
+	c.CloseWithError(0, "")
+	c.transport.Close()
+	c.udp.Close()
+}
+
+func (*Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return (*conn.StdNetBind)(nil).ParseEndpoint(s)
+}
+
+// dial opens a socket on port and connects to the relay from it.
+func (b *Bind) dial(ctx context.Context, port uint16) (*quicConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	mark := b.mark
+	b.mu.Unlock()
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if mark == 0 {
+				return nil
+			}
+			return conn.SetSocketMark(c, mark)
+		},
+	}
+	pc, err := lc.ListenPacket(ctx, "udp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	udp := pc.(*net.UDPConn)
+	transport := &quic.Transport{Conn: udp}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	qc, err := transport.DialEarly(ctx, raddr, b.tlsConfig, &quic.Config{
+		EnableDatagrams: true,
+		MaxIdleTimeout:  idleTimeout,
+		KeepAlivePeriod: keepAlive,
+	})
+	if err != nil {
+		transport.Close()
+		udp.Close()
+		return nil, err
+	}
+	return &quicConn{EarlyConnection: qc, udp: udp, transport: transport}, nil
+}
+
+// Open connects to the relay from a socket bound to port,
+// which is also used when reconnecting.
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	if b.closed != nil {
+		b.mu.Unlock()
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	qc, err := b.dial(ctx, port)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		cancel()
+		qc.close()
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.conn = qc
+	b.port = uint16(qc.udp.LocalAddr().(*net.UDPAddr).Port)
+	b.closed = make(chan struct{})
+	b.cancel = cancel
+	return []conn.ReceiveFunc{b.makeReceive(ctx, qc, b.closed)}, b.port, nil
+}
+
+func (b *Bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	b.closed = nil
+	b.cancel()
+	if b.conn != nil {
+		b.conn.close()
+		b.conn = nil
+	}
+	return nil
+}
+
+func (b *Bind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	if b.conn == nil {
+		return nil
+	}
+	rc, err := b.conn.udp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetSocketMark(rc, mark)
+}
+
+func (b *Bind) BatchSize() int { return 1 }
+
+// reconnect replaces the lost connection old with a new connection to the
+// relay, retrying with exponential backoff until it succeeds or the bind is
+// closed.
+func (b *Bind) reconnect(ctx context.Context, old *quicConn, closed chan struct{}) (*quicConn, error) {
+	old.close()
+	b.mu.Lock()
+	if b.closed != closed {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	port := b.port
+	b.mu.Unlock()
+	backoff := minBackoff
+	for {
+		qc, err := b.dial(ctx, port)
+		if err == nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.closed != closed {
+				qc.close()
+				return nil, net.ErrClosed
+			}
+			b.conn = qc
+			return qc, nil
+		}
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (b *Bind) makeReceive(ctx context.Context, qc *quicConn, closed chan struct{}) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+		for {
+			msg, err := qc.ReceiveDatagram(ctx)
+			if err == nil {
+				if len(msg) > len(bufs[0]) {
+					continue
+				}
+				sizes[0] = copy(bufs[0], msg)
+				eps[0] = &conn.StdNetEndpoint{AddrPort: relayAddrPort(qc.RemoteAddr())}
+				return 1, nil
+			}
+			select {
+			case <-closed:
+				return 0, net.ErrClosed
+			default:
+			}
+			qc, err = b.reconnect(ctx, qc, closed)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func relayAddrPort(addr net.Addr) netip.AddrPort {
+	if addr, ok := addr.(*net.UDPAddr); ok {
+		ap := addr.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	return netip.AddrPort{}
+}
+
+// Send sends each packet as a QUIC datagram. Packets larger than
+// MaxPacketSize, or than the datagrams the relay accepts, are
+// rejected with an error.
+func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	qc := b.conn
+	b.mu.Unlock()
+	if qc == nil {
+		return net.ErrClosed
+	}
+	for _, buf := range bufs {
+		if len(buf) > MaxPacketSize {
+			return fmt.Errorf("packet of %d bytes exceeds the QUIC datagram limit of %d bytes", len(buf), MaxPacketSize)
+		}
+		if err := qc.SendDatagram(buf); err != nil {
+			var tooLarge *quic.DatagramTooLargeError
+			if errors.As(err, &tooLarge) {
+				return fmt.Errorf("packet of %d bytes exceeds the relay's datagram limit: %w", len(buf), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package bindquic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/syntlabs/cyanide-go/conn"
+)
+
+// quicEchoRelay listens for QUIC connections on the loopback interface and
+// echoes every datagram back. The connections it accepted are sent on conns,
+// so that tests can drop them.
+func quicEchoRelay(t *testing.T) (*quic.EarlyListener, chan quic.EarlyConnection) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h3"},
+	}, &quic.Config{EnableDatagrams: true, Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan quic.EarlyConnection, 4)
+	go func() {
+		for {
+			qc, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns <- qc
+			go func() {
+				for {
+					msg, err := qc.ReceiveDatagram(context.Background())
+					if err != nil {
+						return
+					}
+					qc.SendDatagram(msg)
+				}
+			}()
+		}
+	}()
+	return ln, conns
+}
+
+func TestBind(t *testing.T) {
+	ln, conns := quicEchoRelay(t)
+	defer ln.Close()
+
+	bind := NewBind(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) != 1 || bind.BatchSize() != 1 || port == 0 {
+		t.Fatalf("got %d receive funcs, batch size %d and port %d, want 1, 1 and a port", len(fns), bind.BatchSize(), port)
+	}
+	ep, err := bind.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bind.Send([][]byte{make([]byte, MaxPacketSize+1)}, ep); err == nil {
+		t.Error("oversized packet was sent")
+	}
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	for i, msg := range [][]byte{[]byte("one"), bytes.Repeat([]byte{2}, MaxPacketSize)} {
+		received := make(chan error, 1)
+		go func() {
+			_, err := fns[0](bufs, sizes, eps)
+			received <- err
+		}()
+		qc := <-conns
+		if i == 1 {
+			// The session of the first connection is resumed.
+			if !qc.ConnectionState().TLS.DidResume {
+				t.Error("reconnection did not resume the TLS session")
+			}
+		}
+		timeout := time.After(5 * time.Second)
+		ticker := time.NewTicker(50 * time.Millisecond)
+	resend:
+		for {
+			bind.Send([][]byte{msg}, ep)
+			select {
+			case err := <-received:
+				if err != nil {
+					t.Fatalf("receive failed: %v", err)
+				}
+				break resend
+			case <-ticker.C:
+			case <-timeout:
+				t.Fatalf("did not receive %d bytes", len(msg))
+			}
+		}
+		ticker.Stop()
+		if !bytes.Equal(bufs[0][:sizes[0]], msg) {
+			t.Fatalf("received %d bytes, want %d", sizes[0], len(msg))
+		}
+		if got := eps[0].DstToString(); got != ln.Addr().String() {
+			t.Errorf("received from %s, want the relay at %s", got, ln.Addr())
+		}
+		if i == 0 {
+			// Drop the connection; the bind must reconnect.
+			qc.CloseWithError(0, "")
+		}
+	}
+
+	bind.Close()
+	if _, err := fns[0](bufs, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close returned %v, want net.ErrClosed", err)
+	}
+	if err := bind.Send([][]byte{[]byte("late")}, ep); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("send after close returned %v, want net.ErrClosed", err)
+	}
+}
@@ -4,6 +4,8 @@
   * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
  */
 
+// Package bindtest provides an in-memory conn.Bind for tests that connect
+// devices without real sockets.
 package bindtest
 
 import (
@@ -16,6 +18,8 @@ import (
 	"github.com/syntlabs/cyanide-go/conn"
 )
 
+// A ChannelBind is one end of a loopback pair of binds created by
+// NewChannelBinds. Packets sent through one end are received by the other.
 type ChannelBind struct {
 	rx4, tx4         *chan []byte
 	rx6, tx6         *chan []byte
@@ -24,6 +28,8 @@ type ChannelBind struct {
 	target4, target6 ChannelEndpoint
 }
 
+// A ChannelEndpoint addresses a ChannelBind. It parses from and formats as
+// 127.0.0.1 with the endpoint's number as port.
 type ChannelEndpoint uint16
 
 var (
@@ -31,6 +37,10 @@ var (
 	_ conn.Endpoint = (*ChannelEndpoint)(nil)
 )
 
+// NewChannelBinds returns a pair of binds connected to each other in memory.
+// Opening either one reports the port to use in the endpoint of the other,
+// so that two devices using the binds can be configured with the endpoint
+// 127.0.0.1:port, as if they listened on real sockets.
 func NewChannelBinds() [2]conn.Bind {
 	arx4 := make(chan []byte, 8192)
 	brx4 := make(chan []byte, 8192)
@@ -0,0 +1,14 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+// BindToInterface does nothing, as SO_BINDTODEVICE is specific to Linux.
+func (s *StdNetBind) BindToInterface(name string) error {
+	return nil
+}
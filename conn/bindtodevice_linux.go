@@ -0,0 +1,43 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindToInterface restricts the sockets to the network interface called name
+// with SO_BINDTODEVICE, so that packets are only sent and received through it.
+// An empty name removes the restriction. Before Linux 5.7 this requires
+// CAP_NET_RAW. The setting does not survive Close; set it again after Open.
+func (s *StdNetBind) BindToInterface(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range []*net.UDPConn{s.ipv4, s.ipv6} {
+		if conn == nil {
+			continue
+		}
+		rc, err := conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var operr error
+		err = rc.Control(func(fd uintptr) {
+			operr = unix.BindToDevice(int(fd), name)
+		})
+		if err == nil {
+			err = operr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStdNetBindBindToInterface(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	boundTo := func() int {
+		rc, err := bind.ipv4.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var index int
+		var operr error
+		rc.Control(func(fd uintptr) {
+			index, operr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BINDTOIFINDEX)
+		})
+		if operr != nil {
+			t.Skipf("unable to read the bound interface: %v", operr)
+		}
+		return index
+	}
+
+	err = bind.BindToInterface("lo")
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("binding to an interface is not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index := boundTo(); index != lo.Index {
+		t.Errorf("socket bound to interface %d, want %d", index, lo.Index)
+	}
+	if err := bind.BindToInterface(""); err != nil {
+		t.Fatal(err)
+	}
+	if index := boundTo(); index != 0 {
+		t.Errorf("socket still bound to interface %d", index)
+	}
+}
@@ -26,12 +26,16 @@ const (
 // sizes may be zero, and callers should ignore them. Callers must pass a sizes
 // and eps slice with a length greater than or equal to the length of packets.
 // These lengths must not exceed the length of the associated Bind.BatchSize().
+// A ReceiveFunc may return an *EndpointError, which is not fatal: the caller
+// may keep calling it.
 type ReceiveFunc func(packets [][]byte, sizes []int, eps []Endpoint) (n int, err error)
 
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
-// depending on the platform-specific implementation.
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface,
+// InterfaceBinder, EndpointErrorReporter, AddressFamilySelector,
+// SocketBufferSizer, NetworkNamespaceSetter or MarkedSender, depending on the
+// platform-specific implementation.
 type Bind interface {
 	// Open puts the Bind into a listening state on a given port and reports the actual
 	// port that it bound to. Passing zero results in a random selection.
@@ -72,6 +76,102 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// InterfaceBinder is implemented by Bind objects that support restricting
+// their sockets to a network interface given by name.
+type InterfaceBinder interface {
+	BindToInterface(name string) error
+}
+
+// MarkedSender is implemented by Bind objects that can set the fwmark of the
+// datagrams they send on a per-send basis, overriding the mark set by SetMark.
+// StdNetBind implements it on Linux only.
+type MarkedSender interface {
+	SendWithMark(bufs [][]byte, ep Endpoint, mark uint32) error
+}
+
+// EndpointErrorReporter is implemented by Bind objects that can report errors
+// for datagrams they sent, such as an ICMP port unreachable message returned
+// by a host on which nothing listens on the destination port. Once enabled,
+// such errors are returned by the Bind's ReceiveFuncs as *EndpointError.
+// Reporting is off by default, and the setting is kept across Close and Open.
+type EndpointErrorReporter interface {
+	SetReportEndpointErrors(report bool) error
+}
+
+// AddressFamilies selects the IP address families a Bind opens sockets for.
+type AddressFamilies uint8
+
+const (
+	AddressFamiliesV4Only AddressFamilies = 1 << iota
+	AddressFamiliesV6Only
+	AddressFamiliesBoth = AddressFamiliesV4Only | AddressFamiliesV6Only
+)
+
+func (f AddressFamilies) String() string {
+	switch f {
+	case AddressFamiliesV4Only:
+		return "v4only"
+	case AddressFamiliesV6Only:
+		return "v6only"
+	case AddressFamiliesBoth:
+		return "both"
+	}
+	return fmt.Sprintf("AddressFamilies(%d)", uint8(f))
+}
+
+// AddressFamilySelector is implemented by Bind objects that can limit the
+// sockets opened by Open to some address families. The setting takes effect
+// on the next Open and is kept across Close; the default is
+// AddressFamiliesBoth.
+type AddressFamilySelector interface {
+	SetAddressFamilies(families AddressFamilies) error
+}
+
+// SocketBufferSizer is implemented by Bind objects that can set the size of
+// the receive and send buffers of their sockets (SO_RCVBUF and SO_SNDBUF),
+// to absorb bursts that would otherwise be dropped. The size takes effect on
+// the next Open and is kept across Close; zero restores the default.
+// Since the operating system may clamp the size, and Linux doubles it for
+// bookkeeping, SocketBufferSizes reports the sizes the open sockets obtained.
+type SocketBufferSizer interface {
+	SetSocketBufferSize(size int) error
+	SocketBufferSizes() (recv, send int, err error)
+}
+
+// NetworkNamespaceSetter is implemented by Bind objects that can open their
+// sockets in another Linux network namespace than that of the process, given
+// by the path of a namespace file. The setting takes effect on the next Open
+// and is kept across Close; an empty path restores the default.
+type NetworkNamespaceSetter interface {
+	SetNetworkNamespace(path string) error
+}
+
+// FDExporter is implemented by Bind objects that can export the file
+// descriptors of their open sockets, so that they can be handed over to
+// another process and adopted there with NewBindFromFDs. The descriptors
+// remain owned by the Bind and are closed with it; duplicate them before
+// wrapping them with os.NewFile, as an *os.File closes its descriptor when it
+// is garbage collected.
+type FDExporter interface {
+	FDs() ([]uintptr, error)
+}
+
+// An EndpointError reports that a datagram sent to Endpoint was rejected.
+// Err is typically syscall.ECONNREFUSED, syscall.EHOSTUNREACH or
+// syscall.ENETUNREACH.
+type EndpointError struct {
+	Endpoint Endpoint
+	Err      error
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprintf("endpoint %s: %v", e.Endpoint.DstToString(), e.Err)
+}
+
+func (e *EndpointError) Unwrap() error {
+	return e.Err
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
@@ -85,6 +185,14 @@ type Endpoint interface {
 	SrcIP() netip.Addr
 }
 
+// SrcSetter is implemented by Endpoint objects whose source address can be
+// set, so that datagrams to the peer are sent from that local address instead
+// of the one learned from received datagrams or chosen by the routing table.
+// The source address is kept until ClearSrc is called.
+type SrcSetter interface {
+	SetSrc(src netip.Addr) error
+}
+
 var (
 	ErrBindAlreadyOpen   = errors.New("bind is already open")
 	ErrWrongEndpointType = errors.New("endpoint type does not correspond with bind type")
@@ -42,3 +42,11 @@ func listenConfig() *net.ListenConfig {
 		},
 	}
 }
+
+// SetSocketMark sets the firewall mark of the socket behind c, as SetMark
+// does for the sockets of the binds in this package, so that binds
+// implemented elsewhere can honor it. It does nothing on platforms without
+// socket marks.
+func SetSocketMark(c syscall.RawConn, mark uint32) error {
+	return setMark(c, mark)
+}
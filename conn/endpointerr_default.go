@@ -0,0 +1,30 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+// Other platforms either do not report ICMP errors on unconnected UDP sockets
+// at all, or do not tell which destination an error belongs to.
+const endpointErrorsSupported = false
+
+func setRecvErr(conn *net.UDPConn, is6 bool, on bool) error {
+	return errors.ErrUnsupported
+}
+
+func isEndpointErrno(err error) bool {
+	return false
+}
+
+func readEndpointError(conn *net.UDPConn) *EndpointError {
+	return nil
+}
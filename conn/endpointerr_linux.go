@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Linux only reports ICMP errors on unconnected UDP sockets when IP_RECVERR
+// (IPV6_RECVERR) is set. Each error is then queued on the socket's error queue,
+// together with the destination of the datagram that caused it, and the next
+// read or write on the socket fails with the error's errno.
+const endpointErrorsSupported = true
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+
+func setRecvErr(conn *net.UDPConn, is6 bool, on bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	var errSyscall error
+	err = rc.Control(func(fd uintptr) {
+		if is6 {
+			errSyscall = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVERR, value)
+		} else {
+			errSyscall = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return errSyscall
+}
+
+// isEndpointErrno reports whether err may have been raised by an ICMP error
+// queued on the socket.
+func isEndpointErrno(err error) bool {
+	return errors.Is(err, unix.ECONNREFUSED) || errors.Is(err, unix.EHOSTUNREACH) || errors.Is(err, unix.ENETUNREACH)
+}
+
+// readEndpointError dequeues the oldest error from the error queue of conn.
+// It returns nil if the queue is empty or the error did not originate from
+// an ICMP message.
+func readEndpointError(conn *net.UDPConn) *EndpointError {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var (
+		oob     = make([]byte, unix.CmsgSpace(sizeofSockExtendedErr+unix.SizeofSockaddrInet6))
+		oobn    int
+		from    unix.Sockaddr
+		errRecv error
+	)
+	err = rc.Control(func(fd uintptr) {
+		_, oobn, _, from, errRecv = unix.Recvmsg(int(fd), nil, oob, unix.MSG_ERRQUEUE)
+	})
+	if err != nil || errRecv != nil {
+		return nil
+	}
+	var addr netip.AddrPort
+	switch sa := from.(type) {
+	case *unix.SockaddrInet4:
+		addr = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+	case *unix.SockaddrInet6:
+		addr = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+	default:
+		return nil
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil
+	}
+	for _, cmsg := range cmsgs {
+		isRecvErr := (cmsg.Header.Level == unix.IPPROTO_IP && cmsg.Header.Type == unix.IP_RECVERR) ||
+			(cmsg.Header.Level == unix.IPPROTO_IPV6 && cmsg.Header.Type == unix.IPV6_RECVERR)
+		if !isRecvErr || len(cmsg.Data) < sizeofSockExtendedErr {
+			continue
+		}
+		ee := (*unix.SockExtendedErr)(unsafe.Pointer(&cmsg.Data[0]))
+		if ee.Origin != unix.SO_EE_ORIGIN_ICMP && ee.Origin != unix.SO_EE_ORIGIN_ICMP6 {
+			return nil
+		}
+		return &EndpointError{
+			Endpoint: &StdNetEndpoint{AddrPort: addr},
+			Err:      syscall.Errno(ee.Errno),
+		}
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ package conn
 
 import (
 	"runtime"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -64,3 +65,18 @@ func (s *StdNetBind) SetMark(mark uint32) error {
 	}
 	return nil
 }
+
+// setMark sets the mark on the socket behind c, if the platform supports it.
+func setMark(c syscall.RawConn, mark uint32) error {
+	var operr error
+	if fwmarkIoctl == 0 {
+		return nil
+	}
+	err := c.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, fwmarkIoctl, int(mark))
+	})
+	if err == nil {
+		err = operr
+	}
+	return err
+}
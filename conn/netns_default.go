@@ -0,0 +1,21 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+// checkNetworkNamespace accepts any path, as network namespaces are specific
+// to Linux.
+func checkNetworkNamespace(path string) error {
+	return nil
+}
+
+// inNetworkNamespace calls f, ignoring path, as network namespaces are
+// specific to Linux.
+func inNetworkNamespace(path string, f func() error) error {
+	return f()
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkNetworkNamespace reports whether path can be opened as a network
+// namespace, so that a bad path fails when it is set rather than on Open.
+func checkNetworkNamespace(path string) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %w", path, err)
+	}
+	unix.Close(fd)
+	return nil
+}
+
+// inNetworkNamespace calls f on an OS thread that has entered the network
+// namespace at path, so that the sockets f creates belong to it; sockets keep
+// their namespace for their whole life. An empty path calls f directly.
+//
+// f runs on a goroutine of its own, locked to its thread. The thread returns
+// to its original namespace afterwards, or is discarded if that fails, so
+// no other goroutine ever runs in the namespace.
+func inNetworkNamespace(path string, f func() error) error {
+	if path == "" {
+		return f()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("failed to open current network namespace: %w", err)
+			return
+		}
+		defer unix.Close(origin)
+		target, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("failed to open network namespace %s: %w", path, err)
+			return
+		}
+		defer unix.Close(target)
+		if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("failed to enter network namespace %s: %w", path, err)
+			return
+		}
+		err = f()
+		// Leaving the thread locked makes the runtime terminate it when the
+		// goroutine exits.
+		if unix.Setns(origin, unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		errc <- err
+	}()
+	return <-errc
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newNetworkNamespace creates a network namespace that lives until the test
+// ends and returns its path. It is held by a thread that no other goroutine
+// runs on.
+func newNetworkNamespace(t *testing.T) string {
+	pathc := make(chan string, 1)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		// The thread is discarded when the goroutine exits, as it stays locked.
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		pathc <- fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		<-done
+	}()
+	select {
+	case err := <-errc:
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("creating a network namespace requires CAP_SYS_ADMIN")
+		}
+		t.Fatal(err)
+	case path := <-pathc:
+		t.Cleanup(func() { close(done) })
+		return path
+	}
+	return ""
+}
+
+// namespaceInode returns the inode identifying the network namespace of conn.
+func namespaceInode(t *testing.T, conn *net.UDPConn) uint64 {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ns int
+	var operr error
+	rc.Control(func(fd uintptr) {
+		ns, operr = unix.IoctlRetInt(int(fd), unix.SIOCGSKNS)
+	})
+	if operr != nil {
+		t.Skipf("unable to get the network namespace of a socket: %v", operr)
+	}
+	defer unix.Close(ns)
+	var st unix.Stat_t
+	if err := unix.Fstat(ns, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Ino
+}
+
+func TestStdNetBindNetworkNamespace(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	if err := bind.SetNetworkNamespace("/nonexistent/ns/net"); err == nil {
+		t.Fatal("set a network namespace that does not exist")
+	}
+
+	// /proc/self/ns/net is that of the main thread, which may be the one
+	// holding the new namespace, so the process's is taken from a socket.
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	origin := namespaceInode(t, bind.ipv4)
+	bind.Close()
+
+	path := newNetworkNamespace(t)
+	var want unix.Stat_t
+	if err := unix.Stat(path, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bind.SetNetworkNamespace(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := namespaceInode(t, bind.ipv4); got != want.Ino {
+		t.Errorf("socket in namespace %d, want %d", got, want.Ino)
+	}
+	bind.Close()
+
+	// The setting is kept across Close until it is cleared.
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := namespaceInode(t, bind.ipv4); got != want.Ino {
+		t.Errorf("socket reopened in namespace %d, want %d", got, want.Ino)
+	}
+	bind.Close()
+	if err := bind.SetNetworkNamespace(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if got := namespaceInode(t, bind.ipv4); got != origin {
+		t.Errorf("socket in namespace %d after clearing the setting, want the process's %d", got, origin)
+	}
+}
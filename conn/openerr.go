@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import "errors"
+
+// The reasons a Bind can fail to open that callers may want to act on, for
+// example by retrying on an ephemeral port when the configured one is taken.
+// They are matched with errors.Is against the errors WrapOpenError returns.
+var (
+	ErrPortInUse                = errors.New("port is already in use")
+	ErrPermissionDenied         = errors.New("permission denied")
+	ErrAddressFamilyUnavailable = errors.New("address family is unavailable")
+)
+
+// OpenError is an error opening or configuring the sockets of a Bind whose
+// reason is known. It matches both Reason and Err with errors.Is, so the
+// underlying system error can still be inspected.
+type OpenError struct {
+	Reason error // ErrPortInUse, ErrPermissionDenied or ErrAddressFamilyUnavailable
+	Err    error
+}
+
+func (e *OpenError) Error() string {
+	return e.Reason.Error() + ": " + e.Err.Error()
+}
+
+func (e *OpenError) Unwrap() []error {
+	return []error{e.Reason, e.Err}
+}
+
+// WrapOpenError wraps err, returned by opening a Bind or setting up its
+// sockets, in an OpenError if its reason is one of ErrPortInUse,
+// ErrPermissionDenied and ErrAddressFamilyUnavailable: the port being
+// taken, a privileged port or fwmark without the needed privileges, or an
+// address family the system does not support. Other errors, including nil
+// and errors already wrapped, are returned as they are.
+func WrapOpenError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var openErr *OpenError
+	if errors.As(err, &openErr) {
+		return err
+	}
+	var reason error
+	switch {
+	case isPortInUse(err):
+		reason = ErrPortInUse
+	case isPermissionDenied(err):
+		reason = ErrPermissionDenied
+	case isAddressFamilyUnavailable(err):
+		reason = ErrAddressFamilyUnavailable
+	default:
+		return err
+	}
+	return &OpenError{Reason: reason, Err: err}
+}
@@ -0,0 +1,51 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestWrapOpenError(t *testing.T) {
+	sysErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "listen", Net: "udp4", Err: os.NewSyscallError("bind", errno)}
+	}
+	tests := []struct {
+		err    error
+		reason error
+	}{
+		{sysErr(syscall.EADDRINUSE), ErrPortInUse},
+		{sysErr(syscall.EACCES), ErrPermissionDenied},
+		{sysErr(syscall.EAFNOSUPPORT), ErrAddressFamilyUnavailable},
+		{sysErr(syscall.EINVAL), nil},
+		{ErrBindAlreadyOpen, nil},
+	}
+	for _, tt := range tests {
+		err := WrapOpenError(tt.err)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("WrapOpenError(%v) = %v, does not match the original error", tt.err, err)
+		}
+		var openErr *OpenError
+		if got := errors.As(err, &openErr); got != (tt.reason != nil) {
+			t.Errorf("WrapOpenError(%v) = %v, OpenError %v, want %v", tt.err, err, got, tt.reason != nil)
+			continue
+		}
+		if tt.reason != nil && !errors.Is(err, tt.reason) {
+			t.Errorf("WrapOpenError(%v) = %v, does not match %v", tt.err, err, tt.reason)
+		}
+		if again := WrapOpenError(err); again != err {
+			t.Errorf("WrapOpenError wrapped %v again as %v", err, again)
+		}
+	}
+	if WrapOpenError(nil) != nil {
+		t.Error("WrapOpenError(nil) is not nil")
+	}
+}
@@ -0,0 +1,30 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// Winsock reports its own error codes rather than the POSIX ones that
+// syscall emulates on Windows, so both are checked.
+
+func isPortInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE) || errors.Is(err, syscall.EADDRINUSE)
+}
+
+func isPermissionDenied(err error) bool {
+	return errors.Is(err, windows.WSAEACCES)
+}
+
+func isAddressFamilyUnavailable(err error) bool {
+	return errors.Is(err, windows.WSAEAFNOSUPPORT) || errors.Is(err, windows.WSAEPROTONOSUPPORT) ||
+		errors.Is(err, syscall.EAFNOSUPPORT)
+}
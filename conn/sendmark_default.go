@@ -0,0 +1,13 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+// markControlSize is the buffer size needed for a per-send mark control
+// message, which is not supported on this platform.
+const markControlSize = 0
@@ -0,0 +1,43 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SendWithMark is like Send, but sets the fwmark of the datagrams to mark
+// with an SO_MARK control message, overriding the mark set by SetMark.
+// This requires CAP_NET_ADMIN and a kernel that accepts SO_MARK control
+// messages; older kernels fail the send with EINVAL.
+func (s *StdNetBind) SendWithMark(bufs [][]byte, endpoint Endpoint, mark uint32) error {
+	return s.sendWithControl(bufs, endpoint, func(control *[]byte) {
+		setMarkControl(control, mark)
+	})
+}
+
+// setMarkControl appends an SO_MARK control message carrying mark to control.
+// It leaves existing data in control untouched.
+func setMarkControl(control *[]byte, mark uint32) {
+	existingLen := len(*control)
+	space := unix.CmsgSpace(4)
+	if cap(*control)-existingLen < space {
+		return
+	}
+	*control = (*control)[:existingLen+space]
+	markControl := (*control)[existingLen:]
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&markControl[0]))
+	hdr.Level = unix.SOL_SOCKET
+	hdr.Type = unix.SO_MARK
+	hdr.SetLen(unix.CmsgLen(4))
+	*(*uint32)(unsafe.Pointer(&markControl[unix.CmsgLen(0)])) = mark
+}
+
+// markControlSize is the buffer size needed for an SO_MARK control message.
+var markControlSize = unix.CmsgSpace(4)
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetMarkControl(t *testing.T) {
+	control := make([]byte, 0, markControlSize)
+	setMarkControl(&control, 0x1234)
+	msgs, err := unix.ParseSocketControlMessage(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Header.Level != unix.SOL_SOCKET || msgs[0].Header.Type != unix.SO_MARK {
+		t.Fatalf("got control messages %+v, want one SO_MARK", msgs)
+	}
+	if mark := binary.NativeEndian.Uint32(msgs[0].Data); mark != 0x1234 {
+		t.Errorf("got mark %#x, want 0x1234", mark)
+	}
+
+	short := make([]byte, 0, markControlSize-1)
+	setMarkControl(&short, 0x1234)
+	if len(short) != 0 {
+		t.Error("mark control written to a buffer too small for it")
+	}
+}
+
+func TestStdNetBindSendWithMark(t *testing.T) {
+	dst, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	bind := NewStdNetBind().(*StdNetBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep := &StdNetEndpoint{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), uint16(dst.LocalAddr().(*net.UDPAddr).Port))}
+	err = bind.SendWithMark([][]byte{{1, 2, 3}}, ep, 0x1234)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EINVAL) {
+		t.Skipf("per-send marks are not supported here: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := dst.Read(buf); err != nil || n != 3 {
+		t.Errorf("got %d bytes, %v; want the 3 sent", n, err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build wasm
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+func setSocketBufferSize(conn *net.UDPConn, size int) error {
+	if err := conn.SetReadBuffer(size); err != nil {
+		return err
+	}
+	return conn.SetWriteBuffer(size)
+}
+
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSocketBufferSize sets the receive and send buffers of conn to size bytes.
+// Like the default set by controlFns, it attempts to go beyond
+// net.core.{r,w}mem_max with SO_*BUFFORCE, which requires CAP_NET_ADMIN and
+// otherwise fails silently, leaving the sizes clamped.
+func setSocketBufferSize(conn *net.UDPConn, size int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, size); sockErr != nil {
+			return
+		}
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, size); sockErr != nil {
+			return
+		}
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, size)
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, size)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketBufferSizes returns the sizes of the receive and send buffers of conn.
+// Linux reports twice the size that was set, the extra space being used for
+// bookkeeping.
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if recv, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		send, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return recv, send, err
+}
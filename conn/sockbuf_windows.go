@@ -0,0 +1,51 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// setSocketBufferSize sets the receive and send buffers of conn to size bytes.
+func setSocketBufferSize(conn *net.UDPConn, size int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if sockErr = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_RCVBUF, size); sockErr != nil {
+			return
+		}
+		sockErr = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_SNDBUF, size)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketBufferSizes returns the sizes of the receive and send buffers of conn.
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if recv, sockErr = windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		send, sockErr = windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_SNDBUF)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return recv, send, err
+}
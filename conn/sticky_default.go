@@ -8,7 +8,10 @@
 
 package conn
 
-import "net/netip"
+import (
+	"errors"
+	"net/netip"
+)
 
 func (e *StdNetEndpoint) SrcIP() netip.Addr {
 	return netip.Addr{}
@@ -22,6 +25,12 @@ func (e *StdNetEndpoint) SrcToString() string {
 	return ""
 }
 
+// SetSrc reports an error: without sticky sockets, the source address of the
+// datagrams is chosen by the routing table.
+func (e *StdNetEndpoint) SetSrc(src netip.Addr) error {
+	return errors.New("setting the source address is not supported on this platform")
+}
+
 // TODO: macOS, FreeBSD and other BSDs likely do support the sticky sockets
 // {get,set}srcControl feature set, but use alternatively named flags and need
 // ports and require testing.
@@ -9,6 +9,7 @@
 package conn
 
 import (
+	"fmt"
 	"net/netip"
 	"unsafe"
 
@@ -46,6 +47,37 @@ func (e *StdNetEndpoint) SrcToString() string {
 	return e.SrcIP().String()
 }
 
+// SetSrc sets the source address of the datagrams sent to e, which must be
+// of the same family as its destination, leaving the interface to the routing
+// table.
+func (e *StdNetEndpoint) SetSrc(src netip.Addr) error {
+	if !src.IsValid() || src.Is4() != e.DstIP().Is4() {
+		return fmt.Errorf("source address %v does not match the family of %v", src, e.DstIP())
+	}
+	var hdr unix.Cmsghdr
+	var info []byte
+	if src.Is4() {
+		hdr.Level, hdr.Type = unix.IPPROTO_IP, unix.IP_PKTINFO
+		hdr.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		pktinfo := unix.Inet4Pktinfo{Spec_dst: src.As4()}
+		info = unsafe.Slice((*byte)(unsafe.Pointer(&pktinfo)), unix.SizeofInet4Pktinfo)
+	} else {
+		hdr.Level, hdr.Type = unix.IPPROTO_IPV6, unix.IPV6_PKTINFO
+		hdr.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+		pktinfo := unix.Inet6Pktinfo{Addr: src.As16()}
+		info = unsafe.Slice((*byte)(unsafe.Pointer(&pktinfo)), unix.SizeofInet6Pktinfo)
+	}
+	size := unix.CmsgSpace(len(info))
+	if cap(e.src) < size {
+		e.src = make([]byte, 0, size)
+	}
+	e.src = e.src[:size]
+	clear(e.src)
+	copy(e.src, unsafe.Slice((*byte)(unsafe.Pointer(&hdr)), unix.SizeofCmsghdr))
+	copy(e.src[unix.CmsgLen(0):], info)
+	return nil
+}
+
 // getSrcFromControl parses the control for PKTINFO and if found updates ep with
 // the source information found.
 func getSrcFromControl(control []byte, ep *StdNetEndpoint) {
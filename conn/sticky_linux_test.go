@@ -9,6 +9,7 @@
 package conn
 
 import (
+	"bytes"
 	"context"
 	"net"
 	"net/netip"
@@ -212,6 +213,40 @@ func Test_getSrcFromControl(t *testing.T) {
 	})
 }
 
+func TestStdNetEndpointSetSrc(t *testing.T) {
+	for _, tt := range []struct {
+		dst, src string
+	}{
+		{"192.0.2.1:51820", "198.51.100.7"},
+		{"[2001:db8::1]:51820", "2001:db8:1::7"},
+	} {
+		ep := &StdNetEndpoint{AddrPort: netip.MustParseAddrPort(tt.dst)}
+		// The source address replaces the one learned from a datagram.
+		setSrc(ep, netip.MustParseAddr("127.0.0.1"), 5)
+		src := netip.MustParseAddr(tt.src)
+		if err := ep.SetSrc(src); err != nil {
+			t.Fatal(err)
+		}
+		if ep.SrcIP() != src || ep.SrcIfidx() != 0 {
+			t.Errorf("source after SetSrc(%v) is %v on interface %d, want any interface", src, ep.SrcIP(), ep.SrcIfidx())
+		}
+		want := &StdNetEndpoint{}
+		setSrc(want, src, 0)
+		control := make([]byte, stickyControlSize)
+		setSrcControl(&control, ep)
+		if !bytes.Equal(control, want.src) {
+			t.Errorf("control for %v is %x, want %x", src, control, want.src)
+		}
+	}
+
+	ep := &StdNetEndpoint{AddrPort: netip.MustParseAddrPort("192.0.2.1:51820")}
+	for _, src := range []netip.Addr{{}, netip.MustParseAddr("2001:db8::7")} {
+		if err := ep.SetSrc(src); err == nil {
+			t.Errorf("SetSrc(%v) to an IPv4 destination succeeded", src)
+		}
+	}
+}
+
 func Test_listenConfig(t *testing.T) {
 	t.Run("IPv4", func(t *testing.T) {
 		conn, err := listenConfig().ListenPacket(context.Background(), "udp4", ":0")
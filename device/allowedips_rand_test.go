@@ -79,6 +79,15 @@ func (r SlowRouter) RemoveByPeer(peer *Peer) SlowRouter {
 	return r[:n]
 }
 
+func (r SlowRouter) Remove(addr []byte, cidr uint8, peer *Peer) SlowRouter {
+	for i, t := range r {
+		if t.cidr == cidr && commonBits(t.bits, addr) >= cidr && t.peer == peer {
+			return append(r[:i], r[i+1:]...)
+		}
+	}
+	return r
+}
+
 func TestTrieRandom(t *testing.T) {
 	var slow4, slow6 SlowRouter
 	var peers []*Peer
@@ -140,3 +149,74 @@ func TestTrieRandom(t *testing.T) {
 		t.Error("Failed to remove all nodes from trie by peer")
 	}
 }
+
+func TestTrieRandomRemove(t *testing.T) {
+	var slow4, slow6 SlowRouter
+	var peers []*Peer
+	var allowedIPs AllowedIPs
+	var prefixes []netip.Prefix
+	var owners []*Peer
+
+	rand.Seed(1)
+
+	for n := 0; n < NumberOfPeers; n++ {
+		peers = append(peers, &Peer{})
+	}
+
+	for n := 0; n < NumberOfAddresses; n++ {
+		var addr4 [4]byte
+		rand.Read(addr4[:])
+		cidr := uint8(rand.Intn(32) + 1)
+		index := rand.Intn(NumberOfPeers)
+		prefix := netip.PrefixFrom(netip.AddrFrom4(addr4), int(cidr))
+		allowedIPs.Insert(prefix, peers[index])
+		slow4 = slow4.Insert(addr4[:], cidr, peers[index])
+		prefixes, owners = append(prefixes, prefix), append(owners, peers[index])
+
+		var addr6 [16]byte
+		rand.Read(addr6[:])
+		cidr = uint8(rand.Intn(128) + 1)
+		index = rand.Intn(NumberOfPeers)
+		prefix = netip.PrefixFrom(netip.AddrFrom16(addr6), int(cidr))
+		allowedIPs.Insert(prefix, peers[index])
+		slow6 = slow6.Insert(addr6[:], cidr, peers[index])
+		prefixes, owners = append(prefixes, prefix), append(owners, peers[index])
+	}
+
+	for i, n := range rand.Perm(len(prefixes)) {
+		prefix, owner := prefixes[n], owners[n]
+		// A prefix may have been reassigned by a later insertion, in which
+		// case removing it for its first owner must leave it in place.
+		removed := allowedIPs.Remove(prefix, owner)
+		ip := prefix.Masked().Addr().AsSlice()
+		cidr := uint8(prefix.Bits())
+		slow := &slow4
+		if prefix.Addr().Is6() {
+			slow = &slow6
+		}
+		before := len(*slow)
+		*slow = slow.Remove(ip, cidr, owner)
+		if want := len(*slow) < before; removed != want {
+			t.Fatalf("Remove(%v) = %v, want %v", prefix, removed, want)
+		}
+		if i%25 != 0 {
+			continue
+		}
+		for n := 0; n < NumberOfTests/10; n++ {
+			var addr4 [4]byte
+			rand.Read(addr4[:])
+			if peer1, peer2 := slow4.Lookup(addr4[:]), allowedIPs.Lookup(addr4[:]); peer1 != peer2 {
+				t.Fatalf("Trie did not match naive implementation, for %v: want %p, got %p", net.IP(addr4[:]), peer1, peer2)
+			}
+			var addr6 [16]byte
+			rand.Read(addr6[:])
+			if peer1, peer2 := slow6.Lookup(addr6[:]), allowedIPs.Lookup(addr6[:]); peer1 != peer2 {
+				t.Fatalf("Trie did not match naive implementation, for %v: want %p, got %p", net.IP(addr6[:]), peer1, peer2)
+			}
+		}
+	}
+
+	if allowedIPs.IPv4 != nil || allowedIPs.IPv6 != nil {
+		t.Error("Failed to remove all nodes from trie by prefix")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"net"
 	"net/netip"
+	"sync"
 	"testing"
 )
 
@@ -246,3 +247,105 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+func TestPeerAllowedIPs(t *testing.T) {
+	device := new(Device)
+	peer := &Peer{device: device}
+	other := &Peer{device: device}
+
+	var want []netip.Prefix
+	for _, s := range []string{"10.0.0.0/8", "10.0.0.0/24", "192.168.1.0/24", "2001:db8::/32", "fd00::1/128"} {
+		want = append(want, netip.MustParsePrefix(s))
+	}
+	for _, i := range rand.Perm(len(want)) {
+		device.allowedips.Insert(want[i], peer)
+	}
+	device.allowedips.Insert(netip.MustParsePrefix("172.16.0.0/12"), other)
+
+	got := peer.AllowedIPs()
+	if len(got) != len(want) {
+		t.Fatalf("AllowedIPs() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("AllowedIPs() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPeerAddRemoveAllowedIP(t *testing.T) {
+	device := new(Device)
+	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	var peer, other *Peer
+	for i, p := range []**Peer{&peer, &other} {
+		*p = &Peer{device: device}
+		(*p).handshake.remoteStatic[0] = byte(i + 1)
+		device.peers.keyMap[(*p).handshake.remoteStatic] = *p
+	}
+	stable := netip.MustParsePrefix("10.0.0.0/8")
+	if err := other.AddAllowedIP(stable); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups of the other peer's prefix are not disturbed by the changes.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if got := device.allowedips.Lookup([]byte{10, 1, 2, 3}); got != other {
+				t.Errorf("lookup during changes returned %p, want %p", got, other)
+				return
+			}
+		}
+	}()
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.0.0/16"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	for i := 0; i < 100; i++ {
+		for _, prefix := range prefixes {
+			if err := peer.AddAllowedIP(prefix); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := peer.AllowedIPs(); len(got) != len(prefixes) {
+			t.Fatalf("AllowedIPs() = %v after adding %v", got, prefixes)
+		}
+		for _, prefix := range prefixes {
+			if err := peer.RemoveAllowedIP(prefix); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if got := peer.AllowedIPs(); len(got) != 0 {
+		t.Errorf("AllowedIPs() = %v after removing all, want none", got)
+	}
+	if got := other.AllowedIPs(); len(got) != 1 || got[0] != stable {
+		t.Errorf("other peer's AllowedIPs() = %v, want [%v]", got, stable)
+	}
+	if err := peer.RemoveAllowedIP(stable); err == nil {
+		t.Error("removed a prefix of another peer")
+	}
+	if err := peer.RemoveAllowedIP(netip.MustParsePrefix("10.0.0.0/9")); err == nil {
+		t.Error("removed a prefix that is not an allowed IP")
+	}
+	if err := peer.AddAllowedIP(netip.Prefix{}); err == nil {
+		t.Error("added an invalid prefix")
+	}
+	delete(device.peers.keyMap, peer.handshake.remoteStatic)
+	if err := peer.AddAllowedIP(prefixes[0]); err == nil {
+		t.Error("added a prefix to a removed peer")
+	}
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// A bandwidthLimiter is a token bucket that caps the sustained throughput of a peer.
+// The bucket holds at most one second worth of bytes, so after a period of
+// inactivity a peer may burst up to its rate in bytes at full speed before
+// being held to the configured rate.
+type bandwidthLimiter struct {
+	sync.Mutex
+	rate   int64 // bytes per second, 0 means unlimited
+	tokens int64 // bytes available for sending, negative when in debt
+	last   time.Time
+}
+
+func (limiter *bandwidthLimiter) setRate(bytesPerSec int64, now time.Time) {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	limiter.rate = bytesPerSec
+	limiter.tokens = bytesPerSec
+	limiter.last = now
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// has to wait before sending them in order to stay within the rate.
+func (limiter *bandwidthLimiter) reserve(n int, now time.Time) time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.rate == 0 {
+		return 0
+	}
+	elapsed := now.Sub(limiter.last)
+	if elapsed > time.Second {
+		elapsed = time.Second
+	}
+	if elapsed > 0 {
+		if refill := mulDiv(int64(elapsed), limiter.rate, int64(time.Second)); refill >= limiter.rate-limiter.tokens {
+			limiter.tokens = limiter.rate
+		} else {
+			limiter.tokens += refill
+		}
+		limiter.last = now
+	}
+	limiter.tokens -= int64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(mulDiv(-limiter.tokens, int64(time.Second), limiter.rate))
+}
+
+// mulDiv returns a*b/c for non-negative a and b and positive c, saturating at
+// math.MaxInt64 instead of overflowing, as the rate may be arbitrarily high.
+func mulDiv(a, b, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	if hi >= uint64(c) {
+		return math.MaxInt64
+	}
+	q, _ := bits.Div64(hi, lo, uint64(c))
+	if q > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(q)
+}
+
+// SetRateLimit caps the rate at which packets are transmitted to the peer
+// to bytesPerSec, counting the encrypted size of each packet.
+// A peer that has been idle may burst up to one second worth of traffic
+// before being throttled. Zero disables the limit.
+func (peer *Peer) SetRateLimit(bytesPerSec int64) {
+	peer.bandwidth.setRate(bytesPerSec, time.Now())
+}
+
+// waitBandwidth blocks until n bytes may be sent to the peer,
+// or until the peer is stopped.
+func (peer *Peer) waitBandwidth(n int) {
+	const maxSleep = time.Second / 10
+	wait := peer.bandwidth.reserve(n, time.Now())
+	for wait > 0 && peer.isRunning.Load() {
+		sleep := wait
+		if sleep > maxSleep {
+			sleep = maxSleep
+		}
+		time.Sleep(sleep)
+		wait -= sleep
+	}
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	const (
+		rate       = 10_000_000 / 8 // 10 Mbit/s
+		packetSize = 1420
+		duration   = 30 * time.Second
+	)
+	var limiter bandwidthLimiter
+	now := time.Unix(0, 0)
+
+	if wait := limiter.reserve(packetSize, now); wait != 0 {
+		t.Fatalf("unlimited limiter asked to wait %v", wait)
+	}
+
+	limiter.setRate(rate, now)
+	start := now
+	sent := 0
+	for now.Sub(start) < duration {
+		// Offer traffic at ten times the limit, honouring the returned delays.
+		now = now.Add(time.Second * packetSize / (10 * rate))
+		now = now.Add(limiter.reserve(packetSize, now))
+		sent += packetSize
+	}
+	// The initial burst is one second worth of traffic on top of the rate.
+	observed := float64(sent-rate) / now.Sub(start).Seconds()
+	if math.Abs(observed-rate)/rate > 0.01 {
+		t.Errorf("observed rate %.0f B/s, want %d B/s", observed, rate)
+	}
+
+	// Neither the refill nor the wait overflows at a huge rate.
+	limiter.setRate(math.MaxInt64, now)
+	limiter.reserve(math.MaxInt64, now)
+	if wait := limiter.reserve(math.MaxInt64/2, now); (wait - time.Second/2).Abs() > time.Millisecond {
+		t.Errorf("limiter at the maximum rate asked to wait %v for half its rate, want %v", wait, time.Second/2)
+	}
+	now = now.Add(time.Second)
+	if wait := limiter.reserve(math.MaxInt64/4, now); wait != 0 {
+		t.Errorf("limiter at the maximum rate asked to wait %v after refilling for a second", wait)
+	}
+
+	limiter.setRate(0, now)
+	if wait := limiter.reserve(packetSize, now); wait != 0 {
+		t.Errorf("disabled limiter asked to wait %v", wait)
+	}
+}
@@ -72,6 +72,33 @@ func newHandshakeQueue() *handshakeQueue {
 	return q
 }
 
+// A QueueDepth is the number of elements waiting in a queue and its capacity.
+type QueueDepth struct {
+	Len int
+	Cap int
+}
+
+// QueueDepths holds the depths of the queues shared by all peers of a device.
+// Elements of the encryption and decryption queues are batches of packets,
+// those of the handshake queue single handshake messages.
+type QueueDepths struct {
+	Encryption QueueDepth
+	Decryption QueueDepth
+	Handshake  QueueDepth
+}
+
+// QueueDepths returns a snapshot of the depths of the device's encryption,
+// decryption and handshake queues, for example to detect backpressure.
+// A handshake queue filling up is what makes the device under load;
+// see IsUnderLoad.
+func (device *Device) QueueDepths() QueueDepths {
+	return QueueDepths{
+		Encryption: QueueDepth{len(device.queue.encryption.c), cap(device.queue.encryption.c)},
+		Decryption: QueueDepth{len(device.queue.decryption.c), cap(device.queue.decryption.c)},
+		Handshake:  QueueDepth{len(device.queue.handshake.c), cap(device.queue.handshake.c)},
+	}
+}
+
 type autodrainingInboundQueue struct {
 	c chan *QueueInboundElementsContainer
 }
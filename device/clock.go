@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"time"
+)
+
+// A Clock tells the time and runs the timers of the protocol, so that tests
+// can replace the real clock with one whose time they advance themselves;
+// see Device.SetClock.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer calls f in its own goroutine once d has elapsed, like
+	// time.AfterFunc.
+	NewTimer(d time.Duration, f func()) ClockTimer
+
+	// After sends the time on the returned channel once d has elapsed, like
+	// time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// A ClockTimer is a timer started by Clock.NewTimer. Its methods behave like
+// those of time.Timer.
+type ClockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the Clock of the system, used by default.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration, f func()) ClockTimer { return time.AfterFunc(d, f) }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock replaces the clock of the protocol's timing: the peers' timers,
+// for handshake retransmission, keepalives, rekeying and zeroing keys, the
+// ages of keypairs and handshakes, and when peers were last seen, which the
+// idle peer reaper goes by. Statistics, logging, the rate limiter and the
+// cookies keep using the real time. Passing nil restores the real clock,
+// which is the default.
+//
+// It is meant for tests, which can advance a fake clock to make the timers
+// fire instead of sleeping. Since the peers' timers belong to the clock, it
+// can only be set while the device has no peers.
+func (device *Device) SetClock(clock Clock) error {
+	device.peers.Lock()
+	defer device.peers.Unlock()
+	if len(device.peers.keyMap) > 0 {
+		return errors.New("cannot set the clock of a device with peers")
+	}
+	if clock == nil {
+		device.clock.Store(nil)
+	} else {
+		device.clock.Store(&clock)
+	}
+	return nil
+}
+
+// getClock returns the clock set with SetClock.
+func (device *Device) getClock() Clock {
+	if clock := device.clock.Load(); clock != nil {
+		return *clock
+	}
+	return realClock{}
+}
+
+// now returns the current time of the device's clock.
+func (device *Device) now() time.Time {
+	return device.getClock().Now()
+}
+
+// since returns the time elapsed since t on the device's clock.
+func (device *Device) since(t time.Time) time.Duration {
+	return device.now().Sub(t)
+}
@@ -0,0 +1,226 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/tun/tuntest"
+)
+
+// fakeClock is a Clock whose time only moves when advanced. Advance runs
+// the functions of the timers that expire in the calling goroutine.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	f      func()
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration, f func()) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.NewTimer(d, func() { ch <- c.Now() })
+	return ch
+}
+
+// Advance moves the time forward by d, firing the timers that expire on the
+// way in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.active = false
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	return wasActive
+}
+
+func TestSetClock(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	clock := newFakeClock()
+	if err := dev.SetClock(clock); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.now().Equal(clock.Now()) {
+		t.Fatalf("device time %v, want the fake clock's %v", dev.now(), clock.Now())
+	}
+	clock.Advance(time.Hour)
+	if got := dev.since(clock.Now().Add(-time.Hour)); got != time.Hour {
+		t.Fatalf("an hour on the fake clock lasted %v", got)
+	}
+
+	_, pk := randomConfigKeys(t)
+	if _, err := dev.NewPeer(pk); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetClock(nil); err == nil {
+		t.Fatal("changed the clock of a device with peers")
+	}
+	dev.RemoveAllPeers()
+	if err := dev.SetClock(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.getClock().(realClock); !ok {
+		t.Fatalf("clock is %T after SetClock(nil), want the real clock", dev.getClock())
+	}
+}
+
+func TestRekeyAfterTimeWithFakeClock(t *testing.T) {
+	goroutineLeakCheck(t)
+	cfg, endpointCfg := genConfigs(t)
+	binds := bindtest.NewChannelBinds()
+	clock := newFakeClock()
+	var pair testPair
+	for i := range pair {
+		p := &pair[i]
+		p.tun = tuntest.NewChannelTUN()
+		p.ip = netip.AddrFrom4([4]byte{1, 0, 0, byte(i + 1)})
+		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(LogLevelVerbose, fmt.Sprintf("dev%d: ", i)))
+		t.Cleanup(p.dev.Close)
+		// Only the initiator, pair[1], ages its keypairs on the fake clock,
+		// so that pair[0] answers without taking the rekey for a flood.
+		if i == 1 {
+			if err := p.dev.SetClock(clock); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.dev.IpcSet(cfg[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+		endpointCfg[i^1] = fmt.Sprintf(endpointCfg[i^1], p.dev.net.port)
+	}
+	for i := range pair {
+		if err := pair[i].dev.IpcSet(endpointCfg[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pair[1] initiates the handshake; the pong stops it expecting a reply.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	initiations := func() uint64 { return pair[1].dev.HandshakeStats().InitiationsSent }
+	if n := initiations(); n != 1 {
+		t.Fatalf("sent %d initiations, want 1", n)
+	}
+
+	// No rekey until the keypair is older than RekeyAfterTime. The second
+	// ping is sent only after the first one was checked for a rekey.
+	clock.Advance(RekeyAfterTime)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+	if n := initiations(); n != 1 {
+		t.Fatalf("sent %d initiations at RekeyAfterTime, want 1", n)
+	}
+
+	clock.Advance(time.Nanosecond)
+	pair.Send(t, Ping, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for initiations() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %d initiations after RekeyAfterTime, want 2", initiations())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIdlePeerReaperWithFakeClock(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	clock := newFakeClock()
+	if err := dev.SetClock(clock); err != nil {
+		t.Fatal(err)
+	}
+	_, pk := randomConfigKeys(t)
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstFound := make(map[*Peer]time.Time)
+	dev.reapIdlePeers(time.Hour, nil, firstFound)
+
+	// Idleness is measured on the fake clock, from when the peer was last
+	// seen.
+	clock.Advance(30 * time.Minute)
+	peer.seen()
+	clock.Advance(45 * time.Minute)
+	dev.reapIdlePeers(time.Hour, nil, firstFound)
+	if dev.LookupPeer(pk) == nil {
+		t.Fatal("peer seen 45 minutes ago was removed")
+	}
+	clock.Advance(30 * time.Minute)
+	dev.reapIdlePeers(time.Hour, nil, firstFound)
+	if dev.LookupPeer(pk) != nil {
+		t.Fatal("peer idle for 75 minutes was not removed")
+	}
+}
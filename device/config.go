@@ -0,0 +1,534 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/syntlabs/cyanide-go/ipc"
+)
+
+// A Config is a complete device configuration, as returned by MarshalConfig
+// and accepted by ApplyConfig and Reconfigure.
+// It carries the same information as a UAPI "set" operation with
+// replace_peers=true and replace_allowed_ips=true on every peer.
+type Config struct {
+	PrivateKey NoisePrivateKey
+	// ListenPort is the port the device is configured to listen on, with 0
+	// letting the kernel choose one; see Device.ListenPort for the port
+	// actually bound.
+	ListenPort   uint16
+	FirewallMark uint32
+	ASec         ASecConfig
+	Peers        []PeerConfig
+}
+
+// An ASecConfig holds the advanced security parameters of a device.
+// The zero value disables advanced security.
+type ASecConfig struct {
+	JunkPacketCount            int    // jc
+	JunkPacketMinSize          int    // jmin
+	JunkPacketMaxSize          int    // jmax
+	InitPacketJunkSize         int    // s1
+	ResponsePacketJunkSize     int    // s2
+	UnderloadPacketJunkSize    int    // s3
+	InitPacketMagicHeader      uint32 // h1
+	ResponsePacketMagicHeader  uint32 // h2
+	UnderloadPacketMagicHeader uint32 // h3
+	TransportPacketMagicHeader uint32 // h4
+
+	JunkTransportPacketCount       int    // jt
+	JunkTransportPacketMagicHeader uint32 // h5
+
+	// JunkTiming is when the junk packets of an initiation are sent:
+	// "before" (the default, also for ""), "after" or "spread(duration)".
+	JunkTiming string // jtm
+}
+
+// A PeerConfig is the configuration of a single peer within a Config.
+// An endpoint that is not an address and port, such as the URL of a
+// WebSocket, QUIC or SOCKS5 endpoint, is held in EndpointString instead of
+// Endpoint, in the form the bind parses; at most one of them may be set.
+// Leaving both unset leaves the peer's current endpoint, if any, untouched,
+// so that an endpoint learned by roaming survives a reconfiguration.
+type PeerConfig struct {
+	PublicKey                   NoisePublicKey
+	PresharedKey                NoisePresharedKey
+	Endpoint                    netip.AddrPort
+	EndpointString              string
+	PersistentKeepaliveInterval uint16
+	AllowedIPs                  []netip.Prefix
+}
+
+// endpoint returns the endpoint of cfg in the form the bind parses, or "" if
+// it has none.
+func (cfg *PeerConfig) endpoint() string {
+	if cfg.EndpointString != "" {
+		return cfg.EndpointString
+	}
+	if cfg.Endpoint.IsValid() {
+		return cfg.Endpoint.String()
+	}
+	return ""
+}
+
+func (conf *ASecConfig) toASecConfType() aSecConfType {
+	timing, err := parseJunkTiming(conf.JunkTiming)
+	if err != nil {
+		timing = junkTiming{mode: junkTimingInvalid}
+	}
+	return aSecConfType{
+		isSet:                      true,
+		junkPacketCount:            conf.JunkPacketCount,
+		junkPacketMinSize:          conf.JunkPacketMinSize,
+		junkPacketMaxSize:          conf.JunkPacketMaxSize,
+		initPacketJunkSize:         conf.InitPacketJunkSize,
+		responsePacketJunkSize:     conf.ResponsePacketJunkSize,
+		underloadPacketJunkSize:    conf.UnderloadPacketJunkSize,
+		initPacketMagicHeader:      conf.InitPacketMagicHeader,
+		responsePacketMagicHeader:  conf.ResponsePacketMagicHeader,
+		underloadPacketMagicHeader: conf.UnderloadPacketMagicHeader,
+		transportPacketMagicHeader: conf.TransportPacketMagicHeader,
+
+		junkTransportPacketCount:       conf.JunkTransportPacketCount,
+		junkTransportPacketMagicHeader: conf.JunkTransportPacketMagicHeader,
+		junkTiming:                     timing,
+	}
+}
+
+func (conf *aSecConfType) toASecConfig() ASecConfig {
+	var timing string
+	if conf.junkTiming != (junkTiming{}) {
+		timing = conf.junkTiming.String()
+	}
+	return ASecConfig{
+		JunkPacketCount:            conf.junkPacketCount,
+		JunkPacketMinSize:          conf.junkPacketMinSize,
+		JunkPacketMaxSize:          conf.junkPacketMaxSize,
+		InitPacketJunkSize:         conf.initPacketJunkSize,
+		ResponsePacketJunkSize:     conf.responsePacketJunkSize,
+		UnderloadPacketJunkSize:    conf.underloadPacketJunkSize,
+		InitPacketMagicHeader:      conf.initPacketMagicHeader,
+		ResponsePacketMagicHeader:  conf.responsePacketMagicHeader,
+		UnderloadPacketMagicHeader: conf.underloadPacketMagicHeader,
+		TransportPacketMagicHeader: conf.transportPacketMagicHeader,
+
+		JunkTransportPacketCount:       conf.junkTransportPacketCount,
+		JunkTransportPacketMagicHeader: conf.junkTransportPacketMagicHeader,
+		JunkTiming:                     timing,
+	}
+}
+
+// MarshalConfig returns the complete configuration of the device,
+// with peers sorted by public key. Passing it to ApplyConfig restores the
+// same configuration. It fails if the device is closed or a peer's endpoint
+// has no string form to save.
+func (device *Device) MarshalConfig() (*Config, error) {
+	if device.isClosed() {
+		return nil, ErrDeviceClosed
+	}
+
+	device.ipcMutex.RLock()
+	defer device.ipcMutex.RUnlock()
+
+	cfg, err := device.configLocked()
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(cfg.Peers, func(a, b PeerConfig) int {
+		return bytes.Compare(a.PublicKey[:], b.PublicKey[:])
+	})
+	return cfg, nil
+}
+
+// ApplyConfig applies cfg as the complete configuration of the device.
+// It is the counterpart of MarshalConfig; see Reconfigure for details.
+func (device *Device) ApplyConfig(cfg *Config) error {
+	return device.Reconfigure(cfg)
+}
+
+// Reconfigure applies cfg as the complete configuration of the device.
+// Only the differences between the current configuration and cfg are applied:
+// peers that are absent from cfg are removed, new peers are created, and
+// existing peers are only touched where their configuration changed,
+// so their sessions are kept.
+//
+// If any stage fails, the configuration that was in place before the call
+// is restored and the error of the first failing stage is returned.
+// Peers removed by the failed attempt are recreated on rollback, but
+// their sessions are lost.
+func (device *Device) Reconfigure(cfg *Config) error {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	prev, err := device.configLocked()
+	if err != nil {
+		// Without it a failure could not be rolled back.
+		return fmt.Errorf("failed to reconfigure: %w", err)
+	}
+	stage, err := device.applyConfigLocked(cfg)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("failed to reconfigure %s: %w", stage, err)
+	device.log.Errorf("%v; rolling back", err)
+	if rollbackStage, rollbackErr := device.applyConfigLocked(prev); rollbackErr != nil {
+		device.log.Errorf("Failed to roll back %s: %v", rollbackStage, rollbackErr)
+		return fmt.Errorf("%w (rollback of %s failed: %v)", err, rollbackStage, rollbackErr)
+	}
+	return err
+}
+
+// ReplacePeers makes the device's peer set match desired in a single step,
+// holding the peer map locked throughout: peers absent from desired are
+// removed, new peers are created, and existing peers are only touched where
+// their configuration changed, so their sessions are kept.
+// A peer with the device's own public key is ignored.
+//
+// Every entry of desired is validated before anything is applied. If any is
+// invalid, nothing is changed and the errors of all invalid entries are
+// returned joined together.
+func (device *Device) ReplacePeers(desired []PeerConfig) error {
+	if device.isClosed() {
+		return ErrDeviceClosed
+	}
+
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	device.staticIdentity.RLock()
+	self := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+
+	wanted := make(map[NoisePublicKey]*PeerConfig, len(desired))
+	var errs []error
+	for i := range desired {
+		cfg := &desired[i]
+		if cfg.PublicKey.Equals(self) {
+			continue
+		}
+		if _, ok := wanted[cfg.PublicKey]; ok {
+			errs = append(errs, fmt.Errorf("peer %x: duplicate public key", cfg.PublicKey[:]))
+			continue
+		}
+		wanted[cfg.PublicKey] = cfg
+		if err := device.validatePeerConfig(cfg); err != nil {
+			errs = append(errs, fmt.Errorf("peer %x: %w", cfg.PublicKey[:], err))
+		}
+	}
+	if len(wanted) > MaxPeers {
+		errs = append(errs, fmt.Errorf("%d peers exceed the limit of %d", len(wanted), MaxPeers))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	changed, err := device.replacePeers(wanted)
+	// Starting the peers may send packets, which must not happen with the
+	// peer map or the identity locked.
+	for _, peer := range changed {
+		peer.handlePostConfig()
+	}
+	return err
+}
+
+// replacePeers applies the validated peer set wanted for ReplacePeers and
+// returns the peers whose configuration changed. The checks that can fail
+// all come before the first change.
+func (device *Device) replacePeers(wanted map[NoisePublicKey]*PeerConfig) ([]*ipcSetPeer, error) {
+	// New peers precompute their static-static secret with the private key.
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	// The key may have changed since wanted was built.
+	delete(wanted, device.staticIdentity.publicKey)
+	if limit := device.peers.max; limit > 0 && len(wanted) > limit {
+		return nil, ipcErrorf(ipc.IpcErrorInvalid, "peer limit reached: %d peers exceed the limit of %d", len(wanted), limit)
+	}
+
+	for key, peer := range device.peers.keyMap {
+		if _, ok := wanted[key]; !ok {
+			removePeerLocked(device, peer, key)
+		}
+	}
+
+	// With the stale peers removed, the peer map holds fewer peers than
+	// wanted, which is within the limits, and the endpoints were validated,
+	// so neither creating nor configuring a peer fails below.
+	var changed []*ipcSetPeer
+	for key, cfg := range wanted {
+		peer := &ipcSetPeer{Peer: device.peers.keyMap[key]}
+		peer.created = peer.Peer == nil
+		if peer.created {
+			var err error
+			peer.Peer, err = device.newPeerLocked(key)
+			if err != nil {
+				return changed, fmt.Errorf("failed to create peer: %w", err)
+			}
+			device.log.Verbosef("%v - ReplacePeers: Created", peer.Peer)
+		}
+		ok, err := peer.applyConfig(cfg)
+		if err != nil {
+			return changed, fmt.Errorf("%v: %w", peer.Peer, err)
+		}
+		if ok {
+			changed = append(changed, peer)
+		}
+	}
+	return changed, nil
+}
+
+// validatePeerConfig reports the first problem that would keep cfg from
+// being applied to the device.
+func (device *Device) validatePeerConfig(cfg *PeerConfig) error {
+	if cfg.Endpoint.IsValid() && cfg.EndpointString != "" {
+		return fmt.Errorf("endpoint set both as %v and as %q", cfg.Endpoint, cfg.EndpointString)
+	}
+	if endpoint := cfg.endpoint(); endpoint != "" {
+		if _, err := device.net.bind.ParseEndpoint(endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint %s: %w", endpoint, err)
+		}
+	}
+	for _, prefix := range cfg.AllowedIPs {
+		if !prefix.IsValid() {
+			return fmt.Errorf("invalid allowed ip %v", prefix)
+		}
+	}
+	return nil
+}
+
+// configLocked returns a snapshot of the current device configuration.
+// The caller must hold device.ipcMutex.
+func (device *Device) configLocked() (*Config, error) {
+	cfg := new(Config)
+
+	device.net.RLock()
+	cfg.ListenPort = device.net.listenPort
+	cfg.FirewallMark = device.net.fwmark
+	device.net.RUnlock()
+
+	device.staticIdentity.RLock()
+	cfg.PrivateKey = device.staticIdentity.privateKey
+	device.staticIdentity.RUnlock()
+
+	device.aSecMux.RLock()
+	cfg.ASec = device.aSecConf.toASecConfig()
+	device.aSecMux.RUnlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	cfg.Peers = make([]PeerConfig, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peerCfg, err := peer.config()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", peer, err)
+		}
+		cfg.Peers = append(cfg.Peers, peerCfg)
+	}
+	return cfg, nil
+}
+
+// config returns a snapshot of the peer's configuration.
+func (peer *Peer) config() (PeerConfig, error) {
+	var cfg PeerConfig
+	peer.handshake.mutex.RLock()
+	cfg.PublicKey = peer.handshake.remoteStatic
+	cfg.PresharedKey = peer.handshake.presharedKey
+	peer.handshake.mutex.RUnlock()
+
+	peer.endpoint.Lock()
+	endpoint := peer.endpoint.val
+	peer.endpoint.Unlock()
+	if endpoint != nil {
+		dst := endpoint.DstToString()
+		if addrPort, err := netip.ParseAddrPort(dst); err == nil {
+			cfg.Endpoint = addrPort
+		} else if dst != "" {
+			cfg.EndpointString = dst
+		} else {
+			return cfg, fmt.Errorf("endpoint of type %T has no string form", endpoint)
+		}
+	}
+
+	cfg.PersistentKeepaliveInterval = uint16(peer.persistentKeepaliveInterval.Load())
+	cfg.AllowedIPs = peer.AllowedIPs()
+	return cfg, nil
+}
+
+// applyConfigLocked applies the differences between the current configuration
+// and cfg. On failure it reports the stage that failed.
+// The caller must hold device.ipcMutex.
+func (device *Device) applyConfigLocked(cfg *Config) (stage string, err error) {
+	if err := device.SetPrivateKey(cfg.PrivateKey); err != nil {
+		return "private key", err
+	}
+
+	device.net.RLock()
+	port, fwmark := device.net.listenPort, device.net.fwmark
+	device.net.RUnlock()
+
+	if port != cfg.ListenPort {
+		device.net.Lock()
+		device.net.port = cfg.ListenPort
+		device.net.listenPort = cfg.ListenPort
+		device.net.Unlock()
+		if err := device.BindUpdate(); err != nil {
+			return "listen port", err
+		}
+	}
+
+	if fwmark != cfg.FirewallMark {
+		if err := device.BindSetMark(cfg.FirewallMark); err != nil {
+			return "fwmark", err
+		}
+	}
+
+	aSecConf := cfg.ASec.toASecConfType()
+	device.aSecMux.RLock()
+	current := device.aSecConf
+	device.aSecMux.RUnlock()
+	// The device holds the configuration as handlePostConfig applied it.
+	current.isSet = true
+	applied := aSecConf
+	applied.junkPacketMaxSize = applied.effectiveJunkPacketMaxSize()
+	if current != applied {
+		if err := device.handlePostConfig(&aSecConf); err != nil {
+			return "advanced security", err
+		}
+	}
+
+	if err := device.applyPeerConfigsLocked(cfg.Peers); err != nil {
+		return "peers", err
+	}
+	return "", nil
+}
+
+// applyPeerConfigsLocked makes the device's peer set match peers.
+// The caller must hold device.ipcMutex.
+func (device *Device) applyPeerConfigsLocked(peers []PeerConfig) error {
+	device.staticIdentity.RLock()
+	self := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+
+	wanted := make(map[NoisePublicKey]*PeerConfig, len(peers))
+	for i := range peers {
+		if peers[i].PublicKey.Equals(self) {
+			continue
+		}
+		wanted[peers[i].PublicKey] = &peers[i]
+	}
+
+	device.peers.RLock()
+	var stale []NoisePublicKey
+	for key := range device.peers.keyMap {
+		if _, ok := wanted[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	device.peers.RUnlock()
+
+	for _, key := range stale {
+		device.RemovePeer(key)
+	}
+
+	for key, cfg := range wanted {
+		peer := &ipcSetPeer{Peer: device.LookupPeer(key)}
+		peer.created = peer.Peer == nil
+		if peer.created {
+			var err error
+			peer.Peer, err = device.NewPeer(key)
+			if err != nil {
+				return fmt.Errorf("failed to create peer: %w", err)
+			}
+			device.log.Verbosef("%v - Reconfigure: Created", peer.Peer)
+		}
+		changed, err := peer.applyConfig(cfg)
+		if err != nil {
+			if peer.created {
+				device.RemovePeer(key)
+			}
+			return fmt.Errorf("%v: %w", peer.Peer, err)
+		}
+		if changed {
+			peer.handlePostConfig()
+		}
+	}
+	return nil
+}
+
+// applyConfig updates the peer to match cfg and reports whether anything changed.
+func (peer *ipcSetPeer) applyConfig(cfg *PeerConfig) (changed bool, err error) {
+	device := peer.device
+	current, err := peer.config()
+	if err != nil {
+		return peer.created, err
+	}
+	changed = peer.created
+
+	if want := cfg.endpoint(); want != "" && want != current.endpoint() {
+		endpoint, err := device.net.bind.ParseEndpoint(want)
+		if err != nil {
+			return changed, fmt.Errorf("failed to set endpoint %s: %w", want, err)
+		}
+		device.log.Verbosef("%v - Reconfigure: Updating endpoint", peer.Peer)
+		peer.endpoint.Lock()
+		peer.endpoint.val = endpoint
+		peer.endpoint.Unlock()
+		changed = true
+	}
+
+	if cfg.PresharedKey != current.PresharedKey {
+		device.log.Verbosef("%v - Reconfigure: Updating preshared key", peer.Peer)
+		peer.handshake.mutex.Lock()
+		peer.handshake.presharedKey = cfg.PresharedKey
+		peer.handshake.mutex.Unlock()
+		changed = true
+	}
+
+	if cfg.PersistentKeepaliveInterval != current.PersistentKeepaliveInterval {
+		device.log.Verbosef("%v - Reconfigure: Updating persistent keepalive interval", peer.Peer)
+		old := peer.persistentKeepaliveInterval.Swap(uint32(cfg.PersistentKeepaliveInterval))
+		peer.pkaOn = old == 0 && cfg.PersistentKeepaliveInterval != 0
+		changed = true
+	}
+
+	if !samePrefixes(cfg.AllowedIPs, current.AllowedIPs) {
+		device.log.Verbosef("%v - Reconfigure: Replacing allowedips", peer.Peer)
+		device.allowedips.RemoveByPeer(peer.Peer)
+		for _, prefix := range cfg.AllowedIPs {
+			device.allowedips.Insert(prefix, peer.Peer)
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// samePrefixes reports whether a and b hold the same set of prefixes,
+// after masking, regardless of order.
+func samePrefixes(a, b []netip.Prefix) bool {
+	set := make(map[netip.Prefix]bool, len(b))
+	for _, prefix := range b {
+		set[prefix.Masked()] = true
+	}
+	seen := make(map[netip.Prefix]bool, len(a))
+	for _, prefix := range a {
+		prefix = prefix.Masked()
+		if !set[prefix] {
+			return false
+		}
+		seen[prefix] = true
+	}
+	return len(seen) == len(set)
+}
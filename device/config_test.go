@@ -0,0 +1,716 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntlabs/cyanide-go/conn"
+	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/ipc"
+	"github.com/syntlabs/cyanide-go/tun/tuntest"
+)
+
+func randomConfigKeys(tb testing.TB) (sk NoisePrivateKey, pk NoisePublicKey) {
+	if _, err := rand.Read(sk[:]); err != nil {
+		tb.Fatalf("unable to generate private key random bytes: %v", err)
+	}
+	sk.clamp()
+	return sk, sk.publicKey()
+}
+
+// rejectedEndpoint is an endpoint that rejectingBind fails to parse.
+var rejectedEndpoint = netip.MustParseAddrPort("192.0.2.1:1")
+
+// rejectingBind is a Bind that fails to parse rejectedEndpoint.
+type rejectingBind struct {
+	conn.Bind
+}
+
+func (b rejectingBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if s == rejectedEndpoint.String() {
+		return nil, fmt.Errorf("rejected endpoint %s", s)
+	}
+	return b.Bind.ParseEndpoint(s)
+}
+
+// urlEndpoint is an endpoint that is not an address and port, like those
+// of the WebSocket and QUIC binds.
+type urlEndpoint string
+
+func (e urlEndpoint) ClearSrc()           {}
+func (e urlEndpoint) SrcToString() string { return "" }
+func (e urlEndpoint) DstToString() string { return string(e) }
+func (e urlEndpoint) DstToBytes() []byte  { return []byte(e) }
+func (e urlEndpoint) DstIP() netip.Addr   { return netip.Addr{} }
+func (e urlEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+// urlBind is a Bind that parses URLs as urlEndpoints.
+type urlBind struct {
+	conn.Bind
+}
+
+func (b urlBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if strings.Contains(s, "://") {
+		return urlEndpoint(s), nil
+	}
+	return b.Bind.ParseEndpoint(s)
+}
+
+// peerConfig returns the configuration of peer, failing the test if it has
+// none.
+func peerConfig(t testing.TB, peer *Peer) PeerConfig {
+	t.Helper()
+	cfg, err := peer.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReconfigure(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), rejectingBind{binds[0]}, NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, _ := randomConfigKeys(t)
+	_, peer1 := randomConfigKeys(t)
+	_, peer2 := randomConfigKeys(t)
+	_, peer3 := randomConfigKeys(t)
+
+	cfg := &Config{
+		PrivateKey: sk,
+		Peers: []PeerConfig{
+			{PublicKey: peer1, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}},
+			{PublicKey: peer2, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32"), netip.MustParsePrefix("fd00::/64")}},
+		},
+	}
+	if err := dev.Reconfigure(cfg); err != nil {
+		t.Fatalf("initial reconfigure failed: %v", err)
+	}
+	if got := dev.PeerCount(); got != 2 {
+		t.Errorf("PeerCount() = %d, want 2", got)
+	}
+	if keys := dev.Peers(); len(keys) != 2 || keys[0] == keys[1] ||
+		(keys[0] != peer1 && keys[0] != peer2) || (keys[1] != peer1 && keys[1] != peer2) {
+		t.Errorf("Peers() = %v, want %v and %v", keys, peer1, peer2)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want NoisePublicKey
+		ok   bool
+	}{
+		{"10.0.0.1", peer1, true},
+		{"10.0.0.2", peer2, true},
+		{"10.0.0.3", NoisePublicKey{}, false},
+		{"fd00::1", peer2, true},
+		{"fd01::1", NoisePublicKey{}, false},
+		{"", NoisePublicKey{}, false},
+	} {
+		var ip netip.Addr
+		if tt.ip != "" {
+			ip = netip.MustParseAddr(tt.ip)
+		}
+		if got, ok := dev.LookupRoute(ip); got != tt.want || ok != tt.ok {
+			t.Errorf("LookupRoute(%q) = %v, %v; want %v, %v", tt.ip, got, ok, tt.want, tt.ok)
+		}
+	}
+	unchanged := dev.LookupPeer(peer1)
+	if unchanged == nil || dev.LookupPeer(peer2) == nil {
+		t.Fatal("peers were not created")
+	}
+
+	// Replace peer2 with peer3; peer1 must be left alone.
+	cfg.Peers[1] = PeerConfig{PublicKey: peer3, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.3/32")}}
+	if err := dev.Reconfigure(cfg); err != nil {
+		t.Fatalf("reconfigure failed: %v", err)
+	}
+	if dev.LookupPeer(peer1) != unchanged {
+		t.Error("unchanged peer was recreated")
+	}
+	if dev.LookupPeer(peer2) != nil {
+		t.Error("removed peer still present")
+	}
+	if dev.LookupPeer(peer3) == nil {
+		t.Error("added peer missing")
+	}
+
+	// An invalid advanced security configuration must be rolled back.
+	bad := *cfg
+	bad.ASec.JunkPacketMaxSize = MaxSegmentSize
+	if err := dev.Reconfigure(&bad); err == nil {
+		t.Fatal("expected reconfigure with invalid advanced security to fail")
+	}
+	if dev.isAdvancedSecurityOn() {
+		t.Error("advanced security was not rolled back")
+	}
+
+	// A failure while applying peers must restore the removed peers.
+	bad = *cfg
+	bad.Peers = []PeerConfig{cfg.Peers[0]}
+	bad.Peers[0].Endpoint = rejectedEndpoint
+	if err := dev.Reconfigure(&bad); err == nil {
+		t.Fatal("expected reconfigure with invalid endpoint to fail")
+	}
+	restored := dev.LookupPeer(peer3)
+	if restored == nil {
+		t.Fatal("peer was not restored by rollback")
+	}
+	if got := peerConfig(t, restored).AllowedIPs; !samePrefixes(got, cfg.Peers[1].AllowedIPs) {
+		t.Errorf("allowed ips after rollback = %v, want %v", got, cfg.Peers[1].AllowedIPs)
+	}
+}
+
+func TestReplacePeers(t *testing.T) {
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	dev := pair[0].dev
+	cfg, err := dev.MarshalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := dev.LookupPeer(cfg.Peers[0].PublicKey)
+	live.keypairs.RLock()
+	keypair := live.keypairs.current
+	live.keypairs.RUnlock()
+	if keypair == nil {
+		t.Fatal("no keypair after ping")
+	}
+
+	_, added := randomConfigKeys(t)
+	desired := append(cfg.Peers, PeerConfig{PublicKey: added, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.9/32")}})
+	if err := dev.ReplacePeers(desired); err != nil {
+		t.Fatalf("ReplacePeers failed: %v", err)
+	}
+	if dev.LookupPeer(added) == nil {
+		t.Error("added peer missing")
+	}
+	if dev.LookupPeer(cfg.Peers[0].PublicKey) != live {
+		t.Fatal("unchanged peer was recreated")
+	}
+	live.keypairs.RLock()
+	kept := live.keypairs.current == keypair
+	live.keypairs.RUnlock()
+	if !kept {
+		t.Error("keypair of unchanged peer was not preserved")
+	}
+	pair.Send(t, Ping, nil)
+
+	// Invalid entries must be reported together, with nothing applied.
+	_, other := randomConfigKeys(t)
+	invalid := []PeerConfig{
+		cfg.Peers[0],
+		cfg.Peers[0],
+		{PublicKey: other, AllowedIPs: []netip.Prefix{{}}},
+	}
+	err = dev.ReplacePeers(invalid)
+	if err == nil || !strings.Contains(err.Error(), "duplicate public key") || !strings.Contains(err.Error(), "invalid allowed ip") {
+		t.Fatalf("ReplacePeers with invalid peers returned %v", err)
+	}
+	if dev.PeerCount() != 2 || dev.LookupPeer(other) != nil {
+		t.Error("invalid peer set was partially applied")
+	}
+
+	if err := dev.ReplacePeers(cfg.Peers); err != nil {
+		t.Fatalf("ReplacePeers failed: %v", err)
+	}
+	if dev.LookupPeer(added) != nil || dev.LookupPeer(cfg.Peers[0].PublicKey) != live {
+		t.Error("absent peer was not removed or unchanged peer was touched")
+	}
+	pair.Send(t, Pong, nil)
+}
+
+func TestReplacePeersWhileSettingPrivateKey(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, _ := randomConfigKeys(t)
+	if err := dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// New peers with a persistent keepalive send a handshake initiation
+	// when they are started, which takes the identity lock again.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, pk := randomConfigKeys(t)
+			err := dev.ReplacePeers([]PeerConfig{{
+				PublicKey:                   pk,
+				Endpoint:                    netip.MustParseAddrPort("127.0.0.1:2"),
+				AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+				PersistentKeepaliveInterval: 1,
+			}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ReplacePeers deadlocked with SetPrivateKey")
+		}
+		sk, _ := randomConfigKeys(t)
+		if err := dev.SetPrivateKey(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAdvancedSecurity(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	if on, conf := dev.AdvancedSecurity(); on || conf.InitPacketMagicHeader != defaultMessageInitiationType {
+		t.Errorf("AdvancedSecurity() = %v, %+v before configuration", on, conf)
+	}
+
+	sk, _ := randomConfigKeys(t)
+	err := dev.Reconfigure(&Config{
+		PrivateKey: sk,
+		ASec: ASecConfig{
+			JunkPacketCount:       3,
+			JunkPacketMinSize:     20,
+			JunkPacketMaxSize:     20,
+			InitPacketMagicHeader: 1234567,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	on, conf := dev.AdvancedSecurity()
+	want := ASecConfig{
+		JunkPacketCount:            3,
+		JunkPacketMinSize:          20,
+		JunkPacketMaxSize:          21,
+		InitPacketMagicHeader:      1234567,
+		ResponsePacketMagicHeader:  defaultMessageResponseType,
+		UnderloadPacketMagicHeader: defaultMessageCookieReplyType,
+		TransportPacketMagicHeader: defaultMessageTransportType,
+	}
+	if !on || conf != want {
+		t.Errorf("AdvancedSecurity() = %v, %+v, want true, %+v", on, conf, want)
+	}
+
+	// Restore the package-wide message types for the other tests.
+	if err := dev.Reconfigure(&Config{PrivateKey: sk}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateASecConf(t *testing.T) {
+	valid := ASecConfig{
+		JunkPacketCount:            4,
+		JunkPacketMinSize:          40,
+		JunkPacketMaxSize:          70,
+		InitPacketJunkSize:         15,
+		ResponsePacketJunkSize:     18,
+		UnderloadPacketJunkSize:    12,
+		InitPacketMagicHeader:      1234567,
+		ResponsePacketMagicHeader:  2345678,
+		UnderloadPacketMagicHeader: 3456789,
+		TransportPacketMagicHeader: 4567890,
+	}
+	if err := ValidateASecConf(valid); err != nil {
+		t.Errorf("valid configuration rejected: %v", err)
+	}
+	if err := ValidateASecConf(ASecConfig{}); err != nil {
+		t.Errorf("empty configuration rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*ASecConfig)
+		want   string
+	}{
+		{"negative count", func(c *ASecConfig) { c.JunkPacketCount = -1 }, "non negative"},
+		{"max too large", func(c *ASecConfig) { c.JunkPacketMaxSize = MaxSegmentSize }, "JunkPacketMaxSize"},
+		{"max below min", func(c *ASecConfig) { c.JunkPacketMaxSize = 10 }, "should be greater than minSize"},
+		{"init junk too large", func(c *ASecConfig) { c.InitPacketJunkSize = MaxSegmentSize }, "init header size"},
+		{"response junk too large", func(c *ASecConfig) { c.ResponsePacketJunkSize = MaxSegmentSize }, "response header size"},
+		{"negative cookie junk", func(c *ASecConfig) { c.UnderloadPacketJunkSize = -1 }, "UnderloadPacketJunkSize"},
+		{"cookie junk too large", func(c *ASecConfig) { c.UnderloadPacketJunkSize = MaxSegmentSize }, "cookie reply header size"},
+		{"cookie size collides", func(c *ASecConfig) {
+			c.UnderloadPacketJunkSize = MessageResponseSize + c.ResponsePacketJunkSize - MessageCookieReplySize
+		}, "new cookie reply size"},
+		{"same magic headers", func(c *ASecConfig) { c.TransportPacketMagicHeader = c.InitPacketMagicHeader }, "magic headers should differ"},
+		{"negative transport junk count", func(c *ASecConfig) { c.JunkTransportPacketCount = -1 }, "JunkTransportPacketCount"},
+		{"transport junk without header", func(c *ASecConfig) { c.JunkTransportPacketCount = 10 }, "JunkTransportPacketMagicHeader"},
+		{"transport junk header collides", func(c *ASecConfig) {
+			c.JunkTransportPacketCount, c.JunkTransportPacketMagicHeader = 10, c.TransportPacketMagicHeader
+		}, "junk transport magic header"},
+		{"unknown junk timing", func(c *ASecConfig) { c.JunkTiming = "later" }, "JunkTiming"},
+		{"junk spread too long", func(c *ASecConfig) { c.JunkTiming = "spread(1m)" }, "spread window"},
+		{"same packet sizes", func(c *ASecConfig) { c.InitPacketJunkSize, c.ResponsePacketJunkSize = 0, 56 }, "should differ"},
+	}
+	for _, tt := range tests {
+		conf := valid
+		tt.modify(&conf)
+		err := ValidateASecConf(conf)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+
+	// Applying an invalid configuration must leave the device untouched.
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	invalid := valid
+	invalid.TransportPacketMagicHeader = invalid.InitPacketMagicHeader
+	aSecConf := invalid.toASecConfType()
+	if err := dev.handlePostConfig(&aSecConf); err == nil {
+		t.Fatal("invalid configuration was applied")
+	}
+	if dev.isAdvancedSecurityOn() || dev.aSecConf != (aSecConfType{}) {
+		t.Error("invalid configuration changed the device")
+	}
+}
+
+func TestUpdateEndpoint(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	_, pk := randomConfigKeys(t)
+	if err := dev.UpdateEndpoint(pk, "127.0.0.1:1000"); err == nil {
+		t.Error("expected updating the endpoint of a missing peer to fail")
+	}
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.UpdateEndpoint(pk, "not an endpoint"); err == nil {
+		t.Error("expected updating to an invalid endpoint to fail")
+	}
+	if err := dev.UpdateEndpoint(pk, "127.0.0.1:1000"); err != nil {
+		t.Fatal(err)
+	}
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if peer.endpoint.val == nil || peer.endpoint.val.DstToString() != "127.0.0.1:1000" {
+		t.Errorf("endpoint = %v, want 127.0.0.1:1000", peer.endpoint.val)
+	}
+	if !peer.endpoint.clearSrcOnTx {
+		t.Error("source address was not marked for clearing")
+	}
+}
+
+func TestIpcGetPeer(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, _ := randomConfigKeys(t)
+	_, peer1 := randomConfigKeys(t)
+	_, peer2 := randomConfigKeys(t)
+	err := dev.Reconfigure(&Config{
+		PrivateKey: sk,
+		Peers: []PeerConfig{
+			{PublicKey: peer1, Endpoint: netip.MustParseAddrPort("127.0.0.1:1"), AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}},
+			{PublicKey: peer2, Endpoint: netip.MustParseAddrPort("127.0.0.1:2"), AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range []NoisePublicKey{peer1, peer2} {
+		block, err := dev.IpcGetPeer(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(block, fmt.Sprintf("public_key=%x\n", pk[:])) {
+			t.Errorf("peer block does not start with its public key:\n%s", block)
+		}
+		if strings.Count(block, "public_key=") != 1 || !strings.Contains(full, block) {
+			t.Errorf("peer block does not match the full get output:\n%s\nfull:\n%s", block, full)
+		}
+	}
+
+	_, missing := randomConfigKeys(t)
+	if _, err := dev.IpcGetPeer(missing); err == nil {
+		t.Error("expected getting a missing peer to fail")
+	}
+}
+
+// writeRecorder records the chunks written to it,
+// and fails once it has accepted limit of them.
+type writeRecorder struct {
+	chunks []string
+	limit  int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	if len(w.chunks) == w.limit {
+		return 0, errors.New("writer full")
+	}
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func TestIPCErrorCode(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelSilent, ""))
+	defer dev.Close()
+
+	for _, tt := range []struct {
+		name string
+		cfg  string
+	}{
+		{"unknown key", uapiCfg("no_such_key", "1")},
+		{"invalid advanced security", uapiCfg("jc", "-1")},
+	} {
+		err := fmt.Errorf("wrapped: %w", dev.IpcSet(tt.cfg))
+		code, ok := ErrorCode(err)
+		if !ok || code != ipc.IpcErrorInvalid {
+			t.Errorf("%s: ErrorCode(%v) = %v, %v; want %v, true", tt.name, err, code, ok, ipc.IpcErrorInvalid)
+		}
+		if !errors.Is(err, ipc.IpcErrorInvalid) || errors.Is(err, ipc.IpcErrorIO) {
+			t.Errorf("%s: errors.Is does not match %v against its code only", tt.name, err)
+		}
+	}
+	if code, ok := ErrorCode(errors.New("not an IPC error")); ok {
+		t.Errorf("ErrorCode of a plain error = %v, true; want false", code)
+	}
+	if got := ipc.IpcErrorInvalid.Error(); got != "invalid argument" {
+		t.Errorf("ipc.IpcErrorInvalid.Error() = %q", got)
+	}
+}
+
+func TestIpcGetTo(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, _ := randomConfigKeys(t)
+	cfg := &Config{PrivateKey: sk}
+	for i := 0; i < 10; i++ {
+		_, pk := randomConfigKeys(t)
+		cfg.Peers = append(cfg.Peers, PeerConfig{PublicKey: pk, AllowedIPs: []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 32)}})
+	}
+	if err := dev.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &writeRecorder{limit: -1}
+	if err := dev.IpcGetTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.chunks) != 1+len(cfg.Peers) {
+		t.Fatalf("got %d writes, want one for the device and one per peer (%d)", len(w.chunks), 1+len(cfg.Peers))
+	}
+	if !strings.HasPrefix(w.chunks[0], "private_key=") || strings.Contains(w.chunks[0], "public_key=") {
+		t.Errorf("first write is not the device section:\n%s", w.chunks[0])
+	}
+	for _, pc := range cfg.Peers {
+		block, err := dev.IpcGetPeer(pc.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, chunk := range w.chunks[1:] {
+			found = found || chunk == block
+		}
+		if !found {
+			t.Errorf("no write matches the block of peer %x:\n%s", pc.PublicKey[:], block)
+		}
+	}
+
+	w = &writeRecorder{limit: 2}
+	var ipcErr *IPCError
+	if err := dev.IpcGetTo(w); !errors.As(err, &ipcErr) || ipcErr.IpcErrorCode() != ipc.IpcErrorIO {
+		t.Errorf("IpcGetTo to a failing writer returned %v, want an I/O IPC error", err)
+	}
+	if len(w.chunks) != 2 {
+		t.Errorf("IpcGetTo went on writing after a failure: %d writes", len(w.chunks))
+	}
+}
+
+// blockingWriter blocks every write until release is closed.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestIpcGetToSlowWriter(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	_, pk := randomConfigKeys(t)
+	if _, err := dev.NewPeer(pk); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockingWriter{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- dev.IpcGetTo(w) }()
+	<-w.writing
+
+	// A writer that does not return holds no device lock.
+	sk, _ := randomConfigKeys(t)
+	set := make(chan error, 1)
+	go func() { set <- dev.IpcSet(uapiCfg("private_key", hex.EncodeToString(sk[:]))) }()
+	select {
+	case err := <-set:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("IpcSet blocked behind a slow IpcGetTo writer")
+		defer func() { <-set }()
+	}
+	close(w.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconfigureKeepsChosenPort(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, _ := randomConfigKeys(t)
+	cfg := &Config{PrivateKey: sk}
+	if err := dev.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	port := dev.ListenPort()
+	if port == 0 {
+		t.Fatal("device is not listening")
+	}
+
+	// The kernel's choice of port stands as long as the configured port
+	// does not change.
+	if err := dev.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.ListenPort(); got != port {
+		t.Errorf("ListenPort() = %d after reconfiguring with port 0, want %d", got, port)
+	}
+	if got, err := dev.MarshalConfig(); err != nil || got.ListenPort != 0 {
+		t.Errorf("MarshalConfig() port = %d, %v, want the configured 0", got.ListenPort, err)
+	}
+}
+
+func TestMarshalConfig(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, _ := randomConfigKeys(t)
+	_, peer1 := randomConfigKeys(t)
+	_, peer2 := randomConfigKeys(t)
+	if bytes.Compare(peer1[:], peer2[:]) > 0 {
+		peer1, peer2 = peer2, peer1
+	}
+	want := &Config{
+		PrivateKey:   sk,
+		ListenPort:   51820,
+		FirewallMark: 42,
+		ASec: ASecConfig{
+			JunkPacketCount:            3,
+			JunkPacketMinSize:          10,
+			JunkPacketMaxSize:          20,
+			InitPacketJunkSize:         15,
+			ResponsePacketJunkSize:     18,
+			InitPacketMagicHeader:      1234567,
+			ResponsePacketMagicHeader:  2345678,
+			UnderloadPacketMagicHeader: 3456789,
+			TransportPacketMagicHeader: 4567890,
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:                   peer1,
+				PresharedKey:                NoisePresharedKey{1, 2, 3},
+				Endpoint:                    netip.MustParseAddrPort("127.0.0.1:1"),
+				PersistentKeepaliveInterval: 25,
+				AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fd00::/64")},
+			},
+			{
+				PublicKey:  peer2,
+				AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.1.1/32")},
+			},
+		},
+	}
+	if err := dev.ApplyConfig(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dev.MarshalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MarshalConfig() = %+v, want %+v", got, want)
+	}
+
+	// Applying the marshaled configuration again changes nothing.
+	if err := dev.ApplyConfig(got); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := dev.MarshalConfig()
+	if !reflect.DeepEqual(again, want) {
+		t.Errorf("configuration changed on round trip: %+v", again)
+	}
+}
+
+func TestMarshalConfigEndpointString(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), urlBind{bindtest.NewChannelBinds()[0]}, NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	_, pk := randomConfigKeys(t)
+	cfg := &Config{Peers: []PeerConfig{{PublicKey: pk, EndpointString: "wss://peer.example/tunnel"}}}
+	if err := dev.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dev.MarshalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Peers) != 1 || got.Peers[0].EndpointString != "wss://peer.example/tunnel" || got.Peers[0].Endpoint.IsValid() {
+		t.Fatalf("MarshalConfig() = %+v, want the peer's endpoint string kept", got)
+	}
+
+	both := []PeerConfig{{PublicKey: pk, Endpoint: netip.MustParseAddrPort("127.0.0.1:1"), EndpointString: "wss://peer.example/tunnel"}}
+	if err := dev.ReplacePeers(both); err == nil {
+		t.Error("expected a peer with two endpoints to be rejected")
+	}
+
+	dev.Close()
+	if _, err := dev.MarshalConfig(); !errors.Is(err, ErrDeviceClosed) {
+		t.Errorf("MarshalConfig() on a closed device = %v, want ErrDeviceClosed", err)
+	}
+}
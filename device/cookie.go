@@ -24,6 +24,7 @@ type CookieChecker struct {
 	mac2 struct {
 		secret        [blake2s.Size]byte
 		secretSet     time.Time
+		refreshTime   time.Duration // 0 means CookieRefreshTime
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
 }
@@ -67,6 +68,24 @@ func (st *CookieChecker) Init(pk NoisePublicKey) {
 	st.mac2.secretSet = time.Time{}
 }
 
+// SetRefreshTime sets how long a cookie secret is used before it is replaced
+// by a new random one. A refreshTime of 0 restores CookieRefreshTime.
+func (st *CookieChecker) SetRefreshTime(refreshTime time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+	st.mac2.refreshTime = refreshTime
+}
+
+// secretExpired reports whether the cookie secret is due to be replaced.
+// The caller must hold st's lock.
+func (st *CookieChecker) secretExpired() bool {
+	refreshTime := st.mac2.refreshTime
+	if refreshTime == 0 {
+		refreshTime = CookieRefreshTime
+	}
+	return time.Since(st.mac2.secretSet) > refreshTime
+}
+
 func (st *CookieChecker) CheckMAC1(msg []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
@@ -88,7 +107,7 @@ func (st *CookieChecker) CheckMAC2(msg, src []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if st.secretExpired() {
 		return false
 	}
 
@@ -124,7 +143,7 @@ func (st *CookieChecker) CreateReply(
 
 	// refresh cookie secret
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if st.secretExpired() {
 		st.RUnlock()
 		st.Lock()
 		_, err := rand.Read(st.mac2.secret[:])
@@ -213,6 +232,25 @@ func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 	return true
 }
 
+// CookieState reports whether the peer holds a cookie received in a cookie
+// reply, which the peer sends instead of a handshake response while it is
+// under load, and how long ago the cookie was received. The cookie is only
+// added to handshake messages, as mac2, for CookieRefreshTime, after which
+// hasCookie is false again but age keeps growing; age is zero if no cookie
+// was ever received. With the cookie replies counted by Device.HandshakeStats
+// on the other side, this tells whether a peer rejected under load completes
+// the cookie exchange.
+func (peer *Peer) CookieState() (hasCookie bool, age time.Duration) {
+	st := &peer.cookieGenerator
+	st.RLock()
+	defer st.RUnlock()
+	if st.mac2.cookieSet.IsZero() {
+		return false, 0
+	}
+	age = time.Since(st.mac2.cookieSet)
+	return age <= CookieRefreshTime, age
+}
+
 func (st *CookieGenerator) AddMacs(msg []byte) {
 	size := len(msg)
 
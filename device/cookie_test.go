@@ -8,6 +8,7 @@ package device
 
 import (
 	"testing"
+	"time"
 )
 
 func TestCookieMAC1(t *testing.T) {
@@ -189,3 +190,90 @@ func TestCookieMAC1(t *testing.T) {
 		0x7d, 0xa1, 0xd5, 0x85, 0x6d, 0xf0, 0x1b, 0xaa,
 	})
 }
+
+func TestCookieRotationInterval(t *testing.T) {
+	var (
+		device    Device
+		generator CookieGenerator
+	)
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	generator.Init(pk)
+	device.cookieChecker.Init(pk)
+	checker := &device.cookieChecker
+
+	if err := device.SetCookieRotationInterval(time.Second); err == nil {
+		t.Error("SetCookieRotationInterval accepted an interval below the minimum")
+	}
+	if err := device.SetCookieRotationInterval(20 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+	msg := make([]byte, 64)
+	generator.AddMacs(msg)
+	reply, err := checker.CreateReply(msg, 1377, src)
+	if err != nil {
+		t.Fatal("Failed to create cookie reply:", err)
+	}
+	if !generator.ConsumeReply(reply) {
+		t.Fatal("Failed to consume cookie reply")
+	}
+	generator.AddMacs(msg)
+	if !checker.CheckMAC2(msg, src) {
+		t.Fatal("MAC2 verification failed with a fresh secret")
+	}
+
+	// Age the secret past the rotation interval, but not CookieRefreshTime.
+	checker.Lock()
+	checker.mac2.secretSet = checker.mac2.secretSet.Add(-30 * time.Second)
+	checker.Unlock()
+	if checker.CheckMAC2(msg, src) {
+		t.Error("MAC2 verified with a secret older than the rotation interval")
+	}
+	if err := device.SetCookieRotationInterval(0); err != nil {
+		t.Fatal(err)
+	}
+	if !checker.CheckMAC2(msg, src) {
+		t.Error("MAC2 verification failed after restoring the default interval")
+	}
+}
+
+func TestPeerCookieState(t *testing.T) {
+	var checker CookieChecker
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	checker.Init(pk)
+	peer := new(Peer)
+	peer.cookieGenerator.Init(pk)
+	if has, age := peer.CookieState(); has || age != 0 {
+		t.Errorf("CookieState() = %v, %v before any cookie reply, want false, 0", has, age)
+	}
+
+	msg := make([]byte, 64)
+	peer.cookieGenerator.AddMacs(msg)
+	reply, err := checker.CreateReply(msg, 1377, []byte{192, 168, 13, 37, 10, 10, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.cookieGenerator.ConsumeReply(reply) {
+		t.Fatal("Failed to consume cookie reply")
+	}
+	if has, age := peer.CookieState(); !has || age < 0 || age > time.Second {
+		t.Errorf("CookieState() = %v, %v after a cookie reply, want true and a fresh age", has, age)
+	}
+
+	// Once expired, the cookie is no longer used but its age is kept.
+	peer.cookieGenerator.Lock()
+	peer.cookieGenerator.mac2.cookieSet = time.Now().Add(-CookieRefreshTime - time.Second)
+	peer.cookieGenerator.Unlock()
+	if has, age := peer.CookieState(); has || age <= CookieRefreshTime {
+		t.Errorf("CookieState() = %v, %v for an expired cookie, want false and an age over %v", has, age, CookieRefreshTime)
+	}
+}
@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// cryptoImplementation describes the ChaCha20-Poly1305 implementation that
+// golang.org/x/crypto uses for transport data on this architecture and CPU;
+// NewDevice logs it. It is chosen when the program is built and started, not
+// by the device: building with -tags purego leaves all the assembly out, which
+// forces the portable Go implementation, for example on CPUs that misreport
+// their features or for reproducibility.
+func cryptoImplementation() string {
+	if !cryptoAssembly {
+		return "pure Go (assembly left out of the build)"
+	}
+	switch runtime.GOARCH {
+	case "amd64":
+		// The features golang.org/x/crypto/chacha20poly1305 checks before
+		// using its combined assembly; Poly1305 alone has assembly otherwise.
+		switch {
+		case cpu.X86.HasAVX2 && cpu.X86.HasBMI2:
+			return "ChaCha20-Poly1305 assembly (AVX2)"
+		case cpu.X86.HasSSSE3:
+			return "ChaCha20-Poly1305 assembly (SSSE3)"
+		}
+		return "pure Go ChaCha20 with Poly1305 assembly (no SSSE3)"
+	case "arm64":
+		return "ChaCha20 assembly (NEON) and pure Go Poly1305"
+	case "ppc64le":
+		return "ChaCha20 and Poly1305 assembly"
+	case "s390x":
+		if cpu.S390X.HasVX {
+			return "ChaCha20 and Poly1305 assembly (vector facility)"
+		}
+		return "pure Go (no vector facility)"
+	}
+	return "pure Go (no assembly for " + runtime.GOARCH + ")"
+}
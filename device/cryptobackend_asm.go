@@ -0,0 +1,12 @@
+//go:build gc && !purego
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+// cryptoAssembly reports whether the assembly of golang.org/x/crypto is built in.
+const cryptoAssembly = true
@@ -0,0 +1,32 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/cpu"
+)
+
+func TestCryptoImplementation(t *testing.T) {
+	got := cryptoImplementation()
+	var wantAssembly bool
+	switch runtime.GOARCH {
+	case "amd64":
+		wantAssembly = cpu.X86.HasSSSE3
+	case "arm64", "ppc64le":
+		wantAssembly = true
+	case "s390x":
+		wantAssembly = cpu.S390X.HasVX
+	}
+	wantAssembly = wantAssembly && cryptoAssembly
+	if gotAssembly := !strings.HasPrefix(got, "pure Go"); gotAssembly != wantAssembly {
+		t.Errorf("cryptoImplementation() = %q on %s, want assembly %v", got, runtime.GOARCH, wantAssembly)
+	}
+}
@@ -7,6 +7,10 @@
 package device
 
 import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/netip"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -17,10 +21,12 @@ import (
 	"github.com/syntlabs/cyanide-go/ratelimiter"
 	"github.com/syntlabs/cyanide-go/rwcancel"
 	"github.com/syntlabs/cyanide-go/tun"
-	"github.com/syntlabs/cyanide-go/ipc"
 	"github.com/tevino/abool/v2"
 )
 
+// ErrDeviceClosed is returned by operations on a device that has been closed.
+var ErrDeviceClosed = errors.New("device closed")
+
 type Device struct {
 	state struct {
 		// state holds the device's state. It is accessed atomically.
@@ -39,6 +45,9 @@ type Device struct {
 		stopping sync.WaitGroup
 		// mu protects state changes.
 		sync.Mutex
+		// events receives a DeviceStateEvent for every state transition.
+		// Only the holder of mu sends on it.
+		events chan DeviceStateEvent
 	}
 
 	net struct {
@@ -46,9 +55,18 @@ type Device struct {
 		sync.RWMutex
 		bind          conn.Bind // bind interface
 		netlinkCancel *rwcancel.RWCancel
-		port          uint16 // listening port
-		fwmark        uint32 // mark value (0 = disabled)
+		port          uint16               // listening port
+		listenPort    uint16               // port set with listen_port or a Config (0 = chosen by the kernel)
+		fwmark        uint32               // mark value (0 = disabled)
+		ifname        string               // interface the sockets are bound to ("" = any)
+		families      conn.AddressFamilies // set with SetAddressFamilies (0 = not set)
+		bufferSize    int                  // set with SetSocketBufferSize (0 = default)
+		netns         string               // set with SetNetworkNamespace ("" = the process's)
+		closing       atomic.Bool          // set while closeBindLocked closes the bind
+		receiving     receiveRoutines      // whether the receive routines of the bind run; see WaitUp
 		brokenRoaming bool
+		// disableStickySockets prevents the route listener from being started.
+		disableStickySockets bool
 	}
 
 	staticIdentity struct {
@@ -58,13 +76,23 @@ type Device struct {
 	}
 
 	peers struct {
-		sync.RWMutex // protects keyMap
+		sync.RWMutex // protects keyMap and max
 		keyMap       map[NoisePublicKey]*Peer
+		max          int // limit set with SetMaxPeers (0 = MaxPeers)
 	}
 
 	rate struct {
 		underLoadUntil atomic.Int64
 		limiter        ratelimiter.Ratelimiter
+		// underLoadQueueLen and underLoadAfter override the handshake queue
+		// length at which the device is under load and UnderLoadAfterTime,
+		// the latter in nanoseconds. Zero values select the defaults;
+		// see SetUnderLoadThreshold.
+		underLoadQueueLen atomic.Int64
+		underLoadAfter    atomic.Int64
+		// allowlist holds the source prefixes exempt from the limiter;
+		// see SetRateLimitAllowlist.
+		allowlist atomic.Pointer[[]netip.Prefix]
 	}
 
 	allowedips    AllowedIPs
@@ -72,6 +100,9 @@ type Device struct {
 	cookieChecker CookieChecker
 
 	pool struct {
+		maxBuffers  atomic.Pointer[uint32] // limit set with SetMaxBuffers (nil = PreallocatedBuffersPerPool)
+		dropOnLimit atomic.Bool            // drop packets on an exhausted pool; see SetBufferLimitMode
+
 		inboundElementsContainer  *WaitPool
 		outboundElementsContainer *WaitPool
 		messageBuffers            *WaitPool
@@ -86,10 +117,101 @@ type Device struct {
 	}
 
 	tun struct {
-		device tun.Device
-		mtu    atomic.Int32
+		device      tun.Device
+		mtu         atomic.Int32
+		mtuClampMin atomic.Int32 // lower bound of the MTU of outbound packets; see SetMTUClamp (0 = disabled)
+		mtuClampMax atomic.Int32 // upper bound of the MTU of outbound packets; see SetMTUClamp (0 = disabled)
+	}
+
+	handshakeCounters handshakeCounters
+	msgTypeCounters   msgTypeCounters
+
+	// draining is set by CloseGraceful to stop taking in packets from the TUN
+	// device.
+	draining atomic.Bool
+	// drained wakes RemovePeerGraceful and CloseGraceful when the packets
+	// queued for a peer may all have been sent.
+	drained broadcaster
+
+	// unknownPeerPolicy is an UnknownPeerPolicy; see SetUnknownPeerPolicy.
+	unknownPeerPolicy atomic.Int32
+
+	// rxBytes and txBytes total the transfer counters of the peers; see
+	// TotalBytes.
+	rxBytes atomic.Uint64
+	txBytes atomic.Uint64
+
+	// handshakeTimeouts overrides RekeyTimeout and RekeyAttemptTime, in nanoseconds.
+	// Zero values select the defaults; see SetHandshakeTimeouts.
+	handshakeTimeouts struct {
+		rekeyTimeout     atomic.Int64
+		rekeyAttemptTime atomic.Int64
+	}
+
+	// keepaliveJitterMax is the upper bound, in nanoseconds, of the random
+	// delay added to each persistent keepalive (0 = disabled).
+	keepaliveJitterMax atomic.Int64
+
+	// keepalivesDisabled suppresses all persistent keepalives;
+	// see SetKeepalivesEnabled.
+	keepalivesDisabled atomic.Bool
+
+	// endpointErrorHandler is called for errors the bind reports for a peer's
+	// endpoint; see SetEndpointErrorHandler.
+	endpointErrorHandler atomic.Pointer[func(NoisePublicKey, error)]
+
+	// endpointErrors limits the rate at which endpoint errors are handled;
+	// see allowEndpointError.
+	endpointErrors struct {
+		sync.Mutex
+		start   time.Time // start of the current interval
+		handled int       // endpoint errors handled in the current interval
 	}
 
+	// roamingHook is called when a peer roams to a new endpoint;
+	// see SetRoamingHook.
+	roamingHook atomic.Pointer[func(pk NoisePublicKey, old, new conn.Endpoint)]
+
+	// keypairEventHook is called when a peer's current keypair changes;
+	// see SetKeypairEventHook.
+	keypairEventHook atomic.Pointer[func(pk NoisePublicKey, event KeypairEvent)]
+
+	// junk, when set, supplies the randomness of generated junk;
+	// see SetJunkSource.
+	junk atomic.Pointer[lockedJunkSource]
+
+	// pause holds back incoming packets while the device is paused;
+	// see Pause.
+	pause pauseGate
+
+	// clock times the protocol; see SetClock. nil means the real clock.
+	clock atomic.Pointer[Clock]
+
+	// scheduler orders outbound packets on their way to encryption;
+	// see SetScheduler.
+	scheduler outboundScheduler
+
+	// dropLog samples the logging of dropped packets; see SetDropLogging.
+	dropLog dropLog
+
+	// cryptoRoutingDropHook is called for packets dropped because their
+	// source is not an allowed IP of their peer; see SetCryptoRoutingDropHook.
+	cryptoRoutingDropHook atomic.Pointer[func(NoisePublicKey, netip.Addr)]
+
+	// inboundTap inspects decrypted inbound packets; see SetInboundTap.
+	inboundTap atomic.Pointer[func(NoisePublicKey, []byte) bool]
+
+	// outboundTap inspects outbound packets read from the TUN device; see
+	// SetOutboundTap.
+	outboundTap atomic.Pointer[func([]byte) bool]
+
+	// stun holds the STUN binding requests awaiting a response; see
+	// DiscoverExternalEndpoint.
+	stun stunRequests
+
+	// reaper removes idle peers in the background; see SetIdlePeerReaper.
+	reaper idlePeerReaper
+
 	ipcMutex sync.RWMutex
 	closed   chan struct{}
 	log      *Logger
@@ -106,10 +228,17 @@ type aSecConfType struct {
 	junkPacketMaxSize          int
 	initPacketJunkSize         int
 	responsePacketJunkSize     int
+	underloadPacketJunkSize    int
 	initPacketMagicHeader      uint32
 	responsePacketMagicHeader  uint32
 	underloadPacketMagicHeader uint32
 	transportPacketMagicHeader uint32
+	// junkTransportPacketCount is the number of transport packets after which
+	// a junk packet starting with junkTransportPacketMagicHeader is sent (0 = never).
+	junkTransportPacketCount       int
+	junkTransportPacketMagicHeader uint32
+	// junkTiming selects when the junk packets of an initiation are sent.
+	junkTiming junkTiming
 }
 
 // deviceState represents the state of a Device.
@@ -128,6 +257,15 @@ const (
 	deviceStateClosed
 )
 
+// stateEventsSize is the number of state events buffered for StateEvents.
+const stateEventsSize = 8
+
+// A DeviceStateEvent describes a transition of the device from Old to New.
+type DeviceStateEvent struct {
+	Old deviceState
+	New deviceState
+}
+
 // deviceState returns device.state.state as a deviceState
 // See those docs for how to interpret this value.
 func (device *Device) deviceState() deviceState {
@@ -151,6 +289,7 @@ func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 	device.allowedips.RemoveByPeer(peer)
 	peer.Stop()
+	peer.stopEndpointHostname(true)
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
@@ -166,6 +305,12 @@ func (device *Device) changeState(want deviceState) (err error) {
 		device.log.Verbosef("Interface closed, ignored requested state %s", want)
 		return nil
 	}
+	// Peers added by an IPC set operation are started only if the device is up
+	// once they have been created, so hold off any concurrent operation until the
+	// transition is complete; otherwise a peer could be started on a device that
+	// is going down, or be missed by one that is coming up.
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
 	switch want {
 	case old:
 		return nil
@@ -184,27 +329,54 @@ func (device *Device) changeState(want deviceState) (err error) {
 		}
 	}
 	device.log.Verbosef("Interface state was %s, requested %s, now %s", old, want, device.deviceState())
+	device.notifyStateLocked(old, device.deviceState())
 
 	return
 }
 
+// StateEvents returns a channel that receives an event each time the device
+// changes state. The channel is buffered; if the receiver falls behind,
+// the oldest undelivered events are dropped. After the final transition
+// to deviceStateClosed has been delivered, the channel is closed.
+// All callers share the same channel.
+func (device *Device) StateEvents() <-chan DeviceStateEvent {
+	return device.state.events
+}
+
+// notifyStateLocked delivers a DeviceStateEvent if old and new differ,
+// discarding the oldest pending event rather than blocking when the buffer is full.
+// The caller must hold device.state.mu.
+func (device *Device) notifyStateLocked(old, new deviceState) {
+	if old == new {
+		return
+	}
+	event := DeviceStateEvent{Old: old, New: new}
+	for {
+		select {
+		case device.state.events <- event:
+			return
+		default:
+		}
+		select {
+		case <-device.state.events:
+		default:
+		}
+	}
+}
+
 // upLocked attempts to bring the device up and reports whether it succeeded.
-// The caller must hold device.state.mu and is responsible for updating device.state.state.
+// The caller must hold device.state.mu and device.ipcMutex,
+// and is responsible for updating device.state.state.
 func (device *Device) upLocked() error {
 	if err := device.BindUpdate(); err != nil {
 		device.log.Errorf("Unable to update bind: %v", err)
 		return err
 	}
 
-	// The IPC set operation waits for peers to be created before calling Start() on them,
-	// so if there's a concurrent IPC set request happening, we should wait for it to complete.
-	device.ipcMutex.Lock()
-	defer device.ipcMutex.Unlock()
-
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.Start()
-		if peer.persistentKeepaliveInterval.Load() > 0 {
+		if peer.persistentKeepaliveOn() {
 			peer.SendKeepalive()
 		}
 	}
@@ -213,7 +385,8 @@ func (device *Device) upLocked() error {
 }
 
 // downLocked attempts to bring the device down.
-// The caller must hold device.state.mu and is responsible for updating device.state.state.
+// The caller must hold device.state.mu and device.ipcMutex,
+// and is responsible for updating device.state.state.
 func (device *Device) downLocked() error {
 	err := device.BindClose()
 	if err != nil {
@@ -228,6 +401,10 @@ func (device *Device) downLocked() error {
 	return err
 }
 
+// Up brings the device up, opening the sockets of its bind. If they cannot be
+// opened, the device is left down, and the error matches conn.ErrPortInUse,
+// conn.ErrPermissionDenied or conn.ErrAddressFamilyUnavailable with errors.Is
+// if the failure has one of those reasons.
 func (device *Device) Up() error {
 	return device.changeState(deviceStateUp)
 }
@@ -236,18 +413,179 @@ func (device *Device) Down() error {
 	return device.changeState(deviceStateDown)
 }
 
+// SetHandshakeTimeouts overrides how long to wait for a response to a handshake
+// initiation before retrying (RekeyTimeout by default), and how long to keep
+// retrying before giving up (RekeyAttemptTime by default).
+// Passing zero for both restores the defaults.
+func (device *Device) SetHandshakeTimeouts(rekeyTimeout, rekeyAttemptTime time.Duration) error {
+	if rekeyTimeout == 0 && rekeyAttemptTime == 0 {
+		rekeyTimeout, rekeyAttemptTime = RekeyTimeout, RekeyAttemptTime
+	}
+	if rekeyTimeout <= 0 || rekeyTimeout >= rekeyAttemptTime {
+		return fmt.Errorf("invalid handshake timeouts: rekey timeout %v must be positive and less than rekey attempt time %v", rekeyTimeout, rekeyAttemptTime)
+	}
+	device.handshakeTimeouts.rekeyTimeout.Store(int64(rekeyTimeout))
+	device.handshakeTimeouts.rekeyAttemptTime.Store(int64(rekeyAttemptTime))
+	return nil
+}
+
+// rekeyTimeout returns the time to wait for a handshake response before retrying.
+func (device *Device) rekeyTimeout() time.Duration {
+	if timeout := device.handshakeTimeouts.rekeyTimeout.Load(); timeout != 0 {
+		return time.Duration(timeout)
+	}
+	return RekeyTimeout
+}
+
+// rekeyAttemptTime returns how long to keep retrying a handshake before giving up.
+func (device *Device) rekeyAttemptTime() time.Duration {
+	if attemptTime := device.handshakeTimeouts.rekeyAttemptTime.Load(); attemptTime != 0 {
+		return time.Duration(attemptTime)
+	}
+	return RekeyAttemptTime
+}
+
+// maxTimerHandshakes returns the number of handshake retransmissions
+// after which the timers give up.
+func (device *Device) maxTimerHandshakes() uint32 {
+	timeout, attemptTime := device.handshakeTimeouts.rekeyTimeout.Load(), device.handshakeTimeouts.rekeyAttemptTime.Load()
+	if timeout == 0 || attemptTime == 0 {
+		return MaxTimerHandshakes
+	}
+	return uint32(attemptTime / timeout)
+}
+
+// minCookieRotationInterval is the shortest interval accepted by
+// SetCookieRotationInterval. An initiator answered with a cookie reply retries
+// its handshake only after RekeyTimeout, so a secret must outlive at least that.
+const minCookieRotationInterval = 2 * RekeyTimeout
+
+// SetCookieRotationInterval sets how often the secret from which cookies are
+// derived is replaced, CookieRefreshTime by default. Passing zero restores
+// the default.
+// Shorter intervals reduce the window in which a cookie can be reused, but
+// invalidate the cookies held by initiators more often, so that more of their
+// handshakes are answered with a fresh cookie reply while under load.
+func (device *Device) SetCookieRotationInterval(d time.Duration) error {
+	if d != 0 && d < minCookieRotationInterval {
+		return fmt.Errorf("invalid cookie rotation interval %v: must be at least %v", d, minCookieRotationInterval)
+	}
+	device.cookieChecker.SetRefreshTime(d)
+	return nil
+}
+
+// SetKeepaliveJitter adds a random delay in [0, max) to every persistent keepalive,
+// drawn anew each time the keepalive timer is armed, so that peers sharing an
+// interval do not send their keepalives in lockstep. A max of 0 disables jitter.
+func (device *Device) SetKeepaliveJitter(max time.Duration) {
+	device.keepaliveJitterMax.Store(int64(max))
+}
+
+// SetKeepalivesEnabled enables or disables persistent keepalives for all
+// peers, for example to save battery on mobile devices. While disabled, no
+// persistent keepalives are sent, whatever the peers' configured intervals,
+// which are kept: once re-enabled, each running peer with an interval sends a
+// keepalive right away and the timers resume.
+// Keepalives that acknowledge received data are not affected.
+func (device *Device) SetKeepalivesEnabled(enabled bool) {
+	wasDisabled := device.keepalivesDisabled.Swap(!enabled)
+	if !enabled || !wasDisabled || !device.isUp() {
+		return
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if peer.persistentKeepaliveOn() {
+			peer.SendKeepalive()
+		}
+	}
+}
+
+// SetUnderLoadThreshold sets when the device is considered under load and
+// starts answering handshakes with cookie replies: once the handshake queue
+// is filled to queueFraction of its capacity (1/8 by default), and for after
+// since it last was (UnderLoadAfterTime by default). queueFraction must be in
+// (0, 1] and after positive. Passing zero for both restores the defaults.
+func (device *Device) SetUnderLoadThreshold(queueFraction float64, after time.Duration) error {
+	if queueFraction == 0 && after == 0 {
+		device.rate.underLoadQueueLen.Store(0)
+		device.rate.underLoadAfter.Store(0)
+		return nil
+	}
+	if !(queueFraction > 0 && queueFraction <= 1) || after <= 0 {
+		return fmt.Errorf("invalid under load threshold: queue fraction %v must be in (0, 1] and duration %v positive", queueFraction, after)
+	}
+	queueLen := int64(queueFraction * QueueHandshakeSize)
+	if queueLen < 1 {
+		queueLen = 1
+	}
+	device.rate.underLoadQueueLen.Store(queueLen)
+	device.rate.underLoadAfter.Store(int64(after))
+	return nil
+}
+
+// SetRateLimitAllowlist exempts handshakes from sources within prefixes from
+// the rate limiter applied while the device is under load, so that a flood
+// from other sources cannot starve trusted peers such as a hub. Such
+// handshakes must still carry a valid cookie. A nil or empty prefixes clears
+// the allowlist.
+func (device *Device) SetRateLimitAllowlist(prefixes []netip.Prefix) {
+	if len(prefixes) == 0 {
+		device.rate.allowlist.Store(nil)
+		return
+	}
+	masked := make([]netip.Prefix, len(prefixes))
+	for i, prefix := range prefixes {
+		masked[i] = prefix.Masked()
+	}
+	device.rate.allowlist.Store(&masked)
+}
+
+// rateLimitAllowed reports whether handshakes from ip bypass the rate limiter.
+func (device *Device) rateLimitAllowed(ip netip.Addr) bool {
+	allowlist := device.rate.allowlist.Load()
+	if allowlist == nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range *allowlist {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// underLoadThreshold returns the handshake queue length at which the device
+// is under load, and how long it remains so.
+func (device *Device) underLoadThreshold() (queueLen int, after time.Duration) {
+	queueLen, after = QueueHandshakeSize/8, UnderLoadAfterTime
+	if n := device.rate.underLoadQueueLen.Load(); n != 0 {
+		queueLen = int(n)
+	}
+	if d := device.rate.underLoadAfter.Load(); d != 0 {
+		after = time.Duration(d)
+	}
+	return
+}
+
 func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
 	now := time.Now()
-	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
+	queueLen, after := device.underLoadThreshold()
+	underLoad := len(device.queue.handshake.c) >= queueLen
 	if underLoad {
-		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
+		device.rate.underLoadUntil.Store(now.Add(after).UnixNano())
 		return true
 	}
 	// check if recently under load
 	return device.rate.underLoadUntil.Load() > now.UnixNano()
 }
 
+// SetPrivateKey sets the private key of the device. Peers whose public key
+// is the new public key are removed. The current sessions of the other peers
+// are expired if their precomputed static-static secret changed, and kept
+// otherwise.
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// lock required resources
 
@@ -284,13 +622,17 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
 
-	// do static-static DH pre-computations
+	// do static-static DH pre-computations, and expire the sessions of
+	// the peers whose shared secret changed
 
 	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
 	for _, peer := range device.peers.keyMap {
 		handshake := &peer.handshake
-		handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
-		expiredPeers = append(expiredPeers, peer)
+		ss, _ := device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
+		if subtle.ConstantTimeCompare(ss[:], handshake.precomputedStaticStatic[:]) != 1 {
+			expiredPeers = append(expiredPeers, peer)
+		}
+		handshake.precomputedStaticStatic = ss
 	}
 
 	for _, peer := range lockedPeers {
@@ -303,9 +645,50 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	return nil
 }
 
+// RotatePrivateKey sets the private key of the device, as SetPrivateKey does,
+// and initiates a handshake with every remaining peer right away, so that the
+// tunnels move to the new key without waiting for data to trigger a rekey.
+// Peers removed because their public key is the new public key are not
+// handshaked with, and nothing is sent if the key is unchanged. Handshakes
+// that cannot be sent, for example because the device is down or a peer has
+// no endpoint, are logged and left to the usual triggers.
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey) error {
+	if device.isClosed() {
+		return ErrDeviceClosed
+	}
+
+	device.ipcMutex.Lock()
+	device.staticIdentity.RLock()
+	unchanged := sk.Equals(device.staticIdentity.privateKey)
+	device.staticIdentity.RUnlock()
+	if unchanged {
+		device.ipcMutex.Unlock()
+		return nil
+	}
+	if err := device.SetPrivateKey(sk); err != nil {
+		device.ipcMutex.Unlock()
+		return err
+	}
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+	device.ipcMutex.Unlock()
+
+	for _, peer := range peers {
+		if err := peer.InitiateHandshake(); err != nil {
+			device.log.Verbosef("%v - Failed to initiate handshake after key rotation: %v", peer, err)
+		}
+	}
+	return nil
+}
+
 func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device := new(Device)
 	device.state.state.Store(uint32(deviceStateDown))
+	device.state.events = make(chan DeviceStateEvent, stateEventsSize)
 	device.closed = make(chan struct{})
 	device.log = logger
 	device.net.bind = bind
@@ -315,6 +698,10 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 		device.log.Errorf("Trouble determining MTU, assuming default: %v", err)
 		mtu = DefaultMTU
 	}
+	if mtu > MaxContentSize {
+		device.log.Errorf("MTU %v too large, capped at %v", mtu, MaxContentSize)
+		mtu = MaxContentSize
+	}
 	device.tun.mtu.Store(int32(mtu))
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.rate.limiter.Init()
@@ -327,6 +714,8 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.queue.handshake = newHandshakeQueue()
 	device.queue.encryption = newOutboundQueue()
 	device.queue.decryption = newInboundQueue()
+	device.scheduler.init()
+	device.log.Verbosef("Crypto: %s", cryptoImplementation())
 
 	// start workers
 
@@ -367,7 +756,115 @@ func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	return device.peers.keyMap[pk]
 }
 
+// Peers returns a snapshot of the public keys of all configured peers,
+// in no particular order.
+func (device *Device) Peers() []NoisePublicKey {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	keys := make([]NoisePublicKey, 0, len(device.peers.keyMap))
+	for key := range device.peers.keyMap {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ForEachPeer calls fn for each configured peer, in no particular order,
+// until fn returns false. Unlike Peers, it allocates no snapshot.
+//
+// fn is called with the peer list locked for reading, so that no peer is
+// added or removed meanwhile. It must not call methods that lock the peer
+// list, whether device methods such as IpcSet, NewPeer, RemovePeer or
+// LookupPeer or peer methods such as AddAllowedIP: with a writer waiting
+// for the lock, they deadlock. Nor must fn block for long, since it holds
+// back changes to the peer list.
+func (device *Device) ForEachPeer(fn func(pk NoisePublicKey, peer *Peer) bool) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for key, peer := range device.peers.keyMap {
+		if !fn(key, peer) {
+			return
+		}
+	}
+}
+
+// UpdateEndpoint parses endpoint and sets it as the endpoint of the peer with public key pk.
+func (device *Device) UpdateEndpoint(pk NoisePublicKey, endpoint string) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return fmt.Errorf("no peer with public key %x", pk[:])
+	}
+	device.net.RLock()
+	ep, err := device.net.bind.ParseEndpoint(endpoint)
+	device.net.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to parse endpoint %v: %w", endpoint, err)
+	}
+	device.log.Verbosef("%v - Updating endpoint", peer)
+	return peer.SetEndpoint(ep)
+}
+
+// Handshake sends a handshake initiation to the peer with public key pk
+// right away, as with Peer.InitiateHandshake.
+func (device *Device) Handshake(pk NoisePublicKey) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return fmt.Errorf("no peer with public key %x", pk[:])
+	}
+	return peer.InitiateHandshake()
+}
+
+// LookupRoute reports the public key of the peer that packets destined to ip
+// are routed to, using the same longest-prefix match as the data path.
+// It returns false if no peer's allowed IPs cover ip.
+func (device *Device) LookupRoute(ip netip.Addr) (NoisePublicKey, bool) {
+	var peer *Peer
+	switch {
+	case ip.Is4():
+		ip4 := ip.As4()
+		peer = device.allowedips.Lookup(ip4[:])
+	case ip.Is6():
+		ip6 := ip.As16()
+		peer = device.allowedips.Lookup(ip6[:])
+	}
+	if peer == nil {
+		return NoisePublicKey{}, false
+	}
+	peer.handshake.mutex.RLock()
+	defer peer.handshake.mutex.RUnlock()
+	return peer.handshake.remoteStatic, true
+}
+
+// PeerCount returns the number of configured peers.
+func (device *Device) PeerCount() int {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	return len(device.peers.keyMap)
+}
+
+// SetMaxPeers limits the number of peers of the device to n, to bound its
+// memory use. Adding a peer beyond the limit, through IpcSet or any other
+// means, fails with a "peer limit reached" error and creates no peer. Peers
+// already configured are kept if they exceed a lowered limit, but none can be
+// added until their number falls below it. Zero or a negative n removes the
+// limit, leaving only MaxPeers.
+func (device *Device) SetMaxPeers(n int) {
+	device.peers.Lock()
+	defer device.peers.Unlock()
+	device.peers.max = max(n, 0)
+}
+
 func (device *Device) RemovePeer(key NoisePublicKey) {
+	device.RemovePeerOK(key)
+}
+
+// RemovePeerOK removes the peer with public key key like RemovePeer and
+// reports whether there was such a peer to remove. Unlike calling LookupPeer
+// first, the check and the removal are atomic, so when several goroutines
+// remove the same peer, exactly one of them gets true.
+func (device *Device) RemovePeerOK(key NoisePublicKey) bool {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 	// stop peer and remove from routing
@@ -376,6 +873,51 @@ func (device *Device) RemovePeer(key NoisePublicKey) {
 	if ok {
 		removePeerLocked(device, peer, key)
 	}
+	return ok
+}
+
+// RemovePeerGraceful removes the peer with public key key like RemovePeer,
+// but first lets packets already queued for the peer be sent.
+// The peer's allowed IPs are removed at once, so that no new packets are
+// routed to it, and then up to drain is spent waiting for its queues to empty.
+// If they are still not empty once drain has passed, for example because no
+// session could be established, the remaining packets are dropped and the peer
+// is removed immediately, as with RemovePeer. Configuration changes wait for
+// the removal to finish, and a peer added under key by other means meanwhile
+// is left in place.
+func (device *Device) RemovePeerGraceful(key NoisePublicKey, drain time.Duration) error {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	peer := device.LookupPeer(key)
+	if peer == nil {
+		return fmt.Errorf("no peer with public key %x", key[:])
+	}
+	device.allowedips.RemoveByPeer(peer)
+
+	timer := time.NewTimer(drain)
+	defer timer.Stop()
+wait:
+	for {
+		drained := device.drained.wait()
+		if !peer.isRunning.Load() || len(peer.queue.staged) == 0 && peer.queue.pending.Load() == 0 {
+			break
+		}
+		peer.SendStagedPackets()
+		select {
+		case <-drained:
+		case <-timer.C:
+			device.log.Verbosef("%v - Dropping queued packets after %v", peer, drain)
+			break wait
+		}
+	}
+
+	device.peers.Lock()
+	defer device.peers.Unlock()
+	if device.peers.keyMap[key] == peer {
+		removePeerLocked(device, peer, key)
+	}
+	return nil
 }
 
 func (device *Device) RemoveAllPeers() {
@@ -389,6 +931,30 @@ func (device *Device) RemoveAllPeers() {
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 }
 
+// ResetCounters zeroes the transfer counters of every peer, and those of the
+// device returned by TotalBytes.
+// Handshake times and keypairs are left untouched, and the counters keep
+// counting from zero right away.
+func (device *Device) ResetCounters() {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.txBytes.Store(0)
+		peer.rxBytes.Store(0)
+	}
+	device.txBytes.Store(0)
+	device.rxBytes.Store(0)
+}
+
+// TotalBytes returns the number of bytes received from and sent to all peers,
+// counted like the rx_bytes and tx_bytes of each peer, without iterating over
+// them. The totals include the traffic of peers that have since been removed,
+// so that they never go backwards; only ResetCounters zeroes them.
+func (device *Device) TotalBytes() (rx, tx uint64) {
+	return device.rxBytes.Load(), device.txBytes.Load()
+}
+
 func (device *Device) Close() {
 	device.state.Lock()
 	defer device.state.Unlock()
@@ -397,15 +963,18 @@ func (device *Device) Close() {
 	if device.isClosed() {
 		return
 	}
+	old := device.deviceState()
 	device.state.state.Store(uint32(deviceStateClosed))
 	device.log.Verbosef("Device closing")
 
 	device.tun.device.Close()
+	device.wakePaused()
 	device.downLocked()
 
 	// Remove peers before closing queues,
 	// because peers assume that queues are active.
 	device.RemoveAllPeers()
+	device.stopScheduler()
 
 	// We kept a reference to the encryption and decryption queues,
 	// in case we started any new peers that might write to them.
@@ -419,6 +988,73 @@ func (device *Device) Close() {
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
+	device.notifyStateLocked(old, deviceStateClosed)
+	close(device.state.events)
+}
+
+// CloseGraceful closes the device like Close, but first gives the traffic in
+// flight a chance to reach the peers, for example when a server is being
+// decommissioned. It stops taking in packets from the TUN device, sends a
+// keepalive to every peer with a current session, so that the peers' last
+// handshake and receive times reflect the end of the tunnel, and spends up to
+// drain waiting for the packets already queued to be encrypted and sent.
+// Packets that are still queued once drain has passed, for example because no
+// session could be established, are dropped. Either way the device is then
+// closed with Close, so it is fully torn down when CloseGraceful returns.
+func (device *Device) CloseGraceful(drain time.Duration) {
+	if device.isClosed() {
+		return
+	}
+	device.draining.Store(true)
+	if device.isUp() {
+		device.log.Verbosef("Device draining")
+		device.SendKeepalivesToPeersWithCurrentKeypair()
+		timer := time.NewTimer(drain)
+	wait:
+		for {
+			drained := device.drained.wait()
+			if device.flushQueues() {
+				break
+			}
+			select {
+			case <-drained:
+			case <-timer.C:
+				device.log.Verbosef("Dropping queued packets after %v", drain)
+				break wait
+			}
+		}
+		timer.Stop()
+		// Stopping the peers before the bind is closed lets the packets
+		// their senders are sending go out.
+		device.peers.RLock()
+		for _, peer := range device.peers.keyMap {
+			peer.Stop()
+		}
+		device.peers.RUnlock()
+	}
+	device.Close()
+}
+
+// flushQueues hands the packets staged for the peers on to the encryption
+// queue, or has handshakes initiated for them, and reports whether no packets
+// are left queued for sending.
+func (device *Device) flushQueues() bool {
+	empty := true
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if !peer.isRunning.Load() {
+			continue
+		}
+		if len(peer.queue.staged) > 0 {
+			peer.SendStagedPackets()
+			empty = false
+		}
+		if peer.queue.pending.Load() > 0 {
+			empty = false
+		}
+	}
+	return empty
 }
 
 func (device *Device) Wait() chan struct{} {
@@ -432,10 +1068,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
-		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
-		peer.keypairs.RUnlock()
-		if sendKeepalive {
+		if peer.hasCurrentKeypair() {
 			peer.SendKeepalive()
 		}
 	}
@@ -449,11 +1082,17 @@ func closeBindLocked(device *Device) error {
 	netc := &device.net
 	if netc.netlinkCancel != nil {
 		netc.netlinkCancel.Cancel()
+		netc.netlinkCancel = nil
 	}
 	if netc.bind != nil {
 		err = netc.bind.Close()
 	}
+	// let receive routines held back by a pause see that they must stop
+	netc.closing.Store(true)
+	device.wakePaused()
 	netc.stopping.Wait()
+	netc.closing.Store(false)
+	netc.receiving.set(false, 0)
 	return err
 }
 
@@ -463,6 +1102,294 @@ func (device *Device) Bind() conn.Bind {
 	return device.net.bind
 }
 
+// ListenPort returns the port the bind is currently listening on.
+// When the bind was opened with port 0, this is the port chosen by the kernel.
+// It returns 0 if the device is not up, as the bind is closed then.
+func (device *Device) ListenPort() uint16 {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if !device.isUp() {
+		return 0
+	}
+	return device.net.port
+}
+
+// Fwmark returns the mark set with BindSetMark, or 0 if none is set.
+func (device *Device) Fwmark() uint32 {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.net.fwmark
+}
+
+// A BindConfig is a snapshot of the settings applied to the device's bind.
+type BindConfig struct {
+	Port             uint16               // listening port; the one chosen by the kernel once opened with 0
+	Fwmark           uint32               // mark value (0 = disabled)
+	Families         conn.AddressFamilies // address families the sockets are opened for
+	Interface        string               // interface the sockets are bound to ("" = any)
+	SocketBufferSize int                  // requested size of the sockets' buffers (0 = default)
+	NetworkNamespace string               // network namespace the sockets are opened in ("" = the process's)
+}
+
+// BindConfig returns the current settings of the device's bind, so that
+// callers can tell whether calling BindSetMark, BindUpdate or
+// SetAddressFamilies would change anything before reopening sockets.
+// Unlike ListenPort, it reports the port even while the device is down.
+func (device *Device) BindConfig() BindConfig {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	cfg := BindConfig{
+		Port:             device.net.port,
+		Fwmark:           device.net.fwmark,
+		Families:         device.net.families,
+		Interface:        device.net.ifname,
+		SocketBufferSize: device.net.bufferSize,
+		NetworkNamespace: device.net.netns,
+	}
+	if cfg.Families == 0 {
+		cfg.Families = conn.AddressFamiliesBoth
+	}
+	return cfg
+}
+
+// DisableStickySockets controls whether the route listener that keeps the
+// source addresses of peers' endpoints up to date on Linux is started.
+// Disabling it is useful where opening a netlink socket is not permitted,
+// such as in containers without CAP_NET_ADMIN. It takes effect the next
+// time the bind is opened.
+func (device *Device) DisableStickySockets(disable bool) {
+	device.net.Lock()
+	defer device.net.Unlock()
+	device.net.disableStickySockets = disable
+}
+
+// BindToInterface restricts the bind's sockets to the network interface called
+// name, so that packets to peers leave through it whatever the routing table
+// says. An empty name removes the restriction. The setting is applied again
+// whenever the bind is reopened, as by Rebind or BindUpdate.
+//
+// On Linux, conn.StdNetBind uses SO_BINDTODEVICE; on other platforms it
+// accepts the setting but ignores it. An error is returned if the bind does
+// not implement conn.InterfaceBinder.
+func (device *Device) BindToInterface(name string) error {
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	binder, ok := device.net.bind.(conn.InterfaceBinder)
+	if !ok {
+		return fmt.Errorf("bind of type %T does not support binding to an interface", device.net.bind)
+	}
+	if device.isUp() {
+		if err := binder.BindToInterface(name); err != nil {
+			return fmt.Errorf("failed to bind to interface %q: %w", name, err)
+		}
+	}
+	device.net.ifname = name
+	return nil
+}
+
+// SetAddressFamilies limits the bind's sockets to the IP address families in
+// families, for example to run on hosts where IPv4 or IPv6 sockets fail.
+// If the device is up, the bind is reopened for the setting to take effect.
+// An error is returned if the bind does not implement
+// conn.AddressFamilySelector or rejects families.
+func (device *Device) SetAddressFamilies(families conn.AddressFamilies) error {
+	device.net.RLock()
+	selector, ok := device.net.bind.(conn.AddressFamilySelector)
+	device.net.RUnlock()
+	if !ok {
+		return fmt.Errorf("bind of type %T does not support selecting address families", device.net.bind)
+	}
+	if err := selector.SetAddressFamilies(families); err != nil {
+		return err
+	}
+	device.net.Lock()
+	device.net.families = families
+	device.net.Unlock()
+	return device.Rebind()
+}
+
+// SetSocketBufferSize sets the size of the receive and send buffers of the
+// bind's sockets, SO_RCVBUF and SO_SNDBUF, to absorb bursts of traffic that
+// would overflow the default buffers. A size of zero restores the default.
+// If the device is up, the bind is reopened for the setting to take effect;
+// it is applied again whenever the bind is reopened, and the sizes actually
+// obtained, which the operating system may clamp, are logged.
+// An error is returned if the bind does not implement conn.SocketBufferSizer
+// or rejects size.
+func (device *Device) SetSocketBufferSize(size int) error {
+	device.net.RLock()
+	sizer, ok := device.net.bind.(conn.SocketBufferSizer)
+	device.net.RUnlock()
+	if !ok {
+		return fmt.Errorf("bind of type %T does not support setting the socket buffer size", device.net.bind)
+	}
+	if err := sizer.SetSocketBufferSize(size); err != nil {
+		return err
+	}
+	device.net.Lock()
+	device.net.bufferSize = size
+	device.net.Unlock()
+	return device.Rebind()
+}
+
+// SetNetworkNamespace makes the bind open its sockets in the Linux network
+// namespace at path, such as /var/run/netns/NAME, so that the tunnel's
+// encrypted traffic goes through that namespace while the TUN device may live
+// in another one. A namespace held by a file descriptor FD is at
+// /proc/self/fd/FD. An empty path restores the namespace of the process.
+// If the device is up, the bind is reopened for the setting to take effect.
+// It requires CAP_SYS_ADMIN. Network namespaces are specific to Linux: on
+// other platforms conn.StdNetBind accepts the setting but ignores it.
+// An error is returned if the bind does not implement
+// conn.NetworkNamespaceSetter or path is not a namespace it can open.
+func (device *Device) SetNetworkNamespace(path string) error {
+	device.net.RLock()
+	setter, ok := device.net.bind.(conn.NetworkNamespaceSetter)
+	device.net.RUnlock()
+	if !ok {
+		return fmt.Errorf("bind of type %T does not support setting the network namespace", device.net.bind)
+	}
+	if err := setter.SetNetworkNamespace(path); err != nil {
+		return err
+	}
+	device.net.Lock()
+	device.net.netns = path
+	device.net.Unlock()
+	return device.Rebind()
+}
+
+// BindFDs returns the file descriptors of the bind's open sockets, for
+// handing them over to a new process that adopts them with
+// conn.NewBindFromFDs, keeping the listening port across a restart. A bind
+// listening on both IPv4 and IPv6 has a socket for each, and both must be
+// handed over for the new process to keep serving both.
+// The descriptors remain owned by the bind: they are closed when the device
+// goes down or its bind is updated. Duplicate them before wrapping them in an
+// *os.File, for example to pass them in exec.Cmd.ExtraFiles, as the file
+// closes its descriptor when it is closed or garbage collected, which would
+// close the bind's socket under it. An error is returned if the bind does not
+// implement conn.FDExporter or is not open.
+func (device *Device) BindFDs() ([]uintptr, error) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	exporter, ok := device.net.bind.(conn.FDExporter)
+	if !ok {
+		return nil, fmt.Errorf("bind of type %T does not support exporting its file descriptors", device.net.bind)
+	}
+	return exporter.FDs()
+}
+
+// BindFD returns the file descriptor of the bind's first open socket, the
+// IPv4 one if it has both, like BindFDs. A bind listening on both IPv4 and
+// IPv6 only keeps serving both if BindFDs hands over both sockets.
+func (device *Device) BindFD() (uintptr, error) {
+	fds, err := device.BindFDs()
+	if err != nil {
+		return 0, err
+	}
+	return fds[0], nil
+}
+
+// SetEndpointErrorHandler sets fn to be called when a datagram sent to a
+// peer's endpoint is rejected, typically by an ICMP port unreachable message
+// from a host on which nothing listens on the peer's port. This lets the caller
+// try an alternate endpoint without waiting for the handshake to time out.
+// The error passed to fn is a *conn.EndpointError. Passing nil removes the
+// handler.
+//
+// Errors are only reported by binds implementing conn.EndpointErrorReporter.
+// conn.StdNetBind supports it on Linux and Android only; on other platforms
+// fn is never called. ICMP messages are not authenticated, so an error is a
+// hint rather than proof that the endpoint is unreachable, and at most 10
+// errors per second are handled so that a flood of them costs little.
+// fn is called from the receive routines and must not block.
+func (device *Device) SetEndpointErrorHandler(fn func(NoisePublicKey, error)) {
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if fn == nil {
+		device.endpointErrorHandler.Store(nil)
+	} else {
+		device.endpointErrorHandler.Store(&fn)
+	}
+	if reporter, ok := device.net.bind.(conn.EndpointErrorReporter); ok {
+		if err := reporter.SetReportEndpointErrors(fn != nil); err != nil {
+			device.log.Verbosef("Unable to report endpoint errors: %v", err)
+		}
+	}
+}
+
+// Endpoint errors are handled at most endpointErrorBurst times per
+// endpointErrorInterval: the ICMP messages behind them are not authenticated,
+// and each one costs a scan of the peers.
+const (
+	endpointErrorBurst    = 10
+	endpointErrorInterval = time.Second
+)
+
+// allowEndpointError reports whether an endpoint error may be handled within
+// the current interval.
+func (device *Device) allowEndpointError() bool {
+	l := &device.endpointErrors
+	l.Lock()
+	defer l.Unlock()
+	if now := time.Now(); now.Sub(l.start) >= endpointErrorInterval {
+		l.start, l.handled = now, 0
+	}
+	if l.handled >= endpointErrorBurst {
+		return false
+	}
+	l.handled++
+	return true
+}
+
+// handleEndpointError calls the endpoint error handler for every peer whose
+// endpoint is err.Endpoint.
+func (device *Device) handleEndpointError(err *conn.EndpointError) {
+	fn := device.endpointErrorHandler.Load()
+	if fn == nil || !device.allowEndpointError() {
+		return
+	}
+	dst := err.Endpoint.DstToString()
+	device.log.Verbosef("Received error from endpoint %s: %v", dst, err.Err)
+
+	// Comparing the addresses first spares most peers formatting their
+	// endpoint.
+	ip := err.Endpoint.DstIP()
+	var keys []NoisePublicKey
+	device.peers.RLock()
+	for key, peer := range device.peers.keyMap {
+		peer.endpoint.Lock()
+		val := peer.endpoint.val
+		match := val != nil && val.DstIP() == ip && val.DstToString() == dst
+		peer.endpoint.Unlock()
+		if match {
+			keys = append(keys, key)
+		}
+	}
+	device.peers.RUnlock()
+
+	for _, key := range keys {
+		(*fn)(key, err)
+	}
+}
+
+// SetRoamingHook sets fn to be called whenever an authenticated packet from a
+// peer arrives from an endpoint other than the peer's current one, and the
+// peer's endpoint is updated to it. old is nil if the peer had no endpoint.
+// Passing nil removes the hook.
+//
+// fn is called on its own goroutine, so it may block, but calls for
+// successive changes are not ordered.
+func (device *Device) SetRoamingHook(fn func(pk NoisePublicKey, old, new conn.Endpoint)) {
+	if fn == nil {
+		device.roamingHook.Store(nil)
+	} else {
+		device.roamingHook.Store(&fn)
+	}
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -490,13 +1417,31 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
+// Rebind closes the bind and opens it again on the same port, for example
+// after a network change has left the sockets stale. Peers are left untouched,
+// except that their cached source addresses are cleared.
+// It does nothing if the device is not up.
+func (device *Device) Rebind() error {
+	device.state.Lock()
+	defer device.state.Unlock()
+	if !device.isUp() {
+		return nil
+	}
+	device.log.Verbosef("Rebinding")
+	return device.BindUpdate()
+}
+
 func (device *Device) BindUpdate() error {
 	device.net.Lock()
 	defer device.net.Unlock()
 
-	// close existing sockets
-	if err := closeBindLocked(device); err != nil {
-		return err
+	// close existing sockets; a bind that was not opened is left alone, as
+	// closing it would discard the sockets it may have adopted for its first
+	// Open
+	if device.net.receiving.isOpen() {
+		if err := closeBindLocked(device); err != nil {
+			return err
+		}
 	}
 
 	// open new sockets
@@ -512,21 +1457,45 @@ func (device *Device) BindUpdate() error {
 	recvFns, netc.port, err = netc.bind.Open(netc.port)
 	if err != nil {
 		netc.port = 0
-		return err
+		return conn.WrapOpenError(err)
 	}
 
-	netc.netlinkCancel, err = device.startRouteListener(netc.bind)
-	if err != nil {
-		netc.bind.Close()
-		netc.port = 0
-		return err
+	if !netc.disableStickySockets {
+		netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+		if err != nil {
+			netc.bind.Close()
+			netc.port = 0
+			return err
+		}
 	}
 
 	// set fwmark
 	if netc.fwmark != 0 {
 		err = netc.bind.SetMark(netc.fwmark)
 		if err != nil {
-			return err
+			return conn.WrapOpenError(err)
+		}
+	}
+
+	// bind to interface
+	if netc.ifname != "" {
+		if binder, ok := netc.bind.(conn.InterfaceBinder); ok {
+			err = binder.BindToInterface(netc.ifname)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// report the socket buffer sizes obtained
+	if netc.bufferSize != 0 {
+		if sizer, ok := netc.bind.(conn.SocketBufferSizer); ok {
+			recv, send, err := sizer.SocketBufferSizes()
+			if err != nil {
+				device.log.Verbosef("Unable to get socket buffer sizes: %v", err)
+			} else {
+				device.log.Verbosef("Socket buffer size %d requested, got %d for receiving and %d for sending", netc.bufferSize, recv, send)
+			}
 		}
 	}
 
@@ -542,6 +1511,7 @@ func (device *Device) BindUpdate() error {
 	device.queue.decryption.cn.Add(len(recvFns)) // each RoutineReceiveIncoming goroutine writes to device.queue.decryption
 	device.queue.handshake.cn.Add(len(recvFns))  // each RoutineReceiveIncoming goroutine writes to device.queue.handshake
 	batchSize := netc.bind.BatchSize()
+	netc.receiving.set(true, len(recvFns))
 	for _, fn := range recvFns {
 		go device.RoutineReceiveIncoming(batchSize, fn)
 	}
@@ -561,237 +1531,274 @@ func (device *Device) isAdvancedSecurityOn() bool {
 	return device.isASecOn.IsSet()
 }
 
-func (device *Device) handlePostConfig(tempASecConf *aSecConfType) (err error) {
+// AdvancedSecurity reports whether advanced security is on and returns the
+// parameters in effect. These can differ from the configured ones: the junk
+// packet maximum size is raised above the minimum if they were equal, and the
+// magic headers are the message types actually sent, which are the defaults
+// for headers that were not set.
+func (device *Device) AdvancedSecurity() (on bool, conf ASecConfig) {
+	device.aSecMux.RLock()
+	defer device.aSecMux.RUnlock()
+
+	conf = device.aSecConf.toASecConfig()
+	conf.InitPacketMagicHeader, conf.ResponsePacketMagicHeader,
+		conf.UnderloadPacketMagicHeader, conf.TransportPacketMagicHeader = device.aSecConf.messageTypes()
+	return device.isAdvancedSecurityOn(), conf
+}
 
-	if !tempASecConf.isSet {
-		return err
+// ValidateASecConf checks an advanced security configuration without
+// applying it. It reports the same errors as a UAPI "set" operation would.
+func ValidateASecConf(conf ASecConfig) error {
+	aSecConf := conf.toASecConfType()
+	return aSecConf.validate()
+}
+
+// chainIpcErrorf returns a new invalid-configuration error, wrapping err
+// if it is not nil.
+func chainIpcErrorf(err error, format string, args ...any) error {
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, format+"; %w", append(args, err)...)
 	}
+	return ipcErrorf(ipc.IpcErrorInvalid, format, args...)
+}
 
-	isASecOn := false
-	device.aSecMux.Lock()
-	if tempASecConf.junkPacketCount < 0 {
+// effectiveJunkPacketMaxSize returns the maximum junk packet size that is
+// actually used, which must be strictly greater than the minimum.
+func (conf *aSecConfType) effectiveJunkPacketMaxSize() int {
+	if conf.junkPacketCount > 0 && conf.junkPacketMaxSize == conf.junkPacketMinSize {
+		return conf.junkPacketMaxSize + 1
+	}
+	return conf.junkPacketMaxSize
+}
+
+// messageTypes returns the message types that conf selects, falling back
+// to the default type for every magic header that is not set.
+func (conf *aSecConfType) messageTypes() (initiation, response, cookieReply, transport uint32) {
+	magicHeader := func(header, def uint32) uint32 {
+		if header > 4 {
+			return header
+		}
+		return def
+	}
+	return magicHeader(conf.initPacketMagicHeader, defaultMessageInitiationType),
+		magicHeader(conf.responsePacketMagicHeader, defaultMessageResponseType),
+		magicHeader(conf.underloadPacketMagicHeader, defaultMessageCookieReplyType),
+		magicHeader(conf.transportPacketMagicHeader, defaultMessageTransportType)
+}
+
+// validate reports every problem with conf, chained into a single error.
+func (conf *aSecConfType) validate() (err error) {
+	if conf.junkPacketCount < 0 {
 		err = ipcErrorf(
 			ipc.IpcErrorInvalid,
 			"JunkPacketCount should be non negative",
 		)
 	}
-	device.aSecConf.junkPacketCount = tempASecConf.junkPacketCount
-	if tempASecConf.junkPacketCount != 0 {
-		isASecOn = true
-	}
 
-	device.aSecConf.junkPacketMinSize = tempASecConf.junkPacketMinSize
-	if tempASecConf.junkPacketMinSize != 0 {
-		isASecOn = true
+	if conf.junkTransportPacketCount < 0 {
+		err = chainIpcErrorf(
+			err,
+			"JunkTransportPacketCount should be non negative",
+		)
+	} else if conf.junkTransportPacketCount > 0 && conf.junkTransportPacketMagicHeader == 0 {
+		err = chainIpcErrorf(
+			err,
+			"JunkTransportPacketMagicHeader should be set when JunkTransportPacketCount is set",
+		)
 	}
 
-	if device.aSecConf.junkPacketCount > 0 &&
-		tempASecConf.junkPacketMaxSize == tempASecConf.junkPacketMinSize {
-
-		tempASecConf.junkPacketMaxSize++ 
+	switch timing := conf.junkTiming; {
+	case timing.mode == junkTimingInvalid:
+		err = chainIpcErrorf(
+			err,
+			"JunkTiming should be before, after or spread(duration)",
+		)
+	case timing.mode == junkTimingSpread && (timing.window < time.Microsecond || timing.window > maxJunkTimingSpread):
+		err = chainIpcErrorf(
+			err,
+			"JunkTiming: spread window %v; should be between 1µs and %v",
+			timing.window,
+			maxJunkTimingSpread,
+		)
 	}
 
-	if tempASecConf.junkPacketMaxSize >= MaxSegmentSize {
-		device.aSecConf.junkPacketMinSize = 0
-		device.aSecConf.junkPacketMaxSize = 1
-		if err != nil {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				"JunkPacketMaxSize: %d; should be smaller than maxSegmentSize: %d; %w",
-				tempASecConf.junkPacketMaxSize,
-				MaxSegmentSize,
-				err,
-			)
-		} else {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				"JunkPacketMaxSize: %d; should be smaller than maxSegmentSize: %d",
-				tempASecConf.junkPacketMaxSize,
-				MaxSegmentSize,
-			)
-		}
-	} else if tempASecConf.junkPacketMaxSize < tempASecConf.junkPacketMinSize {
-		if err != nil {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				"maxSize: %d; should be greater than minSize: %d; %w",
-				tempASecConf.junkPacketMaxSize,
-				tempASecConf.junkPacketMinSize,
-				err,
-			)
-		} else {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				"maxSize: %d; should be greater than minSize: %d",
-				tempASecConf.junkPacketMaxSize,
-				tempASecConf.junkPacketMinSize,
-			)
-		}
-	} else {
-		device.aSecConf.junkPacketMaxSize = tempASecConf.junkPacketMaxSize
+	junkPacketMaxSize := conf.effectiveJunkPacketMaxSize()
+	if junkPacketMaxSize >= MaxSegmentSize {
+		err = chainIpcErrorf(
+			err,
+			"JunkPacketMaxSize: %d; should be smaller than maxSegmentSize: %d",
+			junkPacketMaxSize,
+			MaxSegmentSize,
+		)
+	} else if junkPacketMaxSize < conf.junkPacketMinSize {
+		err = chainIpcErrorf(
+			err,
+			"maxSize: %d; should be greater than minSize: %d",
+			junkPacketMaxSize,
+			conf.junkPacketMinSize,
+		)
 	}
 
-	if tempASecConf.junkPacketMaxSize != 0 {
-		isASecOn = true
+	if MessageInitiationSize+conf.initPacketJunkSize >= MaxSegmentSize {
+		err = chainIpcErrorf(
+			err,
+			`init header size(148) + junkSize:%d; should be smaller than maxSegmentSize: %d`,
+			conf.initPacketJunkSize,
+			MaxSegmentSize,
+		)
 	}
 
-	if MessageInitiationSize+tempASecConf.initPacketJunkSize >= MaxSegmentSize {
-		if err != nil {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`init header size(148) + junkSize:%d; should be smaller than maxSegmentSize: %d; %w`,
-				tempASecConf.initPacketJunkSize,
-				MaxSegmentSize,
-				err,
-			)
-		} else {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`init header size(148) + junkSize:%d; should be smaller than maxSegmentSize: %d`,
-				tempASecConf.initPacketJunkSize,
-				MaxSegmentSize,
-			)
-		}
-	} else {
-		device.aSecConf.initPacketJunkSize = tempASecConf.initPacketJunkSize
+	if MessageResponseSize+conf.responsePacketJunkSize >= MaxSegmentSize {
+		err = chainIpcErrorf(
+			err,
+			`response header size(92) + junkSize:%d; should be smaller than maxSegmentSize: %d`,
+			conf.responsePacketJunkSize,
+			MaxSegmentSize,
+		)
 	}
 
-	if tempASecConf.initPacketJunkSize != 0 {
-		isASecOn = true
+	if conf.underloadPacketJunkSize < 0 {
+		err = chainIpcErrorf(
+			err,
+			"UnderloadPacketJunkSize: %d; should be non negative",
+			conf.underloadPacketJunkSize,
+		)
+	} else if MessageCookieReplySize+conf.underloadPacketJunkSize >= MaxSegmentSize {
+		err = chainIpcErrorf(
+			err,
+			`cookie reply header size(64) + junkSize:%d; should be smaller than maxSegmentSize: %d`,
+			conf.underloadPacketJunkSize,
+			MaxSegmentSize,
+		)
 	}
 
-	if MessageResponseSize+tempASecConf.responsePacketJunkSize >= MaxSegmentSize {
-		if err != nil {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`response header size(92) + junkSize:%d; should be smaller than maxSegmentSize: %d; %w`,
-				tempASecConf.responsePacketJunkSize,
-				MaxSegmentSize,
-				err,
-			)
-		} else {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`response header size(92) + junkSize:%d; should be smaller than maxSegmentSize: %d`,
-				tempASecConf.responsePacketJunkSize,
-				MaxSegmentSize,
-			)
-		}
-	} else {
-		device.aSecConf.responsePacketJunkSize = tempASecConf.responsePacketJunkSize
-	}
+	initiation, response, cookieReply, transport := conf.messageTypes()
+	isSameMap := map[uint32]bool{}
+	isSameMap[initiation] = true
+	isSameMap[response] = true
+	isSameMap[cookieReply] = true
+	isSameMap[transport] = true
 
-	if tempASecConf.responsePacketJunkSize != 0 {
-		isASecOn = true
+	if len(isSameMap) != 4 {
+		err = chainIpcErrorf(
+			err,
+			`magic headers should differ; got: init:%d; recv:%d; unde:%d; tran:%d`,
+			initiation,
+			response,
+			cookieReply,
+			transport,
+		)
+	} else if junk := conf.junkTransportPacketMagicHeader; junk != 0 && isSameMap[junk] {
+		err = chainIpcErrorf(
+			err,
+			`junk transport magic header:%d; should differ from init:%d; recv:%d; unde:%d; tran:%d`,
+			junk,
+			initiation,
+			response,
+			cookieReply,
+			transport,
+		)
 	}
 
-	if tempASecConf.initPacketMagicHeader > 4 {
-		isASecOn = true
-		device.log.Verbosef("UAPI: Updating init_packet_magic_header")
-		device.aSecConf.initPacketMagicHeader = tempASecConf.initPacketMagicHeader
-		MessageInitiationType = device.aSecConf.initPacketMagicHeader
-	} else {
-		device.log.Verbosef("UAPI: Using default init type")
-		MessageInitiationType = 1
-	}
+	newInitSize := MessageInitiationSize + conf.initPacketJunkSize
+	newResponseSize := MessageResponseSize + conf.responsePacketJunkSize
 
-	if tempASecConf.responsePacketMagicHeader > 4 {
-		isASecOn = true
-		device.log.Verbosef("UAPI: Updating response_packet_magic_header")
-		device.aSecConf.responsePacketMagicHeader = tempASecConf.responsePacketMagicHeader
-		MessageResponseType = device.aSecConf.responsePacketMagicHeader
-	} else {
-		device.log.Verbosef("UAPI: Using default response type")
-		MessageResponseType = 2
+	if newInitSize == newResponseSize {
+		err = chainIpcErrorf(
+			err,
+			`new init size:%d; and new response size:%d; should differ`,
+			newInitSize,
+			newResponseSize,
+		)
 	}
 
-	if tempASecConf.underloadPacketMagicHeader > 4 {
-		isASecOn = true
-		device.log.Verbosef("UAPI: Updating underload_packet_magic_header")
-		device.aSecConf.underloadPacketMagicHeader = tempASecConf.underloadPacketMagicHeader
-		MessageCookieReplyType = device.aSecConf.underloadPacketMagicHeader
-	} else {
-		device.log.Verbosef("UAPI: Using default underload type")
-		MessageCookieReplyType = 3
+	newCookieReplySize := MessageCookieReplySize + conf.underloadPacketJunkSize
+	if newCookieReplySize == newInitSize ||
+		newCookieReplySize == newResponseSize ||
+		newCookieReplySize == MessageTransportSize {
+		err = chainIpcErrorf(
+			err,
+			`new cookie reply size:%d; should differ from new init size:%d; new response size:%d; and transport size:%d`,
+			newCookieReplySize,
+			newInitSize,
+			newResponseSize,
+			MessageTransportSize,
+		)
 	}
 
-	if tempASecConf.transportPacketMagicHeader > 4 {
-		isASecOn = true
-		device.log.Verbosef("UAPI: Updating transport_packet_magic_header")
-		device.aSecConf.transportPacketMagicHeader = tempASecConf.transportPacketMagicHeader
-		MessageTransportType = device.aSecConf.transportPacketMagicHeader
-	} else {
-		device.log.Verbosef("UAPI: Using default transport type")
-		MessageTransportType = 4
+	return err
+}
+
+// handlePostConfig validates tempASecConf and, if it is valid, applies it.
+// An invalid configuration is rejected as a whole and leaves the device
+// untouched.
+func (device *Device) handlePostConfig(tempASecConf *aSecConfType) error {
+	if !tempASecConf.isSet {
+		return nil
 	}
 
-	isSameMap := map[uint32]bool{}
-	isSameMap[MessageInitiationType] = true
-	isSameMap[MessageResponseType] = true
-	isSameMap[MessageCookieReplyType] = true
-	isSameMap[MessageTransportType] = true
+	if err := tempASecConf.validate(); err != nil {
+		return err
+	}
 
-	if len(isSameMap) != 4 {
-		if err != nil {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`magic headers should differ; got: init:%d; recv:%d; unde:%d; tran:%d; %w`,
-				MessageInitiationType,
-				MessageResponseType,
-				MessageCookieReplyType,
-				MessageTransportType,
-				err,
-			)
-		} else {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`magic headers should differ; got: init:%d; recv:%d; unde:%d; tran:%d`,
-				MessageInitiationType,
-				MessageResponseType,
-				MessageCookieReplyType,
-				MessageTransportType,
-			)
+	device.aSecMux.Lock()
+	defer device.aSecMux.Unlock()
+
+	device.aSecConf = *tempASecConf
+	device.aSecConf.junkPacketMaxSize = tempASecConf.effectiveJunkPacketMaxSize()
+
+	isASecOn := device.aSecConf.junkPacketCount != 0 ||
+		device.aSecConf.junkPacketMinSize != 0 ||
+		device.aSecConf.junkPacketMaxSize != 0 ||
+		device.aSecConf.initPacketJunkSize != 0 ||
+		device.aSecConf.responsePacketJunkSize != 0 ||
+		device.aSecConf.underloadPacketJunkSize != 0 ||
+		device.aSecConf.junkTransportPacketCount != 0 ||
+		device.aSecConf.junkTransportPacketMagicHeader != 0
+
+	MessageInitiationType, MessageResponseType, MessageCookieReplyType, MessageTransportType =
+		device.aSecConf.messageTypes()
+
+	for _, header := range []struct {
+		name  string
+		value uint32
+	}{
+		{"init_packet_magic_header", device.aSecConf.initPacketMagicHeader},
+		{"response_packet_magic_header", device.aSecConf.responsePacketMagicHeader},
+		{"underload_packet_magic_header", device.aSecConf.underloadPacketMagicHeader},
+		{"transport_packet_magic_header", device.aSecConf.transportPacketMagicHeader},
+	} {
+		if header.value > 4 {
+			isASecOn = true
+			device.log.Verbosef("UAPI: Updating %s", header.name)
 		}
 	}
 
 	newInitSize := MessageInitiationSize + device.aSecConf.initPacketJunkSize
 	newResponseSize := MessageResponseSize + device.aSecConf.responsePacketJunkSize
+	newCookieReplySize := MessageCookieReplySize + device.aSecConf.underloadPacketJunkSize
 
-	if newInitSize == newResponseSize {
-		if err != nil {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`new init size:%d; and new response size:%d; should differ; %w`,
-				newInitSize,
-				newResponseSize,
-				err,
-			)
-		} else {
-			err = ipcErrorf(
-				ipc.IpcErrorInvalid,
-				`new init size:%d; and new response size:%d; should differ`,
-				newInitSize,
-				newResponseSize,
-			)
-		}
-	} else {
-		packetSizeToMsgType = map[int]uint32{
-			newInitSize:            MessageInitiationType,
-			newResponseSize:        MessageResponseType,
-			MessageCookieReplySize: MessageCookieReplyType,
-			MessageTransportSize:   MessageTransportType,
-		}
+	packetSizeToMsgType = map[int]uint32{
+		newInitSize:          MessageInitiationType,
+		newResponseSize:      MessageResponseType,
+		newCookieReplySize:   MessageCookieReplyType,
+		MessageTransportSize: MessageTransportType,
+	}
 
-		msgTypeToJunkSize = map[uint32]int{
-			MessageInitiationType:  device.aSecConf.initPacketJunkSize,
-			MessageResponseType:    device.aSecConf.responsePacketJunkSize,
-			MessageCookieReplyType: 0,
-			MessageTransportType:   0,
-		}
+	msgTypeToJunkSize = map[uint32]int{
+		MessageInitiationType:  device.aSecConf.initPacketJunkSize,
+		MessageResponseType:    device.aSecConf.responsePacketJunkSize,
+		MessageCookieReplyType: device.aSecConf.underloadPacketJunkSize,
+		MessageTransportType:   0,
 	}
 
-	device.isASecOn.SetTo(isASecOn)
-	device.aSecMux.Unlock()
+	msgTypeToDefault = map[uint32]uint32{
+		MessageInitiationType:  defaultMessageInitiationType,
+		MessageResponseType:    defaultMessageResponseType,
+		MessageCookieReplyType: defaultMessageCookieReplyType,
+		MessageTransportType:   defaultMessageTransportType,
+	}
 
-	return err
-}
\ No newline at end of file
+	device.isASecOn.SetTo(isASecOn)
+	return nil
+}
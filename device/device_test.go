@@ -8,21 +8,32 @@ package device
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math/rand"
+	"net"
 	"net/netip"
 	"os"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/syntlabs/cyanide-go/conn"
 	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/ipc"
+	"github.com/syntlabs/cyanide-go/replay"
 	"github.com/syntlabs/cyanide-go/tun"
 	"github.com/syntlabs/cyanide-go/tun/tuntest"
 )
@@ -117,6 +128,8 @@ func genASecurityConfigs(tb testing.TB) (cfgs, endpointCfgs [2]string) {
 		"h2", "67543",
 		"h4", "32345",
 		"h3", "123123",
+		"jt", "3",
+		"h5", "98765",
 		"public_key", hex.EncodeToString(pub2[:]),
 		"protocol_version", "1",
 		"replace_allowed_ips", "true",
@@ -139,6 +152,8 @@ func genASecurityConfigs(tb testing.TB) (cfgs, endpointCfgs [2]string) {
 		"h2", "67543",
 		"h4", "32345",
 		"h3", "123123",
+		"jt", "3",
+		"h5", "98765",
 		"public_key", hex.EncodeToString(pub1[:]),
 		"protocol_version", "1",
 		"replace_allowed_ips", "true",
@@ -286,276 +301,2836 @@ func TestTwoDevicePingASecurity(t *testing.T) {
 	})
 }
 
+// TestTwoDevicePingChannelBind runs both devices in memory,
+// which needs neither root nor real sockets.
+func TestTwoDevicePingChannelBind(t *testing.T) {
+	goroutineLeakCheck(t)
+	for _, withASecurity := range []bool{false, true} {
+		pair := genTestPair(t, false, withASecurity)
+		t.Run(fmt.Sprintf("asec=%v", withASecurity), func(t *testing.T) {
+			pair.Send(t, Ping, nil)
+			pair.Send(t, Pong, nil)
+		})
+	}
+}
+
+func TestHandshakeStats(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	// The ping is sent by the second device, which initiates the handshake.
+	initiator, responder := pair[1].dev.HandshakeStats(), pair[0].dev.HandshakeStats()
+	if initiator.InitiationsSent == 0 || initiator.ResponsesReceived == 0 {
+		t.Errorf("initiator stats = %+v, want initiations sent and responses received", initiator)
+	}
+	if responder.InitiationsReceived == 0 || responder.ResponsesSent == 0 {
+		t.Errorf("responder stats = %+v, want initiations received and responses sent", responder)
+	}
+	for _, stats := range []HandshakeStats{initiator, responder} {
+		if stats.InitiationsFailed != 0 || stats.ResponsesFailed != 0 || stats.RateLimited != 0 {
+			t.Errorf("unexpected failures in %+v", stats)
+		}
+	}
+}
+
+func TestMessageTypeStats(t *testing.T) {
+	goroutineLeakCheck(t)
+	for _, withASec := range []bool{false, true} {
+		pair := genTestPair(t, false, withASec)
+		pair.Send(t, Ping, nil)
+
+		// The ping is sent by the second device, which initiates the handshake.
+		initiator, responder := pair[1].dev.MessageTypeStats(), pair[0].dev.MessageTypeStats()
+		if len(initiator) != 5 || len(responder) != 5 {
+			t.Errorf("aSec %v: got %d and %d message types, want 5", withASec, len(initiator), len(responder))
+		}
+		if responder[defaultMessageInitiationType] == 0 || responder[defaultMessageTransportType] == 0 {
+			t.Errorf("aSec %v: responder stats = %v, want initiations and transport packets", withASec, responder)
+		}
+		if initiator[defaultMessageResponseType] == 0 {
+			t.Errorf("aSec %v: initiator stats = %v, want responses", withASec, initiator)
+		}
+		// With aSec, the initiator sends jc = 5 junk packets before its initiation.
+		if junk := responder[MessageJunkType]; withASec && junk < 5 || !withASec && junk != 0 {
+			t.Errorf("aSec %v: responder counted %d junk packets", withASec, junk)
+		}
+	}
+}
+
+// offloadTUN is a TUN device reporting fixed offload counters.
+type offloadTUN struct {
+	tun.Device
+	stats tun.OffloadStats
+}
+
+func (t offloadTUN) OffloadStats() tun.OffloadStats { return t.stats }
+
+func TestOffloadStats(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if stats := dev.OffloadStats(); stats != (OffloadStats{}) {
+		t.Errorf("OffloadStats() of a TUN device without offloads = %+v, want zero", stats)
+	}
+
+	stats := tun.OffloadStats{Enabled: true, ReadPackets: 3, ReadGSOPackets: 1, ReadSegments: 2, WritePackets: 8, WriteCoalesced: 4, WriteGROPackets: 3}
+	dev = NewDevice(offloadTUN{tuntest.NewChannelTUN().TUN(), stats}, bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if got := dev.OffloadStats(); got != OffloadStats(stats) {
+		t.Errorf("OffloadStats() = %+v, want %+v", got, stats)
+	}
+}
+
+// indexTUN is a TUN device with a fixed interface index.
+type indexTUN struct {
+	tun.Device
+	index int
+}
+
+func (t indexTUN) Index() (int, error) { return t.index, nil }
+
+func TestTunNameIndex(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if name, err := dev.TunName(); err != nil || name != "loopbackTun1" {
+		t.Errorf("TunName() = %q, %v; want %q", name, err, "loopbackTun1")
+	}
+	if index, err := dev.TunIndex(); err == nil {
+		t.Errorf("TunIndex() of a TUN device without an index = %d", index)
+	}
+
+	dev = NewDevice(indexTUN{tuntest.NewChannelTUN().TUN(), 7}, bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if index, err := dev.TunIndex(); err != nil || index != 7 {
+		t.Errorf("TunIndex() = %d, %v; want 7", index, err)
+	}
+}
+
+func TestHealthyPeers(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	if healthy := pair[0].dev.HealthyPeers(); len(healthy) != 0 {
+		t.Errorf("HealthyPeers() = %x before any handshake, want none", healthy)
+	}
+	pair.Send(t, Ping, nil)
+
+	for i := range pair {
+		other := pair[i^1].dev.staticIdentity.publicKey
+		healthy := pair[i].dev.HealthyPeers()
+		if len(healthy) != 1 || healthy[0] != other {
+			t.Errorf("device %d: HealthyPeers() = %x, want [%x]", i, healthy, other)
+		}
+	}
+
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	last := peer.lastHandshakeNano.Load()
+	peer.lastHandshakeNano.Store(time.Now().Add(-RejectAfterTime - time.Second).UnixNano())
+	if peer.IsHealthy() {
+		t.Error("peer with a stale handshake reported healthy")
+	}
+	peer.lastHandshakeNano.Store(last)
+	peer.keypairs.Lock()
+	peer.keypairs.current.created = time.Now().Add(-RejectAfterTime - time.Second)
+	peer.keypairs.Unlock()
+	if peer.IsHealthy() {
+		t.Error("peer with an expired keypair reported healthy")
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if seen := peer.LastSeen(); !seen.IsZero() {
+		t.Errorf("LastSeen() = %v before any packet, want zero", seen)
+	}
+	pair.Send(t, Ping, nil)
+	seen := peer.LastSeen()
+	if seen.IsZero() {
+		t.Fatal("LastSeen() is zero after receiving a handshake and data")
+	}
+
+	// Data received without a new handshake moves it forward.
+	handshake := peer.lastHandshakeNano.Load()
+	time.Sleep(10 * time.Millisecond)
+	pair.Send(t, Ping, nil)
+	if !peer.LastSeen().After(seen) {
+		t.Errorf("LastSeen() = %v after receiving data, want after %v", peer.LastSeen(), seen)
+	}
+	if peer.lastHandshakeNano.Load() != handshake {
+		t.Error("sending data completed a new handshake")
+	}
+}
+
+func TestTimeToFirstHandshake(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	var peers [2]*Peer
+	for i := range pair {
+		peers[i] = pair[i].dev.LookupPeer(pair[i^1].dev.staticIdentity.publicKey)
+		if d, ok := peers[i].TimeToFirstHandshake(); ok {
+			t.Errorf("device %d: TimeToFirstHandshake() = %v before any handshake", i, d)
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	var first [2]time.Duration
+	for i, peer := range peers {
+		d, ok := peer.TimeToFirstHandshake()
+		if !ok || d <= 0 || d > 5*time.Second {
+			t.Fatalf("device %d: TimeToFirstHandshake() = %v, %v after a handshake", i, d, ok)
+		}
+		first[i] = d
+	}
+
+	// A later handshake leaves it as it is.
+	if err := pair[1].dev.Handshake(pair[0].dev.staticIdentity.publicKey); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	for i, peer := range peers {
+		if d, _ := peer.TimeToFirstHandshake(); d != first[i] {
+			t.Errorf("device %d: TimeToFirstHandshake() = %v after another handshake, want %v", i, d, first[i])
+		}
+	}
+}
+
+func TestIdlePeerReaper(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+	firstFound := make(map[*Peer]time.Time)
+
+	// Peers seen recently, vetoed or in the middle of a handshake are kept.
+	dev.reapIdlePeers(time.Hour, nil, firstFound)
+	vetoed := 0
+	veto := func(got NoisePublicKey) bool {
+		if got != pk {
+			t.Errorf("reaper asked about %x, want %x", got[:], pk[:])
+		}
+		vetoed++
+		return false
+	}
+	dev.reapIdlePeers(time.Nanosecond, veto, firstFound)
+	if vetoed != 1 {
+		t.Errorf("veto called %d times, want 1", vetoed)
+	}
+	peer.handshake.mutex.Lock()
+	state := peer.handshake.state
+	peer.handshake.state = handshakeInitiationCreated
+	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.mutex.Unlock()
+	dev.reapIdlePeers(time.Nanosecond, nil, firstFound)
+	if dev.LookupPeer(pk) == nil {
+		t.Fatal("reaper removed a peer")
+	}
+	peer.handshake.mutex.Lock()
+	peer.handshake.state = state
+	peer.handshake.mutex.Unlock()
+
+	// Idle peers are removed in the background, sweeping no more often than
+	// minIdlePeerSweep however short idle is.
+	dev.SetIdlePeerReaper(time.Nanosecond, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for dev.LookupPeer(pk) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("idle peer was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dev.SetIdlePeerReaper(time.Hour, nil)
+}
+
+func TestFairQueueScheduler(t *testing.T) {
+	bulk, interactive := new(Peer), new(Peer)
+	batch := func(peer *Peer) *QueueOutboundElementsContainer {
+		return &QueueOutboundElementsContainer{elems: []*QueueOutboundElement{{peer: peer}}}
+	}
+	var s FairQueueScheduler
+	if s.Dequeue() != nil {
+		t.Fatal("empty scheduler returned a batch")
+	}
+	var bulkBatches []*QueueOutboundElementsContainer
+	for i := 0; i < 100; i++ {
+		elems := batch(bulk)
+		bulkBatches = append(bulkBatches, elems)
+		s.Enqueue(bulk, elems)
+	}
+	late := batch(interactive)
+	s.Enqueue(interactive, late)
+
+	// First in, first out would send the interactive batch 101st.
+	next := 0
+	for i := 0; ; i++ {
+		elems := s.Dequeue()
+		if elems == nil {
+			break
+		}
+		if elems == late {
+			if i != 1 {
+				t.Errorf("interactive batch dequeued at position %d, want 1", i)
+			}
+			continue
+		}
+		if next >= len(bulkBatches) || elems != bulkBatches[next] {
+			t.Fatalf("bulk batch dequeued out of order at position %d", i)
+		}
+		next++
+	}
+	if next != len(bulkBatches) {
+		t.Errorf("dequeued %d bulk batches, want %d", next, len(bulkBatches))
+	}
+}
+
+func TestSetScheduler(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	for i := range pair {
+		pair[i].dev.SetScheduler(new(FairQueueScheduler))
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Switching back to first in, first out keeps the tunnel going.
+	for i := range pair {
+		pair[i].dev.SetScheduler(nil)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	pair[0].dev.SetScheduler(new(FairQueueScheduler))
+	pair.Send(t, Pong, nil)
+}
+
+func TestResetCounters(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if peer.rxBytes.Load() == 0 {
+		t.Fatal("no bytes received before reset")
+	}
+	handshake := peer.lastHandshakeNano.Load()
+	if err := pair[0].dev.IpcSet("reset_counters=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if rx, tx := peer.rxBytes.Load(), peer.txBytes.Load(); rx != 0 || tx != 0 {
+		t.Errorf("counters after reset: rx=%d tx=%d, want 0", rx, tx)
+	}
+	if peer.lastHandshakeNano.Load() != handshake {
+		t.Error("reset changed the last handshake time")
+	}
+
+	pair.Send(t, Ping, nil)
+	if peer.rxBytes.Load() == 0 {
+		t.Error("counters did not resume after reset")
+	}
+	if err := pair[0].dev.IpcSet("reset_counters=false\n"); err == nil {
+		t.Error("expected reset_counters=false to fail")
+	}
+}
+
+func TestTotalBytes(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	rx, tx := dev.TotalBytes()
+	if rx == 0 || tx == 0 {
+		t.Fatalf("TotalBytes() = %d, %d after a ping and a pong, want both nonzero", rx, tx)
+	}
+	if peerRx, peerTx := peer.rxBytes.Load(), peer.txBytes.Load(); rx != peerRx || tx != peerTx {
+		t.Errorf("TotalBytes() = %d, %d, want the only peer's %d, %d", rx, tx, peerRx, peerTx)
+	}
+
+	// Removing the peer keeps its traffic in the totals.
+	dev.RemovePeer(peer.handshake.remoteStatic)
+	if gotRx, gotTx := dev.TotalBytes(); gotRx != rx || gotTx != tx {
+		t.Errorf("TotalBytes() = %d, %d after removing the peer, want %d, %d", gotRx, gotTx, rx, tx)
+	}
+	dev.ResetCounters()
+	if rx, tx := dev.TotalBytes(); rx != 0 || tx != 0 {
+		t.Errorf("TotalBytes() = %d, %d after ResetCounters, want 0", rx, tx)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+
+	if err := dev.Handshake(pk); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.lastHandshakeNano.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake completed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A forced handshake is not held back by the rekey timeout.
+	if err := dev.Handshake(pk); err != nil {
+		t.Fatal(err)
+	}
+	if sent := dev.handshakeCounters.initiationsSent.Load(); sent != 2 {
+		t.Errorf("sent %d initiations, want 2", sent)
+	}
+
+	if err := dev.Handshake(NoisePublicKey{}); err == nil {
+		t.Error("handshake with an unknown peer succeeded")
+	}
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.InitiateHandshake(); err == nil {
+		t.Error("handshake on a down device succeeded")
+	}
+}
+
+func TestWaitHandshake(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- peer.WaitHandshake(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := dev.Handshake(pk); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WaitHandshake returned %v after a handshake", err)
+	}
+
+	// The completed handshake does not satisfy later calls.
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if err := peer.WaitHandshake(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitHandshake without a new handshake returned %v", err)
+	}
+
+	// Once the peer stops retrying, waiting fails.
+	if err := dev.SetHandshakeTimeouts(20*time.Millisecond, 60*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := pair[1].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- peer.WaitHandshake(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := dev.Handshake(pk); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrHandshakeGaveUp) {
+		t.Errorf("WaitHandshake returned %v after the handshake was given up, want ErrHandshakeGaveUp", err)
+	}
+
+	dev.Close()
+	if err := peer.WaitHandshake(ctx); err == nil {
+		t.Error("WaitHandshake on a closed device succeeded")
+	}
+}
+
+func TestRoamingHook(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	type roam struct {
+		pk       NoisePublicKey
+		old, new conn.Endpoint
+	}
+	roams := make(chan roam, 16)
+	dev.SetRoamingHook(func(pk NoisePublicKey, old, new conn.Endpoint) {
+		roams <- roam{pk, old, new}
+	})
+
+	// Channel binds always report packets as coming from the IPv6 target,
+	// so pointing the peer at the IPv4 target makes the next packet roam.
+	if err := dev.UpdateEndpoint(pk, "127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+
+	select {
+	case r := <-roams:
+		if r.pk != pk || r.old.DstToString() != "127.0.0.1:1" || r.new.DstToString() != "127.0.0.1:3" {
+			t.Errorf("got roam of %x from %v to %v", r.pk[:], r.old.DstToString(), r.new.DstToString())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("roaming hook was not called")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(roams) != 0 {
+		t.Errorf("hook called %d more times without an endpoint change", len(roams))
+	}
+}
+
+func TestSetEndpointHostname(t *testing.T) {
+	var resolved atomic.Pointer[netip.Addr]
+	var lookups atomic.Int32
+	defer func(old func(context.Context, string, string) ([]netip.Addr, error)) { lookupHost = old }(lookupHost)
+	lookupHost = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		lookups.Add(1)
+		if addr := resolved.Load(); addr != nil && host == "peer.example" {
+			return []netip.Addr{*addr}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	setAddr := func(s string) {
+		addr := netip.MustParseAddr(s)
+		resolved.Store(&addr)
+	}
+
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	_, pk := randomConfigKeys(t)
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetEndpointHostname(NoisePublicKey{}, "peer.example", 51820, 0); err == nil {
+		t.Error("expected setting the hostname of a missing peer to fail")
+	}
+	if err := dev.SetEndpointHostname(pk, "peer.example", 51820, 0); err == nil {
+		t.Error("expected an unresolvable hostname to fail")
+	}
+
+	setAddr("192.0.2.1")
+	if err := dev.SetEndpointHostname(pk, "peer.example", 51820, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if got := peerConfig(t, peer).Endpoint.String(); got != "192.0.2.1:51820" {
+		t.Fatalf("endpoint = %s, want 192.0.2.1:51820", got)
+	}
+	setAddr("192.0.2.2")
+	for deadline := time.Now().Add(5 * time.Second); peerConfig(t, peer).Endpoint.String() != "192.0.2.2:51820"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoint = %s after the address changed, want 192.0.2.2:51820", peerConfig(t, peer).Endpoint)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An endpoint the peer roamed to is kept while DNS does not change.
+	roamed, err := dev.net.bind.ParseEndpoint("198.51.100.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SetEndpoint(roamed); err != nil {
+		t.Fatal(err)
+	}
+	for n := lookups.Load(); lookups.Load() < n+3; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := peerConfig(t, peer).Endpoint.String(); got != "198.51.100.1:51820" {
+		t.Fatalf("endpoint = %s with DNS unchanged, want the roamed 198.51.100.1:51820", got)
+	}
+
+	dev.RemovePeer(pk)
+	n := lookups.Load()
+	time.Sleep(50 * time.Millisecond)
+	if lookups.Load() > n+1 {
+		t.Error("hostname still re-resolved after the peer was removed")
+	}
+}
+
+func TestKeypairEventHook(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	events := make(chan KeypairEvent, 16)
+	dev.SetKeypairEventHook(func(key NoisePublicKey, event KeypairEvent) {
+		if key != pk {
+			t.Errorf("event %v for unexpected peer %x", event, key[:])
+		}
+		events <- event
+	})
+	expect := func(want KeypairEvent) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("got keypair event %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v keypair event", want)
+		}
+	}
+
+	pair.Send(t, Ping, nil)
+	expect(KeypairNew)
+
+	dev.LookupPeer(pk).ExpireCurrentKeypairs()
+	expect(KeypairExpired)
+
+	pair.Send(t, Pong, nil)
+	expect(KeypairRotated)
+}
+
+// TestSendStagedPacketsClose races packet sends against Close, which must not
+// make them write to the closed encryption queue.
+func TestSendStagedPacketsClose(t *testing.T) {
+	goroutineLeakCheck(t)
+	for i := 0; i < 20; i++ {
+		pair := genTestPair(t, false, false)
+		pair.Send(t, Ping, nil)
+		dev := pair[0].dev
+		peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+		msg := tuntest.Ping(pair[1].ip, pair[0].ip)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					elems := dev.GetOutboundElementsContainer()
+					elem := dev.NewOutboundElement()
+					elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+copy(elem.buffer[MessageTransportHeaderSize:], msg)]
+					elems.elems = append(elems.elems, elem)
+					peer.StagePackets(elems)
+					if err := peer.SendStagedPackets(); errors.Is(err, ErrDeviceClosed) {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		dev.Close()
+		wg.Wait()
+		pair[1].dev.Close()
+	}
+}
+
+func TestLastHandshakeError(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true, false)
+	dev0, dev1 := pair[0].dev, pair[1].dev
+	peer0 := dev0.LookupPeer(dev1.staticIdentity.publicKey)
+	if reason, when := peer0.LastHandshakeError(); reason != HandshakeFailNone || !when.IsZero() {
+		t.Fatalf("LastHandshakeError() = %v, %v before any handshake", reason, when)
+	}
+
+	// Initiations rejected before their sender is decrypted are not
+	// blamed on the peer they appear to come from, as their source address
+	// could be spoofed. Point the second device at the first under the wrong
+	// public key, so that the first one rejects its initiations for their mac1.
+	initiation, err := dev1.CreateMessageInitiation(dev1.LookupPeer(dev0.staticIdentity.publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wrongKey := randomConfigKeys(t)
+	err = dev1.IpcSet(uapiCfg(
+		"replace_peers", "true",
+		"public_key", hex.EncodeToString(wrongKey[:]),
+		"endpoint", fmt.Sprintf("127.0.0.1:%d", dev0.ListenPort()),
+		"allowed_ip", "1.0.0.1/32",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev1.SetHandshakeTimeouts(100*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+
+	waitFor := func(peer *Peer, want HandshakeFailReason) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			reason, when := peer.LastHandshakeError()
+			if reason == want && !when.IsZero() {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("LastHandshakeError() = %v, want %v", reason, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(dev1.LookupPeer(wrongKey), HandshakeFailTimeout)
+	if reason, _ := peer0.LastHandshakeError(); reason != HandshakeFailNone {
+		t.Fatalf("LastHandshakeError() = %v after initiations with a bad mac1, want %v", reason, HandshakeFailNone)
+	}
+
+	// An initiation rejected once its sender is known is recorded for it:
+	// the second copy of the initiation is a replay.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, initiation)
+	packet := buf.Bytes()
+	var macs CookieGenerator
+	macs.Init(dev0.staticIdentity.publicKey)
+	macs.AddMacs(packet)
+	endpoint, err := dev0.net.bind.ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", dev1.ListenPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		elem := QueueHandshakeElement{
+			msgType:  defaultMessageInitiationType,
+			endpoint: endpoint,
+			buffer:   dev0.GetMessageBuffer(),
+		}
+		elem.packet = elem.buffer[:copy(elem.buffer[:], packet)]
+		dev0.queue.handshake.c <- elem
+	}
+	waitFor(peer0, HandshakeFailReplay)
+}
+
+func TestSetPrivateKeyExpiry(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		t.Fatal("no keypair after ping")
+	}
+	expired := func() bool {
+		return keypair.sendNonce.Load() >= RejectAfterMessages
+	}
+
+	// A key that only differs in bits cleared by clamping is the same key,
+	// so the shared secret with the peer does not change.
+	dev.staticIdentity.RLock()
+	sk := dev.staticIdentity.privateKey
+	dev.staticIdentity.RUnlock()
+	sk[0] ^= 1
+	if err := dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if peer.keypairs.Current() != keypair || expired() {
+		t.Error("keypair of unaffected peer was expired")
+	}
+
+	sk, _ = randomConfigKeys(t)
+	if err := dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if !expired() {
+		t.Error("keypair was not expired after the shared secret changed")
+	}
+}
+
+func TestRotatePrivateKey(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	// The other side learns the new public key, keeping the endpoint.
+	dev := pair[0].dev
+	oldPK := dev.staticIdentity.publicKey
+	sk, pk := randomConfigKeys(t)
+	oldPeer := pair[1].dev.LookupPeer(oldPK)
+	oldPeer.endpoint.Lock()
+	endpoint := oldPeer.endpoint.val.DstToString()
+	oldPeer.endpoint.Unlock()
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(oldPK[:]),
+		"remove", "true",
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", endpoint,
+		"allowed_ip", pair[0].ip.String()+"/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	newPeer := pair[1].dev.LookupPeer(pk)
+
+	// The handshake is initiated without any data to send.
+	if err := dev.RotatePrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if dev.staticIdentity.publicKey != pk {
+		t.Error("public key was not rotated")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for newPeer.lastHandshakeNano.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake with the rotated key")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Rotating to the key of the peer removes it, so nothing is sent.
+	sent := dev.HandshakeStats().InitiationsSent
+	if err := dev.RotatePrivateKey(pair[1].dev.staticIdentity.privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if dev.PeerCount() != 0 {
+		t.Error("peer with the new public key was not removed")
+	}
+	if got := dev.HandshakeStats().InitiationsSent; got != sent {
+		t.Errorf("%d initiations sent after rotating, want none", got-sent)
+	}
+}
+
+func TestTransportJunkPackets(t *testing.T) {
+	peer := &Peer{device: new(Device)}
+	peer.device.aSecConf = aSecConfType{
+		junkPacketMinSize:              40,
+		junkPacketMaxSize:              50,
+		junkTransportPacketCount:       3,
+		junkTransportPacketMagicHeader: 98765,
+	}
+	sent := 0
+	for _, tt := range []struct{ count, junks, sent int }{
+		{2, 0, 2},
+		{7, 3, 0},
+		{1, 0, 1},
+	} {
+		junks, err := peer.createTransportJunkPackets(&sent, tt.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(junks) != tt.junks || sent != tt.sent {
+			t.Fatalf("after %d packets got %d junk packets and %d pending, want %d and %d", tt.count, len(junks), sent, tt.junks, tt.sent)
+		}
+		for _, junk := range junks {
+			if binary.LittleEndian.Uint32(junk) != 98765 || len(junk) < 44 || len(junk) >= 54 {
+				t.Errorf("junk packet of length %d with header %d", len(junk), binary.LittleEndian.Uint32(junk))
+			}
+		}
+	}
+}
+
+func TestJunkSource(t *testing.T) {
+	junks := func(src JunkSource) [][]byte {
+		peer := &Peer{device: new(Device)}
+		peer.device.aSecConf = aSecConfType{
+			junkPacketCount:   4,
+			junkPacketMinSize: 10,
+			junkPacketMaxSize: 100,
+		}
+		peer.device.SetJunkSource(src)
+		junks, err := peer.createJunkPackets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return junks
+	}
+	a, b := junks(rand.New(rand.NewSource(42))), junks(rand.New(rand.NewSource(42)))
+	if len(a) != 4 || len(b) != 4 {
+		t.Fatalf("got %d and %d junk packets, want 4", len(a), len(b))
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			t.Errorf("junk packet %d differs between identically seeded sources", i)
+		}
+	}
+	if c := junks(rand.New(rand.NewSource(43))); bytes.Equal(bytes.Join(a, nil), bytes.Join(c, nil)) {
+		t.Error("differently seeded sources produced the same junk")
+	}
+	if d := junks(nil); len(d) != 4 {
+		t.Errorf("got %d junk packets from the default source, want 4", len(d))
+	}
+}
+
+func TestJunkTiming(t *testing.T) {
+	for _, s := range []string{"before", "after", "spread(250ms)"} {
+		timing, err := parseJunkTiming(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timing.String() != s {
+			t.Errorf("parsed %q as %v", s, timing)
+		}
+	}
+	for _, s := range []string{"now", "spread", "spread(soon)"} {
+		if _, err := parseJunkTiming(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+
+	// sent returns the sizes of the packets that dev sends for an initiation
+	// with the given junk timing, along with the clock of dev and the peer.
+	const junkSize, initSize = 500, MessageInitiationSize + 30
+	sent := func(timing string) (<-chan int, *fakeClock, *Peer) {
+		sizes := make(chan int, 16)
+		bind := conn.NewTeeBind(bindtest.NewChannelBinds()[0], func(data []byte, _ conn.Endpoint) {
+			sizes <- len(data)
+		})
+		dev := NewDevice(tuntest.NewChannelTUN().TUN(), bind, NewLogger(LogLevelError, ""))
+		t.Cleanup(dev.Close)
+		clock := newFakeClock()
+		if err := dev.SetClock(clock); err != nil {
+			t.Fatal(err)
+		}
+		sk, _ := randomConfigKeys(t)
+		_, pk := randomConfigKeys(t)
+		if err := dev.IpcSet(uapiCfg(
+			"private_key", hex.EncodeToString(sk[:]),
+			"jc", "3",
+			"jmin", strconv.Itoa(junkSize),
+			"jmax", strconv.Itoa(junkSize+1),
+			"s1", "30",
+			"s2", "40",
+			"jtm", timing,
+			"public_key", hex.EncodeToString(pk[:]),
+			"endpoint", "127.0.0.1:1",
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+		peer := dev.LookupPeer(pk)
+		if err := peer.SendHandshakeInitiation(false); err != nil {
+			t.Fatal(err)
+		}
+		return sizes, clock, peer
+	}
+	expect := func(sizes <-chan int, want ...int) {
+		t.Helper()
+		for i, w := range want {
+			select {
+			case got := <-sizes:
+				if got != w {
+					t.Fatalf("packet %d has size %d, want %d", i, got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("packet %d of size %d was not sent", i, w)
+			}
+		}
+		select {
+		case got := <-sizes:
+			t.Fatalf("unexpected packet of size %d", got)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	sizes, _, _ := sent("before")
+	expect(sizes, junkSize, junkSize, junkSize, initSize)
+	sizes, _, _ = sent("after")
+	expect(sizes, initSize, junkSize, junkSize, junkSize)
+
+	// Spread junk goes out on the timers of the device's clock.
+	sizes, clock, _ := sent("spread(1s)")
+	expect(sizes, initSize)
+	clock.Advance(time.Second)
+	expect(sizes, junkSize, junkSize, junkSize)
+
+	// Junk still scheduled when the peer stops is not sent.
+	sizes, clock, peer := sent("spread(1s)")
+	expect(sizes, initSize)
+	peer.Stop()
+	clock.Advance(time.Second)
+	expect(sizes)
+}
+
 func TestUpDown(t *testing.T) {
 	goroutineLeakCheck(t)
-	const itrials = 50
-	const otrials = 10
+	const itrials = 50
+	const otrials = 10
+
+	for n := 0; n < otrials; n++ {
+		pair := genTestPair(t, false, false)
+		for i := range pair {
+			for k := range pair[i].dev.peers.keyMap {
+				pair[i].dev.IpcSet(fmt.Sprintf("public_key=%s\npersistent_keepalive_interval=1\n", hex.EncodeToString(k[:])))
+			}
+		}
+		var cn sync.WaitGroup
+		cn.Add(len(pair))
+		for i := range pair {
+			go func(d *Device) {
+				defer cn.Done()
+				for i := 0; i < itrials; i++ {
+					if err := d.Up(); err != nil {
+						t.Errorf("failed up bring up device: %v", err)
+					}
+					time.Sleep(time.Duration(rand.Intn(int(time.Nanosecond * (0x10000 - 1)))))
+					if err := d.Down(); err != nil {
+						t.Errorf("failed to bring down device: %v", err)
+					}
+					time.Sleep(time.Duration(rand.Intn(int(time.Nanosecond * (0x10000 - 1)))))
+				}
+			}(pair[i].dev)
+		}
+		cn.Wait()
+		for i := range pair {
+			pair[i].dev.Up()
+			pair[i].dev.Close()
+		}
+	}
+}
+
+// TestConcurrentIpcSetUpDown adds and removes peers with IpcSet while the
+// device is brought up and down and finally closed. It checks that this
+// neither panics nor deadlocks, and that no peer is left running on a
+// device that is down or closed.
+func TestConcurrentIpcSetUpDown(t *testing.T) {
+	goroutineLeakCheck(t)
+	const iters = 100
+	pair := genTestPair(t, false, false)
+	dev := pair[0].dev
+
+	// wait waits for cn, failing the test if that takes too long.
+	wait := func(cn *sync.WaitGroup) {
+		done := make(chan struct{})
+		go func() {
+			cn.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatal("deadlock: IpcSet, Up, Down and Close did not complete")
+		}
+	}
+	// churn adds iters peers, removing every other one again, and then
+	// closes churned. IpcSet errors fail the test if failOnError is set.
+	churn := func(cn *sync.WaitGroup, churned chan struct{}, failOnError bool) {
+		defer cn.Done()
+		defer close(churned)
+		for i := 0; i < iters; i++ {
+			_, pk := randomConfigKeys(t)
+			pub := hex.EncodeToString(pk[:])
+			err := dev.IpcSet(uapiCfg(
+				"public_key", pub,
+				"persistent_keepalive_interval", "1",
+				"allowed_ip", fmt.Sprintf("10.%d.%d.0/24", i/256, i%256),
+			))
+			if err == nil && i%2 == 0 {
+				err = dev.IpcSet(uapiCfg("public_key", pub, "remove", "true"))
+			}
+			if err != nil && failOnError {
+				t.Errorf("IpcSet failed: %v", err)
+				return
+			}
+		}
+	}
+	running := func() (n int) {
+		dev.peers.RLock()
+		defer dev.peers.RUnlock()
+		for _, peer := range dev.peers.keyMap {
+			if peer.isRunning.Load() {
+				n++
+			}
+		}
+		return n
+	}
+
+	var cn sync.WaitGroup
+	churned := make(chan struct{})
+	cn.Add(2)
+	go churn(&cn, churned, true)
+	go func() {
+		defer cn.Done()
+		for {
+			select {
+			case <-churned:
+				return
+			default:
+			}
+			if err := dev.Up(); err != nil {
+				t.Errorf("failed to bring up device: %v", err)
+			}
+			time.Sleep(time.Duration(rand.Intn(int(time.Nanosecond * (0x10000 - 1)))))
+			if err := dev.Down(); err != nil {
+				t.Errorf("failed to bring down device: %v", err)
+			}
+			// A peer added while the device went down must not be started.
+			// Wait for any IpcSet in progress to finish before checking.
+			dev.ipcMutex.RLock()
+			n := running()
+			dev.ipcMutex.RUnlock()
+			if n != 0 {
+				t.Errorf("%d peers running on a device that is down", n)
+				return
+			}
+		}
+	}()
+	wait(&cn)
+	if got, want := dev.PeerCount(), 1+iters/2; got != want {
+		t.Errorf("PeerCount() = %d, want %d", got, want)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatalf("failed to bring up device: %v", err)
+	}
+	if n, want := running(), dev.PeerCount(); n != want {
+		t.Errorf("%d of %d peers running on a device that is up", n, want)
+	}
+
+	cn.Add(2)
+	go churn(&cn, make(chan struct{}), false)
+	go func() {
+		defer cn.Done()
+		time.Sleep(time.Millisecond)
+		dev.Close()
+	}()
+	wait(&cn)
+	if got := dev.PeerCount(); got != 0 {
+		t.Errorf("PeerCount() = %d after close, want 0", got)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pair[1].dev.staticIdentity.publicKey[:]))); err == nil {
+		t.Error("IpcSet adding a peer to a closed device succeeded")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Pausing the receiver holds back what the bind receives,
+	// pausing the sender what the TUN device reads.
+	for _, paused := range []*Device{pair[0].dev, pair[1].dev} {
+		paused.Pause()
+		msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+		pair[1].tun.Outbound <- msg
+		select {
+		case <-pair[0].tun.Inbound:
+			t.Fatal("packet went through a paused device")
+		case <-time.After(200 * time.Millisecond):
+		}
+		paused.Resume()
+		select {
+		case got := <-pair[0].tun.Inbound:
+			if !bytes.Equal(got, msg) {
+				t.Error("ping did not transit correctly after resuming")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet held back by the pause was not delivered after resuming")
+		}
+	}
+
+	// The device can be brought down and closed while paused.
+	for i := range pair {
+		pair[i].dev.Pause()
+		if err := pair[i].dev.Down(); err != nil {
+			t.Fatal(err)
+		}
+		if err := pair[i].dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	for i := range pair {
+		pair[i].dev.Close()
+	}
+}
+
+func TestExportImportSessions(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	dev := pair[0].dev
+	remote := pair[1].dev.LookupPeer(dev.staticIdentity.publicKey)
+	lastHandshake := remote.lastHandshakeNano.Load()
+
+	dev.Pause()
+	sessions, err := dev.ExportSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pair[1].dev.ImportSessions(sessions); err == nil {
+		t.Error("ImportSessions succeeded on a device that is not paused")
+	}
+	pair[1].dev.Pause()
+	if err := pair[1].dev.ImportSessions(sessions); err == nil {
+		t.Error("ImportSessions succeeded with sessions of an unknown peer")
+	}
+	pair[1].dev.Resume()
+	for _, bad := range [][]byte{nil, sessions[:len(sessions)-1], append(sessions, 0)} {
+		if err := dev.ImportSessions(bad); err == nil {
+			t.Errorf("ImportSessions succeeded with %d bytes of %d", len(bad), len(sessions))
+		}
+	}
+
+	// Importing the sessions back replaces the keypairs with fresh ones,
+	// which keep the tunnel going without a new handshake.
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	peer.keypairs.RLock()
+	old := peer.keypairs.current
+	peer.keypairs.RUnlock()
+
+	// An index taken by another session fails the import without changing
+	// anything.
+	dev.indexTable.Lock()
+	entry := dev.indexTable.table[old.localIndex]
+	dev.indexTable.table[old.localIndex] = IndexTableEntry{peer: peer, handshake: &peer.handshake}
+	dev.indexTable.Unlock()
+	if err := dev.ImportSessions(sessions); err == nil {
+		t.Error("ImportSessions succeeded with an index in use")
+	}
+	peer.keypairs.RLock()
+	current := peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if current != old {
+		t.Error("failed ImportSessions replaced the current keypair")
+	}
+	dev.indexTable.Lock()
+	dev.indexTable.table[old.localIndex] = entry
+	dev.indexTable.Unlock()
+
+	if err := dev.ImportSessions(sessions); err != nil {
+		t.Fatal(err)
+	}
+	dev.Resume()
+	peer.keypairs.RLock()
+	current = peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if current == nil || current == old || current.localIndex != old.localIndex {
+		t.Fatal("current keypair was not imported")
+	}
+	if got, want := current.sendNonce.Load(), old.sendNonce.Load(); got < want+sessionNonceMargin {
+		t.Errorf("imported send counter = %d, want at least %d", got, want+sessionNonceMargin)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if got := remote.lastHandshakeNano.Load(); got != lastHandshake {
+		t.Error("imported sessions needed a new handshake")
+	}
+}
+
+func TestListenPort(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true, false)
+	dev := pair[0].dev
+	if got, want := dev.ListenPort(), dev.net.port; got == 0 || got != want {
+		t.Errorf("ListenPort() = %d, want bound port %d", got, want)
+	}
+	if err := dev.Down(); err != nil {
+		t.Fatalf("failed to bring down device: %v", err)
+	}
+	if got := dev.ListenPort(); got != 0 {
+		t.Errorf("ListenPort() = %d on a down device, want 0", got)
+	}
+}
+
+// TestConcurrencySafety does other things concurrently with tunnel use.
+// It is intended to be used with the race detector to catch data races.
+func TestConcurrencySafety(t *testing.T) {
+	pair := genTestPair(t, true, false)
+	done := make(chan struct{})
+
+	const warmupIters = 10
+	var warmup sync.WaitGroup
+	warmup.Add(warmupIters)
+	go func() {
+		// Send data continuously back and forth until we're done.
+		// Note that we may continue to attempt to send data
+		// even after done is closed.
+		i := warmupIters
+		for ping := Ping; ; ping = !ping {
+			pair.Send(t, ping, done)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i > 0 {
+				warmup.Done()
+				i--
+			}
+		}
+	}()
+	warmup.Wait()
+
+	applyCfg := func(cfg string) {
+		err := pair[0].dev.IpcSet(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Change persistent_keepalive_interval concurrently with tunnel use.
+	t.Run("persistentKeepaliveInterval", func(t *testing.T) {
+		var pub NoisePublicKey
+		for key := range pair[0].dev.peers.keyMap {
+			pub = key
+			break
+		}
+		cfg := uapiCfg(
+			"public_key", hex.EncodeToString(pub[:]),
+			"persistent_keepalive_interval", "1",
+		)
+		for i := 0; i < 1000; i++ {
+			applyCfg(cfg)
+		}
+	})
+
+	// Change private keys concurrently with tunnel use.
+	t.Run("privateKey", func(t *testing.T) {
+		bad := uapiCfg("private_key", "7777777777777777777777777777777777777777777777777777777777777777")
+		good := uapiCfg("private_key", hex.EncodeToString(pair[0].dev.staticIdentity.privateKey[:]))
+		// Set iters to a large number like 1000 to flush out data races quickly.
+		// Don't leave it large. That can cause logical races
+		// in which the handshake is interleaved with key changes
+		// such that the private key appears to be unchanging but
+		// other state gets reset, which can cause handshake failures like
+		// "Received packet with invalid mac1".
+		const iters = 1
+		for i := 0; i < iters; i++ {
+			applyCfg(bad)
+			applyCfg(good)
+		}
+	})
+
+	// Perform bind updates and keepalive sends concurrently with tunnel use.
+	t.Run("bindUpdate and keepalive", func(t *testing.T) {
+		const iters = 10
+		for i := 0; i < iters; i++ {
+			for _, peer := range pair {
+				peer.dev.BindUpdate()
+				peer.dev.SendKeepalivesToPeersWithCurrentKeypair()
+			}
+		}
+	})
+
+	close(done)
+}
+
+func BenchmarkLatency(b *testing.B) {
+	pair := genTestPair(b, true, false)
+
+	// Establish a connection.
+	pair.Send(b, Ping, nil)
+	pair.Send(b, Pong, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pair.Send(b, Ping, nil)
+		pair.Send(b, Pong, nil)
+	}
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	pair := genTestPair(b, true, false)
+
+	// Establish a connection.
+	pair.Send(b, Ping, nil)
+	pair.Send(b, Pong, nil)
+
+	// Measure how long it takes to receive b.N packets,
+	// starting when we receive the first packet.
+	var recv atomic.Uint64
+	var elapsed time.Duration
+	var cn sync.WaitGroup
+	cn.Add(1)
+	go func() {
+		defer cn.Done()
+		var start time.Time
+		for {
+			<-pair[0].tun.Inbound
+			new := recv.Add(1)
+			if new == 1 {
+				start = time.Now()
+			}
+			// Careful! Don't change this to else if; b.N can be equal to 1.
+			if new == uint64(b.N) {
+				elapsed = time.Since(start)
+				return
+			}
+		}
+	}()
+
+	// Send packets as fast as we can until we've received enough.
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pingc := pair[1].tun.Outbound
+	var sent uint64
+	for recv.Load() != uint64(b.N) {
+		sent++
+		pingc <- ping
+	}
+	cn.Wait()
+
+	b.ReportMetric(float64(elapsed)/float64(b.N), "ns/op")
+	b.ReportMetric(1-float64(b.N)/float64(sent), "packet-loss")
+}
+
+func BenchmarkUAPIGet(b *testing.B) {
+	pair := genTestPair(b, true, false)
+	pair.Send(b, Ping, nil)
+	pair.Send(b, Pong, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pair[0].dev.IpcGetOperation(io.Discard)
+	}
+}
+
+func goroutineLeakCheck(t *testing.T) {
+	goroutines := func() (int, []byte) {
+		p := pprof.Lookup("goroutine")
+		b := new(bytes.Buffer)
+		p.WriteTo(b, 1)
+		return p.Count(), b.Bytes()
+	}
+
+	startGoroutines, startStacks := goroutines()
+	t.Cleanup(func() {
+		if t.Failed() {
+			return
+		}
+		// Give goroutines time to exit, if they need it.
+		for i := 0; i < 10000; i++ {
+			if runtime.NumGoroutine() <= startGoroutines {
+				return
+			}
+			time.Sleep(1 * time.Millisecond)
+		}
+		endGoroutines, endStacks := goroutines()
+		t.Logf("starting stacks:\n%s\n", startStacks)
+		t.Logf("ending stacks:\n%s\n", endStacks)
+		t.Fatalf("expected %d goroutines, got %d, leak?", startGoroutines, endGoroutines)
+	})
+}
+
+type fakeBindSized struct {
+	size int
+}
+
+func (b *fakeBindSized) Open(
+	port uint16,
+) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
+	return nil, 0, nil
+}
+func (b *fakeBindSized) Close() error                                  { return nil }
+func (b *fakeBindSized) SetMark(mark uint32) error                     { return nil }
+func (b *fakeBindSized) Send(bufs [][]byte, ep conn.Endpoint) error    { return nil }
+func (b *fakeBindSized) ParseEndpoint(s string) (conn.Endpoint, error) { return nil, nil }
+func (b *fakeBindSized) BatchSize() int                                { return b.size }
+
+type fakeTUNDeviceSized struct {
+	size int
+}
+
+func (t *fakeTUNDeviceSized) File() *os.File { return nil }
+func (t *fakeTUNDeviceSized) Read(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	return 0, nil
+}
+func (t *fakeTUNDeviceSized) Write(bufs [][]byte, offset int) (int, error) { return 0, nil }
+func (t *fakeTUNDeviceSized) MTU() (int, error)                            { return 0, nil }
+func (t *fakeTUNDeviceSized) Name() (string, error)                        { return "", nil }
+func (t *fakeTUNDeviceSized) Events() <-chan tun.Event                     { return nil }
+func (t *fakeTUNDeviceSized) Close() error                                 { return nil }
+func (t *fakeTUNDeviceSized) BatchSize() int                               { return t.size }
+
+func TestBatchSize(t *testing.T) {
+	d := Device{}
+
+	d.net.bind = &fakeBindSized{1}
+	d.tun.device = &fakeTUNDeviceSized{1}
+	if want, got := 1, d.BatchSize(); got != want {
+		t.Errorf("expected batch size %d, got %d", want, got)
+	}
+
+	d.net.bind = &fakeBindSized{1}
+	d.tun.device = &fakeTUNDeviceSized{128}
+	if want, got := 128, d.BatchSize(); got != want {
+		t.Errorf("expected batch size %d, got %d", want, got)
+	}
+
+	d.net.bind = &fakeBindSized{128}
+	d.tun.device = &fakeTUNDeviceSized{1}
+	if want, got := 128, d.BatchSize(); got != want {
+		t.Errorf("expected batch size %d, got %d", want, got)
+	}
+
+	d.net.bind = &fakeBindSized{128}
+	d.tun.device = &fakeTUNDeviceSized{128}
+	if want, got := 128, d.BatchSize(); got != want {
+		t.Errorf("expected batch size %d, got %d", want, got)
+	}
+}
+
+func TestStateEvents(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	events := dev.StateEvents()
+
+	dev.Up()
+	dev.Up() // no transition, no event
+	dev.Down()
+	dev.Up()
+	dev.Close()
+
+	want := []DeviceStateEvent{
+		{deviceStateDown, deviceStateUp},
+		{deviceStateUp, deviceStateDown},
+		{deviceStateDown, deviceStateUp},
+		{deviceStateUp, deviceStateClosed},
+	}
+	var got []DeviceStateEvent
+	for event := range events {
+		got = append(got, event)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+
+	// A listener that never reads must not block state changes;
+	// the oldest events are dropped instead.
+	dev = NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	for i := 0; i < stateEventsSize; i++ {
+		dev.Up()
+		dev.Down()
+	}
+	dev.Close()
+	got = got[:0]
+	for event := range dev.StateEvents() {
+		got = append(got, event)
+	}
+	if len(got) != stateEventsSize || got[len(got)-1].New != deviceStateClosed {
+		t.Errorf("got events %v, want the last %d ending with closed", got, stateEventsSize)
+	}
+}
+
+func TestKeepaliveJitter(t *testing.T) {
+	device := new(Device)
+	if jitter := device.keepaliveJitter(); jitter != 0 {
+		t.Errorf("jitter without SetKeepaliveJitter = %v, want 0", jitter)
+	}
+	const max = 10 * time.Millisecond
+	device.SetKeepaliveJitter(max)
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		jitter := device.keepaliveJitter()
+		if jitter < 0 || jitter >= max {
+			t.Fatalf("jitter %v outside [0, %v)", jitter, max)
+		}
+		seen[jitter] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter is not recomputed")
+	}
+}
+
+func TestSetKeepalivesEnabled(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	pk1 := pair[1].dev.staticIdentity.publicKey
+	sender := pair[0].dev.LookupPeer(pk1)
+	receiver := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	pair[0].dev.SetKeepalivesEnabled(false)
+	if err := pair[0].dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk1[:]), "persistent_keepalive_interval", "1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	rx := receiver.rxBytes.Load()
+	time.Sleep(1500 * time.Millisecond)
+	if got := receiver.rxBytes.Load(); got != rx {
+		t.Errorf("received %d bytes while keepalives were disabled", got-rx)
+	}
+	if got := peerConfig(t, sender).PersistentKeepaliveInterval; got != 1 {
+		t.Errorf("persistent keepalive interval = %d while disabled, want 1", got)
+	}
+
+	pair[0].dev.SetKeepalivesEnabled(true)
+	for deadline := time.Now().Add(time.Second); receiver.rxBytes.Load() == rx; {
+		if time.Now().After(deadline) {
+			t.Fatal("no keepalive after re-enabling keepalives")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandshakeTimeouts(t *testing.T) {
+	device := new(Device)
+	if device.rekeyTimeout() != RekeyTimeout || device.maxTimerHandshakes() != MaxTimerHandshakes {
+		t.Errorf("defaults = %v, %d; want %v, %d", device.rekeyTimeout(), device.maxTimerHandshakes(), RekeyTimeout, MaxTimerHandshakes)
+	}
+	for _, timeouts := range [][2]time.Duration{
+		{10 * time.Second, 10 * time.Second},
+		{20 * time.Second, 10 * time.Second},
+		{-time.Second, 10 * time.Second},
+	} {
+		if err := device.SetHandshakeTimeouts(timeouts[0], timeouts[1]); err == nil {
+			t.Errorf("SetHandshakeTimeouts(%v, %v) succeeded, want error", timeouts[0], timeouts[1])
+		}
+	}
+	if err := device.SetHandshakeTimeouts(15*time.Second, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if device.rekeyTimeout() != 15*time.Second || device.maxTimerHandshakes() != 20 {
+		t.Errorf("got %v, %d; want 15s, 20", device.rekeyTimeout(), device.maxTimerHandshakes())
+	}
+	if err := device.SetHandshakeTimeouts(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if device.rekeyTimeout() != RekeyTimeout || device.maxTimerHandshakes() != MaxTimerHandshakes {
+		t.Errorf("defaults were not restored")
+	}
+}
+
+func TestQueueDepths(t *testing.T) {
+	device := new(Device)
+	device.queue.encryption = newOutboundQueue()
+	device.queue.decryption = newInboundQueue()
+	device.queue.handshake = newHandshakeQueue()
+	defer device.queue.encryption.cn.Done()
+	defer device.queue.decryption.cn.Done()
+	defer device.queue.handshake.cn.Done()
+
+	device.queue.handshake.c <- QueueHandshakeElement{}
+	device.queue.handshake.c <- QueueHandshakeElement{}
+	device.queue.decryption.c <- nil
+	want := QueueDepths{
+		Encryption: QueueDepth{0, QueueOutboundSize},
+		Decryption: QueueDepth{1, QueueInboundSize},
+		Handshake:  QueueDepth{2, QueueHandshakeSize},
+	}
+	if got := device.QueueDepths(); got != want {
+		t.Errorf("QueueDepths() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRateLimitAllowlist(t *testing.T) {
+	device := new(Device)
+	if device.rateLimitAllowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("address allowed with an empty allowlist")
+	}
+	device.SetRateLimitAllowlist([]netip.Prefix{
+		netip.MustParsePrefix("192.0.2.1/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.200", true},
+		{"::ffff:192.0.2.7", true},
+		{"2001:db8::1", true},
+		{"198.51.100.1", false},
+		{"2001:db9::1", false},
+	} {
+		if got := device.rateLimitAllowed(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("rateLimitAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	device.SetRateLimitAllowlist(nil)
+	if device.rateLimitAllowed(netip.MustParseAddr("192.0.2.200")) {
+		t.Error("address allowed after clearing the allowlist")
+	}
+}
+
+func TestUnderLoadThreshold(t *testing.T) {
+	device := new(Device)
+	device.queue.handshake = newHandshakeQueue()
+	defer device.queue.handshake.cn.Done()
+	if queueLen, after := device.underLoadThreshold(); queueLen != QueueHandshakeSize/8 || after != UnderLoadAfterTime {
+		t.Errorf("defaults = %d, %v; want %d, %v", queueLen, after, QueueHandshakeSize/8, UnderLoadAfterTime)
+	}
+	for _, tt := range []struct {
+		fraction float64
+		after    time.Duration
+	}{
+		{0, time.Second},
+		{-0.5, time.Second},
+		{1.5, time.Second},
+		{0.5, 0},
+	} {
+		if err := device.SetUnderLoadThreshold(tt.fraction, tt.after); err == nil {
+			t.Errorf("SetUnderLoadThreshold(%v, %v) succeeded, want error", tt.fraction, tt.after)
+		}
+	}
+
+	if err := device.SetUnderLoadThreshold(1e-9, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if device.IsUnderLoad() {
+		t.Error("under load with an empty handshake queue")
+	}
+	device.queue.handshake.c <- QueueHandshakeElement{}
+	if !device.IsUnderLoad() {
+		t.Error("not under load with a single queued handshake and the lowest threshold")
+	}
+	<-device.queue.handshake.c
+	if !device.IsUnderLoad() {
+		t.Error("under load state did not persist")
+	}
+
+	if err := device.SetUnderLoadThreshold(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if queueLen, after := device.underLoadThreshold(); queueLen != QueueHandshakeSize/8 || after != UnderLoadAfterTime {
+		t.Errorf("defaults were not restored")
+	}
+}
+
+func TestDisableStickySockets(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	dev.DisableStickySockets(true)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	dev.net.RLock()
+	netlinkCancel := dev.net.netlinkCancel
+	dev.net.RUnlock()
+	if netlinkCancel != nil {
+		t.Error("route listener was started with sticky sockets disabled")
+	}
+	// Closing the bind must tolerate the missing route listener.
+	if err := dev.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Rebind(); err != nil {
+		t.Fatalf("Rebind on a down device failed: %v", err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	port := dev.ListenPort()
+	if err := dev.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.ListenPort(); got != port {
+		t.Errorf("port after Rebind = %d, want %d", got, port)
+	}
+}
+
+func TestUpPortInUse(t *testing.T) {
+	taken, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.IpcSet(fmt.Sprintf("listen_port=%d\n", port)); err != nil {
+		t.Fatal(err)
+	}
+	err = dev.Up()
+	if !errors.Is(err, conn.ErrPortInUse) {
+		t.Fatalf("Up on a port in use returned %v, want an error matching conn.ErrPortInUse", err)
+	}
+	if dev.isUp() {
+		t.Error("device is up after failing to open its bind")
+	}
+
+	// The caller can retry on an ephemeral port.
+	if err := dev.IpcSet("listen_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitUp(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
 
-	for n := 0; n < otrials; n++ {
-		pair := genTestPair(t, false, false)
-		for i := range pair {
-			for k := range pair[i].dev.peers.keyMap {
-				pair[i].dev.IpcSet(fmt.Sprintf("public_key=%s\npersistent_keepalive_interval=1\n", hex.EncodeToString(k[:])))
+	waitUp := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return dev.WaitUp(ctx)
+	}
+
+	// The device comes up with the TUN device's up event.
+	if err := waitUp(5 * time.Second); err != nil {
+		t.Fatalf("WaitUp returned %v", err)
+	}
+	dev.net.receiving.Lock()
+	open, pending := dev.net.receiving.open, dev.net.receiving.pending
+	dev.net.receiving.Unlock()
+	if !open || pending != 0 {
+		t.Fatalf("WaitUp returned with bind open %v and %d receive routines yet to start", open, pending)
+	}
+
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitUp(50 * time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitUp on a down device returned %v, want context.DeadlineExceeded", err)
+	}
+
+	// WaitUp started before Up returns once the receive routines run.
+	errs := make(chan error, 1)
+	go func() { errs <- waitUp(5 * time.Second) }()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("WaitUp returned %v after Up", err)
+	}
+
+	go func() { errs <- waitUp(5 * time.Second) }()
+	dev.Close()
+	if err := <-errs; !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("WaitUp returned %v when the device was closed, want ErrDeviceClosed", err)
+	}
+}
+
+func TestSetEndpoints(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	clock := newFakeClock()
+	if err := dev.SetClock(clock); err != nil {
+		t.Fatal(err)
+	}
+	_, pk := randomConfigKeys(t)
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActive := func(want int) {
+		t.Helper()
+		endpoint, i := peer.ActiveEndpoint()
+		if i != want {
+			t.Fatalf("active candidate %d (%v), want %d", i, endpoint, want)
+		}
+	}
+
+	peer.SetEndpoints([]conn.Endpoint{bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(2), bindtest.ChannelEndpoint(3)})
+	if endpoint, _ := peer.ActiveEndpoint(); endpoint != bindtest.ChannelEndpoint(1) {
+		t.Fatalf("endpoint %v, want the first candidate", endpoint)
+	}
+	checkActive(0)
+
+	// Failing over takes RekeyAttemptTime of handshake failures.
+	peer.failOverEndpoint(RekeyTimeout)
+	clock.Advance(RekeyAttemptTime - 2*RekeyTimeout)
+	peer.failOverEndpoint(RekeyTimeout)
+	checkActive(0)
+	clock.Advance(RekeyTimeout)
+	peer.failOverEndpoint(RekeyTimeout)
+	checkActive(1)
+
+	// A completed handshake restarts the failure time.
+	clock.Advance(RekeyAttemptTime - RekeyTimeout)
+	peer.resetEndpointFailOver()
+	clock.Advance(RekeyTimeout)
+	peer.failOverEndpoint(RekeyTimeout)
+	checkActive(1)
+
+	// Roaming overrides the active candidate, and failing over from there
+	// carries on with the next candidate in turn.
+	peer.SetEndpointFromPacket(bindtest.ChannelEndpoint(9))
+	checkActive(-1)
+	clock.Advance(RekeyAttemptTime)
+	peer.failOverEndpoint(RekeyTimeout)
+	checkActive(2)
+	clock.Advance(RekeyAttemptTime)
+	peer.failOverEndpoint(RekeyTimeout)
+	checkActive(0)
+
+	// Without candidates the endpoint is kept.
+	peer.SetEndpoints(nil)
+	clock.Advance(2 * RekeyAttemptTime)
+	peer.failOverEndpoint(RekeyTimeout)
+	if endpoint, i := peer.ActiveEndpoint(); endpoint != bindtest.ChannelEndpoint(1) || i != -1 {
+		t.Fatalf("endpoint %v (candidate %d) after removing the candidates, want the first one kept", endpoint, i)
+	}
+}
+
+func TestSetEndpointsRetransmitFailOver(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	clock := newFakeClock()
+	if err := dev.SetClock(clock); err != nil {
+		t.Fatal(err)
+	}
+	// Give up after 4 retransmissions of 1 second each.
+	if err := dev.SetHandshakeTimeouts(time.Second, 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sk, _ := randomConfigKeys(t)
+	_, pk := randomConfigKeys(t)
+	err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", hex.EncodeToString(pk[:]),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	// The initiations sent to the bind's targets are never answered.
+	peer.SetEndpoints([]conn.Endpoint{bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(3)})
+	if err := peer.InitiateHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	failOver := func(want int) {
+		t.Helper()
+		for elapsed := time.Duration(0); elapsed < 6*time.Second; elapsed += 100 * time.Millisecond {
+			clock.Advance(100 * time.Millisecond)
+			if _, i := peer.ActiveEndpoint(); i == want {
+				return
 			}
 		}
-		var cn sync.WaitGroup
-		cn.Add(len(pair))
-		for i := range pair {
-			go func(d *Device) {
-				defer cn.Done()
-				for i := 0; i < itrials; i++ {
-					if err := d.Up(); err != nil {
-						t.Errorf("failed up bring up device: %v", err)
-					}
-					time.Sleep(time.Duration(rand.Intn(int(time.Nanosecond * (0x10000 - 1)))))
-					if err := d.Down(); err != nil {
-						t.Errorf("failed to bring down device: %v", err)
-					}
-					time.Sleep(time.Duration(rand.Intn(int(time.Nanosecond * (0x10000 - 1)))))
-				}
-			}(pair[i].dev)
+		endpoint, i := peer.ActiveEndpoint()
+		t.Fatalf("active candidate %d (%v) 6 seconds into failing handshakes, want %d", i, endpoint, want)
+	}
+
+	// Failing over takes the configured attempt time, and the retransmit
+	// timer does not give up on the new endpoint before trying it for as
+	// long.
+	failOver(1)
+	failOver(0)
+}
+
+func TestEndpointErrorHandler(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("endpoint errors are only reported on Linux")
+	}
+	// Find a port nothing listens on.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, _ := randomConfigKeys(t)
+	_, pk := randomConfigKeys(t)
+	err = dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", fmt.Sprintf("127.0.0.1:%d", port),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type report struct {
+		key NoisePublicKey
+		err error
+	}
+	reports := make(chan report, 1)
+	dev.SetEndpointErrorHandler(func(key NoisePublicKey, err error) {
+		select {
+		case reports <- report{key, err}:
+		default:
 		}
-		cn.Wait()
-		for i := range pair {
-			pair[i].dev.Up()
-			pair[i].dev.Close()
+	})
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	dev.LookupPeer(pk).SendHandshakeInitiation(false)
+
+	select {
+	case r := <-reports:
+		var epErr *conn.EndpointError
+		if r.key != pk || !errors.As(r.err, &epErr) || !errors.Is(r.err, syscall.ECONNREFUSED) {
+			t.Errorf("handler called with %x, %v; want %x and connection refused", r.key[:], r.err, pk[:])
 		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the endpoint error")
 	}
 }
 
-// TestConcurrencySafety does other things concurrently with tunnel use.
-// It is intended to be used with the race detector to catch data races.
-func TestConcurrencySafety(t *testing.T) {
-	pair := genTestPair(t, true, false)
-	done := make(chan struct{})
+func TestEndpointErrorRateLimit(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	_, pk := randomConfigKeys(t)
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SetEndpoint(bindtest.ChannelEndpoint(1)); err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	dev.SetEndpointErrorHandler(func(key NoisePublicKey, err error) {
+		if key != pk {
+			t.Errorf("handler called for %x, want %x", key[:], pk[:])
+		}
+		calls++
+	})
 
-	const warmupIters = 10
-	var warmup sync.WaitGroup
-	warmup.Add(warmupIters)
+	// A flood of errors is only handled up to the burst.
+	for i := 0; i < 10*endpointErrorBurst; i++ {
+		dev.handleEndpointError(&conn.EndpointError{Endpoint: bindtest.ChannelEndpoint(1), Err: syscall.ECONNREFUSED})
+	}
+	if calls != endpointErrorBurst {
+		t.Errorf("handler called %d times, want %d", calls, endpointErrorBurst)
+	}
+}
+
+func TestBindToInterface(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.BindToInterface("lo"); err == nil {
+		t.Error("expected binding a channel bind to an interface to fail")
+	}
+
+	dev = NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	err := dev.BindToInterface("lo")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to an interface is not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Rebind(); err != nil {
+		t.Fatalf("Rebind while bound to an interface failed: %v", err)
+	}
+	if err := dev.BindToInterface("does-not-exist"); err == nil && (runtime.GOOS == "linux" || runtime.GOOS == "android") {
+		t.Error("expected binding to a missing interface to fail")
+	}
+}
+
+func TestSetAddressFamilies(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.SetAddressFamilies(conn.AddressFamiliesV4Only); err == nil {
+		t.Error("expected selecting address families on a channel bind to fail")
+	}
+
+	dev = NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetAddressFamilies(0); err == nil {
+		t.Error("expected disabling both address families to fail")
+	}
+	if err := dev.SetAddressFamilies(conn.AddressFamiliesV4Only); err != nil {
+		t.Fatal(err)
+	}
+	dev.net.RLock()
+	port := dev.net.port
+	dev.net.RUnlock()
+	if port == 0 {
+		t.Error("bind was not reopened")
+	}
+}
+
+func TestSetSocketBufferSize(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.SetSocketBufferSize(1 << 20); err == nil {
+		t.Error("expected setting the socket buffer size of a channel bind to fail")
+	}
+
+	dev = NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetSocketBufferSize(-1); err == nil {
+		t.Error("expected a negative socket buffer size to fail")
+	}
+	const size = 64 << 10
+	if err := dev.SetSocketBufferSize(size); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.BindConfig().SocketBufferSize; got != size {
+		t.Errorf("BindConfig().SocketBufferSize = %d, want %d", got, size)
+	}
+	// The size is applied again when the bind is reopened.
+	if err := dev.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	recv, _, err := dev.Bind().(conn.SocketBufferSizer).SocketBufferSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recv < size || recv > 2*size {
+		t.Errorf("receive buffer size after rebinding = %d, want %d", recv, size)
+	}
+}
+
+func TestSetNetworkNamespace(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.SetNetworkNamespace("/proc/self/ns/net"); err == nil {
+		t.Error("expected setting the network namespace of a channel bind to fail")
+	}
+
+	dev = NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" {
+		if err := dev.SetNetworkNamespace("/nonexistent/ns/net"); err == nil {
+			t.Error("expected a network namespace that does not exist to fail")
+		}
+		if got := dev.BindConfig().NetworkNamespace; got != "" {
+			t.Errorf("BindConfig().NetworkNamespace = %q after a failed set, want \"\"", got)
+		}
+	}
+	if err := dev.SetNetworkNamespace(""); err != nil {
+		t.Fatal(err)
+	}
+	if dev.ListenPort() == 0 {
+		t.Error("bind not reopened")
+	}
+}
+
+func TestBindConfig(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if got, want := dev.BindConfig(), (BindConfig{Families: conn.AddressFamiliesBoth}); got != want {
+		t.Errorf("BindConfig() of a new device = %+v, want %+v", got, want)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetAddressFamilies(conn.AddressFamiliesV4Only); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.BindSetMark(0x42); err != nil {
+		t.Skipf("setting a mark is not permitted here: %v", err)
+	}
+	cfg := dev.BindConfig()
+	if cfg.Port == 0 || cfg.Port != dev.ListenPort() {
+		t.Errorf("BindConfig().Port = %d, want the listening port %d", cfg.Port, dev.ListenPort())
+	}
+	if cfg.Fwmark != 0x42 || dev.Fwmark() != 0x42 {
+		t.Errorf("fwmark = %#x and %#x, want 0x42", cfg.Fwmark, dev.Fwmark())
+	}
+	if cfg.Families != conn.AddressFamiliesV4Only {
+		t.Errorf("BindConfig().Families = %v, want %v", cfg.Families, conn.AddressFamiliesV4Only)
+	}
+}
+
+func TestPeerSetFwmark(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if err := peer.SetFwmark(0x1234); err == nil {
+		t.Error("expected setting a per-peer mark on a channel bind to fail")
+	}
+	if err := peer.SetFwmark(0); err != nil {
+		t.Errorf("restoring the device-wide mark failed: %v", err)
+	}
+	pair.Send(t, Ping, nil)
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		return
+	}
+	pair = genTestPair(t, true, false)
+	peer = pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if err := peer.SetFwmark(0x1234); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the marked handshake can go through before relying on it.
+	if err := peer.SendBuffers([][]byte{{0}}); errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) {
+		t.Skipf("per-send marks are not supported here: %v", err)
+	}
+	pair.Send(t, Pong, nil)
+}
+
+func TestPinEndpointSource(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	src := netip.MustParseAddr("198.51.100.7")
+	if err := peer.PinEndpointSource(netip.Addr{}); err == nil {
+		t.Error("expected pinning an invalid source address to fail")
+	}
+	if err := peer.PinEndpointSource(src); err == nil {
+		t.Error("expected pinning the source of a channel endpoint to fail")
+	}
+
+	sourceBeforeSend := func() netip.Addr {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		if err := peer.prepareEndpointSrcLocked(peer.endpoint.val); err != nil {
+			t.Fatal(err)
+		}
+		return peer.endpoint.val.SrcIP()
+	}
+	peer.SetEndpoint(&conn.MultiEndpoint{AddrPort: netip.MustParseAddrPort("192.0.2.1:51820")})
+	if err := peer.PinEndpointSource(src); err != nil {
+		t.Fatal(err)
+	}
+	// The pinned source survives clearing and roaming.
+	peer.markEndpointSrcForClearing()
+	if got := sourceBeforeSend(); got != src {
+		t.Errorf("source after clearing is %v, want %v", got, src)
+	}
+	roamed := &conn.MultiEndpoint{AddrPort: netip.MustParseAddrPort("192.0.2.2:51820")}
+	roamed.SetSrc(netip.MustParseAddr("203.0.113.1"))
+	peer.SetEndpointFromPacket(roamed)
+	if got := sourceBeforeSend(); got != src {
+		t.Errorf("source after roaming is %v, want %v", got, src)
+	}
+
+	peer.UnpinEndpointSource()
+	if got := sourceBeforeSend(); got.IsValid() {
+		t.Errorf("source after unpinning is %v, want it cleared", got)
+	}
+}
+
+func TestPeerSetReplayWindow(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	for _, size := range []int{0, 1000, replay.MaxWindowSize * 2} {
+		if err := peer.SetReplayWindow(size); err == nil {
+			t.Errorf("SetReplayWindow(%d) succeeded", size)
+		}
+	}
+	const size = 1 << 16
+	if err := peer.SetReplayWindow(size); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+
+	peer.keypairs.RLock()
+	keypair := peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if keypair == nil || keypair.replayFilter.WindowSize() != size {
+		t.Fatalf("keypair after handshake does not have a replay window of %d", size)
+	}
+	// Counters reordered by more than the default window must all pass.
+	const lag = 30000
+	for _, counter := range []uint64{2*lag + 100, lag + 100, 100} {
+		if !keypair.replayFilter.ValidateCounter(counter, RejectAfterMessages) {
+			t.Errorf("counter %d reordered within the window was dropped", counter)
+		}
+	}
+}
+
+func TestRemovePeerGraceful(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	dev := pair[0].dev
+	if err := dev.RemovePeerGraceful(NoisePublicKey{}, time.Second); err == nil {
+		t.Error("expected removing a missing peer to fail")
+	}
+	key := dev.Peers()[0]
+	if err := dev.RemovePeerGraceful(key, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(key) != nil {
+		t.Error("peer was not removed")
+	}
+	if _, ok := dev.LookupRoute(pair[1].ip); ok {
+		t.Error("allowed ips of the removed peer are still routed")
+	}
+
+	// Packets that can never be sent, because the peer has no endpoint,
+	// are dropped once the drain timeout passes.
+	dev = pair[1].dev
+	key = dev.Peers()[0]
+	peer := dev.LookupPeer(key)
+	peer.endpoint.Lock()
+	peer.endpoint.val = nil
+	peer.endpoint.Unlock()
+	peer.ExpireCurrentKeypairs()
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	for start := time.Now(); len(peer.queue.staged) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("packet was not staged")
+		}
+	}
+	const drain = 50 * time.Millisecond
+	start := time.Now()
+	if err := dev.RemovePeerGraceful(key, drain); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < drain {
+		t.Errorf("removal took %v, want at least %v", elapsed, drain)
+	}
+	if dev.LookupPeer(key) != nil {
+		t.Error("peer was not removed after the drain timeout")
+	}
+
+	// A peer added again under the same key during the drain is left in
+	// place, and configuration changes wait for the removal to finish.
+	config := fmt.Sprintf("public_key=%s\nallowed_ip=%v/32\n", hex.EncodeToString(key[:]), pair[0].ip)
+	if err := dev.IpcSet(config); err != nil {
+		t.Fatal(err)
+	}
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	for start := time.Now(); len(dev.LookupPeer(key).queue.staged) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("packet was not staged")
+		}
+	}
+	removed := make(chan error)
 	go func() {
-		// Send data continuously back and forth until we're done.
-		// Note that we may continue to attempt to send data
-		// even after done is closed.
-		i := warmupIters
-		for ping := Ping; ; ping = !ping {
-			pair.Send(t, ping, done)
-			select {
-			case <-done:
-				return
-			default:
-			}
-			if i > 0 {
-				warmup.Done()
-				i--
-			}
+		removed <- dev.RemovePeerGraceful(key, 5*time.Second)
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if _, ok := dev.LookupRoute(pair[0].ip); !ok {
+			break
 		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("allowed ips were not removed")
+		}
+	}
+	set := make(chan error)
+	go func() {
+		set <- dev.IpcSet(config)
 	}()
-	warmup.Wait()
+	dev.RemovePeer(key)
+	readded, err := dev.NewPeer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-set; err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(key) != readded {
+		t.Error("peer added during the drain was removed")
+	}
+	if got, ok := dev.LookupRoute(pair[0].ip); !ok || got != key {
+		t.Error("allowed ips set during the drain were not applied")
+	}
+}
 
-	applyCfg := func(cfg string) {
-		err := pair[0].dev.IpcSet(cfg)
-		if err != nil {
-			t.Fatal(err)
+func TestCloseGraceful(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// The peer is sent a final keepalive.
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	rx := peer.rxBytes.Load()
+	pair[1].dev.CloseGraceful(time.Second)
+	if !pair[1].dev.isClosed() {
+		t.Fatal("device not closed")
+	}
+	for start := time.Now(); peer.rxBytes.Load() == rx; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("no keepalive received from the closed device")
 		}
 	}
 
-	// Change persistent_keepalive_interval concurrently with tunnel use.
-	t.Run("persistentKeepaliveInterval", func(t *testing.T) {
-		var pub NoisePublicKey
-		for key := range pair[0].dev.peers.keyMap {
-			pub = key
-			break
+	// Packets that can never be sent, because the peer has no endpoint,
+	// are dropped once the drain timeout passes.
+	dev := pair[0].dev
+	peer.endpoint.Lock()
+	peer.endpoint.val = nil
+	peer.endpoint.Unlock()
+	peer.ExpireCurrentKeypairs()
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	for start := time.Now(); len(peer.queue.staged) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("packet was not staged")
+		}
+	}
+	const drain = 50 * time.Millisecond
+	start := time.Now()
+	dev.CloseGraceful(drain)
+	if elapsed := time.Since(start); elapsed < drain {
+		t.Errorf("closing took %v, want at least %v", elapsed, drain)
+	}
+	if !dev.isClosed() {
+		t.Error("device not closed after the drain timeout")
+	}
+}
+
+func TestSetMaxPeers(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	isLimitError := func(err error) bool {
+		return errors.Is(err, ipc.IpcErrorInvalid) &&
+			strings.Contains(err.Error(), "peer limit reached")
+	}
+
+	// Concurrent adds never exceed the limit.
+	const limit = 4
+	dev.SetMaxPeers(limit)
+	var wg sync.WaitGroup
+	var added atomic.Int32
+	for i := 0; i < 4*limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, pk := randomConfigKeys(t)
+			_, err := dev.NewPeer(pk)
+			if err == nil {
+				added.Add(1)
+			} else if !isLimitError(err) {
+				t.Errorf("NewPeer failed with %v, want the peer limit", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added.Load() != limit || dev.PeerCount() != limit {
+		t.Fatalf("added %d peers and have %d, want %d", added.Load(), dev.PeerCount(), limit)
+	}
+
+	_, pk := randomConfigKeys(t)
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]))); !isLimitError(err) {
+		t.Errorf("IpcSet beyond the limit returned %v, want the peer limit", err)
+	}
+	if dev.LookupPeer(pk) != nil {
+		t.Error("peer beyond the limit was created")
+	}
+	desired := make([]PeerConfig, limit+1)
+	for i := range desired {
+		_, desired[i].PublicKey = randomConfigKeys(t)
+	}
+	if err := dev.ReplacePeers(desired); !isLimitError(err) {
+		t.Errorf("ReplacePeers beyond the limit returned %v, want the peer limit", err)
+	}
+	if err := dev.ReplacePeers(desired[:limit]); err != nil {
+		t.Fatal(err)
+	}
+
+	dev.SetMaxPeers(0)
+	if _, err := dev.NewPeer(pk); err != nil {
+		t.Errorf("NewPeer without a limit failed: %v", err)
+	}
+}
+
+func TestHandshakeBackoff(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	peer.SetHandshakeBackoff(10*time.Second, 40*time.Second, 2)
+
+	want := []time.Duration{RekeyTimeout, 10 * time.Second, 20 * time.Second, 40 * time.Second, 40 * time.Second}
+	for i, w := range want {
+		if i > 0 {
+			peer.handshakeInitiationFailed()
 		}
-		cfg := uapiCfg(
-			"public_key", hex.EncodeToString(pub[:]),
-			"persistent_keepalive_interval", "1",
-		)
-		for i := 0; i < 1000; i++ {
-			applyCfg(cfg)
+		if got := peer.handshakeRetryInterval(); got != w {
+			t.Fatalf("retry interval after %d failures = %v, want %v", i, got, w)
 		}
-	})
+	}
 
-	// Change private keys concurrently with tunnel use.
-	t.Run("privateKey", func(t *testing.T) {
-		bad := uapiCfg("private_key", "7777777777777777777777777777777777777777777777777777777777777777")
-		good := uapiCfg("private_key", hex.EncodeToString(pair[0].dev.staticIdentity.privateKey[:]))
-		// Set iters to a large number like 1000 to flush out data races quickly.
-		// Don't leave it large. That can cause logical races
-		// in which the handshake is interleaved with key changes
-		// such that the private key appears to be unchanging but
-		// other state gets reset, which can cause handshake failures like
-		// "Received packet with invalid mac1".
-		const iters = 1
-		for i := 0; i < iters; i++ {
-			applyCfg(bad)
-			applyCfg(good)
-		}
-	})
+	// New traffic does not cause an initiation before the backoff elapsed.
+	sent := time.Now().Add(-2 * RekeyTimeout)
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = sent
+	peer.handshake.mutex.Unlock()
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		t.Fatal(err)
+	}
+	peer.handshake.mutex.RLock()
+	suppressed := peer.handshake.lastSentHandshake.Equal(sent)
+	peer.handshake.mutex.RUnlock()
+	if !suppressed {
+		t.Fatal("initiation sent during the backoff")
+	}
 
-	// Perform bind updates and keepalive sends concurrently with tunnel use.
-	t.Run("bindUpdate and keepalive", func(t *testing.T) {
-		const iters = 10
-		for i := 0; i < iters; i++ {
-			for _, peer := range pair {
-				peer.dev.BindUpdate()
-				peer.dev.SendKeepalivesToPeersWithCurrentKeypair()
-			}
-		}
-	})
+	// A successful handshake resets the backoff.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Time{}
+	peer.handshake.mutex.Unlock()
+	pair.Send(t, Ping, nil)
+	if got := peer.handshakeRetryInterval(); got != RekeyTimeout {
+		t.Fatalf("retry interval after a handshake = %v, want %v", got, RekeyTimeout)
+	}
 
-	close(done)
+	// A base of zero turns the backoff off.
+	peer.handshakeInitiationFailed()
+	peer.SetHandshakeBackoff(0, 0, 0)
+	if got := peer.handshakeRetryInterval(); got != RekeyTimeout {
+		t.Fatalf("retry interval without backoff = %v, want %v", got, RekeyTimeout)
+	}
 }
 
-func BenchmarkLatency(b *testing.B) {
-	pair := genTestPair(b, true, false)
+func TestCryptoRoutingDropHook(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
 
-	// Establish a connection.
-	pair.Send(b, Ping, nil)
-	pair.Send(b, Pong, nil)
+	type drop struct {
+		pk  NoisePublicKey
+		src netip.Addr
+	}
+	drops := make(chan drop, 1)
+	pair[0].dev.SetCryptoRoutingDropHook(func(pk NoisePublicKey, src netip.Addr) {
+		drops <- drop{pk, src}
+	})
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		pair.Send(b, Ping, nil)
-		pair.Send(b, Pong, nil)
+	// pair[1] may only send from 1.0.0.2.
+	spoofed := netip.MustParseAddr("1.0.0.99")
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, spoofed)
+	select {
+	case d := <-drops:
+		if d.pk != pair[1].dev.staticIdentity.publicKey || d.src != spoofed {
+			t.Errorf("hook called with %x, %v; want %x, %v", d.pk[:], d.src, pair[1].dev.staticIdentity.publicKey[:], spoofed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook not called for a packet from a disallowed source")
+	}
+
+	// Allowed packets do not call the hook.
+	pair.Send(t, Ping, nil)
+	select {
+	case d := <-drops:
+		t.Fatalf("hook called for an allowed packet from %v", d.src)
+	default:
+	}
+
+	pair[0].dev.SetCryptoRoutingDropHook(nil)
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, spoofed)
+	pair.Send(t, Ping, nil)
+	select {
+	case d := <-drops:
+		t.Fatalf("removed hook called for %v", d.src)
+	default:
 	}
 }
 
-func BenchmarkThroughput(b *testing.B) {
-	pair := genTestPair(b, true, false)
+func TestInboundTap(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
 
-	// Establish a connection.
-	pair.Send(b, Ping, nil)
-	pair.Send(b, Pong, nil)
+	type tapped struct {
+		pk     NoisePublicKey
+		packet []byte
+	}
+	taps := make(chan tapped, 2)
+	var allow atomic.Bool
+	allow.Store(true)
+	pair[0].dev.SetInboundTap(func(pk NoisePublicKey, packet []byte) bool {
+		taps <- tapped{pk, bytes.Clone(packet)}
+		return allow.Load()
+	})
 
-	// Measure how long it takes to receive b.N packets,
-	// starting when we receive the first packet.
-	var recv atomic.Uint64
-	var elapsed time.Duration
-	var cn sync.WaitGroup
-	cn.Add(1)
-	go func() {
-		defer cn.Done()
-		var start time.Time
-		for {
-			<-pair[0].tun.Inbound
-			new := recv.Add(1)
-			if new == 1 {
-				start = time.Now()
-			}
-			// Careful! Don't change this to else if; b.N can be equal to 1.
-			if new == uint64(b.N) {
-				elapsed = time.Since(start)
-				return
-			}
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair.Send(t, Ping, nil)
+	select {
+	case tp := <-taps:
+		if tp.pk != pair[1].dev.staticIdentity.publicKey || !bytes.Equal(tp.packet, ping) {
+			t.Errorf("tap called with %x, %x; want %x, %x", tp.pk[:], tp.packet, pair[1].dev.staticIdentity.publicKey[:], ping)
 		}
-	}()
+	default:
+		t.Fatal("tap not called for a delivered packet")
+	}
 
-	// Send packets as fast as we can until we've received enough.
-	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
-	pingc := pair[1].tun.Outbound
-	var sent uint64
-	for recv.Load() != uint64(b.N) {
-		sent++
-		pingc <- ping
+	// A packet the tap rejects is not written to the TUN device, and the
+	// packets after it are.
+	allow.Store(false)
+	pair[1].tun.Outbound <- ping
+	select {
+	case <-taps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tap not called")
+	}
+	allow.Store(true)
+	pair.Send(t, Ping, nil)
+	<-taps
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("packet rejected by the tap was delivered")
+	case <-time.After(100 * time.Millisecond):
 	}
-	cn.Wait()
 
-	b.ReportMetric(float64(elapsed)/float64(b.N), "ns/op")
-	b.ReportMetric(1-float64(b.N)/float64(sent), "packet-loss")
+	pair[0].dev.SetInboundTap(nil)
+	pair.Send(t, Ping, nil)
+	select {
+	case <-taps:
+		t.Fatal("removed tap called")
+	default:
+	}
 }
 
-func BenchmarkUAPIGet(b *testing.B) {
-	pair := genTestPair(b, true, false)
-	pair.Send(b, Ping, nil)
-	pair.Send(b, Pong, nil)
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		pair[0].dev.IpcGetOperation(io.Discard)
+func TestOutboundTap(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	pair.Send(t, Ping, nil)
+
+	taps := make(chan []byte, 2)
+	var allow atomic.Bool
+	allow.Store(true)
+	pair[1].dev.SetOutboundTap(func(packet []byte) bool {
+		taps <- bytes.Clone(packet)
+		return allow.Load()
+	})
+
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair.Send(t, Ping, nil)
+	select {
+	case packet := <-taps:
+		if !bytes.Equal(packet, ping) {
+			t.Errorf("tap called with %x, want %x", packet, ping)
+		}
+	default:
+		t.Fatal("tap not called for a sent packet")
+	}
+
+	// A packet the tap rejects is not sent.
+	allow.Store(false)
+	pair[1].tun.Outbound <- ping
+	select {
+	case <-taps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tap not called")
+	}
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("packet rejected by the tap was sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+	allow.Store(true)
+	pair.Send(t, Ping, nil)
+	<-taps
+
+	pair[1].dev.SetOutboundTap(nil)
+	pair.Send(t, Ping, nil)
+	select {
+	case <-taps:
+		t.Fatal("removed tap called")
+	default:
 	}
 }
 
-func goroutineLeakCheck(t *testing.T) {
-	goroutines := func() (int, []byte) {
-		p := pprof.Lookup("goroutine")
-		b := new(bytes.Buffer)
-		p.WriteTo(b, 1)
-		return p.Count(), b.Bytes()
+func TestPeerSetPresharedKey(t *testing.T) {
+	goroutineLeakCheck(t)
+	var psk, otherPSK NoisePresharedKey
+	if _, err := rand.Read(psk[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(otherPSK[:]); err != nil {
+		t.Fatal(err)
+	}
+	peers := func(pair testPair) (*Peer, *Peer) {
+		return pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey),
+			pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
 	}
 
-	startGoroutines, startStacks := goroutines()
-	t.Cleanup(func() {
-		if t.Failed() {
-			return
+	t.Run("matching", func(t *testing.T) {
+		pair := genTestPair(t, false, false)
+		peer0, peer1 := peers(pair)
+		if err := peer0.SetPresharedKey(psk); err != nil {
+			t.Fatal(err)
 		}
-		// Give goroutines time to exit, if they need it.
-		for i := 0; i < 10000; i++ {
-			if runtime.NumGoroutine() <= startGoroutines {
-				return
+		if err := peer1.SetPresharedKey(psk); err != nil {
+			t.Fatal(err)
+		}
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+		if cfg := peerConfig(t, peer0); cfg.PresharedKey != psk {
+			t.Errorf("configured preshared key %x, want %x", cfg.PresharedKey[:], psk[:])
+		}
+
+		// Changing the key of an established session rehandshakes.
+		sent := pair[0].dev.HandshakeStats().InitiationsSent
+		peer0.ClearPresharedKey()
+		if cfg := peerConfig(t, peer0); cfg.PresharedKey != (NoisePresharedKey{}) {
+			t.Errorf("preshared key %x not cleared", cfg.PresharedKey[:])
+		}
+		if n := pair[0].dev.HandshakeStats().InitiationsSent; n != sent+1 {
+			t.Errorf("sent %d initiations after clearing the key, want %d", n, sent+1)
+		}
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		pair := genTestPair(t, false, false)
+		peer0, peer1 := peers(pair)
+		if err := peer0.SetPresharedKey(psk); err != nil {
+			t.Fatal(err)
+		}
+		if err := peer1.SetPresharedKey(otherPSK); err != nil {
+			t.Fatal(err)
+		}
+		// The initiator cannot authenticate the response, which mixes in the
+		// responder's key, so no packet gets through.
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+		deadline := time.Now().Add(5 * time.Second)
+		for pair[1].dev.HandshakeStats().ResponsesFailed == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("response to a mismatched preshared key was not rejected")
 			}
-			time.Sleep(1 * time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case <-pair[0].tun.Inbound:
+			t.Fatal("packet transited despite mismatched preshared keys")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if peer1.keypairs.Current() != nil {
+			t.Fatal("initiator derived a session with a mismatched preshared key")
 		}
-		endGoroutines, endStacks := goroutines()
-		t.Logf("starting stacks:\n%s\n", startStacks)
-		t.Logf("ending stacks:\n%s\n", endStacks)
-		t.Fatalf("expected %d goroutines, got %d, leak?", startGoroutines, endGoroutines)
 	})
-}
 
-type fakeBindSized struct {
-	size int
+	t.Run("removed", func(t *testing.T) {
+		pair := genTestPair(t, false, false)
+		peer0, _ := peers(pair)
+		pair[0].dev.RemovePeer(pair[1].dev.staticIdentity.publicKey)
+		if err := peer0.SetPresharedKey(psk); err == nil {
+			t.Fatal("set the preshared key of a removed peer")
+		}
+	})
 }
 
-func (b *fakeBindSized) Open(
-	port uint16,
-) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
-	return nil, 0, nil
-}
-func (b *fakeBindSized) Close() error                                  { return nil }
-func (b *fakeBindSized) SetMark(mark uint32) error                     { return nil }
-func (b *fakeBindSized) Send(bufs [][]byte, ep conn.Endpoint) error    { return nil }
-func (b *fakeBindSized) ParseEndpoint(s string) (conn.Endpoint, error) { return nil, nil }
-func (b *fakeBindSized) BatchSize() int                                { return b.size }
+func TestForEachPeer(t *testing.T) {
+	goroutineLeakCheck(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	want := make(map[NoisePublicKey]bool)
+	for i := 0; i < 5; i++ {
+		_, pk := randomConfigKeys(t)
+		if _, err := dev.NewPeer(pk); err != nil {
+			t.Fatal(err)
+		}
+		want[pk] = true
+	}
 
-type fakeTUNDeviceSized struct {
-	size int
-}
+	seen := make(map[NoisePublicKey]bool)
+	dev.ForEachPeer(func(pk NoisePublicKey, peer *Peer) bool {
+		if peer.handshake.remoteStatic != pk {
+			t.Errorf("peer %v passed with key %x", peer, pk[:])
+		}
+		if seen[pk] {
+			t.Errorf("peer %x visited twice", pk[:])
+		}
+		seen[pk] = true
+		return true
+	})
+	if !maps.Equal(seen, want) {
+		t.Errorf("visited %d peers, want %d", len(seen), len(want))
+	}
 
-func (t *fakeTUNDeviceSized) File() *os.File { return nil }
-func (t *fakeTUNDeviceSized) Read(bufs [][]byte, sizes []int, offset int) (n int, err error) {
-	return 0, nil
+	visited := 0
+	dev.ForEachPeer(func(NoisePublicKey, *Peer) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Errorf("visited %d peers after fn returned false on the second, want 2", visited)
+	}
 }
-func (t *fakeTUNDeviceSized) Write(bufs [][]byte, offset int) (int, error) { return 0, nil }
-func (t *fakeTUNDeviceSized) MTU() (int, error)                            { return 0, nil }
-func (t *fakeTUNDeviceSized) Name() (string, error)                        { return "", nil }
-func (t *fakeTUNDeviceSized) Events() <-chan tun.Event                     { return nil }
-func (t *fakeTUNDeviceSized) Close() error                                 { return nil }
-func (t *fakeTUNDeviceSized) BatchSize() int                               { return t.size }
 
-func TestBatchSize(t *testing.T) {
-	d := Device{}
+func TestRemovePeerOK(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	_, pk := randomConfigKeys(t)
+	if dev.RemovePeerOK(pk) {
+		t.Fatal("removed a peer that does not exist")
+	}
+	if _, err := dev.NewPeer(pk); err != nil {
+		t.Fatal(err)
+	}
 
-	d.net.bind = &fakeBindSized{1}
-	d.tun.device = &fakeTUNDeviceSized{1}
-	if want, got := 1, d.BatchSize(); got != want {
-		t.Errorf("expected batch size %d, got %d", want, got)
+	// Of concurrent removals, exactly one removes the peer.
+	var removed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if dev.RemovePeerOK(pk) {
+				removed.Add(1)
+			}
+		}()
 	}
+	wg.Wait()
+	if n := removed.Load(); n != 1 {
+		t.Fatalf("%d removals reported success, want 1", n)
+	}
+	if dev.LookupPeer(pk) != nil {
+		t.Fatal("peer still present")
+	}
+}
 
-	d.net.bind = &fakeBindSized{1}
-	d.tun.device = &fakeTUNDeviceSized{128}
-	if want, got := 128, d.BatchSize(); got != want {
-		t.Errorf("expected batch size %d, got %d", want, got)
+func TestUnknownPeerPolicy(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false, false)
+	server := pair[0].dev
+	serverPK := server.staticIdentity.publicKey
+	// Under load, handshake messages without a valid mac2 get a cookie reply.
+	server.rate.underLoadUntil.Store(time.Now().Add(time.Hour).UnixNano())
+
+	stranger := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer stranger.Close()
+	sk, _ := randomConfigKeys(t)
+	if err := stranger.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stranger.NewPeer(serverPK); err != nil {
+		t.Fatal(err)
 	}
 
-	d.net.bind = &fakeBindSized{128}
-	d.tun.device = &fakeTUNDeviceSized{1}
-	if want, got := 128, d.BatchSize(); got != want {
-		t.Errorf("expected batch size %d, got %d", want, got)
+	// inject queues an initiation from dev to the server's handshake workers.
+	inject := func(dev *Device) {
+		t.Helper()
+		peer := dev.LookupPeer(serverPK)
+		msg, err := dev.CreateMessageInitiation(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, msg)
+		packet := buf.Bytes()
+		peer.cookieGenerator.AddMacs(packet)
+		elem := QueueHandshakeElement{
+			msgType:  defaultMessageInitiationType,
+			endpoint: bindtest.ChannelEndpoint(1),
+			buffer:   server.GetMessageBuffer(),
+		}
+		elem.packet = elem.buffer[:copy(elem.buffer[:], packet)]
+		server.queue.handshake.c <- elem
+	}
+	cookieReplies := func(want uint64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for server.HandshakeStats().CookieRepliesSent != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("sent %d cookie replies, want %d", server.HandshakeStats().CookieRepliesSent, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
 	}
 
-	d.net.bind = &fakeBindSized{128}
-	d.tun.device = &fakeTUNDeviceSized{128}
-	if want, got := 128, d.BatchSize(); got != want {
-		t.Errorf("expected batch size %d, got %d", want, got)
+	inject(stranger)
+	cookieReplies(1)
+
+	server.SetUnknownPeerPolicy(UnknownPeerDrop)
+	inject(stranger)
+	inject(pair[1].dev)
+	cookieReplies(2)
+	time.Sleep(10 * time.Millisecond)
+	cookieReplies(2)
+
+	// A response to no initiation of the server's is unknown too.
+	response := &QueueHandshakeElement{msgType: defaultMessageResponseType, packet: make([]byte, MessageResponseSize)}
+	if !server.dropsUnknownPeer(response) {
+		t.Error("response with an unknown receiver index not dropped")
+	}
+	server.SetUnknownPeerPolicy(UnknownPeerDefault)
+	if server.dropsUnknownPeer(response) {
+		t.Error("dropped under the default policy")
 	}
 }
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A dropReason tells why a packet was dropped. It is logged as is,
+// and NewSlogLogger attaches it to the record as the "drop_reason" attribute.
+type dropReason string
+
+const (
+	dropNoAllowedIP dropReason = "no-allowed-ip" // no peer has an allowed IP matching the destination
+	dropAuthFail    dropReason = "auth-fail"     // a transport message failed authentication
+	dropReplay      dropReason = "replay"        // a transport message was replayed or too old
+	dropUnderLoad   dropReason = "under-load"    // a handshake was answered with a cookie reply or rate limited
+	dropUnknownPeer dropReason = "unknown-peer"  // a handshake from an unknown key was dropped; see SetUnknownPeerPolicy
+	dropInboundTap  dropReason = "inbound-tap"   // a decrypted packet was rejected by the inbound tap; see SetInboundTap
+	dropOutboundTap dropReason = "outbound-tap"  // a packet from the TUN device was rejected by the outbound tap; see SetOutboundTap
+	dropBufferLimit dropReason = "buffer-limit"  // a buffer pool was exhausted; see SetBufferLimitMode
+)
+
+// Drop logging logs at most dropLogBurst drops per dropLogInterval,
+// so that a flood does not flood the log as well.
+const (
+	dropLogBurst    = 10
+	dropLogInterval = time.Second
+)
+
+// dropLog samples the logging of dropped packets; see SetDropLogging.
+type dropLog struct {
+	enabled atomic.Bool
+
+	sync.Mutex
+	start      time.Time // start of the current interval
+	logged     int       // drops logged in the current interval
+	suppressed int       // drops not logged in the current interval
+}
+
+// SetDropLogging enables or disables verbose logging of dropped packets,
+// which is disabled by default. Each drop is logged with its reason:
+// no-allowed-ip for outgoing packets that match no peer's allowed IPs,
+// auth-fail for incoming packets that fail decryption, replay for incoming
+// packets rejected by the replay filter, and under-load for handshakes not
+// processed because the device is under load. At most 10 drops are logged
+// per second; the number of drops not logged is reported afterwards.
+func (device *Device) SetDropLogging(enabled bool) {
+	device.dropLog.enabled.Store(enabled)
+}
+
+// dropLogging reports whether drop logging is enabled, so that call sites
+// can skip formatting the arguments of logDrop otherwise.
+func (device *Device) dropLogging() bool {
+	return device.dropLog.enabled.Load()
+}
+
+// logDrop logs a dropped packet with reason, if drop logging is enabled
+// and the current interval still allows it. format and args describe the
+// packet, and are appended to the reason.
+func (device *Device) logDrop(reason dropReason, format string, args ...any) {
+	if !device.dropLogging() {
+		return
+	}
+	l := &device.dropLog
+	l.Lock()
+	now := time.Now()
+	suppressed := 0
+	if now.Sub(l.start) >= dropLogInterval {
+		suppressed = l.suppressed
+		l.start, l.logged, l.suppressed = now, 0, 0
+	}
+	if l.logged >= dropLogBurst {
+		l.suppressed++
+		l.Unlock()
+		return
+	}
+	l.logged++
+	l.Unlock()
+
+	if suppressed > 0 {
+		device.log.Verbosef("Suppressed logging of %d dropped packets", suppressed)
+	}
+	device.log.Verbosef("Dropped packet (%v): "+format, append([]any{reason}, args...)...)
+}
+
+// SetCryptoRoutingDropHook sets fn to be called when an authenticated packet
+// from a peer is dropped because its inner source address is not one of the
+// peer's allowed IPs, which usually means the peer's address and its allowed
+// IPs here do not agree. fn is passed the peer's public key and the source
+// address. Passing nil removes the hook.
+// fn is called from the receive routines and must not block.
+func (device *Device) SetCryptoRoutingDropHook(fn func(pk NoisePublicKey, src netip.Addr)) {
+	if fn == nil {
+		device.cryptoRoutingDropHook.Store(nil)
+	} else {
+		device.cryptoRoutingDropHook.Store(&fn)
+	}
+}
+
+// cryptoRoutingDropped calls the crypto routing drop hook, if any, for a
+// packet from peer with the disallowed source address src.
+func (device *Device) cryptoRoutingDropped(peer *Peer, src []byte) {
+	fn := device.cryptoRoutingDropHook.Load()
+	if fn == nil {
+		return
+	}
+	addr, _ := netip.AddrFromSlice(src)
+	(*fn)(peer.handshake.remoteStatic, addr)
+}
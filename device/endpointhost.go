@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// lookupHost resolves a hostname; tests replace it.
+var lookupHost = net.DefaultResolver.LookupNetIP
+
+// endpointHostTimeout bounds a single resolution of an endpoint hostname.
+const endpointHostTimeout = 10 * time.Second
+
+// SetEndpointHostname resolves host and sets the resulting address, with
+// port, as the endpoint of the peer with public key pk. If refresh is
+// positive, host is then resolved again every refresh interval in the
+// background, and the endpoint is updated whenever the resolved addresses
+// change, so that peers behind dynamic DNS can be followed.
+// While the address last set from host is still among the resolved ones the
+// endpoint is left alone, so that round-robin records do not make it flap and
+// an endpoint the peer roamed to is kept until DNS changes.
+//
+// Re-resolution stops when SetEndpointHostname is called again for the peer,
+// when the peer is removed, or when the device is closed. An empty host only
+// stops it. Resolution failures in the background are logged and the current
+// endpoint is kept.
+func (device *Device) SetEndpointHostname(pk NoisePublicKey, host string, port uint16, refresh time.Duration) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return fmt.Errorf("no peer with public key %x", pk[:])
+	}
+	if host == "" {
+		peer.stopEndpointHostname(false)
+		return nil
+	}
+	resolved, err := peer.resolveEndpointHostname(host, port, netip.AddrPort{})
+	if err != nil {
+		return err
+	}
+
+	peer.endpointHost.Lock()
+	defer peer.endpointHost.Unlock()
+	if peer.endpointHost.removed {
+		return fmt.Errorf("peer with public key %x was removed", pk[:])
+	}
+	if peer.endpointHost.stop != nil {
+		close(peer.endpointHost.stop)
+		peer.endpointHost.stop = nil
+	}
+	if refresh > 0 {
+		peer.endpointHost.stop = make(chan struct{})
+		go peer.routineEndpointHostname(host, port, resolved, refresh, peer.endpointHost.stop)
+	}
+	return nil
+}
+
+// routineEndpointHostname re-resolves host every refresh interval until stop
+// is closed or the device is closed. resolved is the endpoint last set from
+// host.
+func (peer *Peer) routineEndpointHostname(host string, port uint16, resolved netip.AddrPort, refresh time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-peer.device.closed:
+			return
+		case <-ticker.C:
+		}
+		var err error
+		if resolved, err = peer.resolveEndpointHostname(host, port, resolved); err != nil {
+			peer.device.log.Errorf("%v - %v", peer, err)
+		}
+	}
+}
+
+// resolveEndpointHostname resolves host and sets the endpoint of the peer to
+// the first resolved address, unless last, the endpoint last set from host,
+// is still among the resolved ones. It returns the endpoint last set from
+// host, which is last on failure.
+func (peer *Peer) resolveEndpointHostname(host string, port uint16, last netip.AddrPort) (netip.AddrPort, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), endpointHostTimeout)
+	defer cancel()
+	addrs, err := lookupHost(ctx, "ip", host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		return last, fmt.Errorf("failed to resolve endpoint hostname %q: %w", host, err)
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	if last.IsValid() && last.Port() == port && slices.Contains(addrs, last.Addr()) {
+		return last, nil
+	}
+
+	next := netip.AddrPortFrom(addrs[0], port)
+	device := peer.device
+	device.net.RLock()
+	endpoint, err := device.net.bind.ParseEndpoint(next.String())
+	device.net.RUnlock()
+	if err != nil {
+		return last, fmt.Errorf("failed to parse endpoint of hostname %q: %w", host, err)
+	}
+	device.log.Verbosef("%v - Updating endpoint to %v from hostname %q", peer, endpoint.DstToString(), host)
+	if err := peer.SetEndpoint(endpoint); err != nil {
+		return last, err
+	}
+	return next, nil
+}
+
+// stopEndpointHostname stops the re-resolution of the endpoint hostname of
+// the peer, if any. If removed is set, re-resolution is not started anymore.
+func (peer *Peer) stopEndpointHostname(removed bool) {
+	peer.endpointHost.Lock()
+	defer peer.endpointHost.Unlock()
+	if peer.endpointHost.stop != nil {
+		close(peer.endpointHost.stop)
+		peer.endpointHost.stop = nil
+	}
+	peer.endpointHost.removed = peer.endpointHost.removed || removed
+}
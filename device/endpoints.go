@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"slices"
+	"time"
+
+	"github.com/syntlabs/cyanide-go/conn"
+)
+
+// SetEndpoints configures the candidate endpoints of a multi-homed peer, in
+// order of preference, and makes the first one the peer's endpoint. When
+// handshakes to the active candidate have been timing out for the rekey
+// attempt time (RekeyAttemptTime unless changed by SetHandshakeTimeouts), the
+// peer fails over to the next one, wrapping around after the last. An
+// authenticated packet from another address still roams the peer there, as
+// with a single endpoint; a failover from such an endpoint continues with the
+// candidates in turn.
+//
+// A nil or empty endpoints removes the candidates and keeps the current
+// endpoint.
+func (peer *Peer) SetEndpoints(endpoints []conn.Endpoint) {
+	endpoints = slices.DeleteFunc(slices.Clone(endpoints), func(endpoint conn.Endpoint) bool {
+		return endpoint == nil
+	})
+	if len(endpoints) == 0 {
+		peer.endpoint.Lock()
+		peer.endpoint.candidates = nil
+		peer.endpoint.Unlock()
+		return
+	}
+	peer.SetEndpoint(endpoints[0])
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	peer.endpoint.candidates = endpoints
+	peer.endpoint.active = 0
+	peer.endpoint.failingSince = time.Time{}
+}
+
+// ActiveEndpoint returns the endpoint the peer's datagrams are sent to and
+// its index among the candidates set by SetEndpoints, or -1 if it is not one
+// of them, for example because the peer roamed elsewhere.
+func (peer *Peer) ActiveEndpoint() (conn.Endpoint, int) {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	return peer.endpoint.val, peer.activeCandidateLocked()
+}
+
+// activeCandidateLocked returns the index of the peer's endpoint among its
+// candidates, or -1. peer.endpoint must be locked.
+func (peer *Peer) activeCandidateLocked() int {
+	val := peer.endpoint.val
+	if val == nil {
+		return -1
+	}
+	dst := val.DstToString()
+	for i, candidate := range peer.endpoint.candidates {
+		if candidate.DstToString() == dst {
+			return i
+		}
+	}
+	return -1
+}
+
+// failOverEndpoint is called when a handshake initiation sent waited ago got
+// no response. It moves the peer on to its next candidate endpoint once the
+// handshakes have been failing for the rekey attempt time, and restarts the
+// count of handshake attempts so that the timers do not give up on the new
+// endpoint before trying it.
+func (peer *Peer) failOverEndpoint(waited time.Duration) {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if len(peer.endpoint.candidates) < 2 {
+		return
+	}
+	now := peer.device.now()
+	if peer.endpoint.failingSince.IsZero() {
+		peer.endpoint.failingSince = now.Add(-waited)
+	}
+	if now.Sub(peer.endpoint.failingSince) < peer.device.rekeyAttemptTime() {
+		return
+	}
+	if i := peer.activeCandidateLocked(); i >= 0 {
+		peer.endpoint.active = i
+	}
+	peer.endpoint.active = (peer.endpoint.active + 1) % len(peer.endpoint.candidates)
+	next := peer.endpoint.candidates[peer.endpoint.active]
+	peer.device.log.Verbosef("%v - Handshakes failed for %v, failing over to endpoint %v", peer, now.Sub(peer.endpoint.failingSince).Round(time.Second), next.DstToString())
+	peer.endpoint.val = next
+	peer.endpoint.clearSrcOnTx = true
+	peer.endpoint.failingSince = now
+	peer.timers.handshakeAttempts.Store(0)
+}
+
+// resetEndpointFailOver restarts the failure time of the active candidate
+// endpoint after a handshake completed.
+func (peer *Peer) resetEndpointFailOver() {
+	peer.endpoint.Lock()
+	peer.endpoint.failingSince = time.Time{}
+	peer.endpoint.Unlock()
+}
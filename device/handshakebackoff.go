@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// handshakeBackoff spaces out the handshake initiations of a peer whose
+// handshakes keep failing.
+type handshakeBackoff struct {
+	sync.Mutex
+	base     time.Duration // zero if the backoff is off
+	max      time.Duration
+	factor   float64
+	failures uint32 // initiations that failed since the last handshake
+}
+
+// SetHandshakeBackoff makes the peer back off exponentially from a peer that
+// does not answer its handshake initiations, so that a misconfigured peer is
+// not sent initiations at a constant rate forever. After the first failed
+// initiation, the peer waits base before retrying, then factor times longer
+// after every further failure, up to max. The wait is never shorter than the
+// rekey timeout (see Device.SetHandshakeTimeouts) and also delays initiations
+// caused by new traffic. It is reset by a successful handshake.
+//
+// Unlike the rate limiter of handshakes the device receives, the backoff
+// only throttles initiations the peer sends. A base of zero turns it off,
+// which is the default. A factor below 1 is taken as 1, and a max below
+// base as base.
+func (peer *Peer) SetHandshakeBackoff(base, max time.Duration, factor float64) {
+	if base < 0 {
+		base = 0
+	}
+	if max < base {
+		max = base
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	peer.handshakeBackoff.Lock()
+	defer peer.handshakeBackoff.Unlock()
+	peer.handshakeBackoff.base = base
+	peer.handshakeBackoff.max = max
+	peer.handshakeBackoff.factor = factor
+}
+
+// handshakeRetryInterval returns how long the peer waits for a response to a
+// handshake initiation before sending another.
+func (peer *Peer) handshakeRetryInterval() time.Duration {
+	timeout := peer.device.rekeyTimeout()
+	b := &peer.handshakeBackoff
+	b.Lock()
+	defer b.Unlock()
+	if b.base == 0 || b.failures == 0 {
+		return timeout
+	}
+	wait := float64(b.base) * math.Pow(b.factor, float64(b.failures-1))
+	if wait > float64(b.max) {
+		wait = float64(b.max)
+	}
+	return max(timeout, time.Duration(wait))
+}
+
+// handshakeInitiationFailed counts an initiation that was not answered.
+func (peer *Peer) handshakeInitiationFailed() {
+	peer.handshakeBackoff.Lock()
+	defer peer.handshakeBackoff.Unlock()
+	if peer.handshakeBackoff.failures < math.MaxUint32 {
+		peer.handshakeBackoff.failures++
+	}
+}
+
+// resetHandshakeBackoff resets the backoff after a successful handshake.
+func (peer *Peer) resetHandshakeBackoff() {
+	peer.handshakeBackoff.Lock()
+	defer peer.handshakeBackoff.Unlock()
+	peer.handshakeBackoff.failures = 0
+}
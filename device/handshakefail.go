@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// A HandshakeFailReason tells why a handshake with a peer failed.
+type HandshakeFailReason uint32
+
+const (
+	HandshakeFailNone      HandshakeFailReason = iota // no handshake has failed
+	HandshakeFailBadMAC                               // a handshake response had an invalid mac1
+	HandshakeFailUnderLoad                            // a handshake was answered with a cookie reply or rate limited, by either side
+	HandshakeFailDecrypt                              // a handshake message or cookie reply could not be decrypted or was invalid
+	HandshakeFailTimeout                              // no response arrived before the rekey timeout
+	HandshakeFailReplay                               // an initiation was not newer than the last one consumed
+	HandshakeFailFlood                                // an initiation followed the last one consumed too closely
+)
+
+func (r HandshakeFailReason) String() string {
+	switch r {
+	case HandshakeFailNone:
+		return "none"
+	case HandshakeFailBadMAC:
+		return "bad mac"
+	case HandshakeFailUnderLoad:
+		return "under load"
+	case HandshakeFailDecrypt:
+		return "decrypt"
+	case HandshakeFailTimeout:
+		return "timeout"
+	case HandshakeFailReplay:
+		return "replay"
+	case HandshakeFailFlood:
+		return "flood"
+	}
+	return "unknown"
+}
+
+// handshakeFailure is the last handshake failure of a peer.
+type handshakeFailure struct {
+	sync.Mutex
+	reason HandshakeFailReason
+	time   time.Time
+}
+
+// LastHandshakeError returns why and when the last failed handshake with the
+// peer failed, or HandshakeFailNone and the zero time if none has failed.
+// A failure is not cleared by a later successful handshake; compare its time
+// with that of the last handshake to tell whether it still matters.
+func (peer *Peer) LastHandshakeError() (HandshakeFailReason, time.Time) {
+	peer.lastHandshakeFail.Lock()
+	defer peer.lastHandshakeFail.Unlock()
+	return peer.lastHandshakeFail.reason, peer.lastHandshakeFail.time
+}
+
+// handshakeFailed records reason as the last handshake failure of the peer.
+func (peer *Peer) handshakeFailed(reason HandshakeFailReason) {
+	peer.lastHandshakeFail.Lock()
+	defer peer.lastHandshakeFail.Unlock()
+	peer.lastHandshakeFail.reason = reason
+	peer.lastHandshakeFail.time = time.Now()
+}
+
+// handshakeFailed records reason as the last handshake failure of the peer
+// that elem belongs to, if that is certain before the message is decrypted.
+// Responses name the handshake they answer by its index. The sender of an
+// initiation is encrypted, and its source address could be spoofed, so
+// failures of initiations are only recorded once the sender is decrypted;
+// see consumeMessageInitiation.
+func (device *Device) handshakeFailed(elem *QueueHandshakeElement, reason HandshakeFailReason) {
+	if elem.msgType != defaultMessageResponseType {
+		return
+	}
+	receiver := binary.LittleEndian.Uint32(elem.packet[8:12])
+	if peer := device.indexTable.Lookup(receiver).peer; peer != nil {
+		peer.handshakeFailed(reason)
+	}
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeStats holds counters of the handshake messages processed by a device.
+// A message is counted as failed if it could not be created or sent,
+// or if it was received but could not be decoded or was invalid.
+type HandshakeStats struct {
+	InitiationsSent     uint64
+	InitiationsReceived uint64
+	InitiationsFailed   uint64
+	ResponsesSent       uint64
+	ResponsesReceived   uint64
+	ResponsesFailed     uint64
+	CookieRepliesSent   uint64 // handshakes answered with a cookie reply while under load
+	RateLimited         uint64 // handshakes dropped by the rate limiter while under load
+}
+
+type handshakeCounters struct {
+	initiationsSent     atomic.Uint64
+	initiationsReceived atomic.Uint64
+	initiationsFailed   atomic.Uint64
+	responsesSent       atomic.Uint64
+	responsesReceived   atomic.Uint64
+	responsesFailed     atomic.Uint64
+	cookieRepliesSent   atomic.Uint64
+	rateLimited         atomic.Uint64
+}
+
+// HandshakeStats returns a snapshot of the device's handshake counters.
+func (device *Device) HandshakeStats() HandshakeStats {
+	c := &device.handshakeCounters
+	return HandshakeStats{
+		InitiationsSent:     c.initiationsSent.Load(),
+		InitiationsReceived: c.initiationsReceived.Load(),
+		InitiationsFailed:   c.initiationsFailed.Load(),
+		ResponsesSent:       c.responsesSent.Load(),
+		ResponsesReceived:   c.responsesReceived.Load(),
+		ResponsesFailed:     c.responsesFailed.Load(),
+		CookieRepliesSent:   c.cookieRepliesSent.Load(),
+		RateLimited:         c.rateLimited.Load(),
+	}
+}
+
+// countSent increments sent if err is nil and failed otherwise.
+func countSent(sent, failed *atomic.Uint64, err error) {
+	if err != nil {
+		failed.Add(1)
+	} else {
+		sent.Add(1)
+	}
+}
+
+// firstHandshake times the first handshake with a peer.
+type firstHandshake struct {
+	attemptNano  atomic.Int64 // nano seconds since epoch of the first initiation sent or received
+	completeNano atomic.Int64 // nano seconds since epoch of the completion of the first handshake
+}
+
+// handshakeAttempted records the first handshake initiation with the peer,
+// sent or received.
+func (peer *Peer) handshakeAttempted() {
+	peer.firstHandshake.attemptNano.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// handshakeCompleted records the completion of the first handshake
+// with the peer, if one was attempted.
+func (peer *Peer) handshakeCompleted() {
+	if peer.firstHandshake.attemptNano.Load() != 0 {
+		peer.firstHandshake.completeNano.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// TimeToFirstHandshake returns how long the first handshake with the peer
+// took to complete, from the first initiation sent to it or received from it
+// since it was added, including any retries. ok is false until that handshake
+// has completed. Later handshakes do not change it.
+func (peer *Peer) TimeToFirstHandshake() (d time.Duration, ok bool) {
+	complete := peer.firstHandshake.completeNano.Load()
+	if complete == 0 {
+		return 0, false
+	}
+	return time.Duration(complete - peer.firstHandshake.attemptNano.Load()), true
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrHandshakeGaveUp is returned by WaitHandshake when the peer stops
+// retrying a handshake that did not complete.
+var ErrHandshakeGaveUp = errors.New("handshake did not complete")
+
+// handshakeWaiters wakes the callers of WaitHandshake.
+type handshakeWaiters struct {
+	broadcaster
+	sync.Mutex
+	gaveUp time.Time // when the timers last gave up on a handshake
+}
+
+// handshakeGaveUp records that the timers gave up on a handshake at now and
+// wakes the waiters.
+func (w *handshakeWaiters) handshakeGaveUp(now time.Time) {
+	w.Lock()
+	w.gaveUp = now
+	w.Unlock()
+	w.signal()
+}
+
+// WaitHandshake blocks until the peer has a current keypair created after
+// the call, that is until a handshake started before or during the call
+// completes. It returns ctx.Err() if ctx is done first, ErrHandshakeGaveUp if
+// the peer stops retrying the handshake, and an error if the peer is stopped
+// or the device is closed.
+//
+// A handshake that completes before the call is not waited for, so to
+// connect and verify, start waiting before calling InitiateHandshake, or
+// bound the wait with ctx.
+func (peer *Peer) WaitHandshake(ctx context.Context) error {
+	start := peer.device.now()
+	for {
+		changed := peer.handshakeWaiters.wait()
+
+		peer.keypairs.RLock()
+		current := peer.keypairs.current
+		peer.keypairs.RUnlock()
+		if current != nil && current.created.After(start) {
+			return nil
+		}
+		peer.handshakeWaiters.Lock()
+		gaveUp := peer.handshakeWaiters.gaveUp.After(start)
+		peer.handshakeWaiters.Unlock()
+		if gaveUp {
+			return ErrHandshakeGaveUp
+		}
+		if peer.device.isClosed() {
+			return ErrDeviceClosed
+		}
+		if !peer.isRunning.Load() {
+			return errors.New("peer is not running")
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-peer.device.closed:
+			return ErrDeviceClosed
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// hasCurrentKeypair reports whether the peer has a current keypair
+// that is not yet too old to be used.
+func (peer *Peer) hasCurrentKeypair() bool {
+	peer.keypairs.RLock()
+	defer peer.keypairs.RUnlock()
+	current := peer.keypairs.current
+	return current != nil && !current.created.Add(RejectAfterTime).Before(peer.device.now())
+}
+
+// IsHealthy reports whether the tunnel to the peer is usable: the peer has
+// a current keypair that has not expired, and its last handshake completed
+// within RejectAfterTime.
+func (peer *Peer) IsHealthy() bool {
+	last := peer.lastHandshakeNano.Load()
+	if last == 0 || peer.device.since(time.Unix(0, last)) > RejectAfterTime {
+		return false
+	}
+	return peer.hasCurrentKeypair()
+}
+
+// HealthyPeers returns the public keys of the peers whose tunnel is healthy,
+// as reported by Peer.IsHealthy, in no particular order.
+// It suits readiness probes.
+func (device *Device) HealthyPeers() []NoisePublicKey {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	var healthy []NoisePublicKey
+	for key, peer := range device.peers.keyMap {
+		if peer.IsHealthy() {
+			healthy = append(healthy, key)
+		}
+	}
+	return healthy
+}
+
+// seen records that an authenticated packet was received from the peer.
+func (peer *Peer) seen() {
+	peer.lastSeenNano.Store(peer.device.now().UnixNano())
+}
+
+// LastSeen returns when the peer last sent a packet that authenticated, be it
+// a handshake message, a keepalive or data, or the zero time if it never did.
+// Unlike the last handshake, it tells whether the peer is still active between
+// handshakes, for example to remove idle peers with Device.RemovePeer.
+func (peer *Peer) LastSeen() time.Time {
+	nano := peer.lastSeenNano.Load()
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
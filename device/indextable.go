@@ -92,6 +92,52 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 	}
 }
 
+// InsertKeypair registers the keypair of the peer under its local index,
+// for keypairs not derived from a handshake of this device, such as those
+// imported by ImportSessions. It reports false if the index is in use.
+func (table *IndexTable) InsertKeypair(peer *Peer, keypair *Keypair) bool {
+	table.Lock()
+	defer table.Unlock()
+	if _, ok := table.table[keypair.localIndex]; ok {
+		return false
+	}
+	table.table[keypair.localIndex] = IndexTableEntry{
+		peer:    peer,
+		keypair: keypair,
+	}
+	return true
+}
+
+// replaceKeypairs removes the local indices of old and inserts the keypairs of
+// new, with their peers, as a single step. If an index of new is in use other
+// than by old, or twice in new, nothing is changed, and that index is returned
+// with false.
+func (table *IndexTable) replaceKeypairs(old []*Keypair, new []IndexTableEntry) (uint32, bool) {
+	table.Lock()
+	defer table.Unlock()
+	freed := make(map[uint32]bool, len(old))
+	for _, keypair := range old {
+		if entry, ok := table.table[keypair.localIndex]; ok && entry.keypair == keypair {
+			freed[keypair.localIndex] = true
+		}
+	}
+	inserted := make(map[uint32]bool, len(new))
+	for _, entry := range new {
+		index := entry.keypair.localIndex
+		if _, inUse := table.table[index]; (inUse && !freed[index]) || inserted[index] {
+			return index, false
+		}
+		inserted[index] = true
+	}
+	for index := range freed {
+		delete(table.table, index)
+	}
+	for _, entry := range new {
+		table.table[entry.keypair.localIndex] = entry
+	}
+	return 0, true
+}
+
 func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
 	table.RLock()
 	defer table.RUnlock()
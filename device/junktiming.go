@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// junkTimingMode selects when the junk packets of a handshake initiation are
+// sent relative to the initiation.
+type junkTimingMode int
+
+const (
+	junkTimingBefore  junkTimingMode = iota // all right before the initiation (default)
+	junkTimingAfter                         // all right after the initiation
+	junkTimingSpread                        // at random times within a window starting at the initiation
+	junkTimingInvalid                       // a value that failed to parse; rejected by validate
+)
+
+// maxJunkTimingSpread bounds the window of junkTimingSpread, so that the junk
+// of an initiation is out before the initiation is retransmitted.
+const maxJunkTimingSpread = RekeyTimeout
+
+// junkTiming is the jtm option of aSecConfType: "before", "after" or
+// "spread(duration)", for example "spread(200ms)".
+type junkTiming struct {
+	mode   junkTimingMode
+	window time.Duration // for junkTimingSpread
+}
+
+// parseJunkTiming parses the textual form of a junkTiming. The empty string
+// is the default, "before".
+func parseJunkTiming(s string) (junkTiming, error) {
+	switch s {
+	case "", "before":
+		return junkTiming{mode: junkTimingBefore}, nil
+	case "after":
+		return junkTiming{mode: junkTimingAfter}, nil
+	}
+	if window, ok := strings.CutPrefix(s, "spread("); ok {
+		if window, ok := strings.CutSuffix(window, ")"); ok {
+			d, err := time.ParseDuration(window)
+			if err != nil {
+				return junkTiming{}, err
+			}
+			return junkTiming{mode: junkTimingSpread, window: d}, nil
+		}
+	}
+	return junkTiming{}, fmt.Errorf("unknown junk timing %q; want before, after or spread(duration)", s)
+}
+
+func (t junkTiming) String() string {
+	switch t.mode {
+	case junkTimingBefore:
+		return "before"
+	case junkTimingAfter:
+		return "after"
+	case junkTimingSpread:
+		return fmt.Sprintf("spread(%v)", t.window)
+	}
+	return "invalid"
+}
+
+// sendJunkPackets sends the junk packets of a handshake initiation at the
+// times that timing selects. Spread packets are sent from the timers of the
+// device's clock, so the call returns right away for them.
+func (peer *Peer) sendJunkPackets(junks [][]byte, timing junkTiming) error {
+	if len(junks) == 0 {
+		return nil
+	}
+	if timing.mode != junkTimingSpread {
+		return peer.SendBuffers(junks)
+	}
+	src := peer.device.junkSource()
+	clock := peer.device.getClock()
+	// Offsets are drawn in microseconds to stay within the range of Intn on
+	// 32-bit platforms.
+	window := int(timing.window / time.Microsecond)
+	for _, junk := range junks {
+		junk := junk
+		offset := time.Duration(src.Intn(window)) * time.Microsecond
+		clock.NewTimer(offset, func() {
+			if !peer.isRunning.Load() {
+				return
+			}
+			if err := peer.SendBuffers([][]byte{junk}); err != nil {
+				peer.device.log.Verbosef("%v - Failed to send junk packet: %v", peer, err)
+			}
+		})
+	}
+	return nil
+}
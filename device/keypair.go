@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/syntlabs/cyanide-go/replay"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 /* Due to limitations in Go and /x/crypto there is currently
@@ -26,6 +27,8 @@ type Keypair struct {
 	sendNonce    atomic.Uint64
 	send         cipher.AEAD
 	receive      cipher.AEAD
+	sendKey      [chacha20poly1305.KeySize]byte // key of send, kept for ExportSessions
+	receiveKey   [chacha20poly1305.KeySize]byte // key of receive, kept for ExportSessions
 	replayFilter replay.Filter
 	isInitiator  bool
 	created      time.Time
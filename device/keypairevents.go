@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+// A KeypairEvent tells how the current keypair of a peer changed.
+type KeypairEvent uint32
+
+const (
+	KeypairNew     KeypairEvent = iota // a session was established with a peer that had no current keypair
+	KeypairRotated                     // a new session replaced the current keypair
+	KeypairExpired                     // the current keypair was expired or its key material discarded
+)
+
+func (e KeypairEvent) String() string {
+	switch e {
+	case KeypairNew:
+		return "new"
+	case KeypairRotated:
+		return "rotated"
+	case KeypairExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// SetKeypairEventHook sets fn to be called whenever the current keypair of a
+// peer changes: when a handshake completes, with KeypairNew or KeypairRotated,
+// and with KeypairExpired when ExpireCurrentKeypairs is called, as on a private
+// key change, or when all the peer's keys are discarded, because no new session
+// was established in time or because the peer is stopped.
+// Passing nil removes the hook.
+//
+// fn is called on its own goroutine, so that it cannot stall the handshake,
+// but calls for successive events are not ordered.
+func (device *Device) SetKeypairEventHook(fn func(pk NoisePublicKey, event KeypairEvent)) {
+	if fn == nil {
+		device.keypairEventHook.Store(nil)
+	} else {
+		device.keypairEventHook.Store(&fn)
+	}
+}
+
+// keypairEvent dispatches event to the keypair event hook, if any.
+func (peer *Peer) keypairEvent(event KeypairEvent) {
+	if fn := peer.device.keypairEventHook.Load(); fn != nil {
+		go (*fn)(peer.handshake.remoteStatic, event)
+	}
+}
+
+// keypairReplaced dispatches the event for current, the keypair that was
+// current before a new one took its place.
+func (peer *Peer) keypairReplaced(current *Keypair) {
+	if current == nil {
+		peer.keypairEvent(KeypairNew)
+	} else {
+		peer.keypairEvent(KeypairRotated)
+	}
+}
@@ -7,7 +7,10 @@
 package device
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 )
 
@@ -47,3 +50,40 @@ func NewLogger(level int, prepend string) *Logger {
 	}
 	return logger
 }
+
+// NewSlogLogger constructs a Logger that forwards to l.
+// Verbosef is logged at slog.LevelDebug and Errorf at slog.LevelError.
+// Besides being formatted into the message, arguments identifying a peer,
+// a message type or the reason a packet was dropped are attached to the
+// record as the "peer", "msg_type" and "drop_reason" attributes.
+func NewSlogLogger(l *slog.Logger) *Logger {
+	logf := func(level slog.Level) func(string, ...any) {
+		return func(format string, args ...any) {
+			ctx := context.Background()
+			if !l.Enabled(ctx, level) {
+				return
+			}
+			l.LogAttrs(ctx, level, fmt.Sprintf(format, args...), logAttrs(args)...)
+		}
+	}
+	return &Logger{logf(slog.LevelDebug), logf(slog.LevelError)}
+}
+
+// A messageType is a message type that is being logged.
+// It formats like the plain number, but is recognized by NewSlogLogger.
+type messageType uint32
+
+func logAttrs(args []any) []slog.Attr {
+	var attrs []slog.Attr
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case *Peer:
+			attrs = append(attrs, slog.String("peer", v.String()))
+		case messageType:
+			attrs = append(attrs, slog.Uint64("msg_type", uint64(v)))
+		case dropReason:
+			attrs = append(attrs, slog.String("drop_reason", string(v)))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/tun/tuntest"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	logger.Verbosef("dropped")
+	if buf.Len() != 0 {
+		t.Errorf("verbose line logged at error level: %q", buf.String())
+	}
+
+	peer := &Peer{}
+	peer.handshake.remoteStatic[0] = 0xff
+	logger.Errorf("%v - unexpected message type %d", peer, messageType(7))
+	line := buf.String()
+	for _, want := range []string{
+		"level=ERROR",
+		`msg="peer(/wAA…AAAA) - unexpected message type 7"`,
+		"peer=peer(/wAA…AAAA)",
+		"msg_type=7",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %q does not contain %q", line, want)
+		}
+	}
+}
+
+func TestDropLogging(t *testing.T) {
+	buf := new(bytes.Buffer)
+	device := &Device{log: NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))}
+
+	device.logDrop(dropReplay, "counter %d", 1)
+	if buf.Len() != 0 {
+		t.Fatalf("drop logged while drop logging is disabled: %q", buf.String())
+	}
+
+	device.SetDropLogging(true)
+	for i := 0; i < 3*dropLogBurst; i++ {
+		device.logDrop(dropReplay, "counter %d", i)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != dropLogBurst {
+		t.Fatalf("logged %d drops in a flood, want %d", len(lines), dropLogBurst)
+	}
+	for _, want := range []string{`msg="Dropped packet (replay): counter 0"`, "drop_reason=replay"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("log line %q does not contain %q", lines[0], want)
+		}
+	}
+
+	// The next interval reports the drops that were not logged.
+	buf.Reset()
+	device.dropLog.start = device.dropLog.start.Add(-dropLogInterval)
+	device.logDrop(dropAuthFail, "transport message")
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "Suppressed logging of 20 dropped packets") ||
+		!strings.Contains(lines[1], "drop_reason=auth-fail") {
+		t.Errorf("unexpected log lines after a flood: %q", lines)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestDropLoggingNoAllowedIP(t *testing.T) {
+	buf := new(lockedBuffer)
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bindtest.NewChannelBinds()[0], logger)
+	defer dev.Close()
+	dev.SetDropLogging(true)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	tun.Outbound <- tuntest.Ping(netip.MustParseAddr("10.9.9.9"), netip.MustParseAddr("10.0.0.1"))
+	const want = "no peer for destination 10.9.9.9 of"
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(buf.String(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("log does not contain %q:\n%s", want, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
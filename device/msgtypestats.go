@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import "sync/atomic"
+
+// MessageJunkType is the key under which MessageTypeStats counts received
+// packets that carry no message, such as junk.
+const MessageJunkType uint32 = 0
+
+// msgTypeCounters counts received packets by effective message type,
+// indexed by the default message types and MessageJunkType.
+type msgTypeCounters [defaultMessageTransportType + 1]atomic.Uint64
+
+// count counts a received packet classified as msgType.
+func (c *msgTypeCounters) count(msgType uint32) {
+	if msgType > defaultMessageTransportType {
+		msgType = MessageJunkType
+	}
+	c[msgType].Add(1)
+}
+
+// MessageTypeStats returns the number of packets received by the device for
+// each effective message type, that is after any magic headers and junk
+// prefixes of advanced security have been resolved. Packets are keyed by the
+// default WireGuard message types, 1 (initiation) to 4 (transport), whatever
+// the magic headers on the wire, and packets that match none of them, junk
+// included, are counted under MessageJunkType. This allows checking that
+// obfuscated traffic is classified as intended.
+func (device *Device) MessageTypeStats() map[uint32]uint64 {
+	stats := make(map[uint32]uint64, len(device.msgTypeCounters))
+	for msgType := range device.msgTypeCounters {
+		stats[uint32(msgType)] = device.msgTypeCounters[msgType].Load()
+	}
+	return stats
+}
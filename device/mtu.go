@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/syntlabs/cyanide-go/tun"
+)
+
+const (
+	minPathMTU         = 1280 // never back the path MTU off below the IPv6 minimum
+	pathMTULossBackoff = 2    // consecutive losses before backing off
+)
+
+// pathMTU tracks the path MTU towards a peer.
+// The largest packet received from the peer is taken as proof that the path
+// carries packets of that size. When data keeps going unanswered, the
+// estimate backs off to that size.
+type pathMTU struct {
+	largest atomic.Int32  // largest packet received from the peer
+	current atomic.Int32  // current estimate, 0 if not yet backed off
+	losses  atomic.Uint32 // consecutive loss events
+}
+
+// SetMTU sets the MTU the device assumes for the TUN device, which bounds the
+// padding of packets and the path MTU of peers, for example to use jumbo frames
+// on datacenter links. It does not change the MTU of the TUN interface itself,
+// and is overridden by the next MTU update the TUN device reports.
+// mtu must be positive and at most MaxContentSize, which leaves room for the
+// transport header within MaxSegmentSize.
+func (device *Device) SetMTU(mtu int) error {
+	if mtu <= 0 || mtu > MaxContentSize {
+		return fmt.Errorf("invalid MTU %d: must be in [1, %d]", mtu, MaxContentSize)
+	}
+	if old := device.tun.mtu.Swap(int32(mtu)); int(old) != mtu {
+		device.log.Verbosef("MTU updated: %v", mtu)
+	}
+	return nil
+}
+
+// SetMTUClamp bounds the MTU of outbound packets to the range [min, max],
+// regardless of the MTU reported by the TUN device. A bound of zero is ignored.
+// max is applied where outbound packets are sized: a TUN device implementing
+// tun.SegmentMTUSetter, as the Linux one does when it uses offloads, splits the
+// large TCP packets handed over by the kernel into segments of at most max
+// bytes. Other packets cannot be split, so one larger than max is still sent
+// whole; lower the MTU of the TUN interface to keep the kernel from sending
+// them. Both bounds also apply to the padding of outbound packets and to the
+// path MTU of peers; see PathMTU.
+// The bounds must be in [0, MaxContentSize], and min must not exceed a nonzero
+// max.
+func (device *Device) SetMTUClamp(min, max int) error {
+	if min < 0 || max < 0 || min > MaxContentSize || max > MaxContentSize {
+		return fmt.Errorf("invalid MTU clamp [%d, %d]: bounds must be in [0, %d]", min, max, MaxContentSize)
+	}
+	if max > 0 && min > max {
+		return fmt.Errorf("invalid MTU clamp [%d, %d]: min exceeds max", min, max)
+	}
+	device.tun.mtuClampMin.Store(int32(min))
+	device.tun.mtuClampMax.Store(int32(max))
+	if setter, ok := device.tun.device.(tun.SegmentMTUSetter); ok {
+		setter.SetSegmentMTU(max)
+	}
+	return nil
+}
+
+// effectiveMTU returns the MTU of the TUN device, bounded by the MTU clamp.
+func (device *Device) effectiveMTU() int {
+	mtu := int(device.tun.mtu.Load())
+	if max := int(device.tun.mtuClampMax.Load()); max > 0 && mtu > max {
+		mtu = max
+	}
+	if min := int(device.tun.mtuClampMin.Load()); min > 0 && mtu < min {
+		mtu = min
+	}
+	return mtu
+}
+
+// PathMTU returns the MTU estimated for the path towards the peer, which
+// bounds the padding added to the packets sent to it, so that padding does not
+// push a packet past what the path carries. It starts out as the device MTU
+// and is lowered when packets larger than the largest packet received from the
+// peer go unanswered. Packets are not segmented to it, as the TUN device splits
+// them before they are routed to a peer: only the device-wide clamp of
+// SetMTUClamp bounds the segments, and a packet larger than the path MTU is
+// still sent whole.
+func (peer *Peer) PathMTU() int {
+	mtu := peer.device.effectiveMTU()
+	if current := int(peer.pathMTU.current.Load()); current != 0 && current < mtu {
+		mtu = current
+	}
+	return mtu
+}
+
+// pathMTUReceived records that a packet of size bytes was received from the peer.
+func (peer *Peer) pathMTUReceived(size int) {
+	peer.pathMTU.losses.Store(0)
+	for {
+		largest := peer.pathMTU.largest.Load()
+		if int32(size) <= largest {
+			break
+		}
+		if peer.pathMTU.largest.CompareAndSwap(largest, int32(size)) {
+			break
+		}
+	}
+	if current := peer.pathMTU.current.Load(); current != 0 && int32(size) > current {
+		peer.pathMTU.current.CompareAndSwap(current, int32(size))
+	}
+}
+
+// pathMTULost records that data sent to the peer went unanswered.
+func (peer *Peer) pathMTULost() {
+	if peer.pathMTU.losses.Add(1) < pathMTULossBackoff {
+		return
+	}
+	mtu := int(peer.pathMTU.largest.Load())
+	if min := int(peer.device.tun.mtuClampMin.Load()); mtu < min {
+		mtu = min
+	}
+	if mtu < minPathMTU {
+		mtu = minPathMTU
+	}
+	if mtu >= peer.PathMTU() {
+		return
+	}
+	peer.device.log.Verbosef("%v - Backing off path MTU to %d", peer, mtu)
+	peer.pathMTU.current.Store(int32(mtu))
+}
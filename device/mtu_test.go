@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/tun"
+	"github.com/syntlabs/cyanide-go/tun/tuntest"
+)
+
+func TestPathMTU(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelSilent, "")}
+	device.tun.mtu.Store(1500)
+	peer := &Peer{device: device}
+
+	if got := peer.PathMTU(); got != 1500 {
+		t.Errorf("initial path MTU = %d, want 1500", got)
+	}
+
+	if err := device.SetMTUClamp(0, 1420); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer.PathMTU(); got != 1420 {
+		t.Errorf("clamped path MTU = %d, want 1420", got)
+	}
+
+	peer.pathMTUReceived(1350)
+	peer.pathMTULost()
+	if got := peer.PathMTU(); got != 1420 {
+		t.Errorf("path MTU after a single loss = %d, want 1420", got)
+	}
+	peer.pathMTULost()
+	if got := peer.PathMTU(); got != 1350 {
+		t.Errorf("path MTU after repeated loss = %d, want 1350", got)
+	}
+
+	peer.pathMTUReceived(1400)
+	if got := peer.PathMTU(); got != 1400 {
+		t.Errorf("path MTU after receiving larger packet = %d, want 1400", got)
+	}
+
+	if err := device.SetMTUClamp(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, clamp := range [][2]int{{-1, 0}, {0, -1}, {1500, 1400}} {
+		if err := device.SetMTUClamp(clamp[0], clamp[1]); err == nil {
+			t.Errorf("SetMTUClamp(%d, %d) succeeded", clamp[0], clamp[1])
+		}
+	}
+	if got := peer.PathMTU(); got != 1400 {
+		t.Errorf("path MTU without clamp = %d, want 1400", got)
+	}
+}
+
+// segmentingTUN is a TUN device that records the segment MTU it is set to.
+type segmentingTUN struct {
+	tun.Device
+	segmentMTU int
+}
+
+func (s *segmentingTUN) SetSegmentMTU(mtu int) {
+	s.segmentMTU = mtu
+}
+
+func TestMTUClampSegments(t *testing.T) {
+	segmenting := &segmentingTUN{Device: tuntest.NewChannelTUN().TUN()}
+	dev := NewDevice(segmenting, bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.SetMTUClamp(1280, 1380); err != nil {
+		t.Fatal(err)
+	}
+	if segmenting.segmentMTU != 1380 {
+		t.Errorf("segment MTU = %d, want the clamp's 1380", segmenting.segmentMTU)
+	}
+	if err := dev.SetMTUClamp(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if segmenting.segmentMTU != 0 {
+		t.Errorf("segment MTU = %d without a clamp, want 0", segmenting.segmentMTU)
+	}
+}
+
+func TestJumboPacket(t *testing.T) {
+	if MaxContentSize < 9000 {
+		t.Skipf("MaxContentSize %d is too small for jumbo frames", MaxContentSize)
+	}
+	goroutineLeakCheck(t)
+	for _, realSocket := range []bool{false, true} {
+		t.Run(fmt.Sprintf("realSocket=%v", realSocket), func(t *testing.T) {
+			pair := genTestPair(t, realSocket, false)
+			for _, p := range pair {
+				for _, mtu := range []int{0, MaxContentSize + 1} {
+					if err := p.dev.SetMTU(mtu); err == nil {
+						t.Errorf("SetMTU(%d) succeeded", mtu)
+					}
+				}
+				if err := p.dev.SetMTU(9000); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The packets of a batch read from the TUN device are coalesced
+			// when sent on real sockets with UDP GSO.
+			for i := 0; i < 3; i++ {
+				msg := tuntest.PingWithSize(pair[0].ip, pair[1].ip, 8000)
+				pair[1].tun.Outbound <- msg
+				select {
+				case got := <-pair[0].tun.Inbound:
+					if !bytes.Equal(got, msg) {
+						t.Errorf("received %d bytes, want the %d sent", len(got), len(msg))
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("jumbo packet did not transit")
+				}
+			}
+		})
+	}
+}
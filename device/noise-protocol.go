@@ -53,11 +53,21 @@ const (
 	CNLabelCookie     = "cookie--"
 )
 
+// Message types used on the wire when aSec is off. The receive path
+// dispatches on these constants; with aSec on, the configured magic headers
+// are first translated back to them through msgTypeToDefault.
+const (
+	defaultMessageInitiationType  uint32 = 1
+	defaultMessageResponseType    uint32 = 2
+	defaultMessageCookieReplyType uint32 = 3
+	defaultMessageTransportType   uint32 = 4
+)
+
 var (
-	MessageInitiationType  uint32 = 1
-	MessageResponseType    uint32 = 2
-	MessageCookieReplyType uint32 = 3
-	MessageTransportType   uint32 = 4
+	MessageInitiationType  uint32 = defaultMessageInitiationType
+	MessageResponseType    uint32 = defaultMessageResponseType
+	MessageCookieReplyType uint32 = defaultMessageCookieReplyType
+	MessageTransportType   uint32 = defaultMessageTransportType
 )
 
 const (
@@ -78,6 +88,7 @@ const (
 
 var packetSizeToMsgType map[int]uint32
 var msgTypeToJunkSize map[uint32]int
+var msgTypeToDefault map[uint32]uint32
 
 /* Type is an 8-bit field, followed by 3 nul bytes,
  * by marshalling the messages in little-endian byteorder
@@ -249,7 +260,40 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	return &msg, nil
 }
 
+// openInitiationStatic decrypts the static public key of the initiator of msg,
+// leaving the handshake hash and chaining key that follow it in hash and
+// chainKey. The caller must hold device.staticIdentity.
+func (device *Device) openInitiationStatic(msg *MessageInitiation, hash, chainKey *[blake2s.Size]byte) (peerPK NoisePublicKey, ok bool) {
+	mixHash(hash, &InitialHash, device.staticIdentity.publicKey[:])
+	mixHash(hash, hash, msg.Ephemeral[:])
+	mixKey(chainKey, &InitialChainKey, msg.Ephemeral[:])
+
+	// decrypt static key
+	var key [chacha20poly1305.KeySize]byte
+	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+	if err != nil {
+		return peerPK, false
+	}
+	KDF2(chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
+	if err != nil {
+		return peerPK, false
+	}
+	mixHash(hash, hash, msg.Static[:])
+	return peerPK, true
+}
+
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, _, _ := device.consumeMessageInitiation(msg)
+	return peer
+}
+
+// consumeMessageInitiation is ConsumeMessageInitiation, and also returns the
+// running peer that sent msg once its static key has been decrypted, also
+// when msg is rejected after that, together with the reason it was rejected,
+// so that the failure can be recorded.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation) (consumed, sender *Peer, reason HandshakeFailReason) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
@@ -258,36 +302,22 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	device.aSecMux.RLock()
 	if msg.Type != MessageInitiationType {
 		device.aSecMux.RUnlock()
-		return nil
+		return nil, nil, HandshakeFailDecrypt
 	}
 	device.aSecMux.RUnlock()
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
-
-	// decrypt static key
-	var peerPK NoisePublicKey
-	var key [chacha20poly1305.KeySize]byte
-	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-	if err != nil {
-		return nil
-	}
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
-	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
-	if err != nil {
-		return nil
+	peerPK, ok := device.openInitiationStatic(msg, &hash, &chainKey)
+	if !ok {
+		return nil, nil, HandshakeFailDecrypt
 	}
-	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
 	peer := device.LookupPeer(peerPK)
 	if peer == nil || !peer.isRunning.Load() {
-		return nil
+		return nil, nil, HandshakeFailDecrypt
 	}
 
 	handshake := &peer.handshake
@@ -295,12 +325,13 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	// verify identity
 
 	var timestamp tai64n.Timestamp
+	var key [chacha20poly1305.KeySize]byte
 
 	handshake.mutex.RLock()
 
 	if isZero(handshake.precomputedStaticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, peer, HandshakeFailDecrypt
 	}
 	KDF2(
 		&chainKey,
@@ -308,26 +339,26 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	aead, _ = chacha20poly1305.New(key[:])
-	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err := aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, peer, HandshakeFailDecrypt
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
 	// protect against replay & flood
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
+	flood := device.since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
-		return nil
+		return nil, peer, HandshakeFailReplay
 	}
 	if flood {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
-		return nil
+		return nil, peer, HandshakeFailFlood
 	}
 
 	// update handshake state
@@ -341,7 +372,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
-	now := time.Now()
+	now := device.now()
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
@@ -352,7 +383,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	return peer, peer, HandshakeFailNone
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -572,12 +603,16 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair := new(Keypair)
 	keypair.send, _ = chacha20poly1305.New(sendKey[:])
 	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	keypair.sendKey, keypair.receiveKey = sendKey, recvKey
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = device.now()
 	keypair.replayFilter.Reset()
+	if size := peer.replayWindow.Load(); size != 0 {
+		keypair.replayFilter.SetWindowSize(int(size))
+	}
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
@@ -607,6 +642,8 @@ func (peer *Peer) BeginSymmetricSession() error {
 		}
 		device.DeleteKeypair(previous)
 		keypairs.current = keypair
+		peer.keypairReplaced(current)
+		peer.handshakeWaiters.signal()
 	} else {
 		keypairs.next.Store(keypair)
 		device.DeleteKeypair(next)
@@ -631,7 +668,9 @@ func (peer *Peer) ReceivedWithKeypair(receivedKeypair *Keypair) bool {
 	old := keypairs.previous
 	keypairs.previous = keypairs.current
 	peer.device.DeleteKeypair(old)
+	peer.keypairReplaced(keypairs.current)
 	keypairs.current = keypairs.next.Load()
 	keypairs.next.Store(nil)
+	peer.handshakeWaiters.signal()
 	return true
 }
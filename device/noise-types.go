@@ -8,8 +8,10 @@ package device
 
 import (
 	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 )
 
 const (
@@ -25,6 +27,80 @@ type (
 	NoiseNonce        uint64 // padded to 12-bytes
 )
 
+// GeneratePrivateKey returns a new random private key.
+func GeneratePrivateKey() (NoisePrivateKey, error) {
+	return newPrivateKey()
+}
+
+// PublicKey returns the public key of the private key sk, as a peer
+// configures it for the device whose private key sk is.
+func PublicKey(sk NoisePrivateKey) NoisePublicKey {
+	return sk.publicKey()
+}
+
+// ErrKeyLength is the error of a KeyParseError for a string that is valid
+// base64 but does not decode to 32 bytes.
+var ErrKeyLength = errors.New("key is not 32 bytes long")
+
+// A KeyParseError reports that a string is not a key in the standard base64
+// form. Err is ErrKeyLength or a base64.CorruptInputError.
+type KeyParseError struct {
+	Kind string // "private", "public" or "preshared"
+	Err  error
+}
+
+func (e *KeyParseError) Error() string {
+	return fmt.Sprintf("invalid %s key: %v", e.Kind, e.Err)
+}
+
+func (e *KeyParseError) Unwrap() error {
+	return e.Err
+}
+
+// loadExactBase64 decodes the key of the given kind from src into dst.
+func loadExactBase64(dst []byte, src, kind string) error {
+	slice, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		return &KeyParseError{Kind: kind, Err: err}
+	}
+	if len(slice) != len(dst) {
+		return &KeyParseError{Kind: kind, Err: ErrKeyLength}
+	}
+	copy(dst, slice)
+	return nil
+}
+
+// ParsePrivateKey parses a private key in the standard base64 form of
+// configuration files and of the wg tool. The key is clamped, as when it is
+// set through UAPI.
+func ParsePrivateKey(s string) (NoisePrivateKey, error) {
+	var key NoisePrivateKey
+	if err := loadExactBase64(key[:], s, "private"); err != nil {
+		return NoisePrivateKey{}, err
+	}
+	key.clamp()
+	return key, nil
+}
+
+// ParsePublicKey parses a public key in the standard base64 form; see
+// NoisePublicKey.String.
+func ParsePublicKey(s string) (NoisePublicKey, error) {
+	var key NoisePublicKey
+	if err := loadExactBase64(key[:], s, "public"); err != nil {
+		return NoisePublicKey{}, err
+	}
+	return key, nil
+}
+
+// ParsePresharedKey parses a preshared key in the standard base64 form.
+func ParsePresharedKey(s string) (NoisePresharedKey, error) {
+	var key NoisePresharedKey
+	if err := loadExactBase64(key[:], s, "preshared"); err != nil {
+		return NoisePresharedKey{}, err
+	}
+	return key, nil
+}
+
 func loadExactHex(dst []byte, src string) error {
 	slice, err := hex.DecodeString(src)
 	if err != nil {
@@ -74,6 +150,12 @@ func (key NoisePublicKey) Equals(tar NoisePublicKey) bool {
 	return subtle.ConstantTimeCompare(key[:], tar[:]) == 1
 }
 
+// String returns the key in the standard base64 form of configuration files
+// and of the wg tool.
+func (key NoisePublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
 func (key *NoisePresharedKey) FromHex(src string) error {
 	return loadExactHex(key[:], src)
 }
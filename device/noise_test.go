@@ -8,7 +8,11 @@ package device
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/syntlabs/cyanide-go/conn"
@@ -33,6 +37,85 @@ func TestCurveWrappers(t *testing.T) {
 	}
 }
 
+func TestPublicKey(t *testing.T) {
+	// Alice's keys from RFC 7748, section 6.1.
+	var sk NoisePrivateKey
+	assertNil(t, sk.FromHex("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	pk := PublicKey(sk)
+	if got, want := hex.EncodeToString(pk[:]), "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"; got != want {
+		t.Fatalf("PublicKey = %s, want %s", got, want)
+	}
+	if got, want := pk.String(), "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="; got != want {
+		t.Fatalf("String = %s, want %s", got, want)
+	}
+
+	sk1, err := GeneratePrivateKey()
+	assertNil(t, err)
+	sk2, err := GeneratePrivateKey()
+	assertNil(t, err)
+	if sk1.IsZero() || sk1.Equals(sk2) {
+		t.Fatal("GeneratePrivateKey returned a zero or repeated key")
+	}
+	if PublicKey(sk1) != sk1.publicKey() {
+		t.Fatal("PublicKey differs from the device's public key")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	sk, err := GeneratePrivateKey()
+	assertNil(t, err)
+	pk := PublicKey(sk)
+
+	parsedSK, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(sk[:]))
+	assertNil(t, err)
+	if parsedSK != sk {
+		t.Error("ParsePrivateKey did not round-trip")
+	}
+	parsedPK, err := ParsePublicKey(pk.String())
+	assertNil(t, err)
+	if parsedPK != pk {
+		t.Error("ParsePublicKey did not round-trip NoisePublicKey.String")
+	}
+	psk, err := ParsePresharedKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, NoisePresharedKeySize)))
+	assertNil(t, err)
+	if psk != (NoisePresharedKey{7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7}) {
+		t.Error("ParsePresharedKey did not round-trip")
+	}
+
+	// Private keys are clamped.
+	unclamped, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, NoisePrivateKeySize)))
+	assertNil(t, err)
+	if unclamped[0] != 0xf8 || unclamped[31] != 0x7f {
+		t.Errorf("ParsePrivateKey did not clamp the key: %x", unclamped[:])
+	}
+
+	for _, tt := range []struct {
+		in       string
+		isLength bool
+	}{
+		{"", true},
+		{base64.StdEncoding.EncodeToString(make([]byte, 31)), true},
+		{base64.StdEncoding.EncodeToString(make([]byte, 33)), true},
+		{base64.RawStdEncoding.EncodeToString(make([]byte, 32)), false},
+		{strings.Repeat("A", 44), true},   // valid base64 of 33 bytes
+		{hex.EncodeToString(pk[:]), true}, // valid base64 of 48 bytes
+		{"not a key", false},
+	} {
+		_, err := ParsePublicKey(tt.in)
+		var keyErr *KeyParseError
+		if !errors.As(err, &keyErr) || keyErr.Kind != "public" {
+			t.Errorf("ParsePublicKey(%q) = %v, want a *KeyParseError", tt.in, err)
+			continue
+		}
+		if errors.Is(err, ErrKeyLength) != tt.isLength {
+			t.Errorf("ParsePublicKey(%q) = %v, length error %v, want %v", tt.in, err, !tt.isLength, tt.isLength)
+		}
+	}
+	if _, err := ParsePrivateKey("x"); err == nil || !strings.Contains(err.Error(), "invalid private key") {
+		t.Errorf("ParsePrivateKey error %v does not name the key", err)
+	}
+}
+
 func randDevice(t *testing.T) *Device {
 	sk, err := newPrivateKey()
 	if err != nil {
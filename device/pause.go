@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import "sync"
+
+// pauseGate holds back the routines that take packets in
+// from the TUN device and the bind while the device is paused.
+type pauseGate struct {
+	sync.Mutex
+	paused bool
+	wake   chan struct{} // closed to wake up the routines held back
+}
+
+// Pause stops the device from taking in packets, for example to snapshot its
+// state: the routines reading from the TUN device and receiving from the bind
+// hold on to the packets they have read until Resume is called, and read no
+// more. Peers, keypairs and the bind are left untouched, and timers keep
+// running, so that keepalives and handshakes may still be sent.
+// The device may be closed or brought down while paused.
+func (device *Device) Pause() {
+	device.pause.Lock()
+	defer device.pause.Unlock()
+	if device.pause.paused {
+		return
+	}
+	device.pause.paused = true
+	device.pause.wake = make(chan struct{})
+	device.log.Verbosef("Device paused")
+}
+
+// Resume lets a device paused with Pause take in packets again,
+// starting with those held since the pause.
+func (device *Device) Resume() {
+	device.pause.Lock()
+	defer device.pause.Unlock()
+	if !device.pause.paused {
+		return
+	}
+	device.pause.paused = false
+	close(device.pause.wake)
+	device.pause.wake = nil
+	device.log.Verbosef("Device resumed")
+}
+
+// wakePaused wakes the routines held back by a pause,
+// so that they check whether they must stop.
+func (device *Device) wakePaused() {
+	device.pause.Lock()
+	defer device.pause.Unlock()
+	if device.pause.paused {
+		close(device.pause.wake)
+		device.pause.wake = make(chan struct{})
+	}
+}
+
+// waitResumed blocks while the device is paused. It returns false if it gave
+// up because stop reported true, once woken by wakePaused, in which case the
+// packets held back must be dropped.
+func (device *Device) waitResumed(stop func() bool) bool {
+	for {
+		device.pause.Lock()
+		if !device.pause.paused {
+			device.pause.Unlock()
+			return true
+		}
+		if stop() {
+			device.pause.Unlock()
+			return false
+		}
+		wake := device.pause.wake
+		device.pause.Unlock()
+		<-wake
+	}
+}
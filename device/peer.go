@@ -9,11 +9,16 @@ package device
 import (
 	"container/list"
 	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/syntlabs/cyanide-go/conn"
+	"github.com/syntlabs/cyanide-go/ipc"
+	"github.com/syntlabs/cyanide-go/replay"
 )
 
 type Peer struct {
@@ -25,12 +30,27 @@ type Peer struct {
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
+	lastSeenNano      atomic.Int64   // nano seconds since epoch of the last authenticated packet received
+	lastHandshakeFail handshakeFailure
+	handshakeBackoff  handshakeBackoff
+	firstHandshake    firstHandshake
+	handshakeWaiters  handshakeWaiters
 
 	endpoint struct {
 		sync.Mutex
 		val            conn.Endpoint
-		clearSrcOnTx   bool // signal to val.ClearSrc() prior to next packet transmission
+		clearSrcOnTx   bool       // signal to val.ClearSrc() prior to next packet transmission
+		pinnedSrc      netip.Addr // source address set by PinEndpointSource; invalid if not pinned
 		disableRoaming bool
+		candidates     []conn.Endpoint // set by SetEndpoints
+		active         int             // index in candidates of the last one failed over to
+		failingSince   time.Time       // when handshakes to the active candidate started failing; zero if they are not
+	}
+
+	endpointHost struct {
+		sync.Mutex
+		stop    chan struct{} // closed to stop re-resolving the endpoint hostname
+		removed bool
 	}
 
 	timers struct {
@@ -49,19 +69,31 @@ type Peer struct {
 	}
 
 	queue struct {
+		// enqueue is held for reading while staged packets are handed to the
+		// outbound and encryption queues, so that Stop can wait for writers
+		// that saw the peer running before giving up its encryption queue
+		// reference.
+		enqueue  sync.RWMutex
 		staged   chan *QueueOutboundElementsContainer // staged packets before a handshake is available
 		outbound *autodrainingOutboundQueue           // sequential ordering of udp transmission
 		inbound  *autodrainingInboundQueue            // sequential ordering of tun writing
+		// pending counts the batches handed to outbound that the sequential
+		// sender has not finished with; see Device.CloseGraceful.
+		pending atomic.Int32
 	}
 
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
 	persistentKeepaliveInterval atomic.Uint32
+	bandwidth                   bandwidthLimiter
+	pathMTU                     pathMTU
+	fwmark                      atomic.Uint32 // mark for datagrams to the peer (0 = device-wide mark)
+	replayWindow                atomic.Uint32 // replay filter size of new keypairs (0 = replay.DefaultWindowSize)
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	if device.isClosed() {
-		return nil, errors.New("device closed")
+		return nil, ErrDeviceClosed
 	}
 
 	// lock resources
@@ -71,10 +103,19 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
+	return device.newPeerLocked(pk)
+}
+
+// newPeerLocked creates the peer with public key pk.
+// The caller must hold device.staticIdentity.RLock and device.peers.Lock.
+func (device *Device) newPeerLocked(pk NoisePublicKey) (*Peer, error) {
 	// check if over limit
 	if len(device.peers.keyMap) >= MaxPeers {
 		return nil, errors.New("too many peers")
 	}
+	if limit := device.peers.max; limit > 0 && len(device.peers.keyMap) >= limit {
+		return nil, ipcErrorf(ipc.IpcErrorInvalid, "peer limit reached: device has %d of %d peers", len(device.peers.keyMap), limit)
+	}
 
 	// create peer
 	peer := new(Peer)
@@ -128,19 +169,25 @@ func (peer *Peer) SendBuffers(buffers [][]byte) error {
 		peer.endpoint.Unlock()
 		return errors.New("no known endpoint for peer")
 	}
-	if peer.endpoint.clearSrcOnTx {
-		endpoint.ClearSrc()
-		peer.endpoint.clearSrcOnTx = false
+	if err := peer.prepareEndpointSrcLocked(endpoint); err != nil {
+		peer.endpoint.Unlock()
+		return err
 	}
 	peer.endpoint.Unlock()
 
-	err := peer.device.net.bind.Send(buffers, endpoint)
+	var err error
+	if mark := peer.fwmark.Load(); mark != 0 {
+		err = peer.device.net.bind.(conn.MarkedSender).SendWithMark(buffers, endpoint, mark)
+	} else {
+		err = peer.device.net.bind.Send(buffers, endpoint)
+	}
 	if err == nil {
 		var totalLen uint64
 		for _, b := range buffers {
 			totalLen += uint64(len(b))
 		}
 		peer.txBytes.Add(totalLen)
+		peer.device.txBytes.Add(totalLen)
 	}
 	return err
 }
@@ -193,7 +240,7 @@ func (peer *Peer) Start() {
 	peer.stopping.Add(2)
 
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(peer.device.rekeyTimeout() + time.Second))
 	peer.handshake.mutex.Unlock()
 
 	peer.device.queue.encryption.cn.Add(1) // keep encryption queue open for our writes
@@ -219,6 +266,9 @@ func (peer *Peer) ZeroAndFlushAll() {
 
 	keypairs := &peer.keypairs
 	keypairs.Lock()
+	if keypairs.current != nil {
+		peer.keypairEvent(KeypairExpired)
+	}
 	device.DeleteKeypair(keypairs.previous)
 	device.DeleteKeypair(keypairs.current)
 	device.DeleteKeypair(keypairs.next.Load())
@@ -243,13 +293,14 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(peer.device.rekeyTimeout() + time.Second))
 	handshake.mutex.Unlock()
 
 	keypairs := &peer.keypairs
 	keypairs.Lock()
 	if keypairs.current != nil {
 		keypairs.current.sendNonce.Store(RejectAfterMessages)
+		peer.keypairEvent(KeypairExpired)
 	}
 	if next := keypairs.next.Load(); next != nil {
 		next.sendNonce.Store(RejectAfterMessages)
@@ -264,6 +315,9 @@ func (peer *Peer) Stop() {
 	if !peer.isRunning.Swap(false) {
 		return
 	}
+	// Wait for SendStagedPackets calls that may still write to the queues.
+	peer.queue.enqueue.Lock()
+	peer.queue.enqueue.Unlock()
 
 	peer.device.log.Verbosef("%v - Stopping", peer)
 
@@ -275,6 +329,8 @@ func (peer *Peer) Stop() {
 	peer.device.queue.encryption.cn.Done() // no more writes to encryption queue from us
 
 	peer.ZeroAndFlushAll()
+	peer.handshakeWaiters.signal()
+	peer.device.drained.signal()
 }
 
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
@@ -284,7 +340,221 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 		return
 	}
 	peer.endpoint.clearSrcOnTx = false
+	old := peer.endpoint.val
 	peer.endpoint.val = endpoint
+
+	if fn := peer.device.roamingHook.Load(); fn != nil {
+		if old == nil || old.DstToString() != endpoint.DstToString() {
+			go (*fn)(peer.handshake.remoteStatic, old, endpoint)
+		}
+	}
+}
+
+// SetFwmark sets the fwmark of the datagrams sent to the peer to mark,
+// overriding the device-wide mark set with BindSetMark, for example to route
+// traffic to different peers through different tables. A mark of zero
+// restores the device-wide mark.
+//
+// Per-peer marks require a bind implementing conn.MarkedSender, which
+// conn.StdNetBind only does on Linux. With other binds SetFwmark returns an
+// error and the peer keeps using the device-wide mark.
+func (peer *Peer) SetFwmark(mark uint32) error {
+	peer.device.net.RLock()
+	bind := peer.device.net.bind
+	peer.device.net.RUnlock()
+	if _, ok := bind.(conn.MarkedSender); !ok && mark != 0 {
+		return fmt.Errorf("bind of type %T does not support per-peer marks; using the device-wide mark", bind)
+	}
+	peer.fwmark.Store(mark)
+	return nil
+}
+
+// SetReplayWindow sets the size, in counters, of the replay filter of the
+// peer's keypairs, so that transport packets reordered by up to size-64
+// counters are still accepted, for example on fast links that spread packets
+// over parallel paths. The size must be a power of two between
+// replay.MinWindowSize and replay.MaxWindowSize; replay.DefaultWindowSize
+// restores the default.
+//
+// A filter takes size/8 bytes and every peer holds up to three keypairs,
+// so the largest window costs 384 KiB of memory per peer.
+// The new size applies to the keypairs of the following handshakes; use
+// Device.Handshake to apply it at once.
+func (peer *Peer) SetReplayWindow(size int) error {
+	if err := replay.CheckWindowSize(size); err != nil {
+		return err
+	}
+	if size == replay.DefaultWindowSize {
+		size = 0
+	}
+	peer.replayWindow.Store(uint32(size))
+	return nil
+}
+
+// SetPresharedKey sets the key mixed into the peer's handshakes in addition to
+// the static and ephemeral keys, as with the preshared_key UAPI key. The peer
+// must use the same key. If a session with the peer is established, a
+// handshake is initiated so that the session is derived with the new key at
+// once; meanwhile the current session keeps working. Otherwise the key is
+// used by the next handshake. A key of all zeros is the same as none.
+func (peer *Peer) SetPresharedKey(psk NoisePresharedKey) error {
+	device := peer.device
+	device.peers.RLock()
+	removed := device.peers.keyMap[peer.handshake.remoteStatic] != peer
+	device.peers.RUnlock()
+	if removed {
+		return errors.New("peer was removed")
+	}
+
+	device.log.Verbosef("%v - Updating preshared key", peer)
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKey = psk
+	peer.handshake.mutex.Unlock()
+
+	if peer.keypairs.Current() != nil {
+		if err := peer.InitiateHandshake(); err != nil {
+			device.log.Errorf("%v - Failed to initiate handshake with the new preshared key: %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// ClearPresharedKey removes the peer's preshared key, like setting one of all
+// zeros with SetPresharedKey.
+func (peer *Peer) ClearPresharedKey() {
+	peer.SetPresharedKey(NoisePresharedKey{})
+}
+
+// AllowedIPs returns the prefixes routed to the peer, sorted by address
+// (IPv4 before IPv6) and then by prefix length.
+func (peer *Peer) AllowedIPs() []netip.Prefix {
+	var prefixes []netip.Prefix
+	peer.device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+		prefixes = append(prefixes, prefix)
+		return true
+	})
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	return prefixes
+}
+
+// AddAllowedIP routes prefix to the peer, leaving its other allowed IPs as
+// they are. If prefix was routed to another peer, it is moved to this one,
+// as with the allowed_ip UAPI key. Packets being routed meanwhile go to either
+// the old or the new peer.
+func (peer *Peer) AddAllowedIP(prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return errors.New("invalid prefix")
+	}
+	device := peer.device
+	// Hold the peer map so that the peer cannot be removed meanwhile,
+	// which would leave the prefix routed to a stopped peer.
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	if device.peers.keyMap[peer.handshake.remoteStatic] != peer {
+		return errors.New("peer was removed")
+	}
+	device.allowedips.Insert(prefix, peer)
+	return nil
+}
+
+// RemoveAllowedIP stops routing prefix to the peer, leaving its other allowed
+// IPs as they are. It fails if prefix is not one of the peer's allowed IPs;
+// a prefix only contained in one of them is not one.
+func (peer *Peer) RemoveAllowedIP(prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return errors.New("invalid prefix")
+	}
+	if !peer.device.allowedips.Remove(prefix, peer) {
+		return fmt.Errorf("%v is not an allowed IP of the peer", prefix)
+	}
+	return nil
+}
+
+// SetEndpoint replaces the peer's endpoint. The cached source address is
+// cleared on the next send, so that the route to the new endpoint is resolved again.
+func (peer *Peer) SetEndpoint(endpoint conn.Endpoint) error {
+	if endpoint == nil {
+		return errors.New("endpoint is nil")
+	}
+	peer.device.net.RLock()
+	brokenRoaming := peer.device.net.brokenRoaming
+	peer.device.net.RUnlock()
+
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	peer.endpoint.val = endpoint
+	peer.endpoint.clearSrcOnTx = true
+	peer.endpoint.disableRoaming = brokenRoaming
+	return nil
+}
+
+// prepareEndpointSrcLocked sets the source address of endpoint, the peer's
+// endpoint, before a transmission: the pinned one if any, or else none if the
+// cached one is to be cleared. peer.endpoint must be locked.
+func (peer *Peer) prepareEndpointSrcLocked(endpoint conn.Endpoint) error {
+	if src := peer.endpoint.pinnedSrc; src.IsValid() {
+		peer.endpoint.clearSrcOnTx = false
+		if endpoint.SrcIP() == src {
+			return nil
+		}
+		setter, ok := endpoint.(conn.SrcSetter)
+		if !ok {
+			return errors.New("endpoint does not support setting the source address")
+		}
+		return setter.SetSrc(src)
+	}
+	if peer.endpoint.clearSrcOnTx {
+		endpoint.ClearSrc()
+		peer.endpoint.clearSrcOnTx = false
+	}
+	return nil
+}
+
+// PinEndpointSource fixes the local address the datagrams to the peer are sent
+// from to src, for setups with asymmetric routing where the source address
+// resolved again by the routing table would go out of the wrong interface.
+//
+// This overrides sticky sockets for the peer: the source address is no longer
+// the one learned from received datagrams, and it is not cleared when the bind,
+// the fwmark or the routes change. It also applies to the endpoints the peer
+// roams to, which must support conn.SrcSetter and be of the family of src;
+// datagrams to other endpoints fail to send. An error is returned if the
+// current endpoint is not one of them.
+func (peer *Peer) PinEndpointSource(src netip.Addr) error {
+	if !src.IsValid() {
+		return errors.New("invalid source address")
+	}
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if endpoint := peer.endpoint.val; endpoint != nil {
+		setter, ok := endpoint.(conn.SrcSetter)
+		if !ok {
+			return errors.New("endpoint does not support setting the source address")
+		}
+		if err := setter.SetSrc(src); err != nil {
+			return err
+		}
+	}
+	peer.endpoint.pinnedSrc = src
+	peer.endpoint.clearSrcOnTx = false
+	return nil
+}
+
+// UnpinEndpointSource undoes PinEndpointSource. The source address is cleared
+// on the next send, so that it is resolved again and sticky sockets resume.
+func (peer *Peer) UnpinEndpointSource() {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if !peer.endpoint.pinnedSrc.IsValid() {
+		return
+	}
+	peer.endpoint.pinnedSrc = netip.Addr{}
+	peer.endpoint.clearSrcOnTx = peer.endpoint.val != nil
 }
 
 func (peer *Peer) markEndpointSrcForClearing() {
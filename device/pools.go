@@ -16,52 +16,155 @@ type WaitPool struct {
 	cond  sync.Cond
 	lock  sync.Mutex
 	count atomic.Uint32
-	max   uint32
+	max   atomic.Uint32
 }
 
 func NewWaitPool(max uint32, new func() any) *WaitPool {
-	p := &WaitPool{pool: sync.Pool{New: new}, max: max}
+	p := &WaitPool{pool: sync.Pool{New: new}}
 	p.cond = sync.Cond{L: &p.lock}
+	p.max.Store(max)
 	return p
 }
 
+// setMax changes the number of items that may be taken from the pool at once.
+// Lowering it does not reclaim items already taken, but Get blocks until
+// enough of them have been returned.
+func (p *WaitPool) setMax(max uint32) {
+	p.lock.Lock()
+	p.max.Store(max)
+	p.lock.Unlock()
+	p.cond.Broadcast()
+}
+
 func (p *WaitPool) Get() any {
-	if p.max != 0 {
+	if p.max.Load() != 0 {
 		p.lock.Lock()
-		for p.count.Load() >= p.max {
+		for max := p.max.Load(); max != 0 && p.count.Load() >= max; max = p.max.Load() {
 			p.cond.Wait()
 		}
 		p.count.Add(1)
 		p.lock.Unlock()
+	} else {
+		p.count.Add(1)
+	}
+	return p.pool.Get()
+}
+
+// TryGet is like Get, but returns nil rather than blocking if the pool is
+// exhausted.
+func (p *WaitPool) TryGet() any {
+	if p.max.Load() != 0 {
+		p.lock.Lock()
+		if max := p.max.Load(); max != 0 && p.count.Load() >= max {
+			p.lock.Unlock()
+			return nil
+		}
+		p.count.Add(1)
+		p.lock.Unlock()
+	} else {
+		p.count.Add(1)
 	}
 	return p.pool.Get()
 }
 
 func (p *WaitPool) Put(x any) {
 	p.pool.Put(x)
-	if p.max == 0 {
+	p.count.Add(^uint32(0))
+	if p.max.Load() == 0 {
 		return
 	}
-	p.count.Add(^uint32(0))
 	p.cond.Signal()
 }
 
+// A PoolStat describes the usage of a single buffer pool.
+type PoolStat struct {
+	InFlight uint32 // number of items currently taken from the pool
+	Max      uint32 // maximum number of items in flight (0 = unlimited)
+}
+
+// PoolStats describes the usage of the device's buffer pools.
+type PoolStats struct {
+	InboundElementsContainer  PoolStat
+	OutboundElementsContainer PoolStat
+	MessageBuffers            PoolStat
+	InboundElements           PoolStat
+	OutboundElements          PoolStat
+}
+
+func (p *WaitPool) stat() PoolStat {
+	return PoolStat{InFlight: p.count.Load(), Max: p.max.Load()}
+}
+
+// A BufferLimitMode selects what packet processing does when a buffer pool
+// limited with SetMaxBuffers is exhausted.
+type BufferLimitMode int
+
+const (
+	BufferLimitBlock BufferLimitMode = iota // wait until items are returned to the pool
+	BufferLimitDrop                         // drop the packet that needs the item
+)
+
+// SetMaxBuffers limits the number of items that may be taken at once from
+// each of the device's buffer pools, overriding PreallocatedBuffersPerPool.
+// Once a pool is exhausted, packet processing blocks until items are returned,
+// or drops packets read from the bind and the TUN device instead if
+// SetBufferLimitMode selected BufferLimitDrop. Either bounds memory usage under
+// load at the cost of throughput.
+// The limit must comfortably exceed the batch size of the bind and TUN device,
+// or the device stalls. Zero removes the limit.
+func (device *Device) SetMaxBuffers(max uint32) {
+	device.pool.maxBuffers.Store(&max)
+	if device.pool.messageBuffers == nil {
+		// Not populated yet; PopulatePools applies the limit.
+		return
+	}
+	device.pool.inboundElementsContainer.setMax(max)
+	device.pool.outboundElementsContainer.setMax(max)
+	device.pool.messageBuffers.setMax(max)
+	device.pool.inboundElements.setMax(max)
+	device.pool.outboundElements.setMax(max)
+}
+
+// SetBufferLimitMode selects what happens to packets read from the bind and
+// the TUN device while a buffer pool limited with SetMaxBuffers is exhausted.
+// The default is BufferLimitBlock. Dropped packets are logged with the reason
+// buffer-limit; see SetDropLogging.
+func (device *Device) SetBufferLimitMode(mode BufferLimitMode) {
+	device.pool.dropOnLimit.Store(mode == BufferLimitDrop)
+}
+
+// PoolStats returns a snapshot of the usage of the device's buffer pools,
+// which helps to diagnose memory growth under load.
+func (device *Device) PoolStats() PoolStats {
+	return PoolStats{
+		InboundElementsContainer:  device.pool.inboundElementsContainer.stat(),
+		OutboundElementsContainer: device.pool.outboundElementsContainer.stat(),
+		MessageBuffers:            device.pool.messageBuffers.stat(),
+		InboundElements:           device.pool.inboundElements.stat(),
+		OutboundElements:          device.pool.outboundElements.stat(),
+	}
+}
+
 func (device *Device) PopulatePools() {
-	device.pool.inboundElementsContainer = NewWaitPool(PreallocatedBuffersPerPool, func() any {
+	max := uint32(PreallocatedBuffersPerPool)
+	if limit := device.pool.maxBuffers.Load(); limit != nil {
+		max = *limit
+	}
+	device.pool.inboundElementsContainer = NewWaitPool(max, func() any {
 		s := make([]*QueueInboundElement, 0, device.BatchSize())
 		return &QueueInboundElementsContainer{elems: s}
 	})
-	device.pool.outboundElementsContainer = NewWaitPool(PreallocatedBuffersPerPool, func() any {
+	device.pool.outboundElementsContainer = NewWaitPool(max, func() any {
 		s := make([]*QueueOutboundElement, 0, device.BatchSize())
 		return &QueueOutboundElementsContainer{elems: s}
 	})
-	device.pool.messageBuffers = NewWaitPool(PreallocatedBuffersPerPool, func() any {
+	device.pool.messageBuffers = NewWaitPool(max, func() any {
 		return new([MaxMessageSize]byte)
 	})
-	device.pool.inboundElements = NewWaitPool(PreallocatedBuffersPerPool, func() any {
+	device.pool.inboundElements = NewWaitPool(max, func() any {
 		return new(QueueInboundElement)
 	})
-	device.pool.outboundElements = NewWaitPool(PreallocatedBuffersPerPool, func() any {
+	device.pool.outboundElements = NewWaitPool(max, func() any {
 		return new(QueueOutboundElement)
 	})
 }
@@ -72,6 +175,23 @@ func (device *Device) GetInboundElementsContainer() *QueueInboundElementsContain
 	return c
 }
 
+// tryGet takes an item from p, or returns nil if p is exhausted and the
+// device drops packets rather than waiting; see SetBufferLimitMode.
+func (device *Device) tryGet(p *WaitPool) any {
+	if device.pool.dropOnLimit.Load() {
+		return p.TryGet()
+	}
+	return p.Get()
+}
+
+func (device *Device) tryGetInboundElementsContainer() *QueueInboundElementsContainer {
+	c, _ := device.tryGet(device.pool.inboundElementsContainer).(*QueueInboundElementsContainer)
+	if c != nil {
+		c.Mutex = sync.Mutex{}
+	}
+	return c
+}
+
 func (device *Device) PutInboundElementsContainer(c *QueueInboundElementsContainer) {
 	for i := range c.elems {
 		c.elems[i] = nil
@@ -86,6 +206,14 @@ func (device *Device) GetOutboundElementsContainer() *QueueOutboundElementsConta
 	return c
 }
 
+func (device *Device) tryGetOutboundElementsContainer() *QueueOutboundElementsContainer {
+	c, _ := device.tryGet(device.pool.outboundElementsContainer).(*QueueOutboundElementsContainer)
+	if c != nil {
+		c.Mutex = sync.Mutex{}
+	}
+	return c
+}
+
 func (device *Device) PutOutboundElementsContainer(c *QueueOutboundElementsContainer) {
 	for i := range c.elems {
 		c.elems[i] = nil
@@ -98,6 +226,11 @@ func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
 	return device.pool.messageBuffers.Get().(*[MaxMessageSize]byte)
 }
 
+func (device *Device) tryGetMessageBuffer() *[MaxMessageSize]byte {
+	buf, _ := device.tryGet(device.pool.messageBuffers).(*[MaxMessageSize]byte)
+	return buf
+}
+
 func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
 	device.pool.messageBuffers.Put(msg)
 }
@@ -106,6 +239,11 @@ func (device *Device) GetInboundElement() *QueueInboundElement {
 	return device.pool.inboundElements.Get().(*QueueInboundElement)
 }
 
+func (device *Device) tryGetInboundElement() *QueueInboundElement {
+	elem, _ := device.tryGet(device.pool.inboundElements).(*QueueInboundElement)
+	return elem
+}
+
 func (device *Device) PutInboundElement(elem *QueueInboundElement) {
 	elem.clearPointers()
 	device.pool.inboundElements.Put(elem)
@@ -115,6 +253,11 @@ func (device *Device) GetOutboundElement() *QueueOutboundElement {
 	return device.pool.outboundElements.Get().(*QueueOutboundElement)
 }
 
+func (device *Device) tryGetOutboundElement() *QueueOutboundElement {
+	elem, _ := device.tryGet(device.pool.outboundElements).(*QueueOutboundElement)
+	return elem
+}
+
 func (device *Device) PutOutboundElement(elem *QueueOutboundElement) {
 	elem.clearPointers()
 	device.pool.outboundElements.Put(elem)
@@ -13,6 +13,9 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/tun/tuntest"
 )
 
 func TestWaitPool(t *testing.T) {
@@ -34,8 +37,8 @@ func TestWaitPool(t *testing.T) {
 	var max atomic.Uint32
 	updateMax := func() {
 		count := p.count.Load()
-		if count > p.max {
-			t.Errorf("count (%d) > max (%d)", count, p.max)
+		if count > p.max.Load() {
+			t.Errorf("count (%d) > max (%d)", count, p.max.Load())
 		}
 		for {
 			old := max.Load()
@@ -62,8 +65,8 @@ func TestWaitPool(t *testing.T) {
 		}()
 	}
 	cn.Wait()
-	if max.Load() != p.max {
-		t.Errorf("Actual maximum count (%d) != ideal maximum count (%d)", max, p.max)
+	if max.Load() != p.max.Load() {
+		t.Errorf("Actual maximum count (%d) != ideal maximum count (%d)", max.Load(), p.max.Load())
 	}
 }
 
@@ -138,3 +141,150 @@ func BenchmarkSyncPool(b *testing.B) {
 	}
 	cn.Wait()
 }
+
+func TestPoolStats(t *testing.T) {
+	device := new(Device)
+	device.PopulatePools()
+	elem := device.GetOutboundElement()
+	buf1 := device.GetMessageBuffer()
+	buf2 := device.GetMessageBuffer()
+
+	stats := device.PoolStats()
+	if stats.OutboundElements.InFlight != 1 || stats.MessageBuffers.InFlight != 2 || stats.InboundElements.InFlight != 0 {
+		t.Errorf("got %+v, want 1 outbound element and 2 message buffers in flight", stats)
+	}
+	if stats.MessageBuffers.Max != PreallocatedBuffersPerPool {
+		t.Errorf("max = %d, want %d", stats.MessageBuffers.Max, PreallocatedBuffersPerPool)
+	}
+
+	device.PutOutboundElement(elem)
+	device.PutMessageBuffer(buf1)
+	device.PutMessageBuffer(buf2)
+	if stats := device.PoolStats(); stats != (PoolStats{
+		InboundElementsContainer:  PoolStat{Max: PreallocatedBuffersPerPool},
+		OutboundElementsContainer: PoolStat{Max: PreallocatedBuffersPerPool},
+		MessageBuffers:            PoolStat{Max: PreallocatedBuffersPerPool},
+		InboundElements:           PoolStat{Max: PreallocatedBuffersPerPool},
+		OutboundElements:          PoolStat{Max: PreallocatedBuffersPerPool},
+	}) {
+		t.Errorf("got %+v after returning all items, want nothing in flight", stats)
+	}
+}
+
+func TestMaxBuffers(t *testing.T) {
+	const maxBuffers = 8
+	device := new(Device)
+	device.PopulatePools()
+	device.SetMaxBuffers(maxBuffers)
+
+	var cn sync.WaitGroup
+	var highest atomic.Uint32
+	for i := 0; i < 4*maxBuffers; i++ {
+		cn.Add(1)
+		go func() {
+			defer cn.Done()
+			for j := 0; j < 100; j++ {
+				buf := device.GetMessageBuffer()
+				inFlight := device.PoolStats().MessageBuffers.InFlight
+				for {
+					old := highest.Load()
+					if inFlight <= old || highest.CompareAndSwap(old, inFlight) {
+						break
+					}
+				}
+				time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+				device.PutMessageBuffer(buf)
+			}
+		}()
+	}
+	cn.Wait()
+	if got := highest.Load(); got > maxBuffers {
+		t.Errorf("%d buffers in flight, want at most %d", got, maxBuffers)
+	}
+
+	// An exhausted pool blocks until a buffer is returned.
+	var bufs []*[MaxMessageSize]byte
+	for i := 0; i < maxBuffers; i++ {
+		bufs = append(bufs, device.GetMessageBuffer())
+	}
+	got := make(chan *[MaxMessageSize]byte)
+	go func() { got <- device.GetMessageBuffer() }()
+	select {
+	case <-got:
+		t.Fatal("Get did not block on an exhausted pool")
+	case <-time.After(20 * time.Millisecond):
+	}
+	device.PutMessageBuffer(bufs[0])
+	select {
+	case buf := <-got:
+		bufs[0] = buf
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not unblock after a Put")
+	}
+	for _, buf := range bufs {
+		device.PutMessageBuffer(buf)
+	}
+}
+
+func TestBufferLimitDrop(t *testing.T) {
+	const maxBuffers = 2
+	device := new(Device)
+	device.SetMaxBuffers(maxBuffers)
+	device.PopulatePools()
+	if max := device.PoolStats().MessageBuffers.Max; max != maxBuffers {
+		t.Fatalf("max = %d after PopulatePools, want %d", max, maxBuffers)
+	}
+	device.SetBufferLimitMode(BufferLimitDrop)
+
+	var bufs []*[MaxMessageSize]byte
+	for i := 0; i < maxBuffers; i++ {
+		buf := device.tryGetMessageBuffer()
+		if buf == nil {
+			t.Fatalf("got no buffer %d of %d", i+1, maxBuffers)
+		}
+		bufs = append(bufs, buf)
+	}
+	// An exhausted pool returns nothing rather than blocking.
+	if buf := device.tryGetMessageBuffer(); buf != nil {
+		t.Fatal("got a buffer from an exhausted pool")
+	}
+	if elem := device.tryNewOutboundElement(); elem != nil {
+		t.Fatal("got an outbound element without a buffer for it")
+	}
+	if stats := device.PoolStats(); stats.MessageBuffers.InFlight != maxBuffers || stats.OutboundElements.InFlight != 0 {
+		t.Fatalf("got %+v, want only the %d buffers taken in flight", stats, maxBuffers)
+	}
+	device.PutMessageBuffer(bufs[0])
+	if bufs[0] = device.tryGetMessageBuffer(); bufs[0] == nil {
+		t.Fatal("got no buffer after a Put")
+	}
+	for _, buf := range bufs {
+		device.PutMessageBuffer(buf)
+	}
+}
+
+func TestStoppedPeerReturnsContainer(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	_, pk := randomConfigKeys(t)
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The device is down, so the sequential sender finds the peer stopped
+	// and must return the batch to the pools.
+	peer.stopping.Add(1)
+	go peer.RoutineSequentialSender(1)
+	elemsContainer := dev.GetOutboundElementsContainer()
+	elemsContainer.elems = append(elemsContainer.elems, dev.NewOutboundElement())
+	peer.queue.pending.Add(1)
+	peer.queue.outbound.c <- elemsContainer
+	peer.queue.outbound.c <- nil
+	peer.stopping.Wait()
+
+	stats := dev.PoolStats()
+	if stats.OutboundElementsContainer.InFlight != 0 || stats.OutboundElements.InFlight != 0 {
+		t.Errorf("got %+v, want nothing in flight", stats)
+	}
+}
@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// minIdlePeerSweep is the shortest interval between two sweeps of the idle
+// peer reaper, which bounds the work it does for a very short idle.
+const minIdlePeerSweep = 100 * time.Millisecond
+
+// idlePeerReaper is the state of the idle peer reaper; see SetIdlePeerReaper.
+type idlePeerReaper struct {
+	sync.Mutex
+	stop chan struct{} // closed to stop the running reaper; nil if none
+}
+
+// SetIdlePeerReaper starts removing peers that have been idle for longer than
+// idle, that is from which no authenticated packet was received for that long,
+// as reported by Peer.LastSeen. Peers never seen are idle from the time the
+// reaper first finds them. The peers are swept in the background every quarter
+// of idle, but no more often than every 100ms, so an idle peer is removed at
+// most idle/4 late, or 100ms late for an idle under 400ms. Idleness is
+// measured on the clock set with SetClock.
+//
+// Before removing a peer, fn is called with its public key, and the peer is
+// kept if it returns false, for example to pin some peers; a nil fn removes
+// all idle peers. fn is called from the reaper's goroutine and must not call
+// back into the device. Peers in the middle of a handshake are not removed.
+//
+// Calling SetIdlePeerReaper again replaces the reaper, and a non-positive idle
+// only stops it. The reaper stops when the device is closed.
+func (device *Device) SetIdlePeerReaper(idle time.Duration, fn func(pk NoisePublicKey) bool) {
+	device.reaper.Lock()
+	defer device.reaper.Unlock()
+	if device.reaper.stop != nil {
+		close(device.reaper.stop)
+		device.reaper.stop = nil
+	}
+	if idle <= 0 || device.isClosed() {
+		return
+	}
+	device.reaper.stop = make(chan struct{})
+	go device.routineIdlePeerReaper(idle, fn, device.reaper.stop)
+}
+
+// routineIdlePeerReaper sweeps the peers every quarter of idle, but no more
+// often than minIdlePeerSweep, until stop is closed or the device is closed.
+func (device *Device) routineIdlePeerReaper(idle time.Duration, fn func(pk NoisePublicKey) bool, stop chan struct{}) {
+	interval := max(idle/4, minIdlePeerSweep)
+	firstFound := make(map[*Peer]time.Time)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-device.closed:
+			return
+		case <-device.getClock().After(interval):
+		}
+		device.reapIdlePeers(idle, fn, firstFound)
+	}
+}
+
+// reapIdlePeers removes the peers idle for longer than idle, unless fn vetoes
+// it. firstFound holds when peers never seen were first found by a sweep.
+func (device *Device) reapIdlePeers(idle time.Duration, fn func(pk NoisePublicKey) bool, firstFound map[*Peer]time.Time) {
+	now := device.now()
+	idleSince := func(peer *Peer) time.Time {
+		if seen := peer.LastSeen(); !seen.IsZero() {
+			return seen
+		}
+		return firstFound[peer]
+	}
+
+	var candidates []*Peer
+	device.peers.RLock()
+	for peer := range firstFound {
+		if device.peers.keyMap[peer.handshake.remoteStatic] != peer {
+			delete(firstFound, peer)
+		}
+	}
+	for _, peer := range device.peers.keyMap {
+		if _, ok := firstFound[peer]; !ok {
+			firstFound[peer] = now
+		}
+		if now.Sub(idleSince(peer)) > idle && !peer.handshakeInProgress() {
+			candidates = append(candidates, peer)
+		}
+	}
+	device.peers.RUnlock()
+
+	for _, peer := range candidates {
+		pk := peer.handshake.remoteStatic
+		if fn != nil && !fn(pk) {
+			continue
+		}
+		device.ipcMutex.Lock()
+		device.peers.Lock()
+		// The peer may have been removed or become active meanwhile.
+		if !device.isClosed() && device.peers.keyMap[pk] == peer &&
+			device.since(idleSince(peer)) > idle && !peer.handshakeInProgress() {
+			device.log.Verbosef("%v - Removing idle peer", peer)
+			removePeerLocked(device, peer, pk)
+			delete(firstFound, peer)
+		}
+		device.peers.Unlock()
+		device.ipcMutex.Unlock()
+	}
+}
+
+// handshakeInProgress reports whether a handshake with the peer is under way:
+// a handshake message was sent to it or received from it within the rekey
+// timeout, and no session was derived from it yet.
+func (peer *Peer) handshakeInProgress() bool {
+	peer.handshake.mutex.RLock()
+	defer peer.handshake.mutex.RUnlock()
+	if peer.handshake.state == handshakeZeroed {
+		return false
+	}
+	timeout := peer.device.rekeyTimeout()
+	return peer.device.since(peer.handshake.lastSentHandshake) < timeout ||
+		peer.device.since(peer.handshake.lastInitiationConsumption) < timeout
+}
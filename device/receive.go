@@ -21,7 +21,7 @@ import (
 )
 
 type QueueHandshakeElement struct {
-	msgType  uint32
+	msgType  uint32 // one of the default message types
 	packet   []byte
 	endpoint conn.Endpoint
 	buffer   *[MaxMessageSize]byte
@@ -60,7 +60,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair != nil && keypair.isInitiator && peer.device.since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-peer.device.rekeyTimeout()) {
 		peer.timers.sentLastMinuteHandshake.Store(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -81,6 +81,7 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 	}()
 
 	device.log.Verbosef("Routine: receive incoming %s - started", recvName)
+	device.net.receiving.started()
 
 	// receive datagrams until conn is closed
 
@@ -114,6 +115,11 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
+			var epErr *conn.EndpointError
+			if errors.As(err, &epErr) {
+				device.handleEndpointError(epErr)
+				continue
+			}
 			device.log.Verbosef("Failed to receive %s packet: %v", recvName, err)
 			if neterr, ok := err.(net.Error); ok && !neterr.Temporary() {
 				return
@@ -126,45 +132,37 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 			return
 		}
 		deathSpiral = 0
+		if !device.waitResumed(device.net.closing.Load) {
+			return
+		}
 		device.aSecMux.RLock()
 		// handle each packet in the batch
 		for i, size := range sizes[:count] {
+			if device.receiveSTUN(bufsArrs[i][:size]) {
+				continue
+			}
 			if size < MinMessageSize {
+				if size > 0 {
+					device.msgTypeCounters.count(MessageJunkType)
+				}
 				continue
 			}
 
 			// check size of packet
 
 			packet := bufsArrs[i][:size]
-			var msgType uint32
-			if device.isAdvancedSecurityOn() {
-				if assumedMsgType, ok := packetSizeToMsgType[size]; ok {
-					junkSize := msgTypeToJunkSize[assumedMsgType]
-					// transport size can align with other header types;
-					// making sure we have the right msgType
-					msgType = binary.LittleEndian.Uint32(packet[junkSize : junkSize+4])
-					if msgType == assumedMsgType {
-						packet = packet[junkSize:]
-					} else {
-						device.log.Verbosef("Transport packet lined up with another msg type")
-						msgType = binary.LittleEndian.Uint32(packet[:4])
-					}
-				} else {
-					msgType = binary.LittleEndian.Uint32(packet[:4])
-					if msgType != MessageTransportType {
-						device.log.Verbosef("ASec: Received message with unknown type")
-						continue
-					}
-				}
-			} else {
-				msgType = binary.LittleEndian.Uint32(packet[:4])
+			msgType, packet, ok := device.receivedMessageType(packet)
+			if !ok {
+				device.msgTypeCounters.count(MessageJunkType)
+				continue
 			}
+			device.msgTypeCounters.count(msgType)
 
 			switch msgType {
 
 			// check if transport
 
-			case MessageTransportType:
+			case defaultMessageTransportType:
 
 				// check size
 
@@ -185,52 +183,68 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 
 				// check keypair expiry
 
-				if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				if keypair.created.Add(RejectAfterTime).Before(device.now()) {
 					continue
 				}
 
 				// create work element
 				peer := value.peer
-				elem := device.GetInboundElement()
-				elem.packet = packet
-				elem.buffer = bufsArrs[i]
-				elem.keypair = keypair
-				elem.endpoint = endpoints[i]
-				elem.counter = 0
-
 				elemsForPeer, ok := elemsByPeer[peer]
+				elem, buf := device.tryGetInboundElement(), device.tryGetMessageBuffer()
+				if !ok && elem != nil && buf != nil {
+					elemsForPeer = device.tryGetInboundElementsContainer()
+				}
+				if elem == nil || buf == nil || elemsForPeer == nil {
+					if elem != nil {
+						device.PutInboundElement(elem)
+					}
+					if buf != nil {
+						device.PutMessageBuffer(buf)
+					}
+					device.logDrop(dropBufferLimit, "%d-byte transport message", len(packet))
+					continue
+				}
 				if !ok {
-					elemsForPeer = device.GetInboundElementsContainer()
 					elemsForPeer.Lock()
 					elemsByPeer[peer] = elemsForPeer
 				}
+				elem.packet = packet
+				elem.buffer = bufsArrs[i]
+				elem.keypair = keypair
+				elem.endpoint = endpoints[i]
+				elem.counter = 0
 				elemsForPeer.elems = append(elemsForPeer.elems, elem)
-				bufsArrs[i] = device.GetMessageBuffer()
+				bufsArrs[i] = buf
 				bufs[i] = bufsArrs[i][:]
 				continue
 
 			// otherwise it is a fixed size & handshake related packet
 
-			case MessageInitiationType:
+			case defaultMessageInitiationType:
 				if len(packet) != MessageInitiationSize {
 					continue
 				}
 
-			case MessageResponseType:
+			case defaultMessageResponseType:
 				if len(packet) != MessageResponseSize {
 					continue
 				}
 
-			case MessageCookieReplyType:
+			case defaultMessageCookieReplyType:
 				if len(packet) != MessageCookieReplySize {
 					continue
 				}
 
 			default:
-				device.log.Verbosef("Received message with unknown type")
+				device.log.Verbosef("Received message with unknown type %d", messageType(msgType))
 				continue
 			}
 
+			buf := device.tryGetMessageBuffer()
+			if buf == nil {
+				device.logDrop(dropBufferLimit, "%d-byte handshake message", len(packet))
+				continue
+			}
 			select {
 			case device.queue.handshake.c <- QueueHandshakeElement{
 				msgType:  msgType,
@@ -238,9 +252,10 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 				packet:   packet,
 				endpoint: endpoints[i],
 			}:
-				bufsArrs[i] = device.GetMessageBuffer()
+				bufsArrs[i] = buf
 				bufs[i] = bufsArrs[i][:]
 			default:
+				device.PutMessageBuffer(buf)
 			}
 		}
 		device.aSecMux.RUnlock()
@@ -291,6 +306,57 @@ func (device *Device) RoutineDecryption(id int) {
 	}
 }
 
+// receivedMessageType returns the message type of a received packet,
+// translated back to the default message types so that callers can always
+// dispatch on those constants, and the packet with any aSec junk stripped.
+// With aSec off, the type read from the packet is normally a default type
+// already, and the translation map is only consulted if it is not, as the
+// message types are shared by all devices and another device may have changed
+// them. ok is false if the packet is to be dropped.
+// The caller must hold aSecMux for reading.
+func (device *Device) receivedMessageType(packet []byte) (msgType uint32, payload []byte, ok bool) {
+	if !device.isAdvancedSecurityOn() {
+		msgType = binary.LittleEndian.Uint32(packet[:4])
+		if msgType >= defaultMessageInitiationType && msgType <= defaultMessageTransportType {
+			return msgType, packet, true
+		}
+		if defaultType, ok := msgTypeToDefault[msgType]; ok {
+			return defaultType, packet, true
+		}
+		// left for the caller to report as unknown
+		return msgType, packet, true
+	}
+
+	if assumedMsgType, ok := packetSizeToMsgType[len(packet)]; ok {
+		junkSize := msgTypeToJunkSize[assumedMsgType]
+		// transport size can align with other header types;
+		// making sure we have the right msgType
+		msgType = binary.LittleEndian.Uint32(packet[junkSize : junkSize+4])
+		if msgType == assumedMsgType {
+			packet = packet[junkSize:]
+		} else {
+			device.log.Verbosef("Transport packet lined up with another msg type")
+			msgType = binary.LittleEndian.Uint32(packet[:4])
+		}
+	} else {
+		msgType = binary.LittleEndian.Uint32(packet[:4])
+		if msgType != MessageTransportType && msgType != device.aSecConf.junkTransportPacketMagicHeader {
+			device.log.Verbosef("ASec: Received message with unknown type %d", messageType(msgType))
+			return 0, nil, false
+		}
+	}
+	if junk := device.aSecConf.junkTransportPacketMagicHeader; junk != 0 && msgType == junk {
+		// junk interleaved with transport packets
+		return 0, nil, false
+	}
+	defaultType, ok := msgTypeToDefault[msgType]
+	if !ok {
+		device.log.Verbosef("Received message with unknown type %d", messageType(msgType))
+		return 0, nil, false
+	}
+	return defaultType, packet, true
+}
+
 /* Handles incoming packets related to handshake
  */
 func (device *Device) RoutineHandshake(id int) {
@@ -306,7 +372,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 		switch elem.msgType {
 
-		case MessageCookieReplyType:
+		case defaultMessageCookieReplyType:
 
 			// unmarshal packet
 
@@ -330,19 +396,23 @@ func (device *Device) RoutineHandshake(id int) {
 
 			if peer := entry.peer; peer.isRunning.Load() {
 				device.log.Verbosef("Receiving cookie response from %s", elem.endpoint.DstToString())
-				if !peer.cookieGenerator.ConsumeReply(&reply) {
+				if peer.cookieGenerator.ConsumeReply(&reply) {
+					peer.handshakeFailed(HandshakeFailUnderLoad)
+				} else {
 					device.log.Verbosef("Could not decrypt invalid cookie response")
+					peer.handshakeFailed(HandshakeFailDecrypt)
 				}
 			}
 
 			goto skip
 
-		case MessageInitiationType, MessageResponseType:
+		case defaultMessageInitiationType, defaultMessageResponseType:
 
 			// check mac fields and maybe ratelimit
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
 				device.log.Verbosef("Received packet with invalid mac1")
+				device.handshakeFailed(&elem, HandshakeFailBadMAC)
 				goto skip
 			}
 
@@ -353,26 +423,42 @@ func (device *Device) RoutineHandshake(id int) {
 				// verify MAC2 field
 
 				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+					if device.dropsUnknownPeer(&elem) {
+						if device.dropLogging() {
+							device.logDrop(dropUnknownPeer, "handshake message from %v dropped instead of answered with cookie reply", elem.endpoint.DstToString())
+						}
+						goto skip
+					}
+					device.handshakeCounters.cookieRepliesSent.Add(1)
 					device.SendHandshakeCookie(&elem)
+					device.handshakeFailed(&elem, HandshakeFailUnderLoad)
+					if device.dropLogging() {
+						device.logDrop(dropUnderLoad, "handshake message from %v answered with cookie reply", elem.endpoint.DstToString())
+					}
 					goto skip
 				}
 
 				// check ratelimiter
 
-				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+				if ip := elem.endpoint.DstIP(); !device.rateLimitAllowed(ip) && !device.rate.limiter.Allow(ip) {
+					device.handshakeCounters.rateLimited.Add(1)
+					device.handshakeFailed(&elem, HandshakeFailUnderLoad)
+					if device.dropLogging() {
+						device.logDrop(dropUnderLoad, "handshake message from %v rate limited", elem.endpoint.DstToString())
+					}
 					goto skip
 				}
 			}
 
 		default:
-			device.log.Errorf("Invalid packet ended up in the handshake queue")
+			device.log.Errorf("Invalid packet of type %d ended up in the handshake queue", messageType(elem.msgType))
 			goto skip
 		}
 
 		// handle handshake initiation/response content
 
 		switch elem.msgType {
-		case MessageInitiationType:
+		case defaultMessageInitiationType:
 
 			// unmarshal
 
@@ -381,19 +467,27 @@ func (device *Device) RoutineHandshake(id int) {
 			err := binary.Read(reader, binary.LittleEndian, &msg)
 			if err != nil {
 				device.log.Errorf("Failed to decode initiation message")
+				device.handshakeCounters.initiationsFailed.Add(1)
 				goto skip
 			}
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
+			peer, sender, reason := device.consumeMessageInitiation(&msg)
 			if peer == nil {
 				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+				device.handshakeCounters.initiationsFailed.Add(1)
+				if sender != nil {
+					sender.handshakeFailed(reason)
+				}
 				goto skip
 			}
+			device.handshakeCounters.initiationsReceived.Add(1)
+			peer.handshakeAttempted()
 
 			// update timers
 
+			peer.seen()
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
 
@@ -402,10 +496,11 @@ func (device *Device) RoutineHandshake(id int) {
 
 			device.log.Verbosef("%v - Received handshake initiation", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
+			device.rxBytes.Add(uint64(len(elem.packet)))
 
 			peer.SendHandshakeResponse()
 
-		case MessageResponseType:
+		case defaultMessageResponseType:
 
 			// unmarshal
 
@@ -414,6 +509,7 @@ func (device *Device) RoutineHandshake(id int) {
 			err := binary.Read(reader, binary.LittleEndian, &msg)
 			if err != nil {
 				device.log.Errorf("Failed to decode response message")
+				device.handshakeCounters.responsesFailed.Add(1)
 				goto skip
 			}
 
@@ -422,17 +518,22 @@ func (device *Device) RoutineHandshake(id int) {
 			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
 				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
+				device.handshakeCounters.responsesFailed.Add(1)
+				device.handshakeFailed(&elem, HandshakeFailDecrypt)
 				goto skip
 			}
+			device.handshakeCounters.responsesReceived.Add(1)
 
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
 			device.log.Verbosef("%v - Received handshake response", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
+			device.rxBytes.Add(uint64(len(elem.packet)))
 
 			// update timers
 
+			peer.seen()
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
 
@@ -473,13 +574,17 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 		validTailPacket := -1
 		dataPacketReceived := false
 		rxBytesLen := uint64(0)
+		largest := 0
+		tap := device.inboundTap.Load()
 		for i, elem := range elemsContainer.elems {
 			if elem.packet == nil {
 				// decryption failed
+				device.logDrop(dropAuthFail, "transport message from %v", peer)
 				continue
 			}
 
 			if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+				device.logDrop(dropReplay, "counter %d from %v", elem.counter, peer)
 				continue
 			}
 
@@ -511,6 +616,7 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 				src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
 				if device.allowedips.Lookup(src) != peer {
 					device.log.Verbosef("IPv4 packet with disallowed source address from %v", peer)
+					device.cryptoRoutingDropped(peer, src)
 					continue
 				}
 
@@ -528,6 +634,7 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 				src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
 				if device.allowedips.Lookup(src) != peer {
 					device.log.Verbosef("IPv6 packet with disallowed source address from %v", peer)
+					device.cryptoRoutingDropped(peer, src)
 					continue
 				}
 
@@ -536,11 +643,21 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 				continue
 			}
 
+			if tap != nil && !(*tap)(peer.handshake.remoteStatic, elem.packet) {
+				device.logDrop(dropInboundTap, "packet from %v", peer)
+				continue
+			}
+
+			if len(elem.packet) > largest {
+				largest = len(elem.packet)
+			}
 			bufs = append(bufs, elem.buffer[:MessageTransportOffsetContent+len(elem.packet)])
 		}
 
 		peer.rxBytes.Add(rxBytesLen)
+		device.rxBytes.Add(rxBytesLen)
 		if validTailPacket >= 0 {
+			peer.seen()
 			peer.SetEndpointFromPacket(elemsContainer.elems[validTailPacket].endpoint)
 			peer.keepKeyFreshReceiving()
 			peer.timersAnyAuthenticatedPacketTraversal()
@@ -548,6 +665,7 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 		}
 		if dataPacketReceived {
 			peer.timersDataReceived()
+			peer.pathMTUReceived(largest)
 		}
 		if len(bufs) > 0 {
 			_, err := device.tun.device.Write(bufs, MessageTransportOffsetContent)
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/syntlabs/cyanide-go/conn"
+	"github.com/syntlabs/cyanide-go/conn/bindtest"
+	"github.com/syntlabs/cyanide-go/tun/tuntest"
+)
+
+// newDispatchTestDevice returns a device with aSec configured as conf,
+// or with aSec off if conf is nil. The package-wide message types are reset
+// to the defaults when the test finishes.
+func newDispatchTestDevice(tb testing.TB, conf *aSecConfType) *Device {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	tb.Cleanup(func() {
+		device.handlePostConfig(&aSecConfType{isSet: true})
+	})
+	if conf == nil {
+		conf = &aSecConfType{}
+	}
+	conf.isSet = true
+	if err := device.handlePostConfig(conf); err != nil {
+		tb.Fatal(err)
+	}
+	return device
+}
+
+func messageOfType(msgType uint32, junkSize, size int) []byte {
+	packet := make([]byte, junkSize+size)
+	binary.LittleEndian.PutUint32(packet[junkSize:], msgType)
+	return packet
+}
+
+func TestReceivedMessageType(t *testing.T) {
+	device := newDispatchTestDevice(t, &aSecConfType{
+		initPacketJunkSize:             30,
+		responsePacketJunkSize:         40,
+		underloadPacketJunkSize:        20,
+		initPacketMagicHeader:          123456,
+		responsePacketMagicHeader:      67543,
+		underloadPacketMagicHeader:     123123,
+		transportPacketMagicHeader:     32345,
+		junkTransportPacketCount:       3,
+		junkTransportPacketMagicHeader: 98765,
+	})
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+		want   uint32
+		ok     bool
+	}{
+		{"initiation", messageOfType(123456, 30, MessageInitiationSize), defaultMessageInitiationType, true},
+		{"response", messageOfType(67543, 40, MessageResponseSize), defaultMessageResponseType, true},
+		{"cookie reply", messageOfType(123123, 20, MessageCookieReplySize), defaultMessageCookieReplyType, true},
+		{"transport", messageOfType(32345, 0, 200), defaultMessageTransportType, true},
+		{"junk", messageOfType(98765, 0, 200), 0, false},
+		{"default type", messageOfType(defaultMessageTransportType, 0, 200), 0, false},
+	} {
+		got, payload, ok := device.receivedMessageType(tt.packet)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got type %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+		if ok && binary.LittleEndian.Uint32(payload) != binary.LittleEndian.Uint32(tt.packet[len(tt.packet)-len(payload):]) {
+			t.Errorf("%s: junk was not stripped", tt.name)
+		}
+	}
+}
+
+func BenchmarkReceivedMessageType(b *testing.B) {
+	for _, bb := range []struct {
+		name   string
+		conf   *aSecConfType
+		packet []byte
+	}{
+		{"asec=off", nil, messageOfType(defaultMessageTransportType, 0, 1420)},
+		{"asec=on", &aSecConfType{
+			junkPacketCount:            5,
+			junkPacketMinSize:          500,
+			junkPacketMaxSize:          501,
+			transportPacketMagicHeader: 32345,
+		}, messageOfType(32345, 0, 1420)},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			device := newDispatchTestDevice(b, bb.conf)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msgType, _, ok := device.receivedMessageType(bb.packet)
+				if !ok || msgType != defaultMessageTransportType {
+					b.Fatal("packet not recognized as transport")
+				}
+			}
+		})
+	}
+}
+
+func TestSendHandshakeCookieJunk(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	device := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer device.Close()
+	defer device.handlePostConfig(&aSecConfType{isSet: true})
+	if err := device.IpcSet(uapiCfg("s3", "25", "h3", "123123")); err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := binds[1].Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binds[1].Close()
+
+	elem := QueueHandshakeElement{
+		packet:   messageOfType(defaultMessageInitiationType, 0, MessageInitiationSize),
+		endpoint: bindtest.ChannelEndpoint(1),
+	}
+	device.aSecMux.RLock()
+	err = device.SendHandshakeCookie(&elem)
+	device.aSecMux.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs, sizes, eps := [][]byte{make([]byte, MaxMessageSize)}, make([]int, 1), make([]conn.Endpoint, 1)
+	if _, err := fns[0](bufs, sizes, eps); err != nil {
+		t.Fatal(err)
+	}
+	if sizes[0] != MessageCookieReplySize+25 {
+		t.Fatalf("cookie reply size = %d, want %d", sizes[0], MessageCookieReplySize+25)
+	}
+	device.aSecMux.RLock()
+	msgType, payload, ok := device.receivedMessageType(bufs[0][:sizes[0]])
+	device.aSecMux.RUnlock()
+	if !ok || msgType != defaultMessageCookieReplyType || len(payload) != MessageCookieReplySize {
+		t.Errorf("receivedMessageType() = %d, %d bytes, %v; want cookie reply of %d bytes",
+			msgType, len(payload), ok, MessageCookieReplySize)
+	}
+}
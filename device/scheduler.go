@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"sync"
+)
+
+// A Scheduler decides in which order the batches of outbound packets staged
+// by the device's peers are encrypted and sent; see Device.SetScheduler.
+// The device serializes the calls to a Scheduler, so implementations need not
+// be safe for concurrent use, and it bounds the number of batches queued.
+// Every batch enqueued must eventually be dequeued, because the peer waits
+// for its batches in order.
+type Scheduler interface {
+	// Enqueue adds a batch of packets staged for peer.
+	Enqueue(peer *Peer, elems *QueueOutboundElementsContainer)
+
+	// Dequeue removes and returns the batch to encrypt next,
+	// or nil if there is none.
+	Dequeue() *QueueOutboundElementsContainer
+}
+
+// FairQueueScheduler is a Scheduler that takes turns among the peers with
+// batches queued, one batch each, so that a peer sending in bulk does not hold
+// back the packets of the others. The batches of each peer are kept in order.
+// The zero value is ready to use.
+type FairQueueScheduler struct {
+	queues map[*Peer][]*QueueOutboundElementsContainer
+	active []*Peer // peers with batches queued, in turn order
+}
+
+func (s *FairQueueScheduler) Enqueue(peer *Peer, elems *QueueOutboundElementsContainer) {
+	if s.queues == nil {
+		s.queues = make(map[*Peer][]*QueueOutboundElementsContainer)
+	}
+	if len(s.queues[peer]) == 0 {
+		s.active = append(s.active, peer)
+	}
+	s.queues[peer] = append(s.queues[peer], elems)
+}
+
+func (s *FairQueueScheduler) Dequeue() *QueueOutboundElementsContainer {
+	if len(s.active) == 0 {
+		return nil
+	}
+	peer := s.active[0]
+	s.active[0] = nil
+	s.active = s.active[1:]
+	queue := s.queues[peer]
+	elems := queue[0]
+	queue[0] = nil
+	if queue = queue[1:]; len(queue) == 0 {
+		delete(s.queues, peer)
+	} else {
+		s.queues[peer] = queue
+		s.active = append(s.active, peer)
+	}
+	return elems
+}
+
+// schedulerQueueDepth is the number of batches the dispatcher of a scheduler
+// lets wait in the encryption queue, one per encryption worker, so that the
+// scheduler rather than the queue decides the order of the others.
+var schedulerQueueDepth = runtime.NumCPU()
+
+// outboundScheduler feeds the encryption queue through a Scheduler.
+type outboundScheduler struct {
+	sync.Mutex
+	notEmpty  sync.Cond
+	notFull   sync.Cond
+	scheduler Scheduler                         // nil for FIFO through the encryption queue
+	leftover  []*QueueOutboundElementsContainer // queued in a scheduler since replaced by FIFO
+	len       int                               // batches queued in scheduler and leftover
+	running   bool                              // whether routineScheduler runs
+	stopped   bool                              // set to stop routineScheduler once drained
+	done      chan struct{}                     // closed when routineScheduler returns
+	space     chan struct{}                     // signalled when a batch leaves the encryption queue
+}
+
+func (q *outboundScheduler) init() {
+	q.notEmpty.L = &q.Mutex
+	q.notFull.L = &q.Mutex
+	q.space = make(chan struct{}, 1)
+	q.done = make(chan struct{})
+}
+
+// SetScheduler sets the order in which the outbound packets of the peers are
+// encrypted and sent. By default, or if s is nil, batches of packets go first
+// in, first out across all peers; FairQueueScheduler lets a peer sending in
+// bulk share the device with latency-sensitive ones. Batches queued in the
+// previous scheduler are moved to s.
+func (device *Device) SetScheduler(s Scheduler) {
+	q := &device.scheduler
+	q.Lock()
+	defer q.Unlock()
+	if q.stopped {
+		return
+	}
+	old := q.scheduler
+	q.scheduler = s
+	if old != nil {
+		for elems := old.Dequeue(); elems != nil; elems = old.Dequeue() {
+			if s != nil {
+				s.Enqueue(elems.elems[0].peer, elems)
+			} else {
+				q.leftover = append(q.leftover, elems)
+			}
+		}
+	}
+	// Let writers waiting for room fall back to FIFO.
+	q.notFull.Broadcast()
+	if s == nil || q.running {
+		return
+	}
+	q.running = true
+	device.queue.encryption.cn.Add(1) // routineScheduler
+	go device.routineScheduler()
+}
+
+// enqueueEncryption hands a batch of packets locked for encryption to the
+// scheduler, or straight to the encryption queue if there is none.
+func (device *Device) enqueueEncryption(elems *QueueOutboundElementsContainer) {
+	q := &device.scheduler
+	q.Lock()
+	if q.scheduler == nil {
+		q.Unlock()
+		device.queue.encryption.c <- elems
+		return
+	}
+	for q.len >= QueueOutboundSize && q.scheduler != nil {
+		q.notFull.Wait()
+	}
+	if q.scheduler == nil {
+		q.Unlock()
+		device.queue.encryption.c <- elems
+		return
+	}
+	q.scheduler.Enqueue(elems.elems[0].peer, elems)
+	q.len++
+	q.notEmpty.Signal()
+	q.Unlock()
+}
+
+// encryptionDequeued tells the dispatcher of the scheduler, if any,
+// that a batch left the encryption queue.
+func (device *Device) encryptionDequeued() {
+	select {
+	case device.scheduler.space <- struct{}{}:
+	default:
+	}
+}
+
+// routineScheduler moves batches from the scheduler to the encryption queue,
+// keeping the latter short, until stopScheduler is called and nothing is left.
+func (device *Device) routineScheduler() {
+	q := &device.scheduler
+	defer func() {
+		device.queue.encryption.cn.Done()
+		close(q.done)
+	}()
+	for {
+		q.Lock()
+		for q.len == 0 && !q.stopped {
+			q.notEmpty.Wait()
+		}
+		if q.len == 0 {
+			q.Unlock()
+			return
+		}
+		q.Unlock()
+
+		for len(device.queue.encryption.c) >= schedulerQueueDepth {
+			<-q.space
+		}
+
+		q.Lock()
+		var elems *QueueOutboundElementsContainer
+		if len(q.leftover) > 0 {
+			elems = q.leftover[0]
+			q.leftover[0] = nil
+			q.leftover = q.leftover[1:]
+		} else {
+			elems = q.scheduler.Dequeue()
+		}
+		q.len--
+		q.notFull.Broadcast()
+		q.Unlock()
+		device.queue.encryption.c <- elems
+	}
+}
+
+// stopScheduler stops the dispatcher of the scheduler, if any, once it has
+// handed all queued batches to the encryption queue. No scheduler can be set
+// afterwards.
+func (device *Device) stopScheduler() {
+	q := &device.scheduler
+	q.Lock()
+	q.stopped = true
+	running := q.running
+	if running {
+		q.notEmpty.Broadcast()
+	}
+	q.Unlock()
+	if running {
+		<-q.done
+	}
+}
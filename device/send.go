@@ -10,11 +10,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"time"
-	"math/rand"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -67,6 +68,22 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	return elem
 }
 
+// tryNewOutboundElement is like NewOutboundElement, but returns nil if a pool
+// is exhausted and the device drops packets rather than waiting.
+func (device *Device) tryNewOutboundElement() *QueueOutboundElement {
+	elem := device.tryGetOutboundElement()
+	if elem == nil {
+		return nil
+	}
+	elem.buffer = device.tryGetMessageBuffer()
+	if elem.buffer == nil {
+		device.PutOutboundElement(elem)
+		return nil
+	}
+	elem.nonce = 0
+	return elem
+}
+
 // clearPointers clears elem fields that contain pointers.
 // This makes the garbage collector's life easier and
 // avoids accidentally keeping other objects around unnecessarily.
@@ -97,25 +114,32 @@ func (peer *Peer) SendKeepalive() {
 	peer.SendStagedPackets()
 }
 
-func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+func (peer *Peer) SendHandshakeInitiation(isRetry bool) (err error) {
+	// Retries are spaced out by the retransmit timer, which backs off.
+	interval := peer.device.rekeyTimeout()
 	if !isRetry {
 		peer.timers.handshakeAttempts.Store(0)
+		interval = peer.handshakeRetryInterval()
 	}
 
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < interval {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < interval {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
+	peer.handshakeAttempted()
+
+	counters := &peer.device.handshakeCounters
+	defer func() { countSent(&counters.initiationsSent, &counters.initiationsFailed, err) }()
 
 	peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
 
@@ -127,9 +151,12 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	var sendBuffer [][]byte
 	// so only packet processed for cookie generation
 	var junkedHeader []byte
+	var junks [][]byte
+	var timing junkTiming
 	if peer.device.isAdvancedSecurityOn() {
 		peer.device.aSecMux.RLock()
-		junks, err := peer.createJunkPackets()
+		junks, err = peer.createJunkPackets()
+		timing = peer.device.aSecConf.junkTiming
 		peer.device.aSecMux.RUnlock()
 
 		if err != nil {
@@ -137,9 +164,8 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 			return err
 		}
 
-		if len(junks) > 0 {
-			err = peer.SendBuffers(junks)
-
+		if timing.mode != junkTimingAfter {
+			err = peer.sendJunkPackets(junks, timing)
 			if err != nil {
 				peer.device.log.Errorf("%v - Failed to send junk packets: %v", peer, err)
 				return err
@@ -150,7 +176,7 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 		if peer.device.aSecConf.initPacketJunkSize != 0 {
 			buf := make([]byte, 0, peer.device.aSecConf.initPacketJunkSize)
 			writer := bytes.NewBuffer(buf[:0])
-			err = appendJunk(writer, peer.device.aSecConf.initPacketJunkSize)
+			err = appendJunk(writer, peer.device.junkSource(), peer.device.aSecConf.initPacketJunkSize)
 			if err != nil {
 				peer.device.log.Errorf("%v - %v", peer, err)
 				peer.device.aSecMux.RUnlock()
@@ -174,16 +200,40 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	err = peer.SendBuffers(sendBuffer)
 	if err != nil {
 		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+	} else if timing.mode == junkTimingAfter {
+		if err := peer.sendJunkPackets(junks, timing); err != nil {
+			peer.device.log.Errorf("%v - Failed to send junk packets: %v", peer, err)
+		}
 	}
 	peer.timersHandshakeInitiated()
 
 	return err
 }
 
-func (peer *Peer) SendHandshakeResponse() error {
+// InitiateHandshake sends a handshake initiation to the peer right away,
+// without waiting for data to send or for the rekey timers, for example to
+// warm up a tunnel or to check that the peer is reachable.
+// It fails if the device is down or the peer is not running.
+func (peer *Peer) InitiateHandshake() error {
+	if !peer.device.isUp() {
+		return errors.New("device is down")
+	}
+	if !peer.isRunning.Load() {
+		return errors.New("peer is not running")
+	}
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = time.Time{}
 	peer.handshake.mutex.Unlock()
+	return peer.SendHandshakeInitiation(false)
+}
+
+func (peer *Peer) SendHandshakeResponse() (err error) {
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = peer.device.now()
+	peer.handshake.mutex.Unlock()
+
+	counters := &peer.device.handshakeCounters
+	defer func() { countSent(&counters.responsesSent, &counters.responsesFailed, err) }()
 
 	peer.device.log.Verbosef("%v - Sending handshake response", peer)
 
@@ -198,7 +248,7 @@ func (peer *Peer) SendHandshakeResponse() error {
 		if peer.device.aSecConf.responsePacketJunkSize != 0 {
 			buf := make([]byte, 0, peer.device.aSecConf.responsePacketJunkSize)
 			writer := bytes.NewBuffer(buf[:0])
-			err = appendJunk(writer, peer.device.aSecConf.responsePacketJunkSize)
+			err = appendJunk(writer, peer.device.junkSource(), peer.device.aSecConf.responsePacketJunkSize)
 			if err != nil {
 				peer.device.aSecMux.RUnlock()
 				peer.device.log.Errorf("%v - %v", peer, err)
@@ -232,6 +282,9 @@ func (peer *Peer) SendHandshakeResponse() error {
 	return err
 }
 
+// SendHandshakeCookie answers the handshake message in initiatingElem with a
+// cookie reply, prefixed with underload junk when aSec is on.
+// The caller must hold aSecMux for reading.
 func (device *Device) SendHandshakeCookie(
 	initiatingElem *QueueHandshakeElement,
 ) error {
@@ -248,10 +301,19 @@ func (device *Device) SendHandshakeCookie(
 		return err
 	}
 
-	var buf [MessageCookieReplySize]byte
-	writer := bytes.NewBuffer(buf[:0])
+	var junkSize int
+	if device.isAdvancedSecurityOn() {
+		junkSize = device.aSecConf.underloadPacketJunkSize
+	}
+	buf := make([]byte, 0, junkSize+MessageCookieReplySize)
+	writer := bytes.NewBuffer(buf)
+	if junkSize != 0 {
+		if err := appendJunk(writer, device.junkSource(), junkSize); err != nil {
+			device.log.Errorf("Failed to create cookie reply junk: %v", err)
+			return err
+		}
+	}
 	binary.Write(writer, binary.LittleEndian, reply)
-	// TODO: allocation could be avoided
 	device.net.bind.Send([][]byte{writer.Bytes()}, initiatingElem.endpoint)
 	return nil
 }
@@ -262,7 +324,7 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && peer.device.since(keypair.created) > RekeyAfterTime) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -304,6 +366,14 @@ func (device *Device) RoutineReadFromTUN() {
 	for {
 		// read packets
 		count, readErr = device.tun.device.Read(bufs, sizes, offset)
+		if !device.waitResumed(device.isClosed) {
+			return
+		}
+		if device.draining.Load() {
+			// CloseGraceful is draining the queues; take in no more.
+			count = 0
+		}
+		tap := device.outboundTap.Load()
 		for i := 0; i < count; i++ {
 			if sizes[i] < 1 {
 				continue
@@ -312,21 +382,28 @@ func (device *Device) RoutineReadFromTUN() {
 			elem := elems[i]
 			elem.packet = bufs[i][offset : offset+sizes[i]]
 
+			// A rejected packet's element is left in elems, to be read into again.
+			if tap != nil && !(*tap)(elem.packet) {
+				device.logDrop(dropOutboundTap, "%d-byte packet", len(elem.packet))
+				continue
+			}
+
 			// lookup peer
 			var peer *Peer
+			var dst []byte
 			switch elem.packet[0] >> 4 {
 			case 4:
 				if len(elem.packet) < ipv4.HeaderLen {
 					continue
 				}
-				dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+				dst = elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
 				peer = device.allowedips.Lookup(dst)
 
 			case 6:
 				if len(elem.packet) < ipv6.HeaderLen {
 					continue
 				}
-				dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+				dst = elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
 				peer = device.allowedips.Lookup(dst)
 
 			default:
@@ -334,15 +411,30 @@ func (device *Device) RoutineReadFromTUN() {
 			}
 
 			if peer == nil {
+				if device.dropLogging() {
+					addr, _ := netip.AddrFromSlice(dst)
+					device.logDrop(dropNoAllowedIP, "no peer for destination %v of %d-byte packet", addr, len(elem.packet))
+				}
 				continue
 			}
 			elemsForPeer, ok := elemsByPeer[peer]
+			next := device.tryNewOutboundElement()
+			if !ok && next != nil {
+				elemsForPeer = device.tryGetOutboundElementsContainer()
+			}
+			if next == nil || elemsForPeer == nil {
+				if next != nil {
+					device.PutMessageBuffer(next.buffer)
+					device.PutOutboundElement(next)
+				}
+				device.logDrop(dropBufferLimit, "%d-byte packet", len(elem.packet))
+				continue
+			}
 			if !ok {
-				elemsForPeer = device.GetOutboundElementsContainer()
 				elemsByPeer[peer] = elemsForPeer
 			}
 			elemsForPeer.elems = append(elemsForPeer.elems, elem)
-			elems[i] = device.NewOutboundElement()
+			elems[i] = next
 			bufs[i] = elems[i].buffer[:]
 		}
 
@@ -398,16 +490,23 @@ func (peer *Peer) StagePackets(elems *QueueOutboundElementsContainer) {
 	}
 }
 
-func (peer *Peer) SendStagedPackets() {
+// SendStagedPackets hands the staged packets to the encryption queue if the
+// peer has a usable keypair, or else initiates a handshake. Packets staged for
+// a stopped peer are dropped. It returns ErrDeviceClosed if the device has been
+// closed, in which case the staged packets are left alone.
+func (peer *Peer) SendStagedPackets() error {
 top:
+	if peer.device.isClosed() {
+		return ErrDeviceClosed
+	}
 	if len(peer.queue.staged) == 0 || !peer.device.isUp() {
-		return
+		return nil
 	}
 
 	keypair := peer.keypairs.Current()
-	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || peer.device.since(keypair.created) >= RejectAfterTime {
 		peer.SendHandshakeInitiation(false)
-		return
+		return nil
 	}
 
 	for {
@@ -445,10 +544,14 @@ top:
 			}
 
 			// add to parallel and sequential queue
+			peer.queue.enqueue.RLock()
 			if peer.isRunning.Load() {
+				peer.queue.pending.Add(1)
 				peer.queue.outbound.c <- elemsContainer
-				peer.device.queue.encryption.c <- elemsContainer
+				peer.device.enqueueEncryption(elemsContainer)
+				peer.queue.enqueue.RUnlock()
 			} else {
+				peer.queue.enqueue.RUnlock()
 				for _, elem := range elemsContainer.elems {
 					peer.device.PutMessageBuffer(elem.buffer)
 					peer.device.PutOutboundElement(elem)
@@ -460,7 +563,7 @@ top:
 				goto top
 			}
 		default:
-			return
+			return nil
 		}
 	}
 }
@@ -470,13 +573,14 @@ func (peer *Peer) createJunkPackets() ([][]byte, error) {
 		return nil, nil
 	}
 
+	src := peer.device.junkSource()
 	junks := make([][]byte, 0, peer.device.aSecConf.junkPacketCount)
 	for i := 0; i < peer.device.aSecConf.junkPacketCount; i++ {
-		packetSize := rand.Intn(
+		packetSize := src.Intn(
 			peer.device.aSecConf.junkPacketMaxSize-peer.device.aSecConf.junkPacketMinSize,
 		) + peer.device.aSecConf.junkPacketMinSize
 
-		junk, err := randomJunkWithSize(packetSize)
+		junk, err := randomJunkWithSize(src, packetSize)
 		if err != nil {
 			peer.device.log.Errorf(
 				"%v - Failed to create junk packet: %v",
@@ -490,6 +594,33 @@ func (peer *Peer) createJunkPackets() ([][]byte, error) {
 	return junks, nil
 }
 
+// createTransportJunkPackets returns the junk packets to send along with
+// count transport packets, given that *sent transport packets were sent since
+// the last junk packet, and updates *sent.
+// The caller must hold device.aSecMux.RLock.
+func (peer *Peer) createTransportJunkPackets(sent *int, count int) ([][]byte, error) {
+	conf := &peer.device.aSecConf
+	if conf.junkTransportPacketCount == 0 {
+		return nil, nil
+	}
+
+	src := peer.device.junkSource()
+	var junks [][]byte
+	for *sent += count; *sent >= conf.junkTransportPacketCount; *sent -= conf.junkTransportPacketCount {
+		packetSize := conf.junkPacketMinSize
+		if conf.junkPacketMaxSize > conf.junkPacketMinSize {
+			packetSize += src.Intn(conf.junkPacketMaxSize - conf.junkPacketMinSize)
+		}
+		junk, err := randomJunkWithSize(src, 4+packetSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create transport junk packet: %w", err)
+		}
+		binary.LittleEndian.PutUint32(junk, conf.junkTransportPacketMagicHeader)
+		junks = append(junks, junk)
+	}
+	return junks, nil
+}
+
 func (peer *Peer) FlushStagedPackets() {
 	for {
 		select {
@@ -533,6 +664,7 @@ func (device *Device) RoutineEncryption(id int) {
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
 	for elemsContainer := range device.queue.encryption.c {
+		device.encryptionDequeued()
 		for _, elem := range elemsContainer.elems {
 			// populate header fields
 			header := elem.buffer[:MessageTransportHeaderSize]
@@ -546,7 +678,7 @@ func (device *Device) RoutineEncryption(id int) {
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
 			// pad content to multiple of 16
-			paddingSize := calculatePaddingSize(len(elem.packet), int(device.tun.mtu.Load()))
+			paddingSize := calculatePaddingSize(len(elem.packet), elem.peer.PathMTU())
 			elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
 
 			// encrypt content and release to consumer
@@ -572,6 +704,7 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
 
 	bufs := make([][]byte, 0, maxBatchSize)
+	sinceJunk := 0 // transport packets sent since the last transport junk packet
 
 	for elemsContainer := range peer.queue.outbound.c {
 		bufs = bufs[:0]
@@ -590,16 +723,27 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
 			}
+			device.PutOutboundElementsContainer(elemsContainer)
+			if peer.queue.pending.Add(-1) == 0 {
+				device.drained.signal()
+			}
 			continue
 		}
 		dataSent := false
+		size := 0
 		elemsContainer.Lock()
 		for _, elem := range elemsContainer.elems {
 			if len(elem.packet) != MessageKeepaliveSize {
 				dataSent = true
 			}
+			size += len(elem.packet)
 			bufs = append(bufs, elem.packet)
 		}
+		// The packets are encrypted; no one waits for the container now, and
+		// it need not stay locked while the bandwidth limit holds them back.
+		elemsContainer.Unlock()
+
+		peer.waitBandwidth(size)
 
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketSent()
@@ -613,6 +757,9 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 			device.PutOutboundElement(elem)
 		}
 		device.PutOutboundElementsContainer(elemsContainer)
+		if peer.queue.pending.Add(-1) == 0 {
+			device.drained.signal()
+		}
 		if err != nil {
 			var errGSO conn.ErrUDPGSODisabled
 			if errors.As(err, &errGSO) {
@@ -626,5 +773,17 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 		}
 
 		peer.keepKeyFreshSending()
+
+		if device.isAdvancedSecurityOn() {
+			device.aSecMux.RLock()
+			junks, err := peer.createTransportJunkPackets(&sinceJunk, len(bufs))
+			device.aSecMux.RUnlock()
+			if err == nil && len(junks) > 0 {
+				err = peer.SendBuffers(junks)
+			}
+			if err != nil {
+				device.log.Errorf("%v - Failed to send transport junk packets: %v", peer, err)
+			}
+		}
 	}
 }
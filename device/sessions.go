@@ -0,0 +1,357 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/syntlabs/cyanide-go/conn"
+)
+
+// sessionsMagic starts the encoding produced by ExportSessions,
+// followed by its version.
+const (
+	sessionsMagic   = "CYSS"
+	sessionsVersion = 1
+)
+
+// sessionNonceMargin is added to the send counters of imported keypairs, so
+// that the counters used by the exporting device after the export are not
+// used again. Receivers accept the gap, since counters only have to increase.
+const sessionNonceMargin = 1 << 20
+
+// Slots of an exported keypair in Keypairs.
+const (
+	sessionSlotCurrent = iota
+	sessionSlotPrevious
+	sessionSlotNext
+)
+
+// An exportedPeer is the session state of a peer as encoded by ExportSessions.
+type exportedPeer struct {
+	publicKey         NoisePublicKey
+	lastHandshakeNano int64
+	endpoint          string
+	keypairs          []exportedKeypair
+}
+
+// An exportedKeypair is a keypair as encoded by ExportSessions.
+type exportedKeypair struct {
+	slot         uint8
+	isInitiator  bool
+	created      int64 // nanoseconds since epoch
+	localIndex   uint32
+	remoteIndex  uint32
+	sendNonce    uint64
+	sendKey      [chacha20poly1305.KeySize]byte
+	receiveKey   [chacha20poly1305.KeySize]byte
+	replayFilter []byte
+}
+
+// ExportSessions encodes the live sessions of the device's peers: their
+// keypairs with the send counters and replay windows, their last handshake
+// times and their endpoints, so that ImportSessions can take them over on a
+// standby device configured with the same private key and peers, for example
+// across a process restart, without new handshakes.
+//
+// The result holds the session keys in the clear: anyone who obtains it can
+// decrypt the traffic of the exported sessions and inject packets into them
+// until they expire, which takes up to RejectAfterTime, and forward secrecy
+// is lost for that traffic. Encrypt it or keep it in memory, never write it
+// to disk in the clear, and discard it once imported.
+//
+// A session must never send with the same counter twice, so the device must
+// not send anything after the export: pause it beforehand, and close it once
+// the standby has taken over. ImportSessions skips the send counters ahead to
+// tolerate a few packets sent in between, such as keepalives.
+func (device *Device) ExportSessions() ([]byte, error) {
+	if device.isClosed() {
+		return nil, ErrDeviceClosed
+	}
+
+	var peers []exportedPeer
+	device.peers.RLock()
+	for pk, peer := range device.peers.keyMap {
+		exported := exportedPeer{
+			publicKey:         pk,
+			lastHandshakeNano: peer.lastHandshakeNano.Load(),
+		}
+		peer.endpoint.Lock()
+		if peer.endpoint.val != nil {
+			exported.endpoint = peer.endpoint.val.DstToString()
+		}
+		peer.endpoint.Unlock()
+
+		peer.keypairs.RLock()
+		for slot, keypair := range [...]*Keypair{
+			sessionSlotCurrent:  peer.keypairs.current,
+			sessionSlotPrevious: peer.keypairs.previous,
+			sessionSlotNext:     peer.keypairs.next.Load(),
+		} {
+			if keypair == nil {
+				continue
+			}
+			replayFilter, err := keypair.replayFilter.MarshalBinary()
+			if err != nil {
+				peer.keypairs.RUnlock()
+				device.peers.RUnlock()
+				return nil, err
+			}
+			exported.keypairs = append(exported.keypairs, exportedKeypair{
+				slot:         uint8(slot),
+				isInitiator:  keypair.isInitiator,
+				created:      keypair.created.UnixNano(),
+				localIndex:   keypair.localIndex,
+				remoteIndex:  keypair.remoteIndex,
+				sendNonce:    keypair.sendNonce.Load(),
+				sendKey:      keypair.sendKey,
+				receiveKey:   keypair.receiveKey,
+				replayFilter: replayFilter,
+			})
+		}
+		peer.keypairs.RUnlock()
+		if len(exported.keypairs) != 0 {
+			peers = append(peers, exported)
+		}
+	}
+	device.peers.RUnlock()
+
+	b := append([]byte(sessionsMagic), sessionsVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(peers)))
+	for _, peer := range peers {
+		b = append(b, peer.publicKey[:]...)
+		b = binary.LittleEndian.AppendUint64(b, uint64(peer.lastHandshakeNano))
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(peer.endpoint)))
+		b = append(b, peer.endpoint...)
+		b = append(b, uint8(len(peer.keypairs)))
+		for _, kp := range peer.keypairs {
+			b = append(b, kp.slot)
+			if kp.isInitiator {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+			b = binary.LittleEndian.AppendUint64(b, uint64(kp.created))
+			b = binary.LittleEndian.AppendUint32(b, kp.localIndex)
+			b = binary.LittleEndian.AppendUint32(b, kp.remoteIndex)
+			b = binary.LittleEndian.AppendUint64(b, kp.sendNonce)
+			b = append(b, kp.sendKey[:]...)
+			b = append(b, kp.receiveKey[:]...)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(kp.replayFilter)))
+			b = append(b, kp.replayFilter...)
+		}
+	}
+	return b, nil
+}
+
+// sessionsDecoder reads the fields of an encoding produced by ExportSessions.
+type sessionsDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *sessionsDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errors.New("sessions encoding is truncated")
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *sessionsDecoder) uint8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *sessionsDecoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *sessionsDecoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *sessionsDecoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// decodeSessions decodes the encoding produced by ExportSessions.
+func decodeSessions(b []byte) ([]exportedPeer, error) {
+	d := &sessionsDecoder{b: b}
+	if magic := d.bytes(len(sessionsMagic)); d.err == nil && string(magic) != sessionsMagic {
+		return nil, errors.New("not a sessions encoding")
+	}
+	if version := d.uint8(); d.err == nil && version != sessionsVersion {
+		return nil, fmt.Errorf("unsupported sessions encoding version %d", version)
+	}
+	count := d.uint32()
+	var peers []exportedPeer
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		var peer exportedPeer
+		copy(peer.publicKey[:], d.bytes(NoisePublicKeySize))
+		peer.lastHandshakeNano = int64(d.uint64())
+		peer.endpoint = string(d.bytes(int(d.uint16())))
+		keypairs := d.uint8()
+		for j := uint8(0); j < keypairs && d.err == nil; j++ {
+			var kp exportedKeypair
+			kp.slot = d.uint8()
+			kp.isInitiator = d.uint8() != 0
+			kp.created = int64(d.uint64())
+			kp.localIndex = d.uint32()
+			kp.remoteIndex = d.uint32()
+			kp.sendNonce = d.uint64()
+			copy(kp.sendKey[:], d.bytes(len(kp.sendKey)))
+			copy(kp.receiveKey[:], d.bytes(len(kp.receiveKey)))
+			kp.replayFilter = d.bytes(int(d.uint32()))
+			if d.err == nil && kp.slot > sessionSlotNext {
+				d.err = fmt.Errorf("invalid keypair slot %d", kp.slot)
+			}
+			peer.keypairs = append(peer.keypairs, kp)
+		}
+		peers = append(peers, peer)
+	}
+	if d.err == nil && len(d.b) != 0 {
+		d.err = errors.New("trailing data after sessions encoding")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return peers, nil
+}
+
+// ImportSessions takes over the sessions exported by ExportSessions from
+// another device, replacing the keypairs of the matching peers, so that the
+// tunnels go on without new handshakes. The device must be configured with the
+// same private key and peers as the exporting device, and must be paused with
+// Pause, so that no packet is processed while the sessions are replaced;
+// resume it afterwards. A Resume during the import waits for it to finish.
+// Peers' endpoints are set to the exported ones.
+//
+// The sessions are checked before any is imported: if one names a peer the
+// device does not have, cannot be decoded, or has a local index already in use
+// by another session of the device, nothing is changed.
+// See ExportSessions for the security implications.
+func (device *Device) ImportSessions(b []byte) error {
+	if device.isClosed() {
+		return ErrDeviceClosed
+	}
+
+	exported, err := decodeSessions(b)
+	if err != nil {
+		return err
+	}
+	peers := make([]*Peer, len(exported))
+	keypairs := make([][3]*Keypair, len(exported))
+	endpoints := make([]conn.Endpoint, len(exported))
+	seen := make(map[*Peer]bool, len(exported))
+	device.net.RLock()
+	brokenRoaming := device.net.brokenRoaming
+	device.net.RUnlock()
+	for i := range exported {
+		if peers[i] = device.LookupPeer(exported[i].publicKey); peers[i] == nil {
+			return fmt.Errorf("no peer with public key %x", exported[i].publicKey[:])
+		}
+		if seen[peers[i]] {
+			return fmt.Errorf("peer %x: sessions exported twice", exported[i].publicKey[:])
+		}
+		seen[peers[i]] = true
+		for _, kp := range exported[i].keypairs {
+			keypair := &Keypair{
+				isInitiator: kp.isInitiator,
+				created:     time.Unix(0, kp.created),
+				localIndex:  kp.localIndex,
+				remoteIndex: kp.remoteIndex,
+				sendKey:     kp.sendKey,
+				receiveKey:  kp.receiveKey,
+			}
+			keypair.send, _ = chacha20poly1305.New(kp.sendKey[:])
+			keypair.receive, _ = chacha20poly1305.New(kp.receiveKey[:])
+			keypair.sendNonce.Store(kp.sendNonce + sessionNonceMargin)
+			if err := keypair.replayFilter.UnmarshalBinary(kp.replayFilter); err != nil {
+				return fmt.Errorf("peer %x: %w", exported[i].publicKey[:], err)
+			}
+			keypairs[i][kp.slot] = keypair
+		}
+		if endpoint := exported[i].endpoint; endpoint != "" {
+			device.net.RLock()
+			endpoints[i], err = device.net.bind.ParseEndpoint(endpoint)
+			device.net.RUnlock()
+			if err != nil {
+				device.log.Errorf("%v - Failed to set imported endpoint %s: %v", peers[i], endpoint, err)
+			}
+		}
+	}
+
+	// Holding the pause lock keeps the device paused throughout. Closing the
+	// bind takes it with the bind locked, so the bind must not be locked
+	// from here on.
+	device.pause.Lock()
+	defer device.pause.Unlock()
+	if !device.pause.paused {
+		return errors.New("device must be paused to import sessions")
+	}
+
+	for _, peer := range peers {
+		peer.keypairs.Lock()
+		defer peer.keypairs.Unlock()
+	}
+	var old []*Keypair
+	var entries []IndexTableEntry
+	for i, peer := range peers {
+		for _, keypair := range []*Keypair{peer.keypairs.current, peer.keypairs.previous, peer.keypairs.next.Load()} {
+			if keypair != nil {
+				old = append(old, keypair)
+			}
+		}
+		for _, keypair := range keypairs[i] {
+			if keypair != nil {
+				entries = append(entries, IndexTableEntry{peer: peer, keypair: keypair})
+			}
+		}
+	}
+	if index, ok := device.indexTable.replaceKeypairs(old, entries); !ok {
+		return fmt.Errorf("index %d of an imported keypair is already in use", index)
+	}
+
+	for i, peer := range peers {
+		peer.keypairs.current = keypairs[i][sessionSlotCurrent]
+		peer.keypairs.previous = keypairs[i][sessionSlotPrevious]
+		peer.keypairs.next.Store(keypairs[i][sessionSlotNext])
+		if endpoints[i] != nil {
+			peer.endpoint.Lock()
+			peer.endpoint.val = endpoints[i]
+			peer.endpoint.clearSrcOnTx = true
+			peer.endpoint.disableRoaming = brokenRoaming
+			peer.endpoint.Unlock()
+		}
+		peer.lastHandshakeNano.Store(exported[i].lastHandshakeNano)
+		peer.timersSessionDerived()
+		device.log.Verbosef("%v - Imported %d keypairs", peer, len(exported[i].keypairs))
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// STUN (RFC 8489) binding messages, as far as DiscoverExternalEndpoint uses them.
+const (
+	stunHeaderSize           = 20
+	stunMagicCookie          = 0x2112a442
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunBindingError         = 0x0111
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+
+	// stunInitialRTO is the first retransmission timeout of a binding
+	// request, doubled after every retransmission.
+	stunInitialRTO = 500 * time.Millisecond
+)
+
+type stunTransactionID [12]byte
+
+// stunResult is the outcome of a binding request.
+type stunResult struct {
+	addr netip.AddrPort
+	err  error
+}
+
+// stunRequests are the binding requests waiting for a response.
+type stunRequests struct {
+	waiting atomic.Int32 // number of requests in pending, to check it cheaply
+
+	sync.Mutex
+	pending map[stunTransactionID]chan stunResult
+}
+
+// DiscoverExternalEndpoint asks the STUN server stunServer, given as
+// host:port, for the address and port that the datagrams of the device come
+// from as seen from the Internet, past any NAT, so that a coordination layer
+// can tell peers where to reach the device. The binding request is sent from
+// the bind's socket, so the mapping reported is the one WireGuard traffic
+// uses; the response is taken from the socket before it reaches the
+// handshake and transport processing, which carries on undisturbed.
+// The request is retransmitted until a response arrives or timeout elapses.
+//
+// The device must be up, and its bind must deliver the response to its
+// receive functions as it does other datagrams, which conn.StdNetBind does.
+func (device *Device) DiscoverExternalEndpoint(stunServer string, timeout time.Duration) (netip.AddrPort, error) {
+	if !device.isUp() {
+		return netip.AddrPort{}, errors.New("device is down")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", stunServer)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to resolve STUN server %v: %w", stunServer, err)
+	}
+	server := udpAddr.AddrPort()
+	server = netip.AddrPortFrom(server.Addr().Unmap(), server.Port())
+	device.net.RLock()
+	endpoint, err := device.net.bind.ParseEndpoint(server.String())
+	device.net.RUnlock()
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to parse STUN server endpoint %v: %w", server, err)
+	}
+
+	var id stunTransactionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	result := device.stun.add(id)
+	defer device.stun.remove(id)
+
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	copy(request[8:], id[:])
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	rto := stunInitialRTO
+	for {
+		device.net.RLock()
+		err := device.net.bind.Send([][]byte{request}, endpoint)
+		device.net.RUnlock()
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("failed to send STUN binding request to %v: %w", server, err)
+		}
+		retransmit := time.NewTimer(rto)
+		select {
+		case r := <-result:
+			retransmit.Stop()
+			return r.addr, r.err
+		case <-deadline.C:
+			retransmit.Stop()
+			return netip.AddrPort{}, fmt.Errorf("no STUN binding response from %v within %v", server, timeout)
+		case <-device.closed:
+			retransmit.Stop()
+			return netip.AddrPort{}, ErrDeviceClosed
+		case <-retransmit.C:
+			rto *= 2
+		}
+	}
+}
+
+// add registers a binding request and returns the channel its result is
+// delivered on.
+func (s *stunRequests) add(id stunTransactionID) <-chan stunResult {
+	s.Lock()
+	defer s.Unlock()
+	if s.pending == nil {
+		s.pending = make(map[stunTransactionID]chan stunResult)
+	}
+	result := make(chan stunResult, 1)
+	s.pending[id] = result
+	s.waiting.Add(1)
+	return result
+}
+
+// remove unregisters a binding request.
+func (s *stunRequests) remove(id stunTransactionID) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.pending[id]; ok {
+		delete(s.pending, id)
+		s.waiting.Add(-1)
+	}
+}
+
+// receiveSTUN delivers packet to the binding request it answers and reports
+// whether it did. Other packets are left to the protocol.
+func (device *Device) receiveSTUN(packet []byte) bool {
+	if device.stun.waiting.Load() == 0 || len(packet) < stunHeaderSize ||
+		packet[0]&0xc0 != 0 || binary.BigEndian.Uint32(packet[4:]) != stunMagicCookie ||
+		int(binary.BigEndian.Uint16(packet[2:]))+stunHeaderSize != len(packet) {
+		return false
+	}
+	id := stunTransactionID(packet[8:stunHeaderSize])
+	s := &device.stun
+	s.Lock()
+	result, ok := s.pending[id]
+	s.Unlock()
+	if !ok {
+		return false
+	}
+	addr, err := parseSTUNBindingResponse(packet)
+	select {
+	case result <- stunResult{addr, err}:
+	default:
+		// A retransmission was answered as well.
+	}
+	return true
+}
+
+// parseSTUNBindingResponse returns the mapped address of a binding response,
+// preferring the XOR-MAPPED-ADDRESS attribute to MAPPED-ADDRESS.
+func parseSTUNBindingResponse(packet []byte) (netip.AddrPort, error) {
+	switch msgType := binary.BigEndian.Uint16(packet[0:]); msgType {
+	case stunBindingSuccess:
+	case stunBindingError:
+		return netip.AddrPort{}, errors.New("STUN server returned a binding error response")
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unexpected STUN message type %#04x", msgType)
+	}
+	var mapped netip.AddrPort
+	attrs := packet[stunHeaderSize:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			if addr, ok := parseSTUNAddress(value, packet[4:stunHeaderSize]); ok {
+				return addr, nil
+			}
+		case stunAttrMappedAddress:
+			if addr, ok := parseSTUNAddress(value, nil); ok {
+				mapped = addr
+			}
+		}
+		// Attributes are padded to a multiple of 4 bytes.
+		attrs = attrs[min(4+(attrLen+3)&^3, len(attrs)):]
+	}
+	if !mapped.IsValid() {
+		return netip.AddrPort{}, errors.New("STUN binding response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// parseSTUNAddress parses the value of an address attribute. If xor is not
+// nil, it holds the magic cookie and transaction ID the address is XORed with.
+func parseSTUNAddress(value, xor []byte) (netip.AddrPort, bool) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, false
+	}
+	family := value[1]
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := value[4:]
+	switch {
+	case family == stunFamilyIPv4 && len(ip) == 4:
+	case family == stunFamilyIPv6 && len(ip) == 16:
+	default:
+		return netip.AddrPort{}, false
+	}
+	ip = append([]byte(nil), ip...)
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), true
+}
@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseSTUNBindingResponse(t *testing.T) {
+	// The IPv4 XOR-MAPPED-ADDRESS of the sample response in RFC 5769,
+	// following a MAPPED-ADDRESS that is to be ignored.
+	txid, _ := hex.DecodeString("b7e7a701bc34d686fa87dfae")
+	attrs, _ := hex.DecodeString("0001000800010001c0000202" + "002000080001a147e112a643")
+	packet := make([]byte, stunHeaderSize, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(packet[0:], stunBindingSuccess)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(packet[4:], stunMagicCookie)
+	copy(packet[8:], txid)
+	packet = append(packet, attrs...)
+
+	addr, err := parseSTUNBindingResponse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddrPort("192.0.2.1:32853"); addr != want {
+		t.Fatalf("mapped address %v, want %v", addr, want)
+	}
+
+	// Without XOR-MAPPED-ADDRESS, MAPPED-ADDRESS is used.
+	binary.BigEndian.PutUint16(packet[stunHeaderSize+12:], 0x8022)
+	addr, err = parseSTUNBindingResponse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddrPort("192.0.2.2:1"); addr != want {
+		t.Fatalf("mapped address %v, want %v", addr, want)
+	}
+
+	binary.BigEndian.PutUint16(packet[0:], stunBindingError)
+	if _, err := parseSTUNBindingResponse(packet); err == nil {
+		t.Fatal("parsed a binding error response")
+	}
+}
+
+// stunServer answers binding requests on 127.0.0.1 with the address they came
+// from, until the test ends.
+func stunServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if n != stunHeaderSize || binary.BigEndian.Uint16(buf) != stunBindingRequest {
+				continue
+			}
+			resp := make([]byte, stunHeaderSize+12)
+			binary.BigEndian.PutUint16(resp[0:], stunBindingSuccess)
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:stunHeaderSize], buf[4:stunHeaderSize])
+			attr := resp[stunHeaderSize:]
+			binary.BigEndian.PutUint16(attr[0:], stunAttrXorMappedAddress)
+			binary.BigEndian.PutUint16(attr[2:], 8)
+			attr[5] = stunFamilyIPv4
+			binary.BigEndian.PutUint16(attr[6:], from.Port()^uint16(stunMagicCookie>>16))
+			ip := from.Addr().Unmap().As4()
+			for i := range ip {
+				attr[8+i] = ip[i] ^ resp[4+i]
+			}
+			conn.WriteToUDPAddrPort(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDiscoverExternalEndpoint(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true, false)
+	server := stunServer(t)
+
+	addr, err := pair[0].dev.DiscoverExternalEndpoint(server, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), pair[0].dev.net.port); addr != want {
+		t.Fatalf("discovered %v, want %v", addr, want)
+	}
+	if pair[0].dev.stun.waiting.Load() != 0 {
+		t.Fatal("binding request still pending")
+	}
+
+	// The tunnel is undisturbed.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	pair[1].dev.Down()
+	if _, err := pair[1].dev.DiscoverExternalEndpoint(server, time.Second); err == nil {
+		t.Fatal("discovered an endpoint of a device that is down")
+	}
+}
@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+// SetInboundTap sets fn to inspect every inbound IP packet before it is
+// written to the TUN device, for an in-process firewall or intrusion
+// detection. fn is passed the public key of the peer the packet came from and
+// the packet, and the packet is dropped if fn returns false. Passing nil
+// removes the tap.
+//
+// fn sees packets after they have been decrypted and their source address
+// checked against the peer's allowed IPs; keepalives are not passed to it.
+// packet is not modified while fn runs, but fn must not modify it either, or
+// retain it after returning.
+//
+// fn is called synchronously from the peer's sequential receive routine, once
+// per packet, so the time it takes is added to the latency of every inbound
+// packet from that peer and bounds the peer's receive throughput. It should
+// be fast and must not block. With no tap set, the cost is a single atomic
+// load per batch of packets.
+func (device *Device) SetInboundTap(fn func(pk NoisePublicKey, packet []byte) bool) {
+	if fn == nil {
+		device.inboundTap.Store(nil)
+	} else {
+		device.inboundTap.Store(&fn)
+	}
+}
+
+// SetOutboundTap sets fn to inspect every outbound IP packet read from the
+// TUN device before it is routed to a peer and encrypted, for enforcing
+// per-flow policy. The packet is dropped if fn returns false. Passing nil
+// removes the tap.
+//
+// packet is in the buffer the TUN device read it into, which is reused for
+// later reads once fn has returned, so fn must not retain it; it must not
+// modify it either. fn is called synchronously from the TUN reader, so the
+// time it takes bounds the throughput of the whole device. It should be fast
+// and must not block. With no tap set, the cost is a single atomic load per
+// read from the TUN device.
+func (device *Device) SetOutboundTap(fn func(packet []byte) bool) {
+	if fn == nil {
+		device.outboundTap.Store(nil)
+	} else {
+		device.outboundTap.Store(&fn)
+	}
+}
@@ -8,6 +8,7 @@
 package device
 
 import (
+	"math/rand"
 	"sync"
 	"time"
 	_ "unsafe"
@@ -19,7 +20,7 @@ func fastrandn(n uint32) uint32
 // A Timer manages time-based aspects of the Cyanide protocol.
 // Timer roughly copies the interface of the Linux kernel's struct timer_list.
 type Timer struct {
-	*time.Timer
+	ClockTimer
 	modifyingLock sync.RWMutex
 	runningLock   sync.Mutex
 	isPending     bool
@@ -27,7 +28,7 @@ type Timer struct {
 
 func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
 	timer := &Timer{}
-	timer.Timer = time.AfterFunc(time.Hour, func() {
+	timer.ClockTimer = peer.device.getClock().NewTimer(time.Hour, func() {
 		timer.runningLock.Lock()
 		defer timer.runningLock.Unlock()
 
@@ -77,12 +78,18 @@ func (peer *Peer) timersActive() bool {
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes {
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+	peer.handshakeFailed(HandshakeFailTimeout)
+	waited := peer.handshakeRetryInterval()
+	peer.handshakeInitiationFailed()
+	peer.failOverEndpoint(waited)
+	maxHandshakes := peer.device.maxTimerHandshakes()
+	if peer.timers.handshakeAttempts.Load() > maxHandshakes {
+		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, maxHandshakes+2)
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
 		}
+		peer.handshakeWaiters.handshakeGaveUp(peer.device.now())
 
 		/* We drop all packets without a keypair and don't try again,
 		 * if we try unsuccessfully for too long to make a handshake.
@@ -97,7 +104,7 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 	} else {
 		peer.timers.handshakeAttempts.Add(1)
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts.Load()+1)
+		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(waited.Seconds()), peer.timers.handshakeAttempts.Load()+1)
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.markEndpointSrcForClearing()
@@ -117,9 +124,11 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + peer.device.rekeyTimeout()).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.markEndpointSrcForClearing()
+	/* Packets that are too large for the path are a likely cause as well. */
+	peer.pathMTULost()
 	peer.SendHandshakeInitiation(false)
 }
 
@@ -129,15 +138,20 @@ func expiredZeroKeyMaterial(peer *Peer) {
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
-	if peer.persistentKeepaliveInterval.Load() > 0 {
+	if peer.persistentKeepaliveOn() {
 		peer.SendKeepalive()
 	}
 }
 
+// persistentKeepaliveOn reports whether the peer sends persistent keepalives.
+func (peer *Peer) persistentKeepaliveOn() bool {
+	return peer.persistentKeepaliveInterval.Load() > 0 && !peer.device.keepalivesDisabled.Load()
+}
+
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.newHandshake.Mod(KeepaliveTimeout + peer.device.rekeyTimeout() + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -169,7 +183,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.handshakeRetryInterval() + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -180,7 +194,10 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	peer.timers.handshakeAttempts.Store(0)
 	peer.timers.sentLastMinuteHandshake.Store(false)
-	peer.lastHandshakeNano.Store(time.Now().UnixNano())
+	peer.resetHandshakeBackoff()
+	peer.resetEndpointFailOver()
+	peer.lastHandshakeNano.Store(peer.device.now().UnixNano())
+	peer.handshakeCompleted()
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -193,9 +210,19 @@ func (peer *Peer) timersSessionDerived() {
 /* Should be called before a packet with authentication -- keepalive, data, or handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
 	keepalive := peer.persistentKeepaliveInterval.Load()
-	if keepalive > 0 && peer.timersActive() {
-		peer.timers.persistentKeepalive.Mod(time.Duration(keepalive) * time.Second)
+	if keepalive > 0 && !peer.device.keepalivesDisabled.Load() && peer.timersActive() {
+		peer.timers.persistentKeepalive.Mod(time.Duration(keepalive)*time.Second + peer.device.keepaliveJitter())
+	}
+}
+
+// keepaliveJitter returns a random delay in [0, max) to add to a persistent
+// keepalive, where max is set by SetKeepaliveJitter.
+func (device *Device) keepaliveJitter() time.Duration {
+	max := device.keepaliveJitterMax.Load()
+	if max <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(max))
 }
 
 func (peer *Peer) timersInit() {
@@ -52,3 +52,38 @@ func (device *Device) RoutineTUNEventReader() {
 
 	device.log.Verbosef("Routine: event worker - stopped")
 }
+
+// OffloadStats holds counters of the packets the device read from and wrote
+// to its TUN device, and of how many of them were batched through the GSO and
+// GRO offloads of the TUN device; see tun.OffloadStats.
+type OffloadStats tun.OffloadStats
+
+// OffloadStats returns a snapshot of the offload counters of the device's TUN
+// device, which shows whether reads and writes are batched by the kernel or
+// fall back to one packet at a time. The counters are zero, and Enabled is
+// false, if the TUN device does not implement tun.OffloadStatsReporter.
+func (device *Device) OffloadStats() OffloadStats {
+	if reporter, ok := device.tun.device.(tun.OffloadStatsReporter); ok {
+		return OffloadStats(reporter.OffloadStats())
+	}
+	return OffloadStats{}
+}
+
+// TunName returns the name of the device's TUN device, as the operating system
+// knows it, so that callers that created the TUN device need not keep it
+// around to set up routes.
+func (device *Device) TunName() (string, error) {
+	return device.tun.device.Name()
+}
+
+// TunIndex returns the interface index of the device's TUN device. It fails if
+// the TUN device does not implement tun.Indexer, as a TUN device that is not
+// backed by an interface of the operating system, such as a netstack one, has
+// no index.
+func (device *Device) TunIndex() (int, error) {
+	indexer, ok := device.tun.device.(tun.Indexer)
+	if !ok {
+		return 0, fmt.Errorf("TUN device of type %T has no interface index", device.tun.device)
+	}
+	return indexer.Index()
+}
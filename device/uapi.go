@@ -22,9 +22,13 @@ import (
 	"github.com/syntlabs/cyanide-go/ipc"
 )
 
+// An IPCError is the error of a failed configuration operation, such as
+// IpcSet, along with the errno reported to the client. errors.Is matches it
+// against its code, for example ipc.IpcErrorInvalid, and errors.As or
+// ErrorCode retrieve the code.
 type IPCError struct {
-	code int64 // error code
-	err  error // underlying/wrapped error
+	code ipc.IpcErrorCode // error code
+	err  error            // underlying/wrapped error
 }
 
 func (s IPCError) Error() string {
@@ -35,11 +39,33 @@ func (s IPCError) Unwrap() error {
 	return s.err
 }
 
+// Is reports whether target is the code of s, so that errors.Is(err, code)
+// tells whether an operation failed with code.
+func (s IPCError) Is(target error) bool {
+	code, ok := target.(ipc.IpcErrorCode)
+	return ok && code == s.code
+}
+
 func (s IPCError) ErrorCode() int64 {
+	return int64(s.code)
+}
+
+// IpcErrorCode returns the code of s, one of the ipc.IpcError constants.
+func (s IPCError) IpcErrorCode() ipc.IpcErrorCode {
 	return s.code
 }
 
-func ipcErrorf(code int64, msg string, args ...any) *IPCError {
+// ErrorCode returns the code of the first IPCError in err's chain, and
+// whether there is one.
+func ErrorCode(err error) (ipc.IpcErrorCode, bool) {
+	var ipcErr *IPCError
+	if errors.As(err, &ipcErr) {
+		return ipcErr.code, true
+	}
+	return 0, false
+}
+
+func ipcErrorf(code ipc.IpcErrorCode, msg string, args ...any) *IPCError {
 	return &IPCError{code: code, err: fmt.Errorf(msg, args...)}
 }
 
@@ -56,112 +82,215 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 	buf := byteBufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer byteBufferPool.Put(buf)
-	sendf := func(format string, args ...any) {
-		fmt.Fprintf(buf, format, args...)
-		buf.WriteByte('\n')
-	}
-	keyf := func(prefix string, key *[32]byte) {
-		buf.Grow(len(key)*2 + 2 + len(prefix))
-		buf.WriteString(prefix)
-		buf.WriteByte('=')
-		const hex = "0123456789abcdef"
-		for i := 0; i < len(key); i++ {
-			buf.WriteByte(hex[key[i]>>4])
-			buf.WriteByte(hex[key[i]&0xf])
-		}
-		buf.WriteByte('\n')
-	}
+	out := ipcGetWriter{buf}
 
 	func() {
-		// lock required resources
-
-		device.net.RLock()
-		defer device.net.RUnlock()
+		device.ipcGetLock()
+		defer device.ipcGetUnlock()
 
-		device.staticIdentity.RLock()
-		defer device.staticIdentity.RUnlock()
+		out.device(device)
+		for _, peer := range device.peers.keyMap {
+			out.peer(peer)
+		}
+	}()
 
-		device.peers.RLock()
-		defer device.peers.RUnlock()
+	// send lines (does not require resource locks)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	}
 
-		// serialize device related values
+	return nil
+}
 
-		if !device.staticIdentity.privateKey.IsZero() {
-			keyf("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
+// IpcGetTo writes the output of the "get" operation to w like IpcGetOperation,
+// but streams it: the device section and then each peer are written to w as
+// soon as they are serialized, so that memory use stays bounded however many
+// peers there are. The device section and the set of peers are taken while
+// the device is locked, but no device lock is held while writing to w, so a
+// slow writer does not delay configuration changes or handshakes. A peer
+// changed meanwhile is written as it is when its turn comes, and a peer
+// removed meanwhile is still written.
+func (device *Device) IpcGetTo(w io.Writer) error {
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	out := ipcGetWriter{buf}
+	flush := func() error {
+		_, err := w.Write(buf.Bytes())
+		buf.Reset()
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
 		}
+		return nil
+	}
 
-		if device.net.port != 0 {
-			sendf("listen_port=%d", device.net.port)
-		}
+	var peers []*Peer
+	func() {
+		device.ipcMutex.RLock()
+		defer device.ipcMutex.RUnlock()
+		device.ipcGetLock()
+		defer device.ipcGetUnlock()
 
-		if device.net.fwmark != 0 {
-			sendf("fwmark=%d", device.net.fwmark)
+		out.device(device)
+		peers = make([]*Peer, 0, len(device.peers.keyMap))
+		for _, peer := range device.peers.keyMap {
+			peers = append(peers, peer)
 		}
-		if device.isAdvancedSecurityOn() {
-			if device.aSecConf.junkPacketCount != 0 {
-				sendf("jc=%d", device.aSecConf.junkPacketCount)
-			}
-			if device.aSecConf.junkPacketMinSize != 0 {
-				sendf("jmin=%d", device.aSecConf.junkPacketMinSize)
-			}
-			if device.aSecConf.junkPacketMaxSize != 0 {
-				sendf("jmax=%d", device.aSecConf.junkPacketMaxSize)
-			}
-			if device.aSecConf.initPacketJunkSize != 0 {
-				sendf("s1=%d", device.aSecConf.initPacketJunkSize)
-			}
-			if device.aSecConf.responsePacketJunkSize != 0 {
-				sendf("s2=%d", device.aSecConf.responsePacketJunkSize)
-			}
-			if device.aSecConf.initPacketMagicHeader != 0 {
-				sendf("h1=%d", device.aSecConf.initPacketMagicHeader)
-			}
-			if device.aSecConf.responsePacketMagicHeader != 0 {
-				sendf("h2=%d", device.aSecConf.responsePacketMagicHeader)
-			}
-			if device.aSecConf.underloadPacketMagicHeader != 0 {
-				sendf("h3=%d", device.aSecConf.underloadPacketMagicHeader)
-			}
-			if device.aSecConf.transportPacketMagicHeader != 0 {
-				sendf("h4=%d", device.aSecConf.transportPacketMagicHeader)
-			}
+	}()
+
+	if err := flush(); err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		out.peer(peer)
+		if err := flush(); err != nil {
+			return err
 		}
-		for _, peer := range device.peers.keyMap {
-			// Serialize peer state.
-			peer.handshake.mutex.RLock()
-			keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
-			keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
-			peer.handshake.mutex.RUnlock()
-			sendf("protocol_version=1")
-			peer.endpoint.Lock()
-			if peer.endpoint.val != nil {
-				sendf("endpoint=%s", peer.endpoint.val.DstToString())
-			}
-			peer.endpoint.Unlock()
+	}
+	return nil
+}
 
-			nano := peer.lastHandshakeNano.Load()
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+// ipcGetLock locks the resources serialized by the "get" operation.
+// The caller must hold device.ipcMutex.
+func (device *Device) ipcGetLock() {
+	device.net.RLock()
+	device.staticIdentity.RLock()
+	device.peers.RLock()
+}
 
-			sendf("last_handshake_time_sec=%d", secs)
-			sendf("last_handshake_time_nsec=%d", nano)
-			sendf("tx_bytes=%d", peer.txBytes.Load())
-			sendf("rx_bytes=%d", peer.rxBytes.Load())
-			sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+// ipcGetUnlock unlocks the resources locked by ipcGetLock.
+func (device *Device) ipcGetUnlock() {
+	device.peers.RUnlock()
+	device.staticIdentity.RUnlock()
+	device.net.RUnlock()
+}
 
-			device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
-				sendf("allowed_ip=%s", prefix.String())
-				return true
-			})
-		}
-	}()
+// IpcGetPeer returns the part of the "get" operation output that describes
+// the peer with public key pk, without serializing the rest of the device.
+func (device *Device) IpcGetPeer(pk NoisePublicKey) (string, error) {
+	device.ipcMutex.RLock()
+	defer device.ipcMutex.RUnlock()
 
-	// send lines (does not require resource locks)
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return "", ipcErrorf(ipc.IpcErrorInvalid, "no peer with public key %x", pk[:])
 	}
 
-	return nil
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	ipcGetWriter{buf}.peer(peer)
+	return buf.String(), nil
+}
+
+// ipcGetWriter accumulates the lines of a "get" operation response.
+type ipcGetWriter struct {
+	*bytes.Buffer
+}
+
+func (w ipcGetWriter) sendf(format string, args ...any) {
+	fmt.Fprintf(w, format, args...)
+	w.WriteByte('\n')
+}
+
+func (w ipcGetWriter) keyf(prefix string, key *[32]byte) {
+	w.Grow(len(key)*2 + 2 + len(prefix))
+	w.WriteString(prefix)
+	w.WriteByte('=')
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(key); i++ {
+		w.WriteByte(hex[key[i]>>4])
+		w.WriteByte(hex[key[i]&0xf])
+	}
+	w.WriteByte('\n')
+}
+
+// device serializes the device related values.
+// The caller must hold the locks taken by device.ipcGetLock.
+func (w ipcGetWriter) device(device *Device) {
+	sendf, keyf := w.sendf, w.keyf
+
+	if !device.staticIdentity.privateKey.IsZero() {
+		keyf("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
+	}
+
+	if device.net.port != 0 {
+		sendf("listen_port=%d", device.net.port)
+	}
+
+	if device.net.fwmark != 0 {
+		sendf("fwmark=%d", device.net.fwmark)
+	}
+	if device.isAdvancedSecurityOn() {
+		if device.aSecConf.junkPacketCount != 0 {
+			sendf("jc=%d", device.aSecConf.junkPacketCount)
+		}
+		if device.aSecConf.junkPacketMinSize != 0 {
+			sendf("jmin=%d", device.aSecConf.junkPacketMinSize)
+		}
+		if device.aSecConf.junkPacketMaxSize != 0 {
+			sendf("jmax=%d", device.aSecConf.junkPacketMaxSize)
+		}
+		if device.aSecConf.initPacketJunkSize != 0 {
+			sendf("s1=%d", device.aSecConf.initPacketJunkSize)
+		}
+		if device.aSecConf.responsePacketJunkSize != 0 {
+			sendf("s2=%d", device.aSecConf.responsePacketJunkSize)
+		}
+		if device.aSecConf.underloadPacketJunkSize != 0 {
+			sendf("s3=%d", device.aSecConf.underloadPacketJunkSize)
+		}
+		if device.aSecConf.initPacketMagicHeader != 0 {
+			sendf("h1=%d", device.aSecConf.initPacketMagicHeader)
+		}
+		if device.aSecConf.responsePacketMagicHeader != 0 {
+			sendf("h2=%d", device.aSecConf.responsePacketMagicHeader)
+		}
+		if device.aSecConf.underloadPacketMagicHeader != 0 {
+			sendf("h3=%d", device.aSecConf.underloadPacketMagicHeader)
+		}
+		if device.aSecConf.transportPacketMagicHeader != 0 {
+			sendf("h4=%d", device.aSecConf.transportPacketMagicHeader)
+		}
+		if device.aSecConf.junkTransportPacketCount != 0 {
+			sendf("jt=%d", device.aSecConf.junkTransportPacketCount)
+		}
+		if device.aSecConf.junkTransportPacketMagicHeader != 0 {
+			sendf("h5=%d", device.aSecConf.junkTransportPacketMagicHeader)
+		}
+		if device.aSecConf.junkTiming != (junkTiming{}) {
+			sendf("jtm=%v", device.aSecConf.junkTiming)
+		}
+	}
+}
+
+// peer serializes the state of peer.
+func (w ipcGetWriter) peer(peer *Peer) {
+	peer.handshake.mutex.RLock()
+	w.keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
+	w.keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
+	peer.handshake.mutex.RUnlock()
+	w.sendf("protocol_version=1")
+	peer.endpoint.Lock()
+	if peer.endpoint.val != nil {
+		w.sendf("endpoint=%s", peer.endpoint.val.DstToString())
+	}
+	peer.endpoint.Unlock()
+
+	nano := peer.lastHandshakeNano.Load()
+	secs := nano / time.Second.Nanoseconds()
+	nano %= time.Second.Nanoseconds()
+
+	w.sendf("last_handshake_time_sec=%d", secs)
+	w.sendf("last_handshake_time_nsec=%d", nano)
+	w.sendf("tx_bytes=%d", peer.txBytes.Load())
+	w.sendf("rx_bytes=%d", peer.rxBytes.Load())
+	w.sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+
+	peer.device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+		w.sendf("allowed_ip=%s", prefix.String())
+		return true
+	})
 }
 
 // IpcSetOperation implements the Cyanide configuration protocol "set" operation.
@@ -253,6 +382,7 @@ func (device *Device) handleDeviceLine(key, value string, tempASecConf *aSecConf
 
 		device.net.Lock()
 		device.net.port = uint16(port)
+		device.net.listenPort = uint16(port)
 		device.net.Unlock()
 
 		if err := device.BindUpdate(); err != nil {
@@ -276,7 +406,14 @@ func (device *Device) handleDeviceLine(key, value string, tempASecConf *aSecConf
 		}
 		device.log.Verbosef("UAPI: Removing all peers")
 		device.RemoveAllPeers()
-		
+
+	case "reset_counters":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set reset_counters, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Resetting peer counters")
+		device.ResetCounters()
+
 	case "jc":
 		junkPacketCount, err := strconv.Atoi(value)
 		if err != nil {
@@ -322,6 +459,15 @@ func (device *Device) handleDeviceLine(key, value string, tempASecConf *aSecConf
 		tempASecConf.responsePacketJunkSize = responsePacketJunkSize
 		tempASecConf.isSet = true
 
+	case "s3":
+		underloadPacketJunkSize, err := strconv.Atoi(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "faield to parse underload_packet_junk_size %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating underload_packet_junk_size")
+		tempASecConf.underloadPacketJunkSize = underloadPacketJunkSize
+		tempASecConf.isSet = true
+
 	case "h1":
 		initPacketMagicHeader, err := strconv.ParseUint(value, 10, 32)
 		if err != nil {
@@ -354,6 +500,32 @@ func (device *Device) handleDeviceLine(key, value string, tempASecConf *aSecConf
 		tempASecConf.transportPacketMagicHeader = uint32(transportPacketMagicHeader)
 		tempASecConf.isSet = true
 
+	case "jt":
+		junkTransportPacketCount, err := strconv.Atoi(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse junk_transport_packet_count %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating junk_transport_packet_count")
+		tempASecConf.junkTransportPacketCount = junkTransportPacketCount
+		tempASecConf.isSet = true
+
+	case "h5":
+		junkTransportPacketMagicHeader, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse junk_transport_packet_magic_header %w", err)
+		}
+		tempASecConf.junkTransportPacketMagicHeader = uint32(junkTransportPacketMagicHeader)
+		tempASecConf.isSet = true
+
+	case "jtm":
+		junkTiming, err := parseJunkTiming(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse junk_timing %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating junk_timing")
+		tempASecConf.junkTiming = junkTiming
+		tempASecConf.isSet = true
+
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
 	}
@@ -378,7 +550,7 @@ func (peer *ipcSetPeer) handlePostConfig() {
 	}
 	if peer.device.isUp() {
 		peer.Start()
-		if peer.pkaOn {
+		if peer.pkaOn && !peer.device.keepalivesDisabled.Load() {
 			peer.SendKeepalive()
 		}
 		peer.SendStagedPackets()
@@ -509,7 +681,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 
 func (device *Device) IpcGet() (string, error) {
 	buf := new(strings.Builder)
-	if err := device.IpcGetOperation(buf); err != nil {
+	if err := device.IpcGetTo(buf); err != nil {
 		return "", err
 	}
 	return buf.String(), nil
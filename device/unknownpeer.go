@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// An UnknownPeerPolicy selects how the device treats handshake messages from
+// public keys that are not among its peers; see SetUnknownPeerPolicy.
+type UnknownPeerPolicy int32
+
+const (
+	// UnknownPeerDefault answers handshake messages under load with a cookie
+	// reply before finding out who sent them, as the protocol prescribes.
+	UnknownPeerDefault UnknownPeerPolicy = iota
+
+	// UnknownPeerDrop never answers handshake messages from unknown keys,
+	// not even with a cookie reply.
+	UnknownPeerDrop
+)
+
+// SetUnknownPeerPolicy sets how handshake messages from public keys that are
+// not configured as peers are treated, to keep a private server from
+// revealing itself to anyone who knows its public key.
+//
+// No handshake response or error is ever sent to an unknown key. The only
+// reply it can get is the cookie reply that, while the device is under load,
+// answers handshake messages without a valid mac2 before the sender is
+// identified, since identifying the initiator of a handshake costs a
+// Diffie-Hellman operation that the cookie is meant to spare. With
+// UnknownPeerDrop, the device identifies the sender first and silently drops
+// the messages of unknown keys, answering only its peers with cookie replies.
+// The extra Diffie-Hellman operations are subject to the rate limiter.
+func (device *Device) SetUnknownPeerPolicy(policy UnknownPeerPolicy) {
+	device.unknownPeerPolicy.Store(int32(policy))
+}
+
+// dropsUnknownPeer reports whether the handshake message elem, which is to be
+// answered with a cookie reply, is to be dropped instead under the unknown
+// peer policy, either because its sender is not a peer or, for initiations,
+// because identifying it would exceed the rate limit.
+func (device *Device) dropsUnknownPeer(elem *QueueHandshakeElement) bool {
+	if UnknownPeerPolicy(device.unknownPeerPolicy.Load()) != UnknownPeerDrop {
+		return false
+	}
+	switch elem.msgType {
+	case defaultMessageResponseType:
+		// A response answers an initiation of ours, found by its receiver index.
+		receiver := binary.LittleEndian.Uint32(elem.packet[8:12])
+		return device.indexTable.Lookup(receiver).peer == nil
+	case defaultMessageInitiationType:
+		if ip := elem.endpoint.DstIP(); !device.rateLimitAllowed(ip) && !device.rate.limiter.Allow(ip) {
+			device.handshakeCounters.rateLimited.Add(1)
+			return true
+		}
+		var msg MessageInitiation
+		if err := binary.Read(bytes.NewReader(elem.packet), binary.LittleEndian, &msg); err != nil {
+			return true
+		}
+		var hash, chainKey [blake2s.Size]byte
+		device.staticIdentity.RLock()
+		peerPK, ok := device.openInitiationStatic(&msg, &hash, &chainKey)
+		device.staticIdentity.RUnlock()
+		return !ok || device.LookupPeer(peerPK) == nil
+	}
+	return false
+}
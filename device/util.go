@@ -4,10 +4,68 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"fmt"
+	"io"
+	"math/rand"
+	"sync"
 )
 
-func appendJunk(writer *bytes.Buffer, size int) error {
-	headerJunk, err := randomJunkWithSize(size)
+// A JunkSource supplies the randomness of the junk that advanced security
+// adds to the traffic: Intn picks junk packet sizes and Read fills junk with
+// bytes. A *math/rand.Rand is a JunkSource, so that a seeded one makes the
+// emitted junk reproducible, for example in tests.
+type JunkSource interface {
+	Intn(n int) int
+	Read(p []byte) (n int, err error)
+}
+
+// defaultJunkSource draws junk sizes from math/rand and junk bytes from
+// crypto/rand.
+type defaultJunkSource struct{}
+
+func (defaultJunkSource) Intn(n int) int { return rand.Intn(n) }
+
+func (defaultJunkSource) Read(p []byte) (int, error) { return crand.Read(p) }
+
+// lockedJunkSource serializes the use of a JunkSource that, like *rand.Rand,
+// is not safe for concurrent use.
+type lockedJunkSource struct {
+	mu  sync.Mutex
+	src JunkSource
+}
+
+func (s *lockedJunkSource) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Intn(n)
+}
+
+func (s *lockedJunkSource) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Read(p)
+}
+
+// SetJunkSource makes the device use src for all the junk it generates, in
+// place of the default of crypto/rand junk bytes. The device serializes its
+// calls to src. A nil src restores the default.
+func (device *Device) SetJunkSource(src JunkSource) {
+	if src == nil {
+		device.junk.Store(nil)
+	} else {
+		device.junk.Store(&lockedJunkSource{src: src})
+	}
+}
+
+// junkSource returns the JunkSource of the device.
+func (device *Device) junkSource() JunkSource {
+	if src := device.junk.Load(); src != nil {
+		return src
+	}
+	return defaultJunkSource{}
+}
+
+func appendJunk(writer *bytes.Buffer, src JunkSource, size int) error {
+	headerJunk, err := randomJunkWithSize(src, size)
 	if err != nil {
 		return fmt.Errorf("failed to create header junk: %v", err)
 	}
@@ -18,8 +76,35 @@ func appendJunk(writer *bytes.Buffer, size int) error {
 	return nil
 }
 
-func randomJunkWithSize(size int) ([]byte, error) {
+func randomJunkWithSize(src JunkSource, size int) ([]byte, error) {
 	junk := make([]byte, size)
-	_, err := crand.Read(junk)
+	_, err := io.ReadFull(src, junk)
 	return junk, err
-}
\ No newline at end of file
+}
+
+// A broadcaster wakes all the goroutines waiting for the next change of some
+// state. The zero value is ready to use.
+type broadcaster struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+}
+
+// wait returns a channel that is closed on the next change.
+func (b *broadcaster) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	return b.changed
+}
+
+// signal wakes all the current waiters.
+func (b *broadcaster) signal() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
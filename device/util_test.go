@@ -7,7 +7,7 @@ import (
 )
 
 func Test_randomJunktWithSize(t *testing.T) {
-	junk, err := randomJunkWithSize(30)
+	junk, err := randomJunkWithSize(defaultJunkSource{}, 30)
 	fmt.Println(string(junk), len(junk), err)
 }
 
@@ -15,7 +15,7 @@ func Test_appendJunk(t *testing.T) {
 	t.Run("", func(t *testing.T) {
 		s := "apple"
 		buffer := bytes.NewBuffer([]byte(s))
-		err := appendJunk(buffer, 30)
+		err := appendJunk(buffer, defaultJunkSource{}, 30)
 		if err != nil &&
 			buffer.Len() != len(s)+30 {
 			t.Errorf("appendWithJunk() size don't match")
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"sync"
+)
+
+// receiveRoutines tracks whether the receive routines of the open bind have
+// started, for WaitUp.
+type receiveRoutines struct {
+	broadcaster
+	sync.Mutex
+	open    bool // whether BindUpdate opened the bind and started its receive routines
+	pending int  // receive routines of the open bind yet to start
+}
+
+// wait returns whether the bind is open with all its receive routines
+// started, and a channel that is closed on the next change.
+func (r *receiveRoutines) wait() (bool, <-chan struct{}) {
+	changed := r.broadcaster.wait()
+	r.Lock()
+	defer r.Unlock()
+	return r.open && r.pending == 0, changed
+}
+
+// isOpen reports whether BindUpdate opened the bind.
+func (r *receiveRoutines) isOpen() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.open
+}
+
+// set records whether the bind is open and how many receive routines it
+// starts, and wakes the waiters.
+func (r *receiveRoutines) set(open bool, pending int) {
+	r.Lock()
+	r.open, r.pending = open, pending
+	r.Unlock()
+	r.signal()
+}
+
+// started records that a receive routine has started, and wakes the waiters
+// once the last one has.
+func (r *receiveRoutines) started() {
+	r.Lock()
+	last := false
+	if r.pending > 0 {
+		r.pending--
+		last = r.pending == 0
+	}
+	r.Unlock()
+	if last {
+		r.signal()
+	}
+}
+
+// WaitUp blocks until the device is up with its bind open and all the bind's
+// receive routines running, that is until the device is actually listening,
+// which Up does not wait for. It returns ctx.Err() if ctx is done first and
+// ErrDeviceClosed if the device is closed.
+//
+// If the device is down, or fails to come up, WaitUp waits for it to be
+// brought up; bound the wait with ctx.
+func (device *Device) WaitUp(ctx context.Context) error {
+	for {
+		ready, changed := device.net.receiving.wait()
+		if device.isClosed() {
+			return ErrDeviceClosed
+		}
+		if ready && device.isUp() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-device.closed:
+			return ErrDeviceClosed
+		}
+	}
+}
@@ -0,0 +1,30 @@
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package ipc
+
+import "fmt"
+
+// An IpcErrorCode is the errno reported by a failed configuration protocol
+// operation, one of the IpcError constants. It implements error, so that
+// errors.Is can match an error carrying a code against one of the constants.
+type IpcErrorCode int64
+
+func (code IpcErrorCode) Error() string {
+	switch code {
+	case IpcErrorIO:
+		return "I/O error"
+	case IpcErrorProtocol:
+		return "protocol error"
+	case IpcErrorInvalid:
+		return "invalid argument"
+	case IpcErrorPortInUse:
+		return "address already in use"
+	case IpcErrorUnknown:
+		return "unknown error"
+	}
+	return fmt.Sprintf("IPC error %d", int64(code))
+}
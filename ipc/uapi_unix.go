@@ -18,11 +18,11 @@ import (
 )
 
 const (
-	IpcErrorIO        = -int64(unix.EIO)
-	IpcErrorProtocol  = -int64(unix.EPROTO)
-	IpcErrorInvalid   = -int64(unix.EINVAL)
-	IpcErrorPortInUse = -int64(unix.EADDRINUSE)
-	IpcErrorUnknown   = -55 // ENOANO
+	IpcErrorIO        = -IpcErrorCode(unix.EIO)
+	IpcErrorProtocol  = -IpcErrorCode(unix.EPROTO)
+	IpcErrorInvalid   = -IpcErrorCode(unix.EINVAL)
+	IpcErrorPortInUse = -IpcErrorCode(unix.EADDRINUSE)
+	IpcErrorUnknown   = IpcErrorCode(-55) // ENOANO
 )
 
 // socketDirectory is variable because it is modified by a linker
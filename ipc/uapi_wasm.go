@@ -8,9 +8,9 @@ package ipc
 
 // Made up sentinel error codes for {js,wasip1}/wasm.
 const (
-	IpcErrorIO        = 1
-	IpcErrorInvalid   = 2
-	IpcErrorPortInUse = 3
-	IpcErrorUnknown   = 4
-	IpcErrorProtocol  = 5
+	IpcErrorIO        IpcErrorCode = 1
+	IpcErrorInvalid   IpcErrorCode = 2
+	IpcErrorPortInUse IpcErrorCode = 3
+	IpcErrorUnknown   IpcErrorCode = 4
+	IpcErrorProtocol  IpcErrorCode = 5
 )
@@ -15,11 +15,11 @@ import (
 
 // TODO: replace these with actual standard windows error numbers from the win package
 const (
-	IpcErrorIO        = -int64(5)
-	IpcErrorProtocol  = -int64(71)
-	IpcErrorInvalid   = -int64(22)
-	IpcErrorPortInUse = -int64(98)
-	IpcErrorUnknown   = -int64(55)
+	IpcErrorIO        = -IpcErrorCode(5)
+	IpcErrorProtocol  = -IpcErrorCode(71)
+	IpcErrorInvalid   = -IpcErrorCode(22)
+	IpcErrorPortInUse = -IpcErrorCode(98)
+	IpcErrorUnknown   = -IpcErrorCode(55)
 )
 
 type UAPIListener struct {
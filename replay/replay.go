@@ -7,6 +7,12 @@
 // Package replay implements an efficient anti-replay algorithm as specified in RFC 6479.
 package replay
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
 type block uint64
 
 const (
@@ -14,10 +20,16 @@ const (
 	blockBits   = 1 << blockBitLog // must be power of 2
 	ringBlocks  = 1 << 7           // must be power of 2
 	windowSize  = (ringBlocks - 1) * blockBits
-	blockMask   = ringBlocks - 1
 	bitMask     = blockBits - 1
 )
 
+// Sizes, in counters, of the ring of a Filter; see SetWindowSize.
+const (
+	DefaultWindowSize = ringBlocks * blockBits
+	MinWindowSize     = 2 * blockBits
+	MaxWindowSize     = 1 << 20
+)
+
 // A Filter rejects replayed messages by checking if message counter value is
 // within a sliding window of previously received messages.
 // The zero value for Filter is an empty filter ready to use.
@@ -25,12 +37,83 @@ const (
 type Filter struct {
 	last uint64
 	ring [ringBlocks]block
+	big  []block // replaces ring if the window size is not the default
+}
+
+// blocks returns the ring of the filter.
+func (f *Filter) blocks() []block {
+	if f.big != nil {
+		return f.big
+	}
+	return f.ring[:]
 }
 
 // Reset resets the filter to empty state.
 func (f *Filter) Reset() {
 	f.last = 0
-	f.ring[0] = 0
+	f.blocks()[0] = 0
+}
+
+// SetWindowSize resets the filter and sets the size of its ring to size
+// counters, which must be a power of two between MinWindowSize and
+// MaxWindowSize. The filter then accepts counters that arrive up to
+// size-64 behind the highest counter seen so far.
+// The ring takes size/8 bytes; sizes above DefaultWindowSize are allocated
+// on top of the fixed DefaultWindowSize/8 bytes of every Filter.
+func (f *Filter) SetWindowSize(size int) error {
+	if err := CheckWindowSize(size); err != nil {
+		return err
+	}
+	if size == DefaultWindowSize {
+		f.big = nil
+	} else {
+		f.big = make([]block, size/blockBits)
+	}
+	f.Reset()
+	return nil
+}
+
+// CheckWindowSize returns an error if SetWindowSize would reject size.
+func CheckWindowSize(size int) error {
+	if size < MinWindowSize || size > MaxWindowSize || size&(size-1) != 0 {
+		return fmt.Errorf("replay window size %d is not a power of two between %d and %d",
+			size, MinWindowSize, MaxWindowSize)
+	}
+	return nil
+}
+
+// WindowSize returns the size of the ring of the filter in counters.
+func (f *Filter) WindowSize() int {
+	return len(f.blocks()) * blockBits
+}
+
+// MarshalBinary encodes the state of the filter, so that it can be restored
+// with UnmarshalBinary, for example in another process.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	ring := f.blocks()
+	b := make([]byte, 0, 8*(1+len(ring)))
+	b = binary.LittleEndian.AppendUint64(b, f.last)
+	for _, block := range ring {
+		b = binary.LittleEndian.AppendUint64(b, uint64(block))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary restores the state, window size included,
+// of a filter encoded by MarshalBinary.
+func (f *Filter) UnmarshalBinary(b []byte) error {
+	if len(b) < 8 || len(b)%8 != 0 {
+		return errors.New("invalid replay filter encoding length")
+	}
+	if err := f.SetWindowSize((len(b)/8 - 1) * blockBits); err != nil {
+		return err
+	}
+	f.last = binary.LittleEndian.Uint64(b)
+	ring := f.blocks()
+	for i := range ring {
+		ring[i] = block(binary.LittleEndian.Uint64(b[8*(i+1):]))
+	}
+	return nil
 }
 
 // ValidateCounter checks if the counter should be accepted.
@@ -39,25 +122,27 @@ func (f *Filter) ValidateCounter(counter, limit uint64) bool {
 	if counter >= limit {
 		return false
 	}
+	ring := f.blocks()
+	n := uint64(len(ring))
 	indexBlock := counter >> blockBitLog
 	if counter > f.last { // move window forward
 		current := f.last >> blockBitLog
 		diff := indexBlock - current
-		if diff > ringBlocks {
-			diff = ringBlocks // cap diff to clear the whole ring
+		if diff > n {
+			diff = n // cap diff to clear the whole ring
 		}
 		for i := current + 1; i <= current+diff; i++ {
-			f.ring[i&blockMask] = 0
+			ring[i&(n-1)] = 0
 		}
 		f.last = counter
-	} else if f.last-counter > windowSize { // behind current window
+	} else if f.last-counter > (n-1)*blockBits { // behind current window
 		return false
 	}
 	// check and set bit
-	indexBlock &= blockMask
+	indexBlock &= n - 1
 	indexBit := counter & bitMask
-	old := f.ring[indexBlock]
+	old := ring[indexBlock]
 	new := old | 1<<indexBit
-	f.ring[indexBlock] = new
+	ring[indexBlock] = new
 	return old != new
 }
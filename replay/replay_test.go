@@ -118,3 +118,91 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(windowSize+1, true)
 }
+
+func TestWindowSize(t *testing.T) {
+	var filter Filter
+	if filter.WindowSize() != DefaultWindowSize {
+		t.Fatalf("zero Filter has window size %d, want %d", filter.WindowSize(), DefaultWindowSize)
+	}
+	for _, size := range []int{0, MinWindowSize / 2, 3000, MaxWindowSize * 2} {
+		if err := filter.SetWindowSize(size); err == nil {
+			t.Errorf("SetWindowSize(%d) succeeded", size)
+		}
+	}
+
+	// Deliver counters in blocks of 2*lag, each with its halves swapped,
+	// so that counters arrive up to 2*lag-1 behind the highest one seen.
+	reorder := func(filter *Filter, blocks, lag uint64) (dropped int) {
+		for base := uint64(1); base < 1+blocks*2*lag; base += 2 * lag {
+			for _, start := range []uint64{base + lag, base} {
+				for c := start; c < start+lag; c++ {
+					if !filter.ValidateCounter(c, RejectAfterMessages) {
+						dropped++
+					}
+				}
+			}
+		}
+		return dropped
+	}
+	const lag = 30000
+	if dropped := reorder(new(Filter), 2, lag); dropped == 0 {
+		t.Error("default window accepted packets reordered beyond it")
+	}
+	for _, size := range []int{1 << 16, MaxWindowSize} {
+		if err := filter.SetWindowSize(size); err != nil {
+			t.Fatal(err)
+		}
+		if filter.WindowSize() != size {
+			t.Errorf("WindowSize() = %d, want %d", filter.WindowSize(), size)
+		}
+		if dropped := reorder(&filter, 4, lag); dropped != 0 {
+			t.Errorf("window of %d dropped %d reordered packets", size, dropped)
+		}
+		if filter.ValidateCounter(lag, RejectAfterMessages) {
+			t.Errorf("window of %d accepted a replayed counter", size)
+		}
+	}
+	if err := filter.SetWindowSize(DefaultWindowSize); err != nil || filter.WindowSize() != DefaultWindowSize {
+		t.Errorf("SetWindowSize(DefaultWindowSize) = %v, size %d", err, filter.WindowSize())
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, size := range []int{DefaultWindowSize, MinWindowSize, 4096} {
+		var f Filter
+		if err := f.SetWindowSize(size); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []uint64{1, 2, 5, 100, 90} {
+			f.ValidateCounter(n, RejectAfterMessages)
+		}
+		b, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var g Filter
+		if err := g.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if g.WindowSize() != size {
+			t.Errorf("window size %d restored as %d", size, g.WindowSize())
+		}
+		for _, n := range []uint64{1, 2, 5, 100, 90} {
+			if g.ValidateCounter(n, RejectAfterMessages) {
+				t.Errorf("window size %d: restored filter accepted replayed counter %d", size, n)
+			}
+		}
+		for _, n := range []uint64{95, 99, 101} {
+			if !g.ValidateCounter(n, RejectAfterMessages) {
+				t.Errorf("window size %d: restored filter rejected new counter %d", size, n)
+			}
+		}
+	}
+
+	var f Filter
+	for _, b := range [][]byte{nil, make([]byte, 12), make([]byte, 8+3*8)} {
+		if err := f.UnmarshalBinary(b); err == nil {
+			t.Errorf("decoding %d bytes succeeded", len(b))
+		}
+	}
+}
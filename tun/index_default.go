@@ -0,0 +1,23 @@
+//go:build darwin || freebsd || openbsd || windows
+
+/* SPDX-License-Identifier: MIT
+ *
+  * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+  * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
+ */
+
+package tun
+
+import "net"
+
+func (tun *NativeTun) Index() (int, error) {
+	name, err := tun.Name()
+	if err != nil {
+		return 0, err
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return iface.Index, nil
+}
@@ -8,6 +8,8 @@ package tun
 
 import (
 	"net/netip"
+	"os"
+	"slices"
 	"testing"
 
 	"golang.org/x/sys/unix"
@@ -241,7 +243,7 @@ func Test_handleVirtioRead(t *testing.T) {
 				out[i] = make([]byte, 65535)
 			}
 			tt.hdr.encode(tt.pktIn)
-			n, err := handleVirtioRead(tt.pktIn, out, sizes, offset)
+			n, err := handleVirtioRead(tt.pktIn, out, sizes, offset, 0)
 			if err != nil {
 				if tt.wantErr {
 					return
@@ -260,6 +262,66 @@ func Test_handleVirtioRead(t *testing.T) {
 	}
 }
 
+func Test_handleVirtioReadSegmentMTU(t *testing.T) {
+	tcp := virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV4,
+		gsoSize:    200,
+		hdrLen:     40,
+		csumStart:  20,
+		csumOffset: 16,
+	}
+	udp := virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_UDP_L4,
+		gsoSize:    200,
+		hdrLen:     28,
+		csumStart:  20,
+		csumOffset: 6,
+	}
+	for _, tt := range []struct {
+		name       string
+		hdr        virtioNetHdr
+		pktIn      []byte
+		segmentMTU int
+		bufs       int
+		wantLens   []int
+	}{
+		{"tcp4 unbounded", tcp, tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 400, 1), 0, conn.IdealBatchSize, []int{240, 240}},
+		{"tcp4 bounded", tcp, tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 400, 1), 140, conn.IdealBatchSize, []int{140, 140, 140, 140}},
+		{"tcp4 bounded by bufs", tcp, tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 400, 1), 140, 2, []int{240, 240}},
+		{"udp4 bounded", udp, udp4Packet(ip4PortA, ip4PortB, 400), 128, conn.IdealBatchSize, []int{228, 228}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make([][]byte, tt.bufs)
+			sizes := make([]int, tt.bufs)
+			for i := range out {
+				out[i] = make([]byte, 65535)
+			}
+			tt.hdr.encode(tt.pktIn)
+			n, err := handleVirtioRead(tt.pktIn, out, sizes, offset, tt.segmentMTU)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(sizes[:n], tt.wantLens) {
+				t.Fatalf("got sizes %v, want %v", sizes[:n], tt.wantLens)
+			}
+			if tt.hdr.gsoType == unix.VIRTIO_NET_HDR_GSO_UDP_L4 {
+				return
+			}
+			// The segments carry consecutive parts of the payload.
+			seq := uint32(1)
+			for i := 0; i < n; i++ {
+				tcp := header.TCP(out[i][offset+20:])
+				if tcp.SequenceNumber() != seq {
+					t.Fatalf("segment %d has sequence number %d, want %d", i, tcp.SequenceNumber(), seq)
+				}
+				seq += uint32(sizes[i] - 40)
+			}
+		})
+	}
+}
+
 func flipTCP4Checksum(b []byte) []byte {
 	at := virtioNetHdrLen + 20 + 16 // 20 byte ipv4 header; tcp csum offset is 16
 	b[at] ^= 0xFF
@@ -530,6 +592,76 @@ func Test_handleGRO(t *testing.T) {
 	}
 }
 
+func TestNativeTunOffloadStats(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernel.Close()
+	tun := &NativeTun{
+		tunFile:     os.NewFile(uintptr(fds[0]), "tun"),
+		vnetHdr:     true,
+		udpGSO:      true,
+		tcpGROTable: newTCPGROTable(),
+		udpGROTable: newUDPGROTable(),
+	}
+	defer tun.tunFile.Close()
+
+	// A GSO packet of two segments and a packet read on its own.
+	gso := tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck|header.TCPFlagPsh, 200, 1)
+	gsoHdr := virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV4,
+		gsoSize:    100,
+		csumStart:  20,
+		csumOffset: 16,
+	}
+	gsoHdr.encode(gso)
+	single := udp4Packet(ip4PortA, ip4PortB, 100)
+	(&virtioNetHdr{}).encode(single)
+	bufs := make([][]byte, conn.IdealBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, 65535)
+	}
+	sizes := make([]int, len(bufs))
+	for _, pkt := range [][]byte{gso, single} {
+		if _, err := kernel.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tun.Read(bufs, sizes, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Four of eight packets are coalesced into three others.
+	if _, err := tun.Write([][]byte{
+		tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 100, 1),
+		tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 100, 101),
+		tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 100, 201),
+		udp4Packet(ip4PortA, ip4PortB, 100),
+		udp4Packet(ip4PortA, ip4PortB, 100),
+		tcp6Packet(ip6PortA, ip6PortB, header.TCPFlagAck, 100, 1),
+		tcp6Packet(ip6PortA, ip6PortB, header.TCPFlagAck, 100, 101),
+		udp4Packet(ip4PortA, ip4PortC, 100),
+	}, offset); err != nil {
+		t.Fatal(err)
+	}
+
+	want := OffloadStats{
+		Enabled:         true,
+		ReadPackets:     3,
+		ReadGSOPackets:  1,
+		ReadSegments:    2,
+		WritePackets:    8,
+		WriteCoalesced:  4,
+		WriteGROPackets: 3,
+	}
+	if got := tun.OffloadStats(); got != want {
+		t.Errorf("OffloadStats() = %+v, want %+v", got, want)
+	}
+}
+
 func Test_packetIsGROCandidate(t *testing.T) {
 	tcp4 := tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 100, 1)[virtioNetHdrLen:]
 	tcp4TooShort := tcp4[:39]
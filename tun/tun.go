@@ -52,3 +52,45 @@ type Device interface {
 	// lifetime of a Device.
 	BatchSize() int
 }
+
+// OffloadStats holds counters of the packets a Device read and wrote, and of
+// how many of them went through segmentation and coalescing offloads, which
+// move batches of packets between the kernel and the Device at once.
+type OffloadStats struct {
+	Enabled bool // whether the Device uses the offloads
+
+	// Read from the Device, where the kernel hands over large packets that are
+	// split into segments (GSO).
+	ReadPackets    uint64 // packets returned by Read, segments included
+	ReadGSOPackets uint64 // large packets read from the kernel
+	ReadSegments   uint64 // packets the large packets were split into
+
+	// Written to the Device, where packets of the same flow are coalesced into
+	// large packets for the kernel (GRO).
+	WritePackets    uint64 // packets passed to Write
+	WriteCoalesced  uint64 // packets coalesced into another packet
+	WriteGROPackets uint64 // large packets written, with others coalesced into them
+}
+
+// OffloadStatsReporter is implemented by Device objects that count the
+// packets going through segmentation and coalescing offloads.
+type OffloadStatsReporter interface {
+	OffloadStats() OffloadStats
+}
+
+// SegmentMTUSetter is implemented by Device objects that split the large
+// packets handed over by the kernel (GSO) into segments themselves.
+type SegmentMTUSetter interface {
+	// SetSegmentMTU makes Read split large TCP packets into segments of at
+	// most mtu bytes, even where the kernel asks for larger segments. Packets
+	// that are not split, and large UDP packets, whose segments are
+	// datagrams, are not affected. Zero restores the kernel's segment size.
+	SetSegmentMTU(mtu int)
+}
+
+// Indexer is implemented by Device objects backed by a network interface of
+// the operating system, to report the index of that interface.
+type Indexer interface {
+	// Index returns the interface index of the Device.
+	Index() (int, error)
+}
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -40,6 +41,7 @@ type NativeTun struct {
 	batchSize               int
 	vnetHdr                 bool
 	udpGSO                  bool
+	segmentMTU              atomic.Int32 // set with SetSegmentMTU (0 = the kernel's segment size)
 
 	closeOnce sync.Once
 
@@ -54,6 +56,15 @@ type NativeTun struct {
 	toWrite     []int
 	tcpGROTable *tcpGROTable
 	udpGROTable *udpGROTable
+
+	offloadStats struct {
+		readPackets     atomic.Uint64
+		readGSOPackets  atomic.Uint64
+		readSegments    atomic.Uint64
+		writePackets    atomic.Uint64
+		writeCoalesced  atomic.Uint64
+		writeGROPackets atomic.Uint64
+	}
 }
 
 func (tun *NativeTun) File() *os.File {
@@ -305,6 +316,15 @@ func (tun *NativeTun) Name() (string, error) {
 	return tun.nameCache, tun.nameErr
 }
 
+func (tun *NativeTun) Index() (int, error) {
+	name, err := tun.Name()
+	if err != nil {
+		return 0, err
+	}
+	index, err := getIFIndex(name)
+	return int(index), err
+}
+
 func (tun *NativeTun) initNameCache() {
 	tun.nameCache, tun.nameErr = tun.nameSlow()
 }
@@ -351,11 +371,21 @@ func (tun *NativeTun) Write(bufs [][]byte, offset int) (int, error) {
 			return 0, err
 		}
 		offset -= virtioNetHdrLen
+		var groPackets uint64
+		for _, bufsI := range tun.toWrite {
+			var hdr virtioNetHdr
+			if hdr.decode(bufs[bufsI][offset:]) == nil && hdr.gsoType != unix.VIRTIO_NET_HDR_GSO_NONE {
+				groPackets++
+			}
+		}
+		tun.offloadStats.writeCoalesced.Add(uint64(len(bufs) - len(tun.toWrite)))
+		tun.offloadStats.writeGROPackets.Add(groPackets)
 	} else {
 		for i := range bufs {
 			tun.toWrite = append(tun.toWrite, i)
 		}
 	}
+	tun.offloadStats.writePackets.Add(uint64(len(bufs)))
 	for _, bufsI := range tun.toWrite {
 		n, err := tun.tunFile.Write(bufs[bufsI][offset:])
 		if errors.Is(err, syscall.EBADFD) {
@@ -372,8 +402,9 @@ func (tun *NativeTun) Write(bufs [][]byte, offset int) (int, error) {
 
 // handleVirtioRead splits in into bufs, leaving offset bytes at the front of
 // each buffer. It mutates sizes to reflect the size of each element of bufs,
-// and returns the number of packets read.
-func handleVirtioRead(in []byte, bufs [][]byte, sizes []int, offset int) (int, error) {
+// and returns the number of packets read. A nonzero segmentMTU bounds the size
+// of the TCP segments, as far as bufs has room for them.
+func handleVirtioRead(in []byte, bufs [][]byte, sizes []int, offset int, segmentMTU int) (int, error) {
 	var hdr virtioNetHdr
 	err := hdr.decode(in)
 	if err != nil {
@@ -446,6 +477,18 @@ func handleVirtioRead(in []byte, bufs [][]byte, sizes []int, offset int) (int, e
 		return 0, fmt.Errorf("end of checksum offset (%d) exceeds packet length (%d)", cSumAt+1, len(in))
 	}
 
+	// TCP payload may be segmented anywhere, unlike UDP datagrams.
+	if hdr.gsoType != unix.VIRTIO_NET_HDR_GSO_UDP_L4 && segmentMTU > int(hdr.hdrLen) {
+		payload := len(in) - int(hdr.hdrLen)
+		size := segmentMTU - int(hdr.hdrLen)
+		if fit := (payload + len(bufs) - 1) / len(bufs); size < fit {
+			size = fit
+		}
+		if size < int(hdr.gsoSize) {
+			hdr.gsoSize = uint16(size)
+		}
+	}
+
 	return gsoSplit(in, hdr, bufs, sizes, offset, ipVersion == 6)
 }
 
@@ -468,14 +511,44 @@ func (tun *NativeTun) Read(bufs [][]byte, sizes []int, offset int) (int, error)
 			return 0, err
 		}
 		if tun.vnetHdr {
-			return handleVirtioRead(readInto[:n], bufs, sizes, offset)
+			n, err := handleVirtioRead(readInto[:n], bufs, sizes, offset, int(tun.segmentMTU.Load()))
+			if err == nil {
+				tun.offloadStats.readPackets.Add(uint64(n))
+				var hdr virtioNetHdr
+				if hdr.decode(readInto) == nil && hdr.gsoType != unix.VIRTIO_NET_HDR_GSO_NONE {
+					tun.offloadStats.readGSOPackets.Add(1)
+					tun.offloadStats.readSegments.Add(uint64(n))
+				}
+			}
+			return n, err
 		} else {
 			sizes[0] = n
+			tun.offloadStats.readPackets.Add(1)
 			return 1, nil
 		}
 	}
 }
 
+// SetSegmentMTU implements SegmentMTUSetter.
+func (tun *NativeTun) SetSegmentMTU(mtu int) {
+	tun.segmentMTU.Store(int32(mtu))
+}
+
+// OffloadStats returns the counters of the packets read and written,
+// and of those that went through GSO and GRO if the device uses them.
+func (tun *NativeTun) OffloadStats() OffloadStats {
+	c := &tun.offloadStats
+	return OffloadStats{
+		Enabled:         tun.vnetHdr,
+		ReadPackets:     c.readPackets.Load(),
+		ReadGSOPackets:  c.readGSOPackets.Load(),
+		ReadSegments:    c.readSegments.Load(),
+		WritePackets:    c.writePackets.Load(),
+		WriteCoalesced:  c.writeCoalesced.Load(),
+		WriteGROPackets: c.writeGROPackets.Load(),
+	}
+}
+
 func (tun *NativeTun) Events() <-chan Event {
 	return tun.events
 }
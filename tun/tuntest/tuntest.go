@@ -4,6 +4,8 @@
   * Copyright (C) 2023 Synthesis Labs. All Rights Reserved.
  */
 
+// Package tuntest provides an in-memory tun.Device for tests that push IP
+// packets through a device without creating a real interface.
 package tuntest
 
 import (
@@ -15,6 +17,7 @@ import (
 	"github.com/syntlabs/cyanide-go/tun"
 )
 
+// Ping returns an IPv4 ICMP echo request from src to dst.
 func Ping(dst, src netip.Addr) []byte {
 	localPort := uint16(1337)
 	seq := uint16(0)
@@ -26,6 +29,17 @@ func Ping(dst, src netip.Addr) []byte {
 	return genICMPv4(payload, dst, src)
 }
 
+// PingWithSize returns an IPv4 ICMP echo request from src to dst whose total
+// length is size bytes, but at least that of the packets returned by Ping.
+func PingWithSize(dst, src netip.Addr, size int) []byte {
+	payload := make([]byte, max(size-28, 4))
+	binary.BigEndian.PutUint16(payload[0:], 1337)
+	for i := 4; i < len(payload); i++ {
+		payload[i] = byte(i)
+	}
+	return genICMPv4(payload, dst, src)
+}
+
 // Checksum is the "internet checksum" from https://tools.ietf.org/html/rfc1071.
 func checksum(buf []byte, initial uint16) uint16 {
 	v := uint32(initial)
@@ -80,6 +94,9 @@ func genICMPv4(payload []byte, dst, src netip.Addr) []byte {
 	return pkt
 }
 
+// A ChannelTUN is a tun.Device backed by channels. Packets written to Outbound
+// are read by the device as if sent by the operating system, and packets the
+// device writes to the TUN are delivered on Inbound.
 type ChannelTUN struct {
 	Inbound  chan []byte // incoming packets, closed on TUN close
 	Outbound chan []byte // outbound packets, blocks forever on TUN close
@@ -89,6 +106,7 @@ type ChannelTUN struct {
 	tun    chTun
 }
 
+// NewChannelTUN returns a ChannelTUN that is up.
 func NewChannelTUN() *ChannelTUN {
 	c := &ChannelTUN{
 		Inbound:  make(chan []byte),
@@ -101,6 +119,7 @@ func NewChannelTUN() *ChannelTUN {
 	return c
 }
 
+// TUN returns the tun.Device to pass to the device under test.
 func (c *ChannelTUN) TUN() tun.Device {
 	return &c.tun
 }